@@ -14,6 +14,8 @@ var (
 	dbPath         = flag.String("db", "", "Path to wnode database folder")
 	lowerTimestamp = flag.Int("lower", 0, "Removes messages sent starting from this timestamp")
 	upperTimestamp = flag.Int("upper", 0, "Removes messages sent up to this timestamp")
+	tombstones     = flag.Bool("tombstones", false, "Keeps the sent time and hash of removed messages as tombstones")
+	sweep          = flag.Bool("sweep", false, "Removes the tombstones of messages in the range instead of messages")
 )
 
 func missingFlag(f string) {
@@ -53,6 +55,9 @@ func main() {
 	}
 
 	c := mailserver.NewCleanerWithDB(db)
+	if *tombstones {
+		c = mailserver.NewTombstoneCleanerWithDB(db)
+	}
 
 	if err = validateRange(*lowerTimestamp, *upperTimestamp); err != nil {
 		log.Fatal(err)
@@ -61,6 +66,16 @@ func main() {
 	lower := uint32(*lowerTimestamp)
 	upper := uint32(*upperTimestamp)
 
+	if *sweep {
+		n, err := c.SweepTombstones(lower, upper)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("removed %d tombstones.\n", n)
+		return
+	}
+
 	n, err := c.Prune(lower, upper)
 	if err != nil {
 		log.Fatal(err)
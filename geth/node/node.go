@@ -1,12 +1,16 @@
 package node
 
 import (
+	"crypto/ecdsa"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"path"
 	"path/filepath"
+	"time"
+
+	"github.com/beevik/ntp"
 
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/crypto"
@@ -71,6 +75,12 @@ func MakeNode(config *params.NodeConfig, db *leveldb.DB) (*node.Node, error) {
 		stackConfig.P2P.PrivateKey = pk
 	}
 
+	// the mail server signs its responses with the node key, which then
+	// needs to be known before the node is started
+	if config.WhisperConfig != nil && config.WhisperConfig.MailServerSignResponses && stackConfig.P2P.PrivateKey == nil {
+		stackConfig.P2P.PrivateKey = stackConfig.NodeKey()
+	}
+
 	stack, err := node.New(stackConfig)
 	if err != nil {
 		return nil, ErrNodeMakeFailure
@@ -93,7 +103,7 @@ func MakeNode(config *params.NodeConfig, db *leveldb.DB) (*node.Node, error) {
 	}
 
 	// start Whisper service.
-	if err := activateShhService(stack, config, db); err != nil {
+	if err := activateShhService(stack, config, db, stackConfig.P2P.PrivateKey); err != nil {
 		return nil, fmt.Errorf("%v: %v", ErrWhisperServiceRegistrationFailure, err)
 	}
 
@@ -189,13 +199,13 @@ func activateStatusService(stack *node.Node, config *params.NodeConfig) error {
 }
 
 // activateShhService configures Whisper and adds it to the given node.
-func activateShhService(stack *node.Node, config *params.NodeConfig, db *leveldb.DB) (err error) {
+func activateShhService(stack *node.Node, config *params.NodeConfig, db *leveldb.DB, nodeKey *ecdsa.PrivateKey) (err error) {
 	if config.WhisperConfig == nil || !config.WhisperConfig.Enabled {
 		logger.Info("SHH protocol is disabled")
 		return nil
 	}
 	if err := stack.Register(func(*node.ServiceContext) (node.Service, error) {
-		return timesource.Default(), nil
+		return newTimeSource(config.TimeSourceConfig)
 	}); err != nil {
 		return err
 	}
@@ -226,6 +236,10 @@ func activateShhService(stack *node.Node, config *params.NodeConfig, db *leveldb
 			logger.Info("Register MailServer")
 
 			var mailServer mailserver.WMailServer
+			mailServer.SetTimeSource(timeSource)
+			if config.WhisperConfig.MailServerSignResponses {
+				mailServer.SetSigningKey(nodeKey)
+			}
 			whisperService.RegisterServer(&mailServer)
 			err := mailServer.Init(whisperService, config.WhisperConfig)
 			if err != nil {
@@ -258,6 +272,45 @@ func activateShhService(stack *node.Node, config *params.NodeConfig, db *leveldb
 	})
 }
 
+// medianPolicies maps the configured even median policies to their value.
+var medianPolicies = map[string]timesource.MedianPolicy{
+	"":        timesource.MedianAverage,
+	"average": timesource.MedianAverage,
+	"lower":   timesource.MedianLower,
+	"upper":   timesource.MedianUpper,
+}
+
+// newTimeSource creates the ntp time source from the given config, with
+// default settings if nil.
+func newTimeSource(config *params.TimeSourceConfig) (*timesource.NTPTimeSource, error) {
+	if config == nil {
+		return timesource.Default(), nil
+	}
+	policy, ok := medianPolicies[config.EvenMedianPolicy]
+	if !ok {
+		return nil, fmt.Errorf("unknown even median policy: %s", config.EvenMedianPolicy)
+	}
+	return timesource.NewNTPTimeSource(timesource.Config{
+		Servers:             config.Servers,
+		MinServers:          config.MinServers,
+		AllowedFailures:     config.AllowedFailures,
+		AllowedFailureRatio: config.AllowedFailureRatio,
+		UpdatePeriod:        time.Duration(config.UpdatePeriod) * time.Second,
+		MaxRTT:              time.Duration(config.MaxRTT) * time.Millisecond,
+		SampleSize:          config.SampleSize,
+		OffsetFile:          config.OffsetFile,
+		SlewRate:            config.SlewRate,
+		StepThreshold:       time.Duration(config.StepThreshold) * time.Millisecond,
+		QueryOptions: ntp.QueryOptions{
+			Timeout: time.Duration(config.QueryTimeout) * time.Millisecond,
+			Version: config.QueryVersion,
+			TTL:     config.QueryTTL,
+		},
+		EvenMedianPolicy: policy,
+		Parallelism:      config.Parallelism,
+	})
+}
+
 // makeIPCPath returns IPC-RPC filename
 func makeIPCPath(config *params.NodeConfig) string {
 	if !config.IPCEnabled {
@@ -48,3 +48,25 @@ func TestWhisperLightModeEnabledSetsNilBloomFilter(t *testing.T) {
 	require.NoError(t, node.gethService(&whisper))
 	require.Nil(t, whisper.BloomFilter())
 }
+
+func TestNewTimeSource(t *testing.T) {
+	source, err := newTimeSource(nil)
+	require.NoError(t, err)
+	require.NotNil(t, source)
+
+	_, err = newTimeSource(&params.TimeSourceConfig{
+		Servers:          []string{"0.pool.ntp.org", "1.pool.ntp.org"},
+		MinServers:       2,
+		UpdatePeriod:     60,
+		SlewRate:         500,
+		StepThreshold:    100,
+		EvenMedianPolicy: "lower",
+	})
+	require.NoError(t, err)
+
+	_, err = newTimeSource(&params.TimeSourceConfig{Servers: []string{"0.pool.ntp.org"}, MinServers: 2})
+	require.Error(t, err)
+
+	_, err = newTimeSource(&params.TimeSourceConfig{EvenMedianPolicy: "mean"})
+	require.Error(t, err)
+}
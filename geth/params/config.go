@@ -108,9 +108,208 @@ type WhisperConfig struct {
 	// RateLimit minimum time between queries to mail server per peer
 	MailServerRateLimit int
 
+	// MailServerDisableRateLimit turns off the per-peer and per-topic rate limiters, whatever their
+	// configured limits, e.g. on a trusted private network
+	MailServerDisableRateLimit bool
+
+	// MailServerRateLimitJitter adds an exponentially growing random delay to the retry time
+	// suggested to throttled peers, so that they do not retry all at once
+	MailServerRateLimitJitter bool
+
+	// MailServerRateLimitMaxPeers maximum number of peers tracked by the rate limiter, and whose
+	// reputation is kept in memory, the peers seen least recently being evicted first (0 means unlimited)
+	MailServerRateLimitMaxPeers int
+
+	// MailServerLoadTarget number of requests in flight above which the mail server tightens the rate
+	// limit of every peer, in proportion to the excess load (0 keeps the rate limit static)
+	MailServerLoadTarget int
+
+	// MailServerMaxLoadScale maximum factor the rate limit is multiplied by under load (defaults to 4)
+	MailServerMaxLoadScale int
+
+	// MailServerRateLimitExemptions hex-encoded IDs of peers never throttled by the mail server
+	MailServerRateLimitExemptions []string
+
+	// MailServerRequestQuota maximum number of requests served per peer over the quota window, on top
+	// of the rate limit; quotas are persisted across restarts (0 disables the quota)
+	MailServerRequestQuota int
+
+	// MailServerRequestQuotaWindow window in seconds over which the mail server applies the request
+	// quota (0 means a day)
+	MailServerRequestQuotaWindow int
+
+	// MailServerRequestQuotaCalendar resets request quotas at fixed multiples of the window since the
+	// Unix epoch, e.g. at midnight UTC for a day, instead of a window after the first request of a peer
+	MailServerRequestQuotaCalendar bool
+
+	// MailServerRequestQuotaSweepPeriod time in seconds between sweeps of the persisted request quotas
+	// of peers whose window is over, also swept on startup (0 means the quota window)
+	MailServerRequestQuotaSweepPeriod int
+
+	// MailServerPeerReputation makes the mail server scale the rate limit of peers by a persisted
+	// reputation, raised by valid requests and lowered by malformed or over quota ones
+	MailServerPeerReputation bool
+
+	// MailServerRequestCountWindow time window in seconds over which the mail server counts
+	// requests per peer for monitoring (0 disables counting)
+	MailServerRequestCountWindow int
+
+	// MailServerMaxQueueLength maximum number of requests the mail server serves or queues at once;
+	// further requests are rejected as the server is busy (0 means unlimited)
+	MailServerMaxQueueLength int
+
+	// MailServerMaxConcurrentRequests maximum number of requests the mail server serves at once;
+	// further requests wait, the cheapest first as estimated from the archive (0 means unlimited)
+	MailServerMaxConcurrentRequests int
+
+	// MailServerOpenFilesBackoff time in seconds the mail server halves MailServerMaxConcurrentRequests
+	// for after running out of file descriptors (0 keeps the concurrency)
+	MailServerOpenFilesBackoff int
+
+	// MailServerOpenRetries number of times the mail server retries opening its DB on startup, with
+	// an exponential backoff, while another process holds the DB lock (0 fails at once)
+	MailServerOpenRetries int
+
+	// MailServerPauseQueueSize maximum number of envelopes queued in memory while archiving is
+	// paused, archived once it resumes (0 rejects envelopes while paused)
+	MailServerPauseQueueSize int
+
+	// MailServerAckTimeout time in seconds the mail server waits for peers which asked to acknowledge
+	// deliveries before reporting them as unacknowledged (0 disables ack tracking)
+	MailServerAckTimeout int
+
+	// MailServerTopicRateLimit minimum time in seconds between queries to mail server for the same
+	// exact topic, across all peers (0 disables per-topic limiting)
+	MailServerTopicRateLimit int
+
+	// MailServerFutureGrace time in seconds a request upper bound may be ahead of the mail server clock;
+	// such bounds are clamped to the current time and further ones are rejected (0 disables the check)
+	MailServerFutureGrace int
+
+	// MailServerQueryDeadline time in seconds after which the mail server stops scanning for a request
+	// and returns partial results with a cursor (0 means the default of 30 seconds)
+	MailServerQueryDeadline int
+
 	// MailServerCleanupPeriod time in seconds to wait to run mail server cleanup
 	MailServerCleanupPeriod int
 
+	// MailServerCompactionPeriod time in seconds between scheduled compactions of the mail server
+	// database, e.g. 86400 for a nightly compaction (0 disables them)
+	MailServerCompactionPeriod int
+
+	// MailServerMinFreeDiskSpace free disk space in megabytes below which the mail server stops archiving
+	// while still serving requests, resuming once space is freed (0 disables the check)
+	MailServerMinFreeDiskSpace int
+
+	// MailServerMaxArchiveAge time in seconds after which an envelope is too old to be archived
+	// (0 means envelopes of any age are archived)
+	MailServerMaxArchiveAge int
+
+	// MailServerMinTTL minimum TTL in seconds of an envelope to be archived, short-lived envelopes
+	// being ephemeral (0 means envelopes of any TTL are archived)
+	MailServerMinTTL int
+
+	// MailServerSkipEmptyEnvelopes makes the mail server skip envelopes without payload, which carry
+	// no history, instead of archiving them
+	MailServerSkipEmptyEnvelopes bool
+
+	// MailServerArrivalMetadata whether the mail server stores the arrival time, delivering peer and
+	// observed PoW of every archived envelope, for forensic analysis
+	MailServerArrivalMetadata bool
+
+	// MailServerArchiveTopics hex-encoded topics the mail server archives envelopes of, dropping the
+	// others, e.g. for a mail server dedicated to one application (empty archives every topic)
+	MailServerArchiveTopics []string
+
+	// MailServerTopicRewrites hex-encoded topics the mail server archives envelopes of under another
+	// topic, e.g. during a protocol migration (empty leaves topics untouched)
+	MailServerTopicRewrites map[string]string
+
+	// MailServerMaxEnvelopeSize maximum size in bytes of an encoded envelope to be archived
+	// (0 means the whisper protocol limit)
+	MailServerMaxEnvelopeSize int
+
+	// MailServerSyncWrites forces the mail server to sync every archived envelope to disk,
+	// trading throughput for durability in case of a crash
+	MailServerSyncWrites bool
+
+	// MailServerMaxSenderScan maximum number of envelopes the mail server decrypts per request filtered
+	// by sender, after which partial results are returned with a cursor (0 means unlimited)
+	MailServerMaxSenderScan int
+
+	// MailServerDeliveryBatchSize number of envelopes the mail server sends as a single p2p message to
+	// requesting peers that decode batches (0 means the default of 100)
+	MailServerDeliveryBatchSize int
+
+	// MailServerDeliveryPoWCheck makes the mail server withhold archived envelopes below MinimumPoW
+	// on delivery, in case the minimum was raised after they were archived
+	MailServerDeliveryPoWCheck bool
+
+	// MailServerPurgeLowPoW makes the mail server remove the envelopes withheld on delivery
+	// as they are below MinimumPoW, requires MailServerDeliveryPoWCheck
+	MailServerPurgeLowPoW bool
+
+	// MailServerNamespace scopes the archive of the mail server, so that mail servers of different
+	// networks can share a DB (empty means the default namespace)
+	MailServerNamespace string
+
+	// MailServerMonitoringAddr address of an HTTPS endpoint serving the mail server metrics in the
+	// Prometheus format on /metrics and its health on /healthz (empty disables the endpoint)
+	MailServerMonitoringAddr string
+
+	// MailServerMonitoringCertFile TLS certificate of the monitoring endpoint
+	MailServerMonitoringCertFile string
+
+	// MailServerMonitoringKeyFile TLS private key of the monitoring endpoint
+	MailServerMonitoringKeyFile string
+
+	// MailServerHotRetention time in seconds after which archived envelopes are moved to the cold
+	// storage of the mail server, if one is set (0 keeps every envelope in the database)
+	MailServerHotRetention int
+
+	// MailServerMirrorPeers hex-encoded IDs of standby mail servers every archived envelope is
+	// forwarded to, best-effort, to keep them in sync
+	MailServerMirrorPeers []string
+
+	// MailServerMirrorQueueSize maximum number of envelopes waiting to be forwarded to the standby
+	// mail servers, further envelopes being dropped (0 means 1000)
+	MailServerMirrorQueueSize int
+
+	// MailServerMirrorSources hex-encoded IDs of the mail servers whose forwarded envelopes are
+	// archived, this mail server being their standby
+	MailServerMirrorSources []string
+
+	// MailServerCacheEntries maximum number of recently archived or read envelopes the mail server
+	// keeps decoded in memory (0 with MailServerCacheBytes unset disables the cache)
+	MailServerCacheEntries int
+
+	// MailServerCacheBytes maximum encoded size in bytes of the envelopes kept in the cache of the
+	// mail server (0 means no bound on the size)
+	MailServerCacheBytes int
+
+	// MailServerErrorResponses makes the mail server answer rejected requests with a direct message
+	// holding an error code, instead of leaving the peer to time out
+	MailServerErrorResponses bool
+
+	// MailServerSignResponses makes the mail server follow every delivered batch with a proof
+	// listing the delivered envelopes, signed with the node key
+	MailServerSignResponses bool
+
+	// MailServerTombstones makes the mail server keep the sent time and hash of pruned envelopes,
+	// so that they are still accounted for by checksums (default is to delete them)
+	MailServerTombstones bool
+
+	// MailServerBloomFilterBits bits per key of the LevelDB bloom filter used to speed up point
+	// lookups in the mail server database (0 disables the filter)
+	MailServerBloomFilterBits int
+
+	// MailServerReadOnly opens the mail server database read-only; archiving is then disabled
+	MailServerReadOnly bool
+
+	// MailServerSkipHashIndexCheck skips the startup check repairing the hash index of the mail
+	// server database, e.g. for a fast startup on a large archive
+	MailServerSkipHashIndexCheck bool
+
 	// TTL time to live for messages, in seconds
 	TTL int
 
@@ -213,6 +412,62 @@ type UpstreamRPCConfig struct {
 	URL string
 }
 
+// ----------
+// TimeSourceConfig
+// ----------
+
+// TimeSourceConfig holds the configuration of the time source synced with ntp servers.
+// Zero values mean defaults, except for AllowedFailures.
+type TimeSourceConfig struct {
+	// Servers ntp servers to query (defaults to the ntp.org pool)
+	Servers []string
+
+	// MinServers minimum number of distinct servers to configure
+	MinServers int
+
+	// AllowedFailures number of servers allowed to fail per update (0 tolerates no failure)
+	AllowedFailures int
+
+	// AllowedFailureRatio fraction of the servers queried per update allowed to fail, between 0 and 1,
+	// overriding AllowedFailures if set
+	AllowedFailureRatio float64
+
+	// UpdatePeriod time in seconds between updates (0 means 2 minutes)
+	UpdatePeriod int
+
+	// MaxRTT round-trip delay in milliseconds above which ntp responses are discarded (0 means no limit)
+	MaxRTT int
+
+	// SampleSize number of servers queried per update (0 means all of them)
+	SampleSize int
+
+	// OffsetFile file persisting the last known good offset across restarts
+	OffsetFile string
+
+	// SlewRate rate in parts per million at which offset corrections larger than StepThreshold are
+	// applied gradually (0 applies every correction at once)
+	SlewRate float64
+
+	// StepThreshold offset correction in milliseconds up to which corrections are applied at once
+	StepThreshold int
+
+	// QueryTimeout timeout in milliseconds of every ntp query (0 means 2 seconds)
+	QueryTimeout int
+
+	// QueryVersion ntp protocol version of every query (0 means 4)
+	QueryVersion int
+
+	// QueryTTL IP TTL of every ntp query (0 means the system default)
+	QueryTTL int
+
+	// EvenMedianPolicy offset picked out of an even number of responses: "average" of the two middle
+	// offsets, which is the default, or the "lower" or "upper" one
+	EvenMedianPolicy string
+
+	// Parallelism maximum number of servers queried at once per update (0 means all of them)
+	Parallelism int
+}
+
 // ----------
 // NodeConfig
 // ----------
@@ -310,6 +565,9 @@ type NodeConfig struct {
 	// SwarmConfig extra configuration for Swarm and ENS
 	SwarmConfig *SwarmConfig `json:"SwarmConfig," validate:"structonly"`
 
+	// TimeSourceConfig extra configuration for the ntp time source (defaults are used if nil)
+	TimeSourceConfig *TimeSourceConfig `json:"TimeSourceConfig," validate:"structonly"`
+
 	RegisterTopics []discv5.Topic          `json:"RegisterTopics"`
 	RequireTopics  map[discv5.Topic]Limits `json:"RequireTopics"`
 
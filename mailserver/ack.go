@@ -0,0 +1,85 @@
+package mailserver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// pendingAck is a delivery waiting to be acknowledged by the peer.
+type pendingAck struct {
+	peer      string
+	delivered int
+	sent      time.Time
+}
+
+// ackTracker records deliveries made to peers which asked to acknowledge
+// them, keyed by the hash of their request envelope. Peers acknowledge a
+// delivery by sending a request carrying the ack option, so clients which
+// never ask for it are not affected.
+type ackTracker struct {
+	mu sync.Mutex
+
+	timeout time.Duration
+	pending map[common.Hash]pendingAck
+}
+
+func newAckTracker(timeout time.Duration) *ackTracker {
+	return &ackTracker{
+		timeout: timeout,
+		pending: make(map[common.Hash]pendingAck),
+	}
+}
+
+// expect records a delivery to be acknowledged.
+func (t *ackTracker) expect(request common.Hash, peer []byte, delivered int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.pending[request] = pendingAck{
+		peer:      string(peer),
+		delivered: delivered,
+		sent:      time.Now(),
+	}
+}
+
+// ack acknowledges a delivery. It returns false if no delivery to the peer
+// is pending for the request.
+func (t *ackTracker) ack(request common.Hash, peer []byte) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.pending[request]
+	if !ok || p.peer != string(peer) {
+		return false
+	}
+	delete(t.pending, request)
+	deliveryAckedCounter.Inc(1)
+	deliveryAckTimer.UpdateSince(p.sent)
+	return true
+}
+
+// deleteExpired drops and reports deliveries which were not acknowledged
+// in time.
+func (t *ackTracker) deleteExpired() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for request, p := range t.pending {
+		if p.sent.Add(t.timeout).Before(now) {
+			log.Warn("Delivery was not acknowledged", "peer", []byte(p.peer), "request", request,
+				"delivered", p.delivered, "sent", p.sent)
+			deliveryUnackedCounter.Inc(1)
+			delete(t.pending, request)
+		}
+	}
+}
+
+func (t *ackTracker) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.pending)
+}
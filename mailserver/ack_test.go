@@ -0,0 +1,32 @@
+package mailserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAckTracker(t *testing.T) {
+	tracker := newAckTracker(time.Hour)
+	first := common.HexToHash("0x01")
+	second := common.HexToHash("0x02")
+
+	tracker.expect(first, []byte("peer1"), 10)
+	tracker.expect(second, []byte("peer2"), 5)
+	require.Equal(t, 2, tracker.len())
+
+	require.False(t, tracker.ack(first, []byte("peer2")), "only the requesting peer can ack")
+	require.True(t, tracker.ack(first, []byte("peer1")))
+	require.False(t, tracker.ack(first, []byte("peer1")), "a delivery is acked once")
+
+	tracker.deleteExpired()
+	require.Equal(t, 1, tracker.len())
+
+	p := tracker.pending[second]
+	p.sent = time.Now().Add(-2 * time.Hour)
+	tracker.pending[second] = p
+	tracker.deleteExpired()
+	require.Equal(t, 0, tracker.len())
+}
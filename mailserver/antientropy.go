@@ -0,0 +1,212 @@
+package mailserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+var errInvalidReconcileWindow = errors.New("reconcile window must be at least a second")
+
+// Replica is a mail server archive taking part in anti-entropy, which
+// WMailServer implements. Remote archives are reached through a transport
+// exposing these methods, e.g. an RPC client.
+type Replica interface {
+	// Checksums returns the checksum of every window of the given duration
+	// between from and to, both inclusive.
+	Checksums(from, to time.Time, window time.Duration) ([][]byte, error)
+	// Hashes returns the hashes of the envelopes sent between from and to,
+	// both inclusive.
+	Hashes(from, to time.Time) ([]common.Hash, error)
+	// Export returns the envelopes with the given hashes, skipping those
+	// not found.
+	Export(hashes []common.Hash) ([]*whisper.Envelope, error)
+	// Import archives the given envelopes and returns how many were.
+	Import(envelopes []*whisper.Envelope) (int, error)
+}
+
+var _ Replica = (*WMailServer)(nil)
+
+// ReconcileResult describes the outcome of an anti-entropy session.
+type ReconcileResult struct {
+	Windows int // number of windows whose checksums differed
+	Pulled  int // envelopes imported from the peer
+	Pushed  int // envelopes imported by the peer
+}
+
+// Reconcile brings the archive and the one of peer in sync between from and
+// to, both inclusive. Checksums of every window are compared first, so that
+// only the envelope hashes of differing windows are exchanged, and only the
+// envelopes missing on either side are transferred. Running it between the
+// members of a cluster from time to time makes their archives eventually
+// consistent without a central coordinator.
+//
+// Tombstones count as envelopes, so that pruned envelopes are not brought
+// back from a peer which still has them.
+func (s *WMailServer) Reconcile(peer Replica, from, to time.Time, window time.Duration) (ReconcileResult, error) {
+	var result ReconcileResult
+
+	local, err := s.Checksums(from, to, window)
+	if err != nil {
+		return result, err
+	}
+	remote, err := peer.Checksums(from, to, window)
+	if err != nil {
+		return result, fmt.Errorf("peer checksums: %s", err)
+	}
+	if len(local) != len(remote) {
+		return result, fmt.Errorf("peer returned %d checksums, expected %d", len(remote), len(local))
+	}
+
+	for i := range local {
+		if bytes.Equal(local[i], remote[i]) {
+			continue
+		}
+		result.Windows++
+
+		lower, upper := windowBounds(from, to, window, i)
+		pulled, pushed, err := s.reconcileWindow(peer, lower, upper)
+		result.Pulled += pulled
+		result.Pushed += pushed
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if result.Windows > 0 {
+		log.Info("Reconciled archive with peer", "windows", result.Windows,
+			"pulled", result.Pulled, "pushed", result.Pushed)
+	}
+	return result, nil
+}
+
+// reconcileWindow transfers the envelopes of a window missing on either side.
+func (s *WMailServer) reconcileWindow(peer Replica, from, to time.Time) (pulled, pushed int, err error) {
+	local, err := s.Hashes(from, to)
+	if err != nil {
+		return 0, 0, err
+	}
+	remote, err := peer.Hashes(from, to)
+	if err != nil {
+		return 0, 0, fmt.Errorf("peer hashes: %s", err)
+	}
+
+	if missing := missingHashes(remote, local); len(missing) > 0 {
+		envelopes, err := peer.Export(missing)
+		if err != nil {
+			return 0, 0, fmt.Errorf("peer export: %s", err)
+		}
+		if pulled, err = s.Import(envelopes); err != nil {
+			return pulled, 0, err
+		}
+	}
+
+	if missing := missingHashes(local, remote); len(missing) > 0 {
+		envelopes, err := s.Export(missing)
+		if err != nil {
+			return pulled, 0, err
+		}
+		if pushed, err = peer.Import(envelopes); err != nil {
+			return pulled, pushed, fmt.Errorf("peer import: %s", err)
+		}
+	}
+	return pulled, pushed, nil
+}
+
+// windowBounds returns the bounds, both inclusive, of the i-th window of
+// the given duration starting at from, the last one ending at to.
+func windowBounds(from, to time.Time, window time.Duration, i int) (time.Time, time.Time) {
+	lower := from.Add(time.Duration(i) * window)
+	upper := lower.Add(window - time.Second)
+	if upper.After(to) {
+		upper = to
+	}
+	return lower, upper
+}
+
+// missingHashes returns the hashes of want not found in have.
+func missingHashes(want, have []common.Hash) []common.Hash {
+	known := make(map[common.Hash]struct{}, len(have))
+	for _, hash := range have {
+		known[hash] = struct{}{}
+	}
+	var missing []common.Hash
+	for _, hash := range want {
+		if _, ok := known[hash]; !ok {
+			missing = append(missing, hash)
+		}
+	}
+	return missing
+}
+
+// Checksums returns the checksum of every window of the given duration
+// between from and to, both inclusive, as computed by Checksum.
+func (s *WMailServer) Checksums(from, to time.Time, window time.Duration) ([][]byte, error) {
+	if window < time.Second {
+		return nil, errInvalidReconcileWindow
+	}
+
+	var checksums [][]byte
+	for i := 0; !from.Add(time.Duration(i) * window).After(to); i++ {
+		lower, upper := windowBounds(from, to, window, i)
+		checksum, err := s.Checksum(lower, upper)
+		if err != nil {
+			return nil, err
+		}
+		checksums = append(checksums, checksum)
+	}
+	return checksums, nil
+}
+
+// Hashes returns the hashes of the envelopes, or of their tombstones, sent
+// between from and to, both inclusive, in either tier.
+func (s *WMailServer) Hashes(from, to time.Time) ([]common.Hash, error) {
+	var hashes []common.Hash
+	err := s.forEachKey(from, to, func(key []byte) {
+		hashes = append(hashes, envelopeKeyHash(key))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// Export returns the archived envelopes with the given hashes, skipping
+// those not found or pruned.
+func (s *WMailServer) Export(hashes []common.Hash) ([]*whisper.Envelope, error) {
+	var envelopes []*whisper.Envelope
+	for _, hash := range hashes {
+		env, err := s.GetByHash(hash)
+		if err != nil {
+			return nil, err
+		}
+		if env != nil {
+			envelopes = append(envelopes, env)
+		}
+	}
+	return envelopes, nil
+}
+
+// Import archives the given envelopes, e.g. exported by another mail server,
+// and returns how many were. Envelopes are subject to the same policies as
+// when received from whisper, and those rejected are skipped.
+func (s *WMailServer) Import(envelopes []*whisper.Envelope) (int, error) {
+	if s.readOnly {
+		return 0, errReadOnly
+	}
+
+	imported := 0
+	for _, env := range envelopes {
+		if err := s.archive(env); err != nil {
+			log.Debug("Envelope not imported", "hash", env.Hash(), "error", err)
+			continue
+		}
+		imported++
+	}
+	return imported, nil
+}
@@ -0,0 +1,115 @@
+package mailserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/status-im/status-go/timesource"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconcile(t *testing.T) {
+	now := time.Now()
+	from, to := now.Add(-time.Minute), now
+	first := setupTestServer(t)
+	defer first.Close()
+	second := setupTestServer(t)
+	defer second.Close()
+
+	archive := func(sent time.Duration, servers ...*WMailServer) {
+		env, err := generateEnvelope(now.Add(-sent))
+		require.NoError(t, err)
+		for _, server := range servers {
+			require.NoError(t, server.archive(env))
+		}
+	}
+	archive(50*time.Second, first, second)
+	archive(45*time.Second, first)
+	archive(25*time.Second, second)
+	archive(15*time.Second, first, second)
+	archive(5*time.Second, second)
+
+	result, err := first.Reconcile(second, from, to, 10*time.Second)
+	require.NoError(t, err)
+	require.Equal(t, ReconcileResult{Windows: 3, Pulled: 2, Pushed: 1}, result)
+	testMessagesCount(t, 5, first)
+	testMessagesCount(t, 5, second)
+
+	firstSum, err := first.Checksum(from, to)
+	require.NoError(t, err)
+	secondSum, err := second.Checksum(from, to)
+	require.NoError(t, err)
+	require.Equal(t, firstSum, secondSum)
+
+	result, err = second.Reconcile(first, from, to, 10*time.Second)
+	require.NoError(t, err)
+	require.Equal(t, ReconcileResult{}, result, "reconciled archives should have nothing to exchange")
+
+	_, err = first.Checksums(from, to, time.Millisecond)
+	require.Equal(t, errInvalidReconcileWindow, err)
+}
+
+func TestReconcileColdStorage(t *testing.T) {
+	now := time.Now()
+	from, to := now.Add(-3*time.Hour), now
+	first := setupTestServer(t)
+	defer first.Close()
+	second := setupTestServer(t)
+	defer second.Close()
+	first.SetTimeSource(timesource.TimeSourceFunc(func() time.Time { return now }))
+	first.hotRetention = time.Hour
+	first.SetColdStorage(newMemColdStorage())
+
+	for _, age := range []time.Duration{2 * time.Hour, 90 * time.Minute, time.Minute} {
+		env, err := generateEnvelope(now.Add(-age))
+		require.NoError(t, err)
+		require.NoError(t, first.archive(env))
+		require.NoError(t, second.archive(env))
+	}
+	moved, err := first.moveToColdStorage()
+	require.NoError(t, err)
+	require.Equal(t, 2, moved)
+
+	firstSum, err := first.Checksum(from, to)
+	require.NoError(t, err)
+	secondSum, err := second.Checksum(from, to)
+	require.NoError(t, err)
+	require.Equal(t, secondSum, firstSum, "moved envelopes should still be checksummed")
+
+	result, err := first.Reconcile(second, from, to, time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, ReconcileResult{}, result, "moved envelopes should not be pulled again")
+
+	counts, err := first.TopicCounts()
+	require.NoError(t, err)
+	var total int64
+	for _, count := range counts {
+		total += count
+	}
+	require.Equal(t, int64(3), total)
+}
+
+func TestExportImport(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+
+	env := archiveEnvelope(t, now.Add(-time.Second), server)
+	exported, err := server.Export([]common.Hash{env.Hash(), common.HexToHash("0x01")})
+	require.NoError(t, err)
+	require.Len(t, exported, 1, "unknown hashes should be skipped")
+	require.Equal(t, env.Hash(), exported[0].Hash())
+
+	other, err := generateEnvelope(now.Add(-2 * time.Second))
+	require.NoError(t, err)
+	imported, err := server.Import([]*whisper.Envelope{other})
+	require.NoError(t, err)
+	require.Equal(t, 1, imported)
+	testMessagesCount(t, 2, server)
+
+	server.readOnly = true
+	_, err = server.Import([]*whisper.Envelope{other})
+	require.Equal(t, errReadOnly, err)
+}
@@ -0,0 +1,68 @@
+package mailserver
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// SetArchiveTopics restricts archiving to the envelopes of the given topics,
+// e.g. for a mail server dedicated to a single application, so that it does
+// not waste storage on unrelated traffic. Without topics, envelopes of every
+// topic are archived. It can be called while the server is running.
+func (s *WMailServer) SetArchiveTopics(topics []whisper.TopicType) {
+	var allowed map[whisper.TopicType]struct{}
+	if len(topics) > 0 {
+		allowed = make(map[whisper.TopicType]struct{}, len(topics))
+		for _, topic := range topics {
+			allowed[topic] = struct{}{}
+		}
+	}
+
+	s.archiveTopicsMu.Lock()
+	defer s.archiveTopicsMu.Unlock()
+	s.archiveTopics = allowed
+}
+
+// ArchiveTopics returns the topics archiving is restricted to, nil if
+// envelopes of every topic are archived.
+func (s *WMailServer) ArchiveTopics() []whisper.TopicType {
+	s.archiveTopicsMu.RLock()
+	defer s.archiveTopicsMu.RUnlock()
+
+	var topics []whisper.TopicType
+	for topic := range s.archiveTopics {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// isArchivedTopic reports whether envelopes of the given topic are archived.
+func (s *WMailServer) isArchivedTopic(topic whisper.TopicType) bool {
+	s.archiveTopicsMu.RLock()
+	defer s.archiveTopicsMu.RUnlock()
+
+	if s.archiveTopics == nil {
+		return true
+	}
+	_, ok := s.archiveTopics[topic]
+	return ok
+}
+
+// decodeTopics decodes hex-encoded topics.
+func decodeTopics(topics []string) ([]whisper.TopicType, error) {
+	var decoded []whisper.TopicType
+	for _, topic := range topics {
+		raw, err := hex.DecodeString(strings.TrimPrefix(topic, "0x"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid topic %s: %s", topic, err)
+		}
+		if len(raw) != whisper.TopicLength {
+			return nil, fmt.Errorf("invalid topic %s: expected %d bytes", topic, whisper.TopicLength)
+		}
+		decoded = append(decoded, whisper.BytesToTopic(raw))
+	}
+	return decoded, nil
+}
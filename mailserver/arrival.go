@@ -0,0 +1,104 @@
+package mailserver
+
+import (
+	"math"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// arrivalPrefix prefixes the keys of the arrival records, stored next to the
+// envelopes archived while arrival metadata is enabled. Records are keyed by
+// the DB key of their envelope and removed along with it.
+var arrivalPrefix = []byte{reservedPrefix, 'a'}
+
+func arrivalKey(key []byte) []byte {
+	return append(append([]byte(nil), arrivalPrefix...), key...)
+}
+
+// Arrival describes how an envelope reached the archive, to investigate the
+// provenance of suspicious messages.
+type Arrival struct {
+	Time uint64 // server time the envelope was archived at, in unix nanoseconds
+	Peer []byte // ID of the peer that delivered the envelope, empty if unknown
+	PoW  uint64 // bits of the PoW observed on arrival, see ObservedPoW
+}
+
+func newArrival(t time.Time, peer []byte, pow float64) Arrival {
+	return Arrival{Time: uint64(t.UnixNano()), Peer: peer, PoW: math.Float64bits(pow)}
+}
+
+// ArrivedAt returns the server time the envelope was archived at.
+func (a Arrival) ArrivedAt() time.Time {
+	return time.Unix(0, int64(a.Time))
+}
+
+// ObservedPoW returns the PoW of the envelope observed on arrival.
+func (a Arrival) ObservedPoW() float64 {
+	return math.Float64frombits(a.PoW)
+}
+
+// ArchiveFrom archives a whisper envelope delivered by the given peer. The
+// peer is recorded along with the envelope if arrival metadata is enabled.
+func (s *WMailServer) ArchiveFrom(peer []byte, env *whisper.Envelope) {
+	if err := s.archiveFrom(peer, env); err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// encodeArrival returns the arrival record of an envelope being archived, or
+// nil if arrival metadata is disabled.
+func (s *WMailServer) encodeArrival(peer []byte, env *whisper.Envelope) ([]byte, error) {
+	if !s.arrivalMetadata {
+		return nil, nil
+	}
+	return rlp.EncodeToBytes(newArrival(s.now(), peer, env.PoW()))
+}
+
+// readArrival returns the arrival record of the envelope stored under the
+// given key, or nil if there is none.
+func (s *WMailServer) readArrival(key []byte) (*Arrival, error) {
+	value, err := s.db.Get(arrivalKey(key), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var arrival Arrival
+	if err := rlp.DecodeBytes(value, &arrival); err != nil {
+		return nil, err
+	}
+	return &arrival, nil
+}
+
+// arrivalRemovals collects the envelopes deleted or replaced by their
+// tombstone in a batch. It implements leveldb.BatchReplay.
+type arrivalRemovals [][]byte
+
+func (r *arrivalRemovals) Put(key, value []byte) {
+	if isEnvelopeKey(key) && isTombstone(value) {
+		*r = append(*r, arrivalKey(key))
+	}
+}
+
+func (r *arrivalRemovals) Delete(key []byte) {
+	if isEnvelopeKey(key) {
+		*r = append(*r, arrivalKey(key))
+	}
+}
+
+// removeArrivals adds to the batch the removal of the arrival records of
+// the envelopes it removes.
+func removeArrivals(batch *leveldb.Batch) error {
+	var removals arrivalRemovals
+	if err := batch.Replay(&removals); err != nil {
+		return err
+	}
+	for _, key := range removals {
+		batch.Delete(key)
+	}
+	return nil
+}
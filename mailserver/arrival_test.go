@@ -0,0 +1,83 @@
+package mailserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func TestArrivalMetadata(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+
+	// envelopes archived while arrival metadata is disabled have no record
+	untracked := archiveEnvelope(t, now.Add(-3*time.Second), server)
+	server.arrivalMetadata = true
+	fromPeer, err := BuildEnvelope(whisper.BytesToTopic([]byte("abcd")), []byte("peer"), now.Add(-2*time.Second))
+	require.NoError(t, err)
+	require.NoError(t, server.archiveFrom([]byte("peer"), fromPeer))
+	unknown := archiveEnvelope(t, now.Add(-time.Second), server)
+
+	peerKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	r := &messagesRequest{
+		lower:        uint32(now.Add(-time.Minute).Unix()),
+		upper:        uint32(now.Unix()),
+		bloom:        whisper.MakeFullNodeBloom(),
+		src:          &peerKey.PublicKey,
+		metadataOnly: true,
+	}
+	descriptors := func() []EnvelopeDescriptor {
+		messages, result := server.processRequest(nil, r)
+		require.Equal(t, 3, result.Delivered)
+		msg := messages[0].Open(&whisper.Filter{KeyAsym: peerKey})
+		require.NotNil(t, msg)
+		var descriptors []EnvelopeDescriptor
+		require.NoError(t, rlp.DecodeBytes(msg.Payload, &descriptors))
+		return descriptors
+	}
+
+	for _, d := range descriptors() {
+		require.Empty(t, d.Arrival, "arrival metadata should only be included on request")
+	}
+
+	r.arrival = true
+	got := descriptors()
+	require.Equal(t, untracked.Hash(), got[0].Hash)
+	require.Empty(t, got[0].Arrival)
+
+	require.Equal(t, fromPeer.Hash(), got[1].Hash)
+	require.Len(t, got[1].Arrival, 1)
+	arrival := got[1].Arrival[0]
+	require.Equal(t, []byte("peer"), arrival.Peer)
+	require.Equal(t, fromPeer.PoW(), arrival.ObservedPoW())
+	require.WithinDuration(t, time.Now(), arrival.ArrivedAt(), time.Minute)
+
+	require.Equal(t, unknown.Hash(), got[2].Hash)
+	require.Len(t, got[2].Arrival, 1)
+	require.Empty(t, got[2].Arrival[0].Peer)
+
+	// records are removed along with their envelope
+	_, err = server.DeleteRange(now.Add(-2*time.Second), now.Add(-2*time.Second))
+	require.NoError(t, err)
+	key := NewNamespacedDbKey(server.namespace, fromPeer.Expiry-fromPeer.TTL, fromPeer.Hash())
+	_, err = server.db.Get(arrivalKey(key.raw), nil)
+	require.Equal(t, leveldb.ErrNotFound, err)
+}
+
+func TestDecodeArrivalOption(t *testing.T) {
+	option, err := newRequestOption(arrivalOptionCode, true)
+	require.NoError(t, err)
+	raw, err := encodeRequestOptions(option)
+	require.NoError(t, err)
+
+	var r messagesRequest
+	require.NoError(t, decodeRequestOptions(raw, &r))
+	require.True(t, r.arrival)
+}
@@ -0,0 +1,50 @@
+package mailserver
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// AuditRecord describes a request served by the mail server.
+type AuditRecord struct {
+	PeerID    []byte    // ID of the requesting peer
+	Lower     uint32    // lower bound of the requested window
+	Upper     uint32    // upper bound of the requested window
+	Bloom     []byte    // bloom filter of the request
+	Delivered int       // number of envelopes delivered
+	Time      time.Time // time the request was served at
+}
+
+// AuditLogger keeps a durable record of the requests served, e.g. in a
+// file, a DB or a SIEM, as opposed to debug logging. It is called once per
+// request, after it is served, from the goroutine serving it.
+type AuditLogger interface {
+	LogRequest(record AuditRecord) error
+}
+
+// SetAuditLogger sets the logger recording every request served. A nil
+// logger, the default, records nothing.
+func (s *WMailServer) SetAuditLogger(logger AuditLogger) {
+	s.auditLogger = logger
+}
+
+// audit records a served request, if an audit logger is set.
+func (s *WMailServer) audit(peerID []byte, r *messagesRequest, result RequestResult) {
+	if s.auditLogger == nil {
+		return
+	}
+
+	err := s.auditLogger.LogRequest(AuditRecord{
+		PeerID:    peerID,
+		Lower:     r.lower,
+		Upper:     r.upper,
+		Bloom:     r.bloom,
+		Delivered: result.Delivered,
+		Time:      s.now(),
+	})
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to record request for audit: %s", err))
+	}
+}
@@ -0,0 +1,51 @@
+package mailserver
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/status-im/status-go/timesource"
+	"github.com/stretchr/testify/require"
+)
+
+type auditRecorder struct {
+	records []AuditRecord
+	err     error
+}
+
+func (a *auditRecorder) LogRequest(record AuditRecord) error {
+	a.records = append(a.records, record)
+	return a.err
+}
+
+func TestAudit(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	server := setupTestServer(t)
+	defer server.Close()
+	server.SetTimeSource(timesource.TimeSourceFunc(func() time.Time { return now }))
+
+	r := &messagesRequest{lower: 10, upper: 20, bloom: whisper.MakeFullNodeBloom()}
+	result := RequestResult{Delivered: 3}
+
+	// nothing is recorded by default
+	server.audit([]byte("peer"), r, result)
+
+	recorder := &auditRecorder{}
+	server.SetAuditLogger(recorder)
+	server.audit([]byte("peer"), r, result)
+	require.Equal(t, []AuditRecord{{
+		PeerID:    []byte("peer"),
+		Lower:     10,
+		Upper:     20,
+		Bloom:     r.bloom,
+		Delivered: 3,
+		Time:      now,
+	}}, recorder.records)
+
+	// a failing logger does not fail the request
+	recorder.err = errors.New("disk full")
+	server.audit([]byte("peer"), r, result)
+	require.Len(t, recorder.records, 2)
+}
@@ -0,0 +1,99 @@
+package mailserver
+
+import (
+	"container/list"
+	"sync"
+
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// envelopeCache keeps recently archived or read envelopes decoded, keyed by
+// their DB key, so that overlapping requests for recent windows do not
+// decode the same envelopes over and over.
+//
+// Range scans only consult the cache for keys found in the DB, so pruned
+// envelopes are never delivered from it. As a DB key embeds the hash of the
+// envelope, a cached envelope cannot be stale either.
+type envelopeCache struct {
+	mu sync.Mutex
+
+	maxEntries int // 0 means no bound on the number of entries
+	maxBytes   int // 0 means no bound on the encoded size of the entries
+	bytes      int
+
+	order    *list.List // least recently used first
+	elements map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key  string
+	env  *whisper.Envelope
+	size int
+}
+
+func newEnvelopeCache(maxEntries, maxBytes int) *envelopeCache {
+	return &envelopeCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		order:      list.New(),
+		elements:   make(map[string]*list.Element),
+	}
+}
+
+// get returns the envelope cached for the given DB key, if any. Cached
+// envelopes are shared and must not be modified.
+func (c *envelopeCache) get(key []byte) (*whisper.Envelope, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.elements[string(key)]
+	if !ok {
+		envelopeCacheMissCounter.Inc(1)
+		return nil, false
+	}
+	envelopeCacheHitCounter.Inc(1)
+	c.order.MoveToBack(e)
+	return e.Value.(*cacheEntry).env, true
+}
+
+// add caches a copy of the envelope stored under the given DB key with the
+// given encoded size.
+func (c *envelopeCache) add(key []byte, env *whisper.Envelope, size int) {
+	if c.maxBytes > 0 && size > c.maxBytes {
+		return
+	}
+
+	// the copy is only read once cached, so its lazily computed fields are
+	// filled beforehand for concurrent requests not to race on them
+	cached := *env
+	cached.PoW()
+	cached.Hash()
+	cached.Bloom()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.elements[string(key)]; ok {
+		c.order.MoveToBack(e)
+		return
+	}
+	c.elements[string(key)] = c.order.PushBack(&cacheEntry{key: string(key), env: &cached, size: size})
+	c.bytes += size
+
+	for (c.maxEntries > 0 && c.order.Len() > c.maxEntries) || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		c.remove(c.order.Front())
+	}
+}
+
+// remove drops a cached envelope. It must be called with mu held.
+func (c *envelopeCache) remove(e *list.Element) {
+	entry := c.order.Remove(e).(*cacheEntry)
+	delete(c.elements, entry.key)
+	c.bytes -= entry.size
+}
+
+func (c *envelopeCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
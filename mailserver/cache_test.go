@@ -0,0 +1,87 @@
+package mailserver
+
+import (
+	"testing"
+	"time"
+
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvelopeCacheEviction(t *testing.T) {
+	now := time.Now()
+	var envs []*whisper.Envelope
+	for i := 3; i > 0; i-- {
+		env, err := generateEnvelope(now.Add(-time.Duration(i) * time.Second))
+		require.NoError(t, err)
+		envs = append(envs, env)
+	}
+	key := func(i int) []byte { return NewDbKey(uint32(i), envs[i].Hash()).raw }
+
+	testCases := []struct {
+		maxEntries, maxBytes int
+		cached               []bool
+		info                 string
+	}{
+		{2, 0, []bool{false, true, true}, "bounded in entries"},
+		{0, 250, []bool{false, true, true}, "bounded in bytes"},
+		{0, 0, []bool{true, true, true}, "unbounded"},
+	}
+	for _, tc := range testCases {
+		c := newEnvelopeCache(tc.maxEntries, tc.maxBytes)
+		for i, env := range envs {
+			c.add(key(i), env, 100)
+		}
+		for i, expected := range tc.cached {
+			cached, ok := c.get(key(i))
+			require.Equal(t, expected, ok, tc.info)
+			if ok {
+				require.Equal(t, envs[i].Hash(), cached.Hash(), tc.info)
+				require.False(t, cached == envs[i], "a copy should be cached")
+			}
+		}
+	}
+
+	// reading an envelope makes it the most recently used
+	c := newEnvelopeCache(2, 0)
+	c.add(key(0), envs[0], 100)
+	c.add(key(1), envs[1], 100)
+	c.get(key(0))
+	c.add(key(2), envs[2], 100)
+	_, ok := c.get(key(0))
+	require.True(t, ok)
+	_, ok = c.get(key(1))
+	require.False(t, ok)
+}
+
+func TestEnvelopeCachePrune(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+	server.cache = newEnvelopeCache(10, 0)
+
+	archiveEnvelope(t, now.Add(-2*time.Hour), server)
+	recent := archiveEnvelope(t, now.Add(-time.Minute), server)
+	require.Equal(t, 2, server.cache.len(), "archived envelopes should be cached")
+
+	r := &messagesRequest{
+		lower: uint32(now.Add(-3 * time.Hour).Unix()),
+		upper: uint32(now.Unix()),
+		bloom: whisper.MakeFullNodeBloom(),
+	}
+	mail, _ := server.processRequest(nil, r)
+	require.Len(t, mail, 2)
+
+	// pruned envelopes are not delivered from the cache
+	_, err := server.DeleteRange(now.Add(-3*time.Hour), now.Add(-time.Hour))
+	require.NoError(t, err)
+	mail, _ = server.processRequest(nil, r)
+	require.Len(t, mail, 1)
+	require.Equal(t, recent.Hash(), mail[0].Hash())
+
+	// envelopes read from the DB are cached too
+	server.cache = newEnvelopeCache(10, 0)
+	mail, _ = server.processRequest(nil, r)
+	require.Len(t, mail, 1)
+	require.Equal(t, 1, server.cache.len())
+}
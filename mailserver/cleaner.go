@@ -1,7 +1,11 @@
 package mailserver
 
 import (
+	"sync"
+
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/iterator"
 	"github.com/syndtr/goleveldb/leveldb/util"
@@ -13,6 +17,18 @@ const batchSize = 1000
 type Cleaner struct {
 	db        *leveldb.DB
 	batchSize int
+
+	// tombstones makes prune keep the keys of removed messages, which embed
+	// their sent time and hash, so that they can still be accounted for.
+	tombstones bool
+
+	// namespace prefixes the keys of the messages, nil for the default
+	// namespace.
+	namespace []byte
+
+	// indexMu serializes index updates with the other writers of db, e.g.
+	// the mail server it belongs to.
+	indexMu *sync.Mutex
 }
 
 // NewCleanerWithDB returns a new Cleaner for db
@@ -20,44 +36,152 @@ func NewCleanerWithDB(db *leveldb.DB) *Cleaner {
 	return &Cleaner{
 		db:        db,
 		batchSize: batchSize,
+		indexMu:   new(sync.Mutex),
 	}
 }
 
+// NewTombstoneCleanerWithDB returns a new Cleaner for db which leaves
+// tombstones behind instead of deleting messages
+func NewTombstoneCleanerWithDB(db *leveldb.DB) *Cleaner {
+	c := NewCleanerWithDB(db)
+	c.tombstones = true
+	return c
+}
+
 // Prune removes messages sent between lower and upper timestamps and returns how many has been removed
 func (c *Cleaner) Prune(lower, upper uint32) (int, error) {
-	var zero common.Hash
-	kl := NewDbKey(lower, zero)
-	ku := NewDbKey(upper, zero)
-	i := c.db.NewIterator(&util.Range{Start: kl.raw, Limit: ku.raw}, nil)
+	i := c.newIterator(lower, upper)
+	defer i.Release()
+
+	return c.prune(i, 0)
+}
+
+// PruneVersion removes messages of the given whisper version sent between
+// lower and upper timestamps and returns how many has been removed
+func (c *Cleaner) PruneVersion(lower, upper uint32, version uint) (int, error) {
+	i := c.newIterator(lower, upper)
 	defer i.Release()
 
-	return c.prune(i)
+	return c.prune(i, version)
 }
 
-func (c *Cleaner) prune(i iterator.Iterator) (int, error) {
+// SweepTombstones removes the tombstones of messages sent between lower and
+// upper timestamps and returns how many has been removed
+func (c *Cleaner) SweepTombstones(lower, upper uint32) (int, error) {
+	// held from the scan on, so that a message archived again over its
+	// tombstone is not swept along with it
+	c.indexMu.Lock()
+	defer c.indexMu.Unlock()
+
+	i := c.newIterator(lower, upper)
+	defer i.Release()
+
 	batch := leveldb.Batch{}
+	for i.Next() {
+		if isEnvelopeKey(i.Key()) && isTombstone(i.Value()) {
+			batch.Delete(i.Key())
+		}
+	}
+	if err := i.Error(); err != nil {
+		return 0, err
+	}
+
+	return batch.Len(), c.db.Write(&batch, nil)
+}
+
+func (c *Cleaner) newIterator(lower, upper uint32) iterator.Iterator {
+	var zero common.Hash
+	kl := NewNamespacedDbKey(c.namespace, lower, zero)
+	ku := NewNamespacedDbKey(c.namespace, upper, zero)
+	return c.db.NewIterator(&util.Range{Start: kl.raw, Limit: ku.raw}, nil)
+}
+
+// prune removes the messages of the iterator of the given whisper version,
+// or of any version if 0.
+func (c *Cleaner) prune(i iterator.Iterator, version uint) (int, error) {
+	batch := leveldb.Batch{}
+	counts := topicCounts{}
 	removed := 0
+	pending := 0
 
 	for i.Next() {
-		batch.Delete(i.Key())
+		if !isEnvelopeKey(i.Key()) || isTombstone(i.Value()) {
+			continue
+		}
+		v := EnvelopeVersion(i.Value())
+		if version != 0 && v != version {
+			continue
+		}
 
-		if batch.Len() == c.batchSize {
-			if err := c.db.Write(&batch, nil); err != nil {
+		if c.tombstones {
+			batch.Put(i.Key(), nil)
+		} else {
+			batch.Delete(i.Key())
+		}
+		// whisper v5 envelopes cannot be decoded, so they were never indexed
+		if v != whisperV5 {
+			if err := counts.addEnvelope(i.Key(), i.Value(), -1); err != nil {
+				log.Warn("failed to decode pruned envelope, topic index not updated", "err", err)
+			}
+		}
+		pending++
+
+		if pending == c.batchSize {
+			if err := c.write(&batch, counts); err != nil {
 				return removed, err
 			}
 
-			removed = removed + batch.Len()
+			removed = removed + pending
+			pending = 0
 			batch.Reset()
+			counts = topicCounts{}
 		}
 	}
 
-	if batch.Len() > 0 {
-		if err := c.db.Write(&batch, nil); err != nil {
+	if pending > 0 {
+		if err := c.write(&batch, counts); err != nil {
 			return removed, err
 		}
 
-		removed = removed + batch.Len()
+		removed = removed + pending
 	}
 
 	return removed, nil
 }
+
+// removeEnvelopes removes the envelopes with the given DB keys, which were
+// found to have the given topics.
+func (c *Cleaner) removeEnvelopes(keys [][]byte, topics []whisper.TopicType) error {
+	batch := leveldb.Batch{}
+	counts := topicCounts{}
+	for i, key := range keys {
+		if c.tombstones {
+			batch.Put(key, nil)
+		} else {
+			batch.Delete(key)
+		}
+		counts.add(key, topics[i], -1)
+	}
+	return c.write(&batch, counts)
+}
+
+// write applies the batch along with the matching topic, topic size and hash
+// index changes, removing the arrival records of the removed envelopes.
+func (c *Cleaner) write(batch *leveldb.Batch, counts topicCounts) error {
+	c.indexMu.Lock()
+	defer c.indexMu.Unlock()
+
+	if err := counts.write(c.db, batch); err != nil {
+		return err
+	}
+	if err := updateTopicSizes(c.db, batch); err != nil {
+		return err
+	}
+	if err := updateHashIndex(c.db, batch); err != nil {
+		return err
+	}
+	if err := removeArrivals(batch); err != nil {
+		return err
+	}
+	return c.db.Write(batch, nil)
+}
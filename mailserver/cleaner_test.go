@@ -31,6 +31,76 @@ func TestCleaner(t *testing.T) {
 	testPrune(t, now, 0, cleaner, server)
 }
 
+func TestDeleteRange(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+
+	outside := []*whisper.Envelope{
+		archiveEnvelope(t, now.Add(-10*time.Second), server),
+		archiveEnvelope(t, now.Add(-1*time.Second), server),
+	}
+	archiveEnvelope(t, now.Add(-5*time.Second), server)
+	archiveEnvelope(t, now.Add(-3*time.Second), server)
+
+	removed, err := server.DeleteRange(now.Add(-5*time.Second), now.Add(-3*time.Second))
+	require.NoError(t, err)
+	require.Equal(t, 2, removed)
+	testMessagesCount(t, 2, server)
+
+	for _, env := range outside {
+		key := NewDbKey(env.Expiry-env.TTL, env.Hash())
+		_, err := server.db.Get(key.raw, nil)
+		require.NoError(t, err)
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+	server.tombstones = true
+
+	pruned := archiveEnvelope(t, now.Add(-5*time.Second), server)
+	archiveEnvelope(t, now.Add(-1*time.Second), server)
+	checksum, err := server.Checksum(now.Add(-10*time.Second), now)
+	require.NoError(t, err)
+
+	removed, err := server.DeleteRange(now.Add(-5*time.Second), now.Add(-5*time.Second))
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+	testMessagesCount(t, 1, server)
+
+	// the tombstone keeps the checksum, but not the envelope nor its topic
+	afterPrune, err := server.Checksum(now.Add(-10*time.Second), now)
+	require.NoError(t, err)
+	require.Equal(t, checksum, afterPrune)
+	counts, err := server.TopicCounts()
+	require.NoError(t, err)
+	require.Equal(t, map[whisper.TopicType]int64{pruned.Topic: 1}, counts)
+
+	r := &messagesRequest{
+		lower: uint32(now.Add(-10 * time.Second).Unix()),
+		upper: uint32(now.Unix()) + 1,
+		bloom: whisper.MakeFullNodeBloom(),
+	}
+	envelopes, _ := server.processRequest(nil, r)
+	require.Len(t, envelopes, 1, "tombstones should not be delivered")
+
+	// pruning again does not count the tombstone
+	removed, err = server.DeleteRange(now.Add(-5*time.Second), now.Add(-5*time.Second))
+	require.NoError(t, err)
+	require.Equal(t, 0, removed)
+
+	swept, err := server.SweepTombstones(now.Add(-10*time.Second), now)
+	require.NoError(t, err)
+	require.Equal(t, 1, swept)
+	afterSweep, err := server.Checksum(now.Add(-10*time.Second), now)
+	require.NoError(t, err)
+	require.NotEqual(t, checksum, afterSweep)
+	testMessagesCount(t, 1, server)
+}
+
 func benchmarkCleanerPrune(b *testing.B, messages int, batchSize int) {
 	t := &testing.T{}
 	now := time.Now()
@@ -69,7 +139,7 @@ func BenchmarkCleanerPruneM100_000_B100(b *testing.B) {
 func setupTestServer(t *testing.T) *WMailServer {
 	var s WMailServer
 	s.db, _ = leveldb.Open(storage.NewMemStorage(), nil)
-	s.pow = powRequirement
+	s.setMinimumPoW(powRequirement)
 	return &s
 }
 
@@ -108,6 +178,9 @@ func countMessages(t *testing.T, db *leveldb.DB) int {
 	defer i.Release()
 
 	for i.Next() {
+		if isTombstone(i.Value()) {
+			continue
+		}
 		var env whisper.Envelope
 		err := rlp.DecodeBytes(i.Value(), &env)
 		if err != nil {
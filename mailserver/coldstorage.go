@@ -0,0 +1,191 @@
+package mailserver
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/comparer"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	// coldMigrationPeriod is how often envelopes past the hot retention are
+	// moved to the cold storage.
+	coldMigrationPeriod = time.Hour
+	// coldBatchSize is the number of envelopes moved per write.
+	coldBatchSize = 1000
+)
+
+// ColdEntry is an archived envelope as stored in the cold storage.
+type ColdEntry struct {
+	Key   []byte // DB key of the envelope
+	Value []byte // RLP-encoded envelope
+}
+
+// ColdStorage is a cheaper, usually remote, tier of the archive holding the
+// envelopes past the hot retention, e.g. an S3-style object store.
+//
+// Envelopes are always archived to the DB, which is the hot tier, and moved
+// to the cold storage once older than MailServerHotRetention. Requests
+// reaching past the hot retention read both tiers transparently. The topic
+// index keeps counting moved envelopes, while pruning only applies to the
+// hot tier.
+type ColdStorage interface {
+	// Put stores the given envelopes. It must not return before they can
+	// be read back.
+	Put(entries []ColdEntry) error
+	// Range returns the envelopes with a key in [start, limit), in key order.
+	Range(start, limit []byte) ([]ColdEntry, error)
+}
+
+// SetColdStorage moves envelopes past the hot retention to the given cold
+// storage and serves them from it.
+func (s *WMailServer) SetColdStorage(cold ColdStorage) {
+	s.coldStorage = cold
+	if s.hotRetention <= 0 || s.readOnly {
+		return
+	}
+	s.coldTick = &ticker{}
+	s.coldTick.run(coldMigrationPeriod, func() {
+		if _, err := s.moveToColdStorage(); err != nil {
+			log.Error(fmt.Sprintf("Failed to move envelopes to cold storage: %s", err))
+		}
+	})
+}
+
+// moveToColdStorage moves the envelopes past the hot retention to the cold
+// storage. Envelopes are written to the cold storage before being deleted
+// from the DB, so that they can always be found in at least one tier.
+//
+// The topic, topic size, hash and sequence indexes keep covering moved
+// envelopes, so a move implies no index change. It is made with indexMu
+// held, so that an envelope pruned or archived again while being moved is
+// neither lost nor counted twice.
+func (s *WMailServer) moveToColdStorage() (moved int, err error) {
+	var zero common.Hash
+	cutoff := uint32(s.now().Add(-s.hotRetention).Unix())
+	kl := NewNamespacedDbKey(s.namespace, 0, zero)
+	ku := NewNamespacedDbKey(s.namespace, cutoff, zero)
+	i := s.db.NewIterator(&util.Range{Start: kl.raw, Limit: ku.raw}, nil)
+	defer i.Release()
+
+	var entries []ColdEntry
+	flush := func() error {
+		s.indexMu.Lock()
+		defer s.indexMu.Unlock()
+
+		// envelopes pruned since they were read are left to the cleaner
+		unchanged := entries[:0]
+		for _, entry := range entries {
+			value, err := s.db.Get(entry.Key, nil)
+			if err == leveldb.ErrNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if bytes.Equal(value, entry.Value) {
+				unchanged = append(unchanged, entry)
+			}
+		}
+		entries = entries[:0]
+		if len(unchanged) == 0 {
+			return nil
+		}
+
+		if err := s.coldStorage.Put(unchanged); err != nil {
+			return err
+		}
+		batch := new(leveldb.Batch)
+		for _, entry := range unchanged {
+			batch.Delete(entry.Key)
+		}
+		if err := s.db.Write(batch, s.writeOptions); err != nil {
+			return err
+		}
+		moved += len(unchanged)
+		return nil
+	}
+
+	for i.Next() {
+		// tombstones are left in the DB, where they are swept
+		if !isEnvelopeKey(i.Key()) || isTombstone(i.Value()) {
+			continue
+		}
+		entries = append(entries, ColdEntry{
+			Key:   append([]byte(nil), i.Key()...),
+			Value: append([]byte(nil), i.Value()...),
+		})
+		if len(entries) == coldBatchSize {
+			if err := flush(); err != nil {
+				return moved, err
+			}
+		}
+	}
+	if err := i.Error(); err != nil {
+		return moved, err
+	}
+
+	if len(entries) > 0 {
+		if err := flush(); err != nil {
+			return moved, err
+		}
+	}
+	if moved > 0 {
+		coldMovedCounter.Inc(int64(moved))
+		log.Info("Moved envelopes to cold storage", "envelopes", moved)
+	}
+	return moved, nil
+}
+
+// newRangeIterator returns an iterator over the envelopes of both tiers in
+// the given range, in key order. The DB iterator is created before reading
+// the cold storage: an envelope moved in between is then seen in both tiers,
+// in which case iterator keys repeat, but never in neither.
+func (s *WMailServer) newRangeIterator(slice *util.Range) (iterator.Iterator, error) {
+	hot := s.db.NewIterator(slice, nil)
+	if s.coldStorage == nil || !s.reachesColdStorage(slice) {
+		return hot, nil
+	}
+
+	entries, err := s.coldStorage.Range(slice.Start, slice.Limit)
+	if err != nil {
+		hot.Release()
+		return nil, fmt.Errorf("cold storage error: %s", err)
+	}
+	coldReadCounter.Inc(1)
+	cold := iterator.NewArrayIterator(coldEntries(entries))
+	return iterator.NewMergedIterator([]iterator.Iterator{cold, hot}, comparer.DefaultComparer, false), nil
+}
+
+// reachesColdStorage reports whether the range starts past the hot
+// retention. Without a retention envelopes are never moved, but the cold
+// storage may still hold envelopes moved by a previous configuration.
+func (s *WMailServer) reachesColdStorage(slice *util.Range) bool {
+	if s.hotRetention <= 0 {
+		return true
+	}
+	var zero common.Hash
+	cutoff := NewNamespacedDbKey(s.namespace, uint32(s.now().Add(-s.hotRetention).Unix()), zero)
+	return bytes.Compare(slice.Start, cutoff.raw) < 0
+}
+
+// coldEntries adapts envelopes read from the cold storage to an iterator.
+type coldEntries []ColdEntry
+
+func (e coldEntries) Len() int {
+	return len(e)
+}
+
+func (e coldEntries) Search(key []byte) int {
+	return sort.Search(len(e), func(i int) bool { return bytes.Compare(e[i].Key, key) >= 0 })
+}
+
+func (e coldEntries) Index(i int) (key, value []byte) {
+	return e[i].Key, e[i].Value
+}
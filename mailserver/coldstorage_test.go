@@ -0,0 +1,186 @@
+package mailserver
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/status-im/status-go/timesource"
+	"github.com/stretchr/testify/require"
+)
+
+// memColdStorage is a fake remote tier keeping envelopes in memory.
+type memColdStorage struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+	reads   int
+	err     error
+}
+
+func newMemColdStorage() *memColdStorage {
+	return &memColdStorage{entries: make(map[string][]byte)}
+}
+
+func (m *memColdStorage) Put(entries []ColdEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, entry := range entries {
+		m.entries[string(entry.Key)] = append([]byte(nil), entry.Value...)
+	}
+	return nil
+}
+
+func (m *memColdStorage) Range(start, limit []byte) ([]ColdEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reads++
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	var entries []ColdEntry
+	for key, value := range m.entries {
+		if bytes.Compare([]byte(key), start) >= 0 && bytes.Compare([]byte(key), limit) < 0 {
+			entries = append(entries, ColdEntry{Key: []byte(key), Value: value})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i].Key, entries[j].Key) < 0 })
+	return entries, nil
+}
+
+func TestColdStorage(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+	server.SetTimeSource(timesource.TimeSourceFunc(func() time.Time { return now }))
+	server.hotRetention = time.Hour
+	cold := newMemColdStorage()
+	server.SetColdStorage(cold)
+
+	var archived []*whisper.Envelope
+	for _, age := range []time.Duration{4 * time.Hour, 3 * time.Hour, 2 * time.Hour, time.Minute, time.Second} {
+		archived = append(archived, archiveEnvelope(t, now.Add(-age), server))
+	}
+
+	moved, err := server.moveToColdStorage()
+	require.NoError(t, err)
+	require.Equal(t, 3, moved, "envelopes past the hot retention should be moved")
+	require.Len(t, cold.entries, 3)
+	testMessagesCount(t, 2, server)
+
+	moved, err = server.moveToColdStorage()
+	require.NoError(t, err)
+	require.Equal(t, 0, moved)
+
+	testCases := []struct {
+		lower, upper time.Time
+		expected     []*whisper.Envelope
+		coldRead     bool
+		info         string
+	}{
+		{now.Add(-5 * time.Hour), now, archived, true, "window spanning both tiers"},
+		{now.Add(-5 * time.Hour), now.Add(-time.Hour), archived[:3], true, "window in the cold tier"},
+		{now.Add(-30 * time.Minute), now, archived[3:], false, "window in the hot tier"},
+	}
+	for _, tc := range testCases {
+		reads := cold.reads
+		r := &messagesRequest{
+			lower: uint32(tc.lower.Unix()),
+			upper: uint32(tc.upper.Unix()),
+			bloom: whisper.MakeFullNodeBloom(),
+		}
+		mail, _ := server.processRequest(nil, r)
+		require.Len(t, mail, len(tc.expected), tc.info)
+		for i, env := range tc.expected {
+			require.Equal(t, env.Hash(), mail[i].Hash(), tc.info)
+		}
+		require.Equal(t, tc.coldRead, cold.reads > reads, tc.info)
+	}
+
+	// truncated requests resume across the hot/cold boundary
+	r := &messagesRequest{
+		lower: uint32(now.Add(-5 * time.Hour).Unix()),
+		upper: uint32(now.Unix()),
+		bloom: whisper.MakeFullNodeBloom(),
+		limit: 2,
+	}
+	var delivered []*whisper.Envelope
+	for {
+		mail, result := server.processRequest(nil, r)
+		delivered = append(delivered, mail...)
+		if !result.Truncated {
+			break
+		}
+		r.cursor = result.NextCursor
+	}
+	require.Len(t, delivered, len(archived))
+	for i, env := range archived {
+		require.Equal(t, env.Hash(), delivered[i].Hash())
+	}
+}
+
+func TestColdStorageDuplicates(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+	cold := newMemColdStorage()
+	server.SetColdStorage(cold)
+
+	// an envelope copied to the cold storage but not yet deleted from the DB
+	env := archiveEnvelope(t, now.Add(-time.Hour), server)
+	key := NewDbKey(env.Expiry-env.TTL, env.Hash()).raw
+	value, err := server.db.Get(key, nil)
+	require.NoError(t, err)
+	require.NoError(t, cold.Put([]ColdEntry{{Key: key, Value: value}}))
+
+	r := &messagesRequest{
+		lower: uint32(now.Add(-2 * time.Hour).Unix()),
+		upper: uint32(now.Unix()),
+		bloom: whisper.MakeFullNodeBloom(),
+	}
+	mail, _ := server.processRequest(nil, r)
+	require.Len(t, mail, 1, "envelopes in both tiers should be delivered once")
+
+	cold.err = errors.New("unreachable")
+	_, err = server.processRequestStream(r, func(*whisper.Envelope) error { return nil })
+	require.Error(t, err)
+}
+
+func TestColdStorageArchiveAgain(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+	server.SetTimeSource(timesource.TimeSourceFunc(func() time.Time { return now }))
+	server.hotRetention = time.Hour
+	cold := newMemColdStorage()
+	server.SetColdStorage(cold)
+
+	env := archiveEnvelope(t, now.Add(-2*time.Hour), server)
+	counts, err := server.TopicCounts()
+	require.NoError(t, err)
+	sizes, err := server.TopicSizes()
+	require.NoError(t, err)
+	moved, err := server.moveToColdStorage()
+	require.NoError(t, err)
+	require.Equal(t, 1, moved)
+
+	// an envelope moved to the cold storage is not archived again
+	require.NoError(t, server.archive(env))
+	testMessagesCount(t, 0, server)
+	recounted, err := server.TopicCounts()
+	require.NoError(t, err)
+	require.Equal(t, counts, recounted)
+	resized, err := server.TopicSizes()
+	require.NoError(t, err)
+	require.Equal(t, sizes, resized)
+	seq, err := server.readLastSequence()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), seq)
+	found, err := server.GetByHash(env.Hash())
+	require.NoError(t, err)
+	require.Equal(t, env.Hash(), found.Hash())
+}
@@ -0,0 +1,45 @@
+package mailserver
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var errCompactionRunning = errors.New("compaction is already running")
+
+// Compact compacts the whole database, reclaiming the space of pruned
+// envelopes. It fails if a compaction is already running.
+func (s *WMailServer) Compact() error {
+	if s.readOnly {
+		return errReadOnly
+	}
+	if !atomic.CompareAndSwapInt32(&s.compacting, 0, 1) {
+		return errCompactionRunning
+	}
+	defer atomic.StoreInt32(&s.compacting, 0)
+
+	start := time.Now()
+	if err := s.db.CompactRange(util.Range{}); err != nil {
+		return err
+	}
+	compactionTimer.UpdateSince(start)
+	log.Info("Compacted mail server database", "duration", time.Since(start))
+	return nil
+}
+
+// setupCompaction periodically compacts the database.
+func (s *WMailServer) setupCompaction(period time.Duration) {
+	if period <= 0 || s.readOnly {
+		return
+	}
+	s.compactTick = &ticker{}
+	s.compactTick.run(period, func() {
+		if err := s.Compact(); err != nil {
+			log.Warn("Skipped scheduled compaction", "error", err)
+		}
+	})
+}
@@ -0,0 +1,30 @@
+package mailserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompact(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+
+	archiveEnvelope(t, now.Add(-2*time.Second), server)
+	archiveEnvelope(t, now.Add(-1*time.Second), server)
+	_, err := server.DeleteRange(now.Add(-2*time.Second), now.Add(-2*time.Second))
+	require.NoError(t, err)
+
+	require.NoError(t, server.Compact())
+	testMessagesCount(t, 1, server)
+
+	// compactions do not overlap
+	server.compacting = 1
+	require.Equal(t, errCompactionRunning, server.Compact())
+	server.compacting = 0
+
+	server.readOnly = true
+	require.Equal(t, errReadOnly, server.Compact())
+}
@@ -0,0 +1,76 @@
+package mailserver
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// Query is one window and bloom filter of a compound request, letting a
+// client syncing several chats, each last synced at a different time, fetch
+// all of them in a single round trip. The queries replace the window and
+// bloom filter of the request itself, which are ignored.
+type Query struct {
+	Lower uint32
+	Upper uint32
+	Bloom []byte
+}
+
+// QueryResult tags the envelopes delivered for one query of a compound
+// request. It is the RLP-encoded payload of a direct message with the topic
+// of the request, sent after the envelopes of the query.
+type QueryResult struct {
+	Index      uint          // index of the query in the request
+	Hashes     []common.Hash // hashes of the envelopes delivered for the query
+	NextCursor []byte        // cursor to resume the query from, if truncated
+}
+
+// processQueries serves the queries of a compound request in turn, each as a
+// request of its own sharing the options of the compound request. Without a
+// peer, the envelopes matching every query are returned instead.
+func (s *WMailServer) processQueries(peer *whisper.Peer, r *messagesRequest) ([][]*whisper.Envelope, RequestResult) {
+	var (
+		mail  = make([][]*whisper.Envelope, len(r.queries))
+		total RequestResult
+	)
+	for i, q := range r.queries {
+		query := *r
+		query.lower, query.upper, query.bloom = q.Lower, q.Upper, q.Bloom
+		query.queries = nil
+		query.compound = true
+		query.queryIndex = uint(i)
+		// the compound request is acknowledged as a whole
+		query.expectAck = false
+
+		var result RequestResult
+		mail[i], result = s.processRequest(peer, &query)
+		total.Delivered += result.Delivered
+		total.Bytes += result.Bytes
+		total.Scanned += result.Scanned
+		total.Truncated = total.Truncated || result.Truncated
+		total.Duration += result.Duration
+	}
+
+	if s.acks != nil && r.expectAck && peer != nil && !r.countOnly {
+		s.acks.expect(r.hash, peer.ID(), total.Delivered)
+	}
+	return mail, total
+}
+
+// sendQueryResult sends the peer the tag of the envelopes delivered for a
+// query of a compound request.
+func (s *WMailServer) sendQueryResult(peer *whisper.Peer, r *messagesRequest, hashes []common.Hash, result RequestResult) error {
+	env, err := s.newDirectMessage(r.src, r.topic, QueryResult{
+		Index:      r.queryIndex,
+		Hashes:     hashes,
+		NextCursor: result.NextCursor,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create query result: %s", err)
+	}
+	if err := s.w.SendP2PDirect(peer, env); err != nil {
+		return fmt.Errorf("Failed to send query result to peer: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package mailserver
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeQueriesOption(t *testing.T) {
+	bloom := whisper.MakeFullNodeBloom()
+	testCases := []struct {
+		queries []Query
+		err     error
+		info    string
+	}{
+		{[]Query{{Lower: 1, Upper: 2, Bloom: bloom}, {Lower: 3, Upper: 4, Bloom: bloom}}, nil, "valid queries"},
+		{make([]Query, maxRequestQueries+1), errTooManyQueries, "too many queries"},
+		{[]Query{{Lower: 1, Upper: 2, Bloom: bloom[1:]}}, errInvalidQuery, "invalid bloom filter"},
+		{[]Query{{Lower: 2, Upper: 1, Bloom: bloom}}, errInvalidQuery, "inverted window"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.info, func(t *testing.T) {
+			option, err := newRequestOption(queriesOptionCode, tc.queries)
+			require.NoError(t, err)
+			raw, err := encodeRequestOptions(option)
+			require.NoError(t, err)
+
+			var r messagesRequest
+			require.Equal(t, tc.err, decodeRequestOptions(raw, &r))
+			if tc.err == nil {
+				require.Equal(t, tc.queries, r.queries)
+			}
+		})
+	}
+}
+
+func TestProcessQueries(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+
+	now := time.Now()
+	chat1 := whisper.TopicType{0x01, 0x01, 0x01, 0x01}
+	chat2 := whisper.TopicType{0x02, 0x02, 0x02, 0x02}
+	archive := func(topic whisper.TopicType, sent time.Time) *whisper.Envelope {
+		env, err := BuildEnvelope(topic, []byte("test payload"), sent)
+		require.NoError(t, err)
+		require.NoError(t, server.archive(env))
+		return env
+	}
+	old1 := archive(chat1, now.Add(-3*time.Hour))
+	archive(chat2, now.Add(-3*time.Hour))
+	archive(chat1, now.Add(-time.Hour))
+	recent2 := archive(chat2, now.Add(-time.Hour))
+
+	// chat1 was last synced four hours ago, chat2 two hours ago
+	r := &messagesRequest{
+		queries: []Query{
+			{Lower: uint32(now.Add(-4 * time.Hour).Unix()), Upper: uint32(now.Add(-2 * time.Hour).Unix()), Bloom: whisper.TopicToBloom(chat1)},
+			{Lower: uint32(now.Add(-2 * time.Hour).Unix()), Upper: uint32(now.Unix()), Bloom: whisper.TopicToBloom(chat2)},
+		},
+	}
+	mail, result := server.processQueries(nil, r)
+	require.Len(t, mail, 2)
+	require.Len(t, mail[0], 1)
+	require.Equal(t, old1.Hash(), mail[0][0].Hash(), "first query")
+	require.Len(t, mail[1], 1)
+	require.Equal(t, recent2.Hash(), mail[1][0].Hash(), "second query")
+	require.Equal(t, 2, result.Delivered)
+}
+
+func TestCheckCompoundRequest(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+	server.AddSymKey(testEnvelopeKey[:])
+	peerKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	peerID := crypto.FromECDSAPub(&peerKey.PublicKey)[1:]
+
+	now := time.Now()
+	newRequest := func(options ...requestOption) *whisper.Envelope {
+		payload := make([]byte, 8)
+		binary.BigEndian.PutUint32(payload, uint32(now.Add(-time.Hour).Unix()))
+		binary.BigEndian.PutUint32(payload[4:], uint32(now.Unix()))
+		payload = append(payload, whisper.MakeFullNodeBloom()...)
+		raw, err := encodeRequestOptions(options...)
+		require.NoError(t, err)
+		params := &whisper.MessageParams{
+			KeySym:   testEnvelopeKey[:],
+			Src:      peerKey,
+			Topic:    whisper.TopicType{0x01, 0x02, 0x03, 0x04},
+			Payload:  append(payload, raw...),
+			PoW:      powRequirement,
+			WorkTime: 2,
+		}
+		msg, err := whisper.NewSentMessage(params)
+		require.NoError(t, err)
+		env, err := msg.Wrap(params, time.Now())
+		require.NoError(t, err)
+		return env
+	}
+	queries := func(lower time.Time) requestOption {
+		option, err := newRequestOption(queriesOptionCode, []Query{
+			{Lower: uint32(lower.Unix()), Upper: uint32(now.Unix()), Bloom: whisper.MakeFullNodeBloom()},
+		})
+		require.NoError(t, err)
+		return option
+	}
+	cursor, err := newRequestOption(cursorOptionCode,
+		newCursor(uint32(now.Add(-time.Hour).Unix()), uint32(now.Unix()), NewDbKey(uint32(now.Add(-time.Minute).Unix()), testEnvelopeKey).raw))
+	require.NoError(t, err)
+
+	testCases := []struct {
+		request *whisper.Envelope
+		code    uint
+		info    string
+	}{
+		{newRequest(queries(now.Add(-time.Hour))), 0, "valid compound request"},
+		{newRequest(queries(now.Add(-48 * time.Hour))), ErrorCodeWindowSize, "query window too large"},
+		{newRequest(queries(now.Add(-time.Hour)), cursor), ErrorCodeInvalidRequest, "cursor in compound request"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.info, func(t *testing.T) {
+			r, requestErr := server.checkRequest(peerID, tc.request)
+			if tc.code == 0 {
+				require.Nil(t, requestErr)
+				require.Len(t, r.queries, 1)
+				return
+			}
+			require.NotNil(t, requestErr)
+			require.Equal(t, tc.code, requestErr.Code)
+		})
+	}
+}
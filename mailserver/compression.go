@@ -0,0 +1,124 @@
+package mailserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// compressedChunkSize is the size of the compressed data carried by each
+// direct message of a compressed response, well below the whisper limit.
+const compressedChunkSize = 256 * 1024
+
+var errIncompleteStream = errors.New("compressed response stream is incomplete")
+
+// CompressedChunk is a part of a compressed response. Requests asking for a
+// compressed response are answered with direct messages encrypted with the
+// public key of the requesting peer, with the topic of the request and the
+// RLP-encoded chunk as payload, instead of the envelopes themselves.
+// Concatenated by sequence number, the chunks form a gzip stream of the
+// RLP-encoded matching envelopes, which DecodeCompressedStream decodes.
+//
+// Whisper payloads are encrypted and randomly padded, so they do not
+// compress: the stream of a backfill of chat messages is as large as the
+// envelopes, with an overhead below 0.1% (see TestCompressionRatio), and
+// only pays off for envelopes carrying compressible data.
+type CompressedChunk struct {
+	Seq  uint32 // position of the chunk in the stream, from 0
+	Last bool   // whether the chunk ends the stream
+	Data []byte
+}
+
+// compressedStream compresses the envelopes delivered in response to a
+// request into a single stream, sent to the peer in chunks.
+type compressedStream struct {
+	server *WMailServer
+	r      *messagesRequest
+	send   func(*whisper.Envelope) error
+
+	buf bytes.Buffer
+	gz  *gzip.Writer
+	seq uint32
+}
+
+func (s *WMailServer) newCompressedStream(r *messagesRequest, send func(*whisper.Envelope) error) *compressedStream {
+	c := &compressedStream{server: s, r: r, send: send}
+	c.gz = gzip.NewWriter(&c.buf)
+	return c
+}
+
+// add compresses the envelope, sending the chunks filled up.
+func (c *compressedStream) add(env *whisper.Envelope) error {
+	if err := rlp.Encode(c.gz, env); err != nil {
+		return err
+	}
+	for c.buf.Len() >= compressedChunkSize {
+		if err := c.sendChunk(c.buf.Next(compressedChunkSize), false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush ends the stream and sends its last chunk.
+func (c *compressedStream) flush() error {
+	if err := c.gz.Close(); err != nil {
+		return err
+	}
+	return c.sendChunk(c.buf.Next(c.buf.Len()), true)
+}
+
+func (c *compressedStream) sendChunk(data []byte, last bool) error {
+	env, err := c.server.newDirectMessage(c.r.src, c.r.topic, CompressedChunk{
+		Seq:  c.seq,
+		Last: last,
+		Data: data,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create compressed chunk: %s", err)
+	}
+	c.seq++
+	return c.send(env)
+}
+
+// DecodeCompressedStream returns the envelopes of a compressed response
+// from its chunks, in any order.
+func DecodeCompressedStream(chunks []CompressedChunk) ([]*whisper.Envelope, error) {
+	sorted := append([]CompressedChunk(nil), chunks...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Seq < sorted[j].Seq })
+
+	var stream bytes.Buffer
+	for i, chunk := range sorted {
+		if chunk.Seq != uint32(i) || chunk.Last != (i == len(sorted)-1) {
+			return nil, errIncompleteStream
+		}
+		stream.Write(chunk.Data) // nolint: errcheck
+	}
+	if len(sorted) == 0 {
+		return nil, errIncompleteStream
+	}
+
+	gz, err := gzip.NewReader(&stream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid compressed response stream: %s", err)
+	}
+	defer gz.Close()
+
+	var envelopes []*whisper.Envelope
+	s := rlp.NewStream(gz, 0)
+	for {
+		var env whisper.Envelope
+		if err := s.Decode(&env); err == io.EOF {
+			return envelopes, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid compressed response stream: %s", err)
+		}
+		envelopes = append(envelopes, &env)
+	}
+}
@@ -0,0 +1,133 @@
+package mailserver
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressedRequest(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+
+	var archived []*whisper.Envelope
+	for i := 3; i > 0; i-- {
+		archived = append(archived, archiveEnvelope(t, now.Add(-time.Duration(i)*time.Second), server))
+	}
+
+	peerKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	r := &messagesRequest{
+		lower:      uint32(now.Add(-time.Minute).Unix()),
+		upper:      uint32(now.Unix()),
+		bloom:      whisper.MakeFullNodeBloom(),
+		src:        &peerKey.PublicKey,
+		compressed: true,
+	}
+	messages, result := server.processRequest(nil, r)
+	require.Equal(t, 3, result.Delivered)
+	require.Len(t, messages, 1)
+
+	envelopes, err := DecodeCompressedStream(openChunks(t, messages, peerKey))
+	require.NoError(t, err)
+	require.Len(t, envelopes, 3)
+	for i, env := range archived {
+		require.Equal(t, env.Hash(), envelopes[i].Hash())
+	}
+}
+
+func TestDecodeCompressedStream(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+	peerKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+
+	var messages []*whisper.Envelope
+	stream := server.newCompressedStream(&messagesRequest{src: &peerKey.PublicKey}, func(env *whisper.Envelope) error {
+		messages = append(messages, env)
+		return nil
+	})
+	// incompressible envelopes spanning several chunks
+	var sent []*whisper.Envelope
+	for i := 0; i < 3; i++ {
+		env := &whisper.Envelope{Expiry: uint32(i), Data: make([]byte, compressedChunkSize/2)}
+		_, err := rand.Read(env.Data)
+		require.NoError(t, err)
+		sent = append(sent, env)
+		require.NoError(t, stream.add(env))
+	}
+	require.NoError(t, stream.flush())
+	require.True(t, len(messages) > 1)
+
+	chunks := openChunks(t, messages, peerKey)
+	// chunks can be received in any order
+	chunks[0], chunks[1] = chunks[1], chunks[0]
+	envelopes, err := DecodeCompressedStream(chunks)
+	require.NoError(t, err)
+	require.Len(t, envelopes, 3)
+	for i, env := range sent {
+		require.Equal(t, env.Data, envelopes[i].Data)
+	}
+
+	_, err = DecodeCompressedStream(chunks[1:])
+	require.Equal(t, errIncompleteStream, err, "missing chunks should be detected")
+	_, err = DecodeCompressedStream(nil)
+	require.Equal(t, errIncompleteStream, err)
+}
+
+// TestCompressionRatio measures the size of the compressed stream of chat
+// messages relative to the size of their envelopes.
+func TestCompressionRatio(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+	peerKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+
+	var compressed int
+	stream := server.newCompressedStream(&messagesRequest{src: &peerKey.PublicKey}, func(env *whisper.Envelope) error {
+		msg := env.Open(&whisper.Filter{KeyAsym: peerKey})
+		var chunk CompressedChunk
+		require.NoError(t, rlp.DecodeBytes(msg.Payload, &chunk))
+		compressed += len(chunk.Data)
+		return nil
+	})
+
+	var size int
+	topic := whisper.TopicType{0x1F, 0x7E, 0xA1, 0x7F}
+	for i := 0; i < 500; i++ {
+		payload := fmt.Sprintf(`["~#c4",["hey, are we still meeting at the usual place tomorrow? message %d","text/plain","~:public-group-user-message",%d]]`, i, 1500000000000+i)
+		env, err := BuildEnvelope(topic, []byte(payload), time.Now())
+		require.NoError(t, err)
+		raw, err := rlp.EncodeToBytes(env)
+		require.NoError(t, err)
+		size += len(raw)
+		require.NoError(t, stream.add(env))
+	}
+	require.NoError(t, stream.flush())
+
+	// encrypted and randomly padded payloads do not compress, only the
+	// overhead of the stream is checked
+	ratio := float64(compressed) / float64(size)
+	t.Logf("compressed %d bytes of envelopes to %d bytes, ratio %.3f", size, compressed, ratio)
+	require.True(t, ratio < 1.01, "the stream should not be significantly larger than the envelopes")
+}
+
+func openChunks(t *testing.T, messages []*whisper.Envelope, key *ecdsa.PrivateKey) []CompressedChunk {
+	var chunks []CompressedChunk
+	for _, env := range messages {
+		msg := env.Open(&whisper.Filter{KeyAsym: key})
+		require.NotNil(t, msg)
+		var chunk CompressedChunk
+		require.NoError(t, rlp.DecodeBytes(msg.Payload, &chunk))
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
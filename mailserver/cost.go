@@ -0,0 +1,52 @@
+package mailserver
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// envelopesRange spans the envelope keys of every namespace, stopping short
+// of the reserved keys.
+var envelopesRange = util.Range{Start: []byte{}, Limit: []byte{reservedPrefix}}
+
+// EstimateQueryCost returns the approximate number of archived envelopes a
+// request for the given window and bloom filter would deliver, without
+// scanning the archive, so that expensive requests can be throttled before
+// they are served.
+//
+// The storage space used by the window, as reported by LevelDB, is turned
+// into a number of envelopes using the average size of an archived envelope,
+// and scaled down by the share of the topic index matching the bloom filter,
+// both within the namespace of the server. It does not account for recently
+// written envelopes not yet flushed to disk, nor for tombstones.
+func (s *WMailServer) EstimateQueryCost(low, upp uint32, bloom []byte) (keys int64, err error) {
+	counts, err := s.TopicCounts()
+	if err != nil {
+		return 0, err
+	}
+
+	var matching int64
+	for topic, count := range counts {
+		if whisper.BloomFilterMatch(bloom, whisper.TopicToBloom(topic)) {
+			matching += count
+		}
+	}
+	if matching == 0 {
+		return 0, nil
+	}
+
+	var zero common.Hash
+	kl := NewNamespacedDbKey(s.namespace, low, zero)
+	ku := NewNamespacedDbKey(s.namespace, upp, zero)
+	sizes, err := s.db.SizeOf([]util.Range{{Start: kl.raw, Limit: ku.raw}, *s.namespaceRange()})
+	if err != nil {
+		return 0, err
+	}
+	if sizes[1] == 0 {
+		return 0, nil
+	}
+
+	// computed in floating point as the product can overflow on large archives
+	return int64(float64(sizes[0]) * float64(matching) / float64(sizes[1])), nil
+}
@@ -0,0 +1,51 @@
+package mailserver
+
+import (
+	"testing"
+	"time"
+
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+func TestEstimateQueryCost(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+
+	keys, err := server.EstimateQueryCost(0, uint32(time.Now().Unix()), nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), keys, "empty archive")
+
+	const count = 1000
+	start := time.Now().Add(-time.Duration(count) * time.Second)
+	for i := 0; i < count; i++ {
+		archiveEnvelope(t, start.Add(time.Duration(i)*time.Second), server)
+	}
+	// sizes are only reported for data flushed to disk
+	require.NoError(t, server.db.CompactRange(util.Range{}))
+
+	env, err := generateEnvelope(start)
+	require.NoError(t, err)
+	low := uint32(start.Unix())
+	middle := low + count/2
+	upp := low + count
+
+	testCases := []struct {
+		low, upp uint32
+		bloom    []byte
+		expected int64
+		info     string
+	}{
+		{low, upp, nil, count, "whole archive with a full bloom filter"},
+		{low, upp, env.Bloom(), count, "whole archive with a matching bloom filter"},
+		{low, middle, env.Bloom(), count / 2, "half of the archive"},
+		{low, upp, whisper.TopicToBloom(whisper.TopicType{0x01}), 0, "bloom filter matching no topic"},
+		{upp, upp + 1000, nil, 0, "window after the archive"},
+	}
+	for _, tc := range testCases {
+		keys, err := server.EstimateQueryCost(tc.low, tc.upp, tc.bloom)
+		require.NoError(t, err, tc.info)
+		require.InDelta(t, tc.expected, keys, count/10, tc.info)
+	}
+}
@@ -0,0 +1,42 @@
+package mailserver
+
+import (
+	"fmt"
+
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// MatchCount is the response to a request in count-only mode. It is the
+// RLP-encoded payload of a direct message with the topic of the request,
+// letting a client find out how much history matches before fetching it.
+//
+// Envelopes are matched exactly as they would be for delivery, but are
+// neither encoded nor sent, and the limit of the request is ignored. The
+// count is only partial if the scan hit the query deadline, in which case
+// counting can be resumed from the cursor.
+type MatchCount struct {
+	Count      uint   // number of matching envelopes
+	Bytes      uint   // RLP size of the matching envelopes
+	NextCursor []byte // cursor to resume counting from, if partial
+}
+
+// sendMatchCount sends the peer the number of envelopes matching the
+// request. Without a peer, the message is returned instead.
+func (s *WMailServer) sendMatchCount(peer *whisper.Peer, r *messagesRequest, result RequestResult) ([]*whisper.Envelope, error) {
+	env, err := s.newDirectMessage(r.src, r.topic, MatchCount{
+		Count:      uint(result.Delivered),
+		Bytes:      uint(result.Bytes),
+		NextCursor: result.NextCursor,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create match count: %s", err)
+	}
+	if peer == nil {
+		// used for test purposes
+		return []*whisper.Envelope{env}, nil
+	}
+	if err := s.w.SendP2PDirect(peer, env); err != nil {
+		return nil, fmt.Errorf("Failed to send match count to peer: %s", err)
+	}
+	return nil, nil
+}
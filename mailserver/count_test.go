@@ -0,0 +1,70 @@
+package mailserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCountOnlyRequest(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+
+	topics := []whisper.TopicType{whisper.BytesToTopic([]byte("abcd")), whisper.BytesToTopic([]byte("efgh"))}
+	for i := 0; i < 5; i++ {
+		env, err := BuildEnvelope(topics[i%2], []byte{byte(i)}, now.Add(-time.Duration(i)*time.Second))
+		require.NoError(t, err)
+		server.Archive(env)
+	}
+
+	peerKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	testCases := []struct {
+		bloom []byte
+		count uint
+		info  string
+	}{
+		{whisper.MakeFullNodeBloom(), 5, "full bloom"},
+		{whisper.TopicToBloom(topics[0]), 3, "bloom of the first topic"},
+		{whisper.TopicToBloom(whisper.BytesToTopic([]byte("ijkl"))), 0, "bloom of another topic"},
+	}
+	for _, tc := range testCases {
+		r := &messagesRequest{
+			lower: uint32(now.Add(-time.Minute).Unix()),
+			upper: uint32(now.Add(time.Second).Unix()),
+			bloom: tc.bloom,
+			src:   &peerKey.PublicKey,
+		}
+		_, delivered := server.processRequest(nil, r)
+
+		r.countOnly = true
+		r.limit = 1
+		messages, result := server.processRequest(nil, r)
+		require.Equal(t, delivered.Delivered, result.Delivered, tc.info)
+		require.Len(t, messages, 1, tc.info)
+
+		msg := messages[0].Open(&whisper.Filter{KeyAsym: peerKey})
+		require.NotNil(t, msg, tc.info)
+		var count MatchCount
+		require.NoError(t, rlp.DecodeBytes(msg.Payload, &count), tc.info)
+		require.Equal(t, tc.count, count.Count, tc.info)
+		require.Equal(t, uint(delivered.Bytes), count.Bytes, tc.info)
+		require.Empty(t, count.NextCursor, tc.info)
+	}
+}
+
+func TestDecodeCountOnlyOption(t *testing.T) {
+	option, err := newRequestOption(countOnlyCode, true)
+	require.NoError(t, err)
+	raw, err := encodeRequestOptions(option)
+	require.NoError(t, err)
+
+	var r messagesRequest
+	require.NoError(t, decodeRequestOptions(raw, &r))
+	require.True(t, r.countOnly)
+}
@@ -0,0 +1,37 @@
+package mailserver
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// openRetryDelay is how long opening a locked DB waits before the first
+// retry, doubling on every further retry.
+const openRetryDelay = 500 * time.Millisecond
+
+// isLockError reports whether opening the DB failed because its lock is held,
+// e.g. by the previous process not done shutting down during a restart.
+func isLockError(err error) bool {
+	return err == storage.ErrLocked || err == syscall.EWOULDBLOCK || err == syscall.EAGAIN
+}
+
+// openDB opens the DB at path, retrying up to the given number of times with
+// an exponential backoff while its lock is held. Other errors, such as
+// permission or corruption errors, are returned at once.
+func openDB(path string, options *opt.Options, retries int, delay time.Duration) (*leveldb.DB, error) {
+	for attempt := 0; ; attempt++ {
+		db, err := leveldb.OpenFile(path, options)
+		if err == nil || !isLockError(err) || attempt >= retries {
+			return db, err
+		}
+		log.Warn(fmt.Sprintf("Mail server DB is locked, retrying in %s: %s", delay, err))
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
@@ -0,0 +1,51 @@
+package mailserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func TestOpenDBRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailserver-open")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// another process holds the lock for a while
+	locked, err := leveldb.OpenFile(dir, nil)
+	require.NoError(t, err)
+	released := make(chan struct{})
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		locked.Close()
+		close(released)
+	}()
+
+	_, err = openDB(dir, nil, 0, time.Millisecond)
+	require.True(t, isLockError(err), "no retries should fail on the lock: %v", err)
+
+	db, err := openDB(dir, nil, 5, 20*time.Millisecond)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	<-released
+}
+
+func TestOpenDBFailsFast(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailserver-open")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// a file in place of the DB directory is not a lock error
+	path := filepath.Join(dir, "db")
+	require.NoError(t, ioutil.WriteFile(path, nil, 0600))
+	start := time.Now()
+	_, err = openDB(path, nil, 5, time.Hour)
+	require.Error(t, err)
+	require.False(t, isLockError(err))
+	require.True(t, time.Since(start) < time.Minute, "other errors should not be retried")
+}
@@ -0,0 +1,119 @@
+package mailserver
+
+import (
+	"github.com/ethereum/go-ethereum/log"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// defaultDeliveryBatchSize is the number of envelopes buffered before being
+// sent to the requesting peer as a single p2p message, unless configured
+// otherwise.
+const defaultDeliveryBatchSize = 100
+
+// deliverer sends the envelopes matching a request to the peer.
+type deliverer interface {
+	add(*whisper.Envelope) error
+	flush() error // sends what is left once the request is processed
+}
+
+// newDeliverer returns the deliverer of the envelopes matching the request,
+// compressing them if the request asked for it. Envelopes are sent in
+// batches of deliveryBatchSize to peers decoding them, one by one to the
+// others. Without a peer, the envelopes are collected in ret instead.
+func (s *WMailServer) newDeliverer(peer *whisper.Peer, r *messagesRequest, ret *[]*whisper.Envelope) deliverer {
+	if r.compressed {
+		return s.newCompressedStream(r, func(env *whisper.Envelope) error {
+			if peer == nil {
+				// used for test purposes
+				*ret = append(*ret, env)
+				return nil
+			}
+			return s.w.SendP2PDirect(peer, env)
+		})
+	}
+	size := 1
+	if r.batches {
+		size = s.deliveryBatchSize
+	}
+	return newEnvelopeBatch(size, func(envelopes []*whisper.Envelope) error {
+		if peer == nil {
+			// used for test purposes
+			*ret = append(*ret, envelopes...)
+			return nil
+		}
+		return s.sendEnvelopes(peer, envelopes)
+	})
+}
+
+// envelopeBatch buffers envelopes delivered to a peer and sends them in
+// batches, so that sending is not interleaved with the archive scan.
+type envelopeBatch struct {
+	size      int
+	envelopes []*whisper.Envelope
+	send      func([]*whisper.Envelope) error
+}
+
+func newEnvelopeBatch(size int, send func([]*whisper.Envelope) error) *envelopeBatch {
+	if size <= 0 {
+		size = defaultDeliveryBatchSize
+	}
+	return &envelopeBatch{
+		size:      size,
+		envelopes: make([]*whisper.Envelope, 0, size),
+		send:      send,
+	}
+}
+
+// add buffers the envelope, sending the batch once it is full.
+func (b *envelopeBatch) add(env *whisper.Envelope) error {
+	b.envelopes = append(b.envelopes, env)
+	if len(b.envelopes) < b.size {
+		return nil
+	}
+	return b.flush()
+}
+
+// flush sends the buffered envelopes, if any.
+func (b *envelopeBatch) flush() error {
+	if len(b.envelopes) == 0 {
+		return nil
+	}
+	err := b.send(b.envelopes)
+	b.envelopes = b.envelopes[:0]
+	return err
+}
+
+// sendEnvelopes sends a batch of envelopes to the peer as a single p2p
+// message. A single envelope is sent on its own, as understood by every peer.
+func (s *WMailServer) sendEnvelopes(peer *whisper.Peer, envelopes []*whisper.Envelope) error {
+	if len(envelopes) == 1 {
+		return s.w.SendP2PDirect(peer, envelopes[0])
+	}
+	return s.w.SendP2PDirectBatch(peer, envelopes)
+}
+
+// lowPoWEnvelopes collects the envelopes withheld on delivery as they no
+// longer satisfy the minimum PoW.
+type lowPoWEnvelopes struct {
+	keys   [][]byte
+	topics []whisper.TopicType
+}
+
+func (e *lowPoWEnvelopes) add(key []byte, topic whisper.TopicType) {
+	e.keys = append(e.keys, append([]byte(nil), key...))
+	e.topics = append(e.topics, topic)
+}
+
+// removeLowPoW removes the envelopes withheld on delivery, if purging is
+// enabled, so that later requests do not scan them again.
+func (s *WMailServer) removeLowPoW(envelopes lowPoWEnvelopes) {
+	if !s.purgeLowPoW || s.readOnly || len(envelopes.keys) == 0 {
+		return
+	}
+
+	if err := s.newCleaner().removeEnvelopes(envelopes.keys, envelopes.topics); err != nil {
+		log.Error("Failed to remove envelopes below the minimum PoW", "error", err)
+		return
+	}
+	log.Info("Removed envelopes below the minimum PoW", "count", len(envelopes.keys))
+}
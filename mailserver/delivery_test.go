@@ -0,0 +1,70 @@
+package mailserver
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvelopeBatch(t *testing.T) {
+	var sent [][]*whisper.Envelope
+	batch := newEnvelopeBatch(2, func(envelopes []*whisper.Envelope) error {
+		sent = append(sent, append([]*whisper.Envelope(nil), envelopes...))
+		return nil
+	})
+
+	var envelopes []*whisper.Envelope
+	for i := 0; i < 5; i++ {
+		env, err := generateEnvelope(time.Now())
+		require.NoError(t, err)
+		envelopes = append(envelopes, env)
+		require.NoError(t, batch.add(env))
+	}
+	require.Len(t, sent, 2, "full batches are sent as they fill up")
+
+	require.NoError(t, batch.flush())
+	require.Equal(t, [][]*whisper.Envelope{envelopes[:2], envelopes[2:4], envelopes[4:]}, sent)
+	require.NoError(t, batch.flush(), "flushing an empty batch sends nothing")
+	require.Len(t, sent, 3)
+
+	errSend := errors.New("send failed")
+	batch = newEnvelopeBatch(1, func([]*whisper.Envelope) error { return errSend })
+	require.Equal(t, errSend, batch.add(envelopes[0]))
+	require.Equal(t, defaultDeliveryBatchSize, newEnvelopeBatch(0, nil).size)
+}
+
+func TestDeliveryPoWCheck(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+
+	for i := 3; i > 0; i-- {
+		archiveEnvelope(t, now.Add(-time.Duration(i)*time.Second), server)
+	}
+	r := &messagesRequest{
+		lower: uint32(now.Add(-time.Minute).Unix()),
+		upper: uint32(now.Unix()) + 1,
+		bloom: whisper.MakeFullNodeBloom(),
+	}
+
+	// the minimum PoW was raised after the envelopes were archived
+	server.setMinimumPoW(1000)
+	mail, _ := server.processRequest(nil, r)
+	require.Len(t, mail, 3, "envelopes are delivered verbatim by default")
+
+	server.deliveryPoW = true
+	mail, _ = server.processRequest(nil, r)
+	require.Len(t, mail, 0)
+	testMessagesCount(t, 3, server)
+
+	server.purgeLowPoW = true
+	mail, _ = server.processRequest(nil, r)
+	require.Len(t, mail, 0)
+	testMessagesCount(t, 0, server)
+	counts, err := server.TopicCounts()
+	require.NoError(t, err)
+	require.Empty(t, counts)
+}
@@ -0,0 +1,32 @@
+package mailserver
+
+import (
+	"crypto/ecdsa"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// newDirectMessage returns an envelope to be sent directly to a peer, with
+// the RLP encoding of value as payload. It is encrypted with the given
+// public key and signed with the signing key, if set.
+func (s *WMailServer) newDirectMessage(dst *ecdsa.PublicKey, topic whisper.TopicType, value interface{}) (*whisper.Envelope, error) {
+	payload, err := rlp.EncodeToBytes(value)
+	if err != nil {
+		return nil, err
+	}
+
+	params := &whisper.MessageParams{
+		TTL:     whisper.DefaultTTL,
+		Src:     s.signingKey,
+		Dst:     dst,
+		Topic:   topic,
+		Payload: payload,
+	}
+	msg, err := whisper.NewSentMessage(params)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Wrap(params, time.Now())
+}
@@ -0,0 +1,61 @@
+package mailserver
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// diskSpaceCheckPeriod is how often the free disk space is checked when a
+// minimum is configured.
+const diskSpaceCheckPeriod = 30 * time.Second
+
+var errDiskFull = errors.New("archiving is stopped as the disk is nearly full")
+
+// setupDiskSpaceMonitor stops archiving while the disk holding the DB at
+// path has less than minFree bytes free, so that the server keeps serving
+// requests instead of LevelDB failing writes unpredictably once the disk is
+// full. Archiving resumes once space is freed, e.g. by pruning and
+// compacting the archive.
+func (s *WMailServer) setupDiskSpaceMonitor(path string, minFree uint64) {
+	if minFree == 0 || s.readOnly {
+		return
+	}
+	s.minFreeSpace = minFree
+	s.freeSpace = func() (uint64, error) { return freeDiskSpace(path) }
+	s.checkDiskSpace()
+	s.diskTick = &ticker{}
+	s.diskTick.run(diskSpaceCheckPeriod, s.checkDiskSpace)
+}
+
+// checkDiskSpace stops or resumes archiving depending on the free disk
+// space. Archiving is left as is if the free space cannot be read.
+func (s *WMailServer) checkDiskSpace() {
+	free, err := s.freeSpace()
+	if err != nil {
+		log.Warn(fmt.Sprintf("Failed to read mail server free disk space: %s", err))
+		return
+	}
+	full := free < s.minFreeSpace
+	if full == s.isDiskFull() {
+		return
+	}
+	if full {
+		atomic.StoreInt32(&s.diskFull, 1)
+		diskFullGauge.Update(1)
+		log.Error("Mail server archiving stopped as the disk is nearly full, prune or compact the archive",
+			"free", free, "minimum", s.minFreeSpace)
+		return
+	}
+	atomic.StoreInt32(&s.diskFull, 0)
+	diskFullGauge.Update(0)
+	log.Info("Mail server archiving resumed as disk space was freed", "free", free)
+}
+
+// isDiskFull reports whether archiving is stopped for lack of disk space.
+func (s *WMailServer) isDiskFull() bool {
+	return atomic.LoadInt32(&s.diskFull) == 1
+}
@@ -0,0 +1,65 @@
+package mailserver
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskSpaceMonitor(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+
+	var (
+		free    uint64 = 1000
+		freeErr error
+	)
+	server.minFreeSpace = 100
+	server.freeSpace = func() (uint64, error) { return free, freeErr }
+	archived := archiveEnvelope(t, now.Add(-time.Minute), server)
+
+	testCases := []struct {
+		free    uint64
+		err     error
+		stopped bool
+		info    string
+	}{
+		{1000, nil, false, "archiving with enough space"},
+		{50, nil, true, "archiving stops below the threshold"},
+		{1000, errors.New("statfs failed"), true, "archiving is left as is if the space cannot be read"},
+		{200, nil, false, "archiving resumes once space is freed"},
+	}
+	for _, tc := range testCases {
+		free, freeErr = tc.free, tc.err
+		server.checkDiskSpace()
+		require.Equal(t, tc.stopped, server.Stats().DiskFull, tc.info)
+
+		env, err := BuildEnvelope(whisper.BytesToTopic([]byte("abcd")), []byte(tc.info), now.Add(-time.Second))
+		require.NoError(t, err)
+		err = server.archive(env)
+		if tc.stopped {
+			require.Equal(t, errDiskFull, err, tc.info)
+		} else {
+			require.NoError(t, err, tc.info)
+		}
+
+		// reads are served either way
+		found, err := server.GetByHash(archived.Hash())
+		require.NoError(t, err)
+		require.NotNil(t, found, tc.info)
+	}
+}
+
+func TestFreeDiskSpace(t *testing.T) {
+	free, err := freeDiskSpace(os.TempDir())
+	require.NoError(t, err)
+	require.NotZero(t, free)
+
+	_, err = freeDiskSpace("/does/not/exist")
+	require.Error(t, err)
+}
@@ -0,0 +1,69 @@
+package mailserver
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// Error codes sent to peers whose request is rejected.
+const (
+	ErrorCodeInvalidRequest = 1 // the request is malformed
+	ErrorCodeTimeRange      = 2 // the bounds of the request are invalid
+	ErrorCodeWindowSize     = 3 // the requested window is too large
+	ErrorCodeRateLimited    = 4 // the peer or the requested topics are throttled
+	ErrorCodeUnauthorized   = 5 // the request could not be opened or authenticated
+	ErrorCodeQuotaExceeded  = 6 // the peer exhausted its request quota
+)
+
+var errInsufficientPoW = errors.New("insufficient PoW of p2p request")
+
+// RequestError is sent back to peers whose request is rejected, if error
+// responses are enabled. It is the RLP-encoded payload of a direct message
+// with the topic of the request. The message is encrypted with the public
+// key the request was signed with or, if the request could not be opened,
+// with the node key of the peer.
+type RequestError struct {
+	Code       uint
+	Message    string
+	RetryAfter uint64 // seconds to wait before retrying, if rate limited or over quota
+}
+
+func newRequestError(code uint, err error) *RequestError {
+	return &RequestError{Code: code, Message: err.Error()}
+}
+
+func (e *RequestError) Error() string {
+	return e.Message
+}
+
+// sendRequestError answers a rejected request. The decoded request may be
+// nil if it could not be opened.
+func (s *WMailServer) sendRequestError(peer *whisper.Peer, request *whisper.Envelope, r *messagesRequest, requestErr *RequestError) {
+	if !s.errorResponses {
+		return
+	}
+
+	env, err := s.newRequestErrorEnvelope(peer.ID(), request, r, requestErr)
+	if err == nil {
+		err = s.w.SendP2PDirect(peer, env)
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to send request error to peer: %s", err))
+	}
+}
+
+func (s *WMailServer) newRequestErrorEnvelope(peerID []byte, request *whisper.Envelope, r *messagesRequest, requestErr *RequestError) (*whisper.Envelope, error) {
+	dst := crypto.ToECDSAPub(append([]byte{0x04}, peerID...))
+	if r != nil && r.src != nil {
+		dst = r.src
+	}
+	if dst == nil || dst.X == nil {
+		return nil, errors.New("invalid peer ID")
+	}
+
+	return s.newDirectMessage(dst, request.Topic, requestErr)
+}
@@ -0,0 +1,76 @@
+package mailserver
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckRequestErrorCodes(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+	server.futureGrace = time.Minute
+	server.AddSymKey(testEnvelopeKey[:])
+	peerKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	peerID := crypto.FromECDSAPub(&peerKey.PublicKey)[1:]
+
+	newRequest := func(lower, upper time.Time, key []byte) *whisper.Envelope {
+		payload := make([]byte, 8)
+		binary.BigEndian.PutUint32(payload, uint32(lower.Unix()))
+		binary.BigEndian.PutUint32(payload[4:], uint32(upper.Unix()))
+		params := &whisper.MessageParams{
+			KeySym:   key,
+			Src:      peerKey,
+			Topic:    whisper.TopicType{0x01, 0x02, 0x03, 0x04},
+			Payload:  payload,
+			PoW:      powRequirement,
+			WorkTime: 2,
+		}
+		msg, err := whisper.NewSentMessage(params)
+		require.NoError(t, err)
+		env, err := msg.Wrap(params, time.Now())
+		require.NoError(t, err)
+		return env
+	}
+
+	now := time.Now()
+	otherKey := crypto.Keccak256([]byte("other key"))
+	testCases := []struct {
+		request *whisper.Envelope
+		code    uint
+		info    string
+	}{
+		{newRequest(now.Add(-time.Hour), now, testEnvelopeKey[:]), 0, "valid request"},
+		{newRequest(now.Add(-time.Hour), now, otherKey), ErrorCodeUnauthorized, "unknown key"},
+		{newRequest(now.Add(-48*time.Hour), now, testEnvelopeKey[:]), ErrorCodeWindowSize, "window too large"},
+		{newRequest(now, now.Add(time.Hour), testEnvelopeKey[:]), ErrorCodeTimeRange, "upper bound in the future"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.info, func(t *testing.T) {
+			r, requestErr := server.checkRequest(peerID, tc.request)
+			if tc.code == 0 {
+				require.Nil(t, requestErr)
+				require.NotNil(t, r)
+				return
+			}
+			require.NotNil(t, requestErr)
+			require.Equal(t, tc.code, requestErr.Code)
+
+			// the error can be read by the peer
+			env, err := server.newRequestErrorEnvelope(peerID, tc.request, r, requestErr)
+			require.NoError(t, err)
+			msg := env.Open(&whisper.Filter{KeyAsym: peerKey})
+			require.NotNil(t, msg)
+			var received RequestError
+			require.NoError(t, rlp.DecodeBytes(msg.Payload, &received))
+			require.Equal(t, *requestErr, received)
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package mailserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var errInvalidCheckpoint = errors.New("export checkpoint is not an envelope key of the archive namespace")
+
+// ExportFrom writes the archived envelopes of the namespace of the server,
+// in key order, starting after the given checkpoint or from the first one if
+// nil. Envelopes are written as a stream of RLP-encoded envelopes, so that
+// huge archives can be exported without holding them in memory.
+//
+// It returns a checkpoint to resume the export from, the DB key of the last
+// envelope written, even along with an error: a failed export is resumed by
+// passing it again. The checkpoint is returned unchanged if there was
+// nothing to write. Envelopes moved to the cold storage are exported too.
+func (s *WMailServer) ExportFrom(checkpoint []byte, w io.Writer) ([]byte, error) {
+	if checkpoint != nil && !s.inNamespace(checkpoint) {
+		return checkpoint, errInvalidCheckpoint
+	}
+
+	i, err := s.newRangeIterator(s.namespaceRange())
+	if err != nil {
+		return checkpoint, err
+	}
+	defer i.Release()
+
+	next := i.First
+	if checkpoint != nil {
+		next = func() bool { return seekAfter(i, checkpoint) }
+	}
+
+	last := checkpoint
+	for ok := next(); ok; ok = i.Next() {
+		if !s.inNamespace(i.Key()) || isTombstone(i.Value()) {
+			continue
+		}
+		// an envelope being moved to the cold storage can be seen in both tiers
+		if bytes.Equal(i.Key(), last) {
+			continue
+		}
+		if _, err := w.Write(i.Value()); err != nil {
+			return last, fmt.Errorf("failed to write exported envelope: %s", err)
+		}
+		last = append([]byte(nil), i.Key()...)
+	}
+	if err := i.Error(); err != nil {
+		return last, err
+	}
+	return last, nil
+}
@@ -0,0 +1,86 @@
+package mailserver
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rlp"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/stretchr/testify/require"
+)
+
+// interruptedWriter fails once the given number of envelopes were written,
+// writing every envelope wholly or not at all.
+type interruptedWriter struct {
+	w      io.Writer
+	writes int
+}
+
+func (i *interruptedWriter) Write(p []byte) (int, error) {
+	if i.writes == 0 {
+		return 0, errors.New("connection reset")
+	}
+	i.writes--
+	return i.w.Write(p)
+}
+
+func decodeExport(t *testing.T, data []byte) []common.Hash {
+	var hashes []common.Hash
+	stream := rlp.NewStream(bytes.NewReader(data), 0)
+	for {
+		var env whisper.Envelope
+		if err := stream.Decode(&env); err == io.EOF {
+			return hashes
+		} else {
+			require.NoError(t, err)
+		}
+		hashes = append(hashes, env.Hash())
+	}
+}
+
+func TestExportFrom(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+	other := &WMailServer{db: server.db, pow: server.pow, namespace: newNamespace("other")}
+
+	var archived []common.Hash
+	for i := 5; i > 0; i-- {
+		archived = append(archived, archiveEnvelope(t, now.Add(-time.Duration(i)*time.Minute), server).Hash())
+	}
+	archiveEnvelope(t, now.Add(-time.Minute), other)
+	_, err := server.DeleteRange(now.Add(-5*time.Minute), now.Add(-5*time.Minute))
+	require.NoError(t, err)
+	archived = archived[1:]
+
+	// the export is interrupted after two envelopes
+	var out bytes.Buffer
+	checkpoint, err := server.ExportFrom(nil, &interruptedWriter{w: &out, writes: 2})
+	require.Error(t, err)
+	require.Equal(t, archived[:2], decodeExport(t, out.Bytes()))
+	require.Equal(t, archived[1], envelopeKeyHash(checkpoint))
+
+	// and resumed from its checkpoint
+	checkpoint, err = server.ExportFrom(checkpoint, &out)
+	require.NoError(t, err)
+	require.Equal(t, archived, decodeExport(t, out.Bytes()))
+	require.Equal(t, archived[len(archived)-1], envelopeKeyHash(checkpoint))
+
+	// nothing is left to export past the last checkpoint
+	out.Reset()
+	resumed, err := server.ExportFrom(checkpoint, &out)
+	require.NoError(t, err)
+	require.Equal(t, checkpoint, resumed)
+	require.Zero(t, out.Len())
+
+	// namespaces are exported independently
+	_, err = other.ExportFrom(nil, &out)
+	require.NoError(t, err)
+	require.Len(t, decodeExport(t, out.Bytes()), 1)
+	_, err = other.ExportFrom(checkpoint, &out)
+	require.Equal(t, errInvalidCheckpoint, err)
+}
@@ -0,0 +1,72 @@
+package mailserver
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// formatKey holds a DB key encoded by this mail server for a known timestamp
+// and hash. Range scans rely on keys starting with the big-endian sent time,
+// so an archive written with another encoding, e.g. by a forked build, would
+// silently return wrong results.
+var formatKey = []byte{reservedPrefix, 'f'}
+
+// formatMarker is the timestamp and hash encoded in the format marker, chosen
+// so that any byte order other than big-endian yields a different key.
+var formatMarker = NewDbKey(0x01020304, common.HexToHash("0x0102030405060708"))
+
+var errKeyFormatMismatch = errors.New("archive keys were written with an incompatible encoding")
+
+// checkKeyFormat verifies the format marker of the archive, writing it if
+// the archive has none yet. Archives written before the marker was
+// introduced are accepted if the key of their first envelope encodes its
+// sent time.
+func checkKeyFormat(db *leveldb.DB, readOnly bool) error {
+	marker, err := db.Get(formatKey, nil)
+	if err == nil {
+		if !bytes.Equal(marker, formatMarker.raw) {
+			return errKeyFormatMismatch
+		}
+		return nil
+	} else if err != leveldb.ErrNotFound {
+		return err
+	}
+
+	if err := checkFirstEnvelopeKey(db); err != nil {
+		return err
+	}
+	if readOnly {
+		log.Warn("Mail server archive has no key format marker and cannot be updated in read-only mode")
+		return nil
+	}
+	return db.Put(formatKey, formatMarker.raw, nil)
+}
+
+// checkFirstEnvelopeKey checks that the key of the first archived envelope
+// starts with its sent time.
+func checkFirstEnvelopeKey(db *leveldb.DB) error {
+	i := db.NewIterator(nil, nil)
+	defer i.Release()
+
+	for ok := i.First(); ok; ok = i.Next() {
+		if !isEnvelopeKey(i.Key()) || isTombstone(i.Value()) {
+			continue
+		}
+		var env whisper.Envelope
+		if err := rlp.DecodeBytes(i.Value(), &env); err != nil {
+			log.Warn("Cannot check key format of undecodable envelope", "key", i.Key(), "error", err)
+			return nil
+		}
+		if !bytes.Equal(stripNamespace(i.Key()), NewDbKey(env.Expiry-env.TTL, env.Hash()).raw) {
+			return errKeyFormatMismatch
+		}
+		return nil
+	}
+	return i.Error()
+}
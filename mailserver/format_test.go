@@ -0,0 +1,46 @@
+package mailserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckKeyFormat(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+
+	// the marker is written on first use and verified afterwards
+	require.NoError(t, checkKeyFormat(server.db, false))
+	marker, err := server.db.Get(formatKey, nil)
+	require.NoError(t, err)
+	require.Equal(t, formatMarker.raw, marker)
+	require.NoError(t, checkKeyFormat(server.db, false))
+
+	require.NoError(t, server.db.Put(formatKey, NewDbKey(0x04030201, formatMarker.hash).raw, nil))
+	require.Equal(t, errKeyFormatMismatch, checkKeyFormat(server.db, false))
+}
+
+func TestCheckKeyFormatLegacyArchive(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+
+	env, err := generateEnvelope(time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	raw, err := rlp.EncodeToBytes(env)
+	require.NoError(t, err)
+
+	// a little-endian sent time does not match the envelope
+	key := NewDbKey(env.Expiry-env.TTL, env.Hash()).raw
+	key[0], key[1], key[2], key[3] = key[3], key[2], key[1], key[0]
+	require.NoError(t, server.db.Put(key, raw, nil))
+	require.Equal(t, errKeyFormatMismatch, checkKeyFormat(server.db, true))
+
+	require.NoError(t, server.db.Delete(key, nil))
+	require.NoError(t, server.db.Put(NewDbKey(env.Expiry-env.TTL, env.Hash()).raw, raw, nil))
+	require.NoError(t, checkKeyFormat(server.db, true))
+	_, err = server.db.Get(formatKey, nil)
+	require.Error(t, err, "read-only archives are not updated")
+}
@@ -0,0 +1,324 @@
+package mailserver
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// hashIndexPrefix prefixes the keys of the hash index, which maps every
+// archived envelope hash to the DB keys it is stored under.
+//
+// Envelope hashes cover their sent time, so within a namespace a hash is
+// only ever stored under one key. The same envelope can however be archived
+// in several namespaces sharing a DB, so the index keeps a list of keys per
+// hash instead of letting one namespace clobber another. Such collisions are
+// logged and counted, and lookups pick the key of their own namespace.
+var hashIndexPrefix = []byte{reservedPrefix, 'h'}
+
+func hashIndexKey(hash common.Hash) []byte {
+	return append(append([]byte(nil), hashIndexPrefix...), hash[:]...)
+}
+
+// envelopeKeyHash returns the hash embedded in an envelope key.
+func envelopeKeyHash(key []byte) common.Hash {
+	return common.BytesToHash(stripNamespace(key)[4:])
+}
+
+// hashIndexChanges accumulates changes of the hash index. It implements
+// leveldb.BatchReplay, so that the changes implied by a batch of envelope
+// writes can be collected by replaying it.
+type hashIndexChanges struct {
+	added   map[common.Hash][][]byte
+	removed map[common.Hash][][]byte
+}
+
+func newHashIndexChanges() *hashIndexChanges {
+	return &hashIndexChanges{
+		added:   make(map[common.Hash][][]byte),
+		removed: make(map[common.Hash][][]byte),
+	}
+}
+
+// Put accounts for an envelope stored or replaced by its tombstone.
+func (c *hashIndexChanges) Put(key, value []byte) {
+	if !isEnvelopeKey(key) {
+		return
+	}
+	hash := envelopeKeyHash(key)
+	if isTombstone(value) {
+		c.removed[hash] = append(c.removed[hash], append([]byte(nil), key...))
+		return
+	}
+	c.added[hash] = append(c.added[hash], append([]byte(nil), key...))
+}
+
+// Delete accounts for an envelope removed.
+func (c *hashIndexChanges) Delete(key []byte) {
+	if !isEnvelopeKey(key) {
+		return
+	}
+	hash := envelopeKeyHash(key)
+	c.removed[hash] = append(c.removed[hash], append([]byte(nil), key...))
+}
+
+// write adds the accumulated changes to the batch. It must be called with
+// indexMu held until the batch is written.
+func (c *hashIndexChanges) write(db *leveldb.DB, batch *leveldb.Batch) error {
+	hashes := make(map[common.Hash]struct{}, len(c.added)+len(c.removed))
+	for hash := range c.added {
+		hashes[hash] = struct{}{}
+	}
+	for hash := range c.removed {
+		hashes[hash] = struct{}{}
+	}
+
+	for hash := range hashes {
+		key := hashIndexKey(hash)
+		keys, err := readHashKeys(db, key)
+		if err != nil {
+			return err
+		}
+
+		for _, removed := range c.removed[hash] {
+			keys = removeKey(keys, removed)
+		}
+		for _, added := range c.added[hash] {
+			if containsKey(keys, added) {
+				continue
+			}
+			if len(keys) > 0 {
+				log.Warn("Envelope hash archived under several keys", "hash", hash, "keys", len(keys)+1)
+				hashCollisionCounter.Inc(1)
+			}
+			keys = append(keys, added)
+		}
+
+		if len(keys) == 0 {
+			batch.Delete(key)
+			continue
+		}
+		value, err := rlp.EncodeToBytes(keys)
+		if err != nil {
+			return err
+		}
+		batch.Put(key, value)
+	}
+	return nil
+}
+
+// updateHashIndex adds to the batch the hash index changes implied by the
+// envelope writes it holds. It must be called with indexMu held until the
+// batch is written.
+func updateHashIndex(db *leveldb.DB, batch *leveldb.Batch) error {
+	changes := newHashIndexChanges()
+	if err := batch.Replay(changes); err != nil {
+		return err
+	}
+	return changes.write(db, batch)
+}
+
+func readHashKeys(db *leveldb.DB, key []byte) ([][]byte, error) {
+	value, err := db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var keys [][]byte
+	if err := rlp.DecodeBytes(value, &keys); err != nil {
+		return nil, fmt.Errorf("invalid hash index entry: %s", err)
+	}
+	return keys, nil
+}
+
+func containsKey(keys [][]byte, key []byte) bool {
+	for _, k := range keys {
+		if bytes.Equal(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func removeKey(keys [][]byte, key []byte) [][]byte {
+	for i, k := range keys {
+		if bytes.Equal(k, key) {
+			return append(keys[:i], keys[i+1:]...)
+		}
+	}
+	return keys
+}
+
+// GetByHash returns the archived envelope with the given hash in the
+// namespace of the server, or nil if there is none. Envelopes moved to the
+// cold storage are looked up there.
+func (s *WMailServer) GetByHash(hash common.Hash) (*whisper.Envelope, error) {
+	keys, err := readHashKeys(s.db, hashIndexKey(hash))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		if !bytes.Equal(key[:len(key)-dbKeySize], s.namespace) {
+			continue
+		}
+
+		raw, err := s.getEnvelope(key)
+		if err != nil || raw == nil {
+			return nil, err
+		}
+		var env whisper.Envelope
+		if err := rlp.DecodeBytes(raw, &env); err != nil {
+			return nil, fmt.Errorf("RLP decoding failed: %s", err)
+		}
+		return &env, nil
+	}
+	return nil, nil
+}
+
+// getEnvelope returns the RLP-encoded envelope stored under the given key in
+// either tier, or nil if there is none.
+func (s *WMailServer) getEnvelope(key []byte) ([]byte, error) {
+	raw, err := s.db.Get(key, nil)
+	if err == nil {
+		if isTombstone(raw) {
+			return nil, nil
+		}
+		return raw, nil
+	} else if err != leveldb.ErrNotFound {
+		return nil, err
+	}
+
+	if s.coldStorage == nil {
+		return nil, nil
+	}
+	entries, err := s.coldStorage.Range(key, append(append([]byte(nil), key...), 0))
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	return entries[0].Value, nil
+}
+
+// checkHashIndex verifies that every archived envelope, in any namespace, has
+// an entry in the hash index and that every entry points at an archived
+// envelope, repairing the discrepancies left e.g. by a crash or by tools
+// writing to the DB directly. It returns the number of repairs, which are
+// only counted, not made, if repair is false.
+//
+// The cold storage is not read, so keys of envelopes sent before coldCutoff,
+// which may have been moved there, are kept as long as they are not
+// tombstones.
+func checkHashIndex(db *leveldb.DB, indexMu *sync.Mutex, coldCutoff uint32, repair bool) (int, error) {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	var (
+		changes = newHashIndexChanges()
+		repairs int
+		pending int
+	)
+	flush := func() error {
+		if pending == 0 || !repair {
+			changes, pending = newHashIndexChanges(), 0
+			return nil
+		}
+		batch := new(leveldb.Batch)
+		if err := changes.write(db, batch); err != nil {
+			return err
+		}
+		changes, pending = newHashIndexChanges(), 0
+		return db.Write(batch, nil)
+	}
+
+	// entries pointing at missing envelopes are removed first, so that the
+	// entries of envelopes found missing from the index can then be merged
+	i := db.NewIterator(util.BytesPrefix(hashIndexPrefix), nil)
+	defer i.Release()
+	for i.Next() {
+		hash := common.BytesToHash(i.Key()[len(hashIndexPrefix):])
+		var keys [][]byte
+		if err := rlp.DecodeBytes(i.Value(), &keys); err != nil {
+			// the keys of the envelopes are added back below
+			repairs++
+			if repair {
+				if err := db.Delete(append([]byte(nil), i.Key()...), nil); err != nil {
+					return repairs, err
+				}
+			}
+			continue
+		}
+		for _, key := range keys {
+			stale, err := isStaleHashKey(db, hash, key, coldCutoff)
+			if err != nil {
+				return repairs, err
+			}
+			if !stale {
+				continue
+			}
+			changes.removed[hash] = append(changes.removed[hash], key)
+			repairs++
+			if pending++; pending == migrationBatchSize {
+				if err := flush(); err != nil {
+					return repairs, err
+				}
+			}
+		}
+	}
+	if err := i.Error(); err != nil {
+		return repairs, err
+	}
+	if err := flush(); err != nil {
+		return repairs, err
+	}
+
+	slice := envelopesRange
+	e := db.NewIterator(&slice, nil)
+	defer e.Release()
+	for e.Next() {
+		if !isEnvelopeKey(e.Key()) || isTombstone(e.Value()) {
+			continue
+		}
+		keys, err := readHashKeys(db, hashIndexKey(envelopeKeyHash(e.Key())))
+		if err != nil {
+			return repairs, err
+		}
+		if containsKey(keys, e.Key()) {
+			continue
+		}
+		changes.Put(append([]byte(nil), e.Key()...), e.Value())
+		repairs++
+		if pending++; pending == migrationBatchSize {
+			if err := flush(); err != nil {
+				return repairs, err
+			}
+		}
+	}
+	if err := e.Error(); err != nil {
+		return repairs, err
+	}
+	return repairs, flush()
+}
+
+// isStaleHashKey reports whether a key listed in the hash index entry of the
+// given hash does not point at an archived envelope with that hash.
+func isStaleHashKey(db *leveldb.DB, hash common.Hash, key []byte, coldCutoff uint32) (bool, error) {
+	if !isEnvelopeKey(key) || envelopeKeyHash(key) != hash {
+		return true, nil
+	}
+	value, err := db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return keySentTime(key) >= coldCutoff, nil
+	} else if err != nil {
+		return false, err
+	}
+	return isTombstone(value), nil
+}
@@ -0,0 +1,130 @@
+package mailserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetByHash(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+
+	env := archiveEnvelope(t, now.Add(-time.Minute), server)
+	found, err := server.GetByHash(env.Hash())
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	require.Equal(t, env.Hash(), found.Hash())
+
+	found, err = server.GetByHash(common.HexToHash("0x01"))
+	require.NoError(t, err)
+	require.Nil(t, found, "unknown hash")
+
+	// archiving the same envelope again does not duplicate its key
+	server.Archive(env)
+	keys, err := readHashKeys(server.db, hashIndexKey(env.Hash()))
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+
+	_, err = server.DeleteRange(now.Add(-time.Hour), now)
+	require.NoError(t, err)
+	found, err = server.GetByHash(env.Hash())
+	require.NoError(t, err)
+	require.Nil(t, found, "pruned envelope")
+	_, err = server.db.Get(hashIndexKey(env.Hash()), nil)
+	require.Error(t, err, "the index entry should be removed with the last key")
+}
+
+func TestHashIndexCollisions(t *testing.T) {
+	now := time.Now()
+	defaultNS := setupTestServer(t)
+	defer defaultNS.Close()
+	other := &WMailServer{db: defaultNS.db, pow: defaultNS.pow, namespace: newNamespace("other")}
+
+	// the same envelope archived in two namespaces collides in the index
+	env := archiveEnvelope(t, now.Add(-time.Minute), defaultNS)
+	require.NoError(t, other.archive(env))
+	keys, err := readHashKeys(defaultNS.db, hashIndexKey(env.Hash()))
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{
+		NewDbKey(env.Expiry-env.TTL, env.Hash()).raw,
+		NewNamespacedDbKey(other.namespace, env.Expiry-env.TTL, env.Hash()).raw,
+	}, keys, "colliding keys should all be kept")
+
+	for _, server := range []*WMailServer{defaultNS, other} {
+		found, err := server.GetByHash(env.Hash())
+		require.NoError(t, err)
+		require.NotNil(t, found)
+	}
+
+	// removing the envelope from one namespace leaves the other untouched
+	_, err = other.DeleteRange(now.Add(-time.Hour), now)
+	require.NoError(t, err)
+	found, err := other.GetByHash(env.Hash())
+	require.NoError(t, err)
+	require.Nil(t, found)
+	found, err = defaultNS.GetByHash(env.Hash())
+	require.NoError(t, err)
+	require.NotNil(t, found)
+}
+
+func TestGetByHashColdStorage(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+	server.hotRetention = time.Hour
+	server.SetColdStorage(newMemColdStorage())
+
+	env := archiveEnvelope(t, now.Add(-2*time.Hour), server)
+	moved, err := server.moveToColdStorage()
+	require.NoError(t, err)
+	require.Equal(t, 1, moved)
+
+	found, err := server.GetByHash(env.Hash())
+	require.NoError(t, err)
+	require.NotNil(t, found, "envelopes moved to the cold storage should still be found")
+}
+
+func TestCheckHashIndex(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+
+	unindexed := archiveEnvelope(t, now.Add(-time.Minute), server)
+	missing := archiveEnvelope(t, now.Add(-2*time.Minute), server)
+	cold := archiveEnvelope(t, now.Add(-time.Hour), server)
+	require.NoError(t, server.db.Delete(hashIndexKey(unindexed.Hash()), nil))
+	require.NoError(t, server.db.Delete(NewDbKey(missing.Expiry-missing.TTL, missing.Hash()).raw, nil))
+	require.NoError(t, server.db.Delete(NewDbKey(cold.Expiry-cold.TTL, cold.Hash()).raw, nil))
+	invalid := hashIndexKey(common.HexToHash("0x01"))
+	require.NoError(t, server.db.Put(invalid, []byte{0x01, 0x02}, nil))
+
+	cutoff := uint32(now.Add(-30 * time.Minute).Unix())
+	repairs, err := checkHashIndex(server.db, &server.indexMu, cutoff, false)
+	require.NoError(t, err)
+	require.Equal(t, 3, repairs)
+	found, err := server.GetByHash(unindexed.Hash())
+	require.NoError(t, err)
+	require.Nil(t, found, "repairs should only be counted")
+
+	repairs, err = checkHashIndex(server.db, &server.indexMu, cutoff, true)
+	require.NoError(t, err)
+	require.Equal(t, 3, repairs)
+	found, err = server.GetByHash(unindexed.Hash())
+	require.NoError(t, err)
+	require.NotNil(t, found, "missing entries should be added")
+	_, err = server.db.Get(hashIndexKey(missing.Hash()), nil)
+	require.Error(t, err, "entries of missing envelopes should be removed")
+	_, err = server.db.Get(invalid, nil)
+	require.Error(t, err, "invalid entries should be removed")
+	keys, err := readHashKeys(server.db, hashIndexKey(cold.Hash()))
+	require.NoError(t, err)
+	require.Len(t, keys, 1, "entries of envelopes possibly in cold storage should be kept")
+
+	repairs, err = checkHashIndex(server.db, &server.indexMu, cutoff, true)
+	require.NoError(t, err)
+	require.Equal(t, 0, repairs)
+}
@@ -1,21 +1,50 @@
 package mailserver
 
 import (
+	"container/list"
+	"math/rand"
 	"sync"
 	"time"
 )
 
+// maxJitterExponent caps the exponential growth of the retry jitter.
+const maxJitterExponent = 5
+
 type limiter struct {
 	mu sync.RWMutex
 
 	timeout time.Duration
 	db      map[string]time.Time
+
+	// jitter adds a random delay to suggested retries which grows
+	// exponentially with the number of consecutive rejections.
+	jitter     bool
+	rejections map[string]int
+	rand       *rand.Rand
+
+	// maxEntries, if set, caps the size of db. Once reached, the entry
+	// seen least recently is evicted, tracked by order, oldest first.
+	maxEntries int
+	order      *list.List
+	elements   map[string]*list.Element
+
+	// scale, if set, returns the factor the timeout of a peer is multiplied
+	// by, e.g. depending on its reputation.
+	scale func(id string) float64
+
+	// loadScale, if set, returns the factor the timeout of every peer is
+	// multiplied by, e.g. depending on the load of the server.
+	loadScale func() float64
 }
 
 func newLimiter(timeout time.Duration) *limiter {
 	return &limiter{
-		timeout: timeout,
-		db:      make(map[string]time.Time),
+		timeout:    timeout,
+		db:         make(map[string]time.Time),
+		rejections: make(map[string]int),
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		order:      list.New(),
+		elements:   make(map[string]*list.Element),
 	}
 }
 
@@ -24,6 +53,34 @@ func (l *limiter) add(id string) {
 	defer l.mu.Unlock()
 
 	l.db[id] = time.Now()
+	delete(l.rejections, id)
+
+	if l.maxEntries <= 0 {
+		return
+	}
+	if e, ok := l.elements[id]; ok {
+		l.order.MoveToBack(e)
+	} else {
+		l.elements[id] = l.order.PushBack(id)
+	}
+	for len(l.db) > l.maxEntries {
+		oldest := l.order.Front()
+		if oldest == nil {
+			break
+		}
+		l.remove(oldest.Value.(string))
+		limiterEvictedCounter.Inc(1)
+	}
+}
+
+// remove drops the entry with the given ID. It must be called with mu held.
+func (l *limiter) remove(id string) {
+	delete(l.db, id)
+	delete(l.rejections, id)
+	if e, ok := l.elements[id]; ok {
+		l.order.Remove(e)
+		delete(l.elements, id)
+	}
 }
 
 func (l *limiter) isAllowed(id string) bool {
@@ -31,20 +88,144 @@ func (l *limiter) isAllowed(id string) bool {
 	defer l.mu.RUnlock()
 
 	if lastRequestTime, ok := l.db[id]; ok {
-		return lastRequestTime.Add(l.timeout).Before(time.Now())
+		return lastRequestTime.Add(l.timeoutOf(id)).Before(time.Now())
 	}
 
 	return true
 }
 
+// timeoutOf returns the timeout of the given ID.
+func (l *limiter) timeoutOf(id string) time.Duration {
+	timeout := l.effectiveTimeout()
+	if l.scale == nil {
+		return timeout
+	}
+	return time.Duration(float64(timeout) * l.scale(id))
+}
+
+// effectiveTimeout returns the timeout before the scale of any ID is applied.
+func (l *limiter) effectiveTimeout() time.Duration {
+	if l.loadScale == nil {
+		return l.timeout
+	}
+	return time.Duration(float64(l.timeout) * l.loadScale())
+}
+
+// retryAfter returns a suggested duration a rejected peer should wait before
+// sending its next request.
+func (l *limiter) retryAfter(id string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lastRequestTime, ok := l.db[id]
+	if !ok {
+		return 0
+	}
+
+	wait := lastRequestTime.Add(l.timeoutOf(id)).Sub(time.Now())
+	if wait < 0 {
+		wait = 0
+	}
+	if !l.jitter {
+		return wait
+	}
+
+	exp := l.rejections[id]
+	if exp > maxJitterExponent {
+		exp = maxJitterExponent
+	}
+	l.rejections[id]++
+
+	return wait + time.Duration(l.rand.Int63n(int64(l.timeout)<<uint(exp)))
+}
+
 func (l *limiter) deleteExpired() {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
 	now := time.Now()
 	for id, lastRequestTime := range l.db {
-		if lastRequestTime.Add(l.timeout).Before(now) {
-			delete(l.db, id)
+		if lastRequestTime.Add(l.timeoutOf(id)).Before(now) {
+			l.remove(id)
 		}
 	}
 }
+
+// active returns the IDs whose last request is still within the timeout,
+// i.e. which would be rejected if they sent a request now.
+func (l *limiter) active() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var ids []string
+	now := time.Now()
+	for id, lastRequestTime := range l.db {
+		if !lastRequestTime.Add(l.timeoutOf(id)).Before(now) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// requestCounter keeps a rolling count of requests per peer over a window.
+type requestCounter struct {
+	mu sync.Mutex
+
+	window    time.Duration
+	requests  map[string][]time.Time // request times per peer, oldest first
+	lastSweep time.Time
+}
+
+func newRequestCounter(window time.Duration) *requestCounter {
+	return &requestCounter{
+		window:    window,
+		requests:  make(map[string][]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+func (c *requestCounter) add(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.requests[id] = append(c.expire(c.requests[id], now), now)
+
+	// peers that stopped sending requests are swept once per window
+	if now.Sub(c.lastSweep) > c.window {
+		c.sweep(now)
+	}
+}
+
+// counts returns the number of requests per peer within the window.
+func (c *requestCounter) counts() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sweep(time.Now())
+	counts := make(map[string]int, len(c.requests))
+	for id, times := range c.requests {
+		counts[id] = len(times)
+	}
+	return counts
+}
+
+func (c *requestCounter) sweep(now time.Time) {
+	for id, times := range c.requests {
+		if times = c.expire(times, now); len(times) == 0 {
+			delete(c.requests, id)
+		} else {
+			c.requests[id] = times
+		}
+	}
+	c.lastSweep = now
+}
+
+// expire drops the request times which fell out of the window.
+func (c *requestCounter) expire(times []time.Time, now time.Time) []time.Time {
+	i := 0
+	for i < len(times) && !times[i].Add(c.window).After(now) {
+		i++
+	}
+	return times[i:]
+}
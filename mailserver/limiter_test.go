@@ -2,6 +2,7 @@ package mailserver
 
 import (
 	"fmt"
+	"math/rand"
 	"testing"
 	"time"
 
@@ -82,6 +83,36 @@ func TestRemoveExpiredRateLimits(t *testing.T) {
 	}
 }
 
+func TestActiveRateLimits(t *testing.T) {
+	l := newLimiter(time.Duration(5) * time.Second)
+	l.db["active"] = time.Now().Add(-time.Second)
+	l.db["expired"] = time.Now().Add(-10 * time.Second)
+
+	assert.Equal(t, []string{"active"}, l.active())
+}
+
+func TestMaxEntries(t *testing.T) {
+	l := newLimiter(time.Hour)
+	l.maxEntries = 10
+	for i := 0; i < 1000; i++ {
+		l.add(fmt.Sprintf("peer%d", i))
+		assert.True(t, len(l.db) <= 10, "limiter should never track more than maxEntries peers")
+	}
+	assert.Equal(t, 10, l.order.Len())
+	assert.Equal(t, 10, len(l.elements))
+
+	// peers seen again are evicted last
+	l.add("peer990")
+	l.add("new")
+	_, ok := l.db["peer990"]
+	assert.True(t, ok)
+	_, ok = l.db["peer991"]
+	assert.False(t, ok, "the peer seen least recently should be evicted")
+
+	l.deleteExpired()
+	assert.Equal(t, len(l.db), l.order.Len())
+}
+
 func TestAddingLimts(t *testing.T) {
 	peerID := "peerAdding"
 	l := newLimiter(time.Duration(5) * time.Second)
@@ -91,3 +122,70 @@ func TestAddingLimts(t *testing.T) {
 	assert.True(t, l.db[peerID].After(pre))
 	assert.True(t, l.db[peerID].Before(post))
 }
+
+func TestRetryAfter(t *testing.T) {
+	peerID := "peerRetry"
+	l := newLimiter(time.Second)
+	assert.Equal(t, time.Duration(0), l.retryAfter(peerID))
+
+	l.add(peerID)
+	retryAfter := l.retryAfter(peerID)
+	assert.True(t, retryAfter > 0 && retryAfter <= time.Second)
+	// without jitter the suggestion only depends on the window
+	assert.True(t, l.retryAfter(peerID) <= retryAfter)
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	testCases := []struct {
+		wait     time.Duration
+		expected uint64
+		info     string
+	}{
+		{0, 0, "no wait"},
+		{-time.Second, 0, "window already elapsed"},
+		{time.Millisecond, 1, "rounded up to a second"},
+		{time.Second, 1, "whole second"},
+		{1500 * time.Millisecond, 2, "rounded up to the next second"},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, retryAfterSeconds(tc.wait), tc.info)
+	}
+}
+
+func TestRetryAfterJitter(t *testing.T) {
+	peerID := "peerJitter"
+	l := newLimiter(time.Second)
+	l.jitter = true
+	l.rand = rand.New(rand.NewSource(1))
+	l.add(peerID)
+
+	for i := 0; i < 10; i++ {
+		exp := i
+		if exp > maxJitterExponent {
+			exp = maxJitterExponent
+		}
+		retryAfter := l.retryAfter(peerID)
+		assert.True(t, retryAfter <= time.Second+time.Second<<uint(exp),
+			fmt.Sprintf("rejection %d: retry after %s exceeds jitter bound", i, retryAfter))
+	}
+	assert.Equal(t, 10, l.rejections[peerID])
+
+	// a successful request resets the jitter
+	l.add(peerID)
+	_, ok := l.rejections[peerID]
+	assert.False(t, ok)
+}
+
+func TestRequestCounter(t *testing.T) {
+	c := newRequestCounter(time.Hour)
+	c.add("peer1")
+	c.add("peer1")
+	c.add("peer2")
+	assert.Equal(t, map[string]int{"peer1": 2, "peer2": 1}, c.counts())
+
+	// requests older than the window are expired, along with idle peers
+	c.requests["peer1"][0] = time.Now().Add(-2 * time.Hour)
+	c.requests["peer2"][0] = time.Now().Add(-2 * time.Hour)
+	assert.Equal(t, map[string]int{"peer1": 1}, c.counts())
+	assert.Len(t, c.requests, 1)
+}
@@ -0,0 +1,60 @@
+package mailserver
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// defaultMaxLoadScale is the factor the rate limit is multiplied by at most
+// under load, unless configured otherwise.
+const defaultMaxLoadScale = 4
+
+// loadScaler tightens the rate limit of every peer while the server is
+// loaded. Once more requests than target are in flight, the rate limit grows
+// with the ratio of the requests in flight to the target, up to maxScale
+// times the static limit, and goes back to the static limit as load drops.
+type loadScaler struct {
+	target   int64
+	maxScale float64
+	load     func() int64 // requests in flight
+}
+
+// scale returns the factor the rate limit is currently multiplied by.
+func (l *loadScaler) scale() float64 {
+	load := l.load()
+	if load <= l.target {
+		return 1
+	}
+	scale := float64(load) / float64(l.target)
+	if scale > l.maxScale {
+		return l.maxScale
+	}
+	return scale
+}
+
+// setupLoadScaling tightens the rate limit when more than target requests
+// are in flight, by maxScale at most, if a rate limit has been setup on the
+// current server.
+func (s *WMailServer) setupLoadScaling(target, maxScale int) {
+	if s.limit == nil || target <= 0 {
+		return
+	}
+	if maxScale <= 1 {
+		maxScale = defaultMaxLoadScale
+	}
+	scaler := &loadScaler{
+		target:   int64(target),
+		maxScale: float64(maxScale),
+		load:     func() int64 { return atomic.LoadInt64(&s.inFlightRequests) },
+	}
+	s.limit.loadScale = scaler.scale
+}
+
+// effectiveRateLimit returns the rate limit currently applied to peers with
+// a neutral reputation, 0 if rate limiting is disabled.
+func (s *WMailServer) effectiveRateLimit() time.Duration {
+	if s.limit == nil {
+		return 0
+	}
+	return s.limit.effectiveTimeout()
+}
@@ -0,0 +1,46 @@
+package mailserver
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadScaling(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+	server.limit = newLimiter(time.Hour)
+	server.setupLoadScaling(2, 4)
+
+	testCases := []struct {
+		inFlight  int64
+		rateLimit time.Duration
+		allowed   bool
+		info      string
+	}{
+		{1, time.Hour, true, "the static limit applies below the target"},
+		{6, 3 * time.Hour, false, "a load spike tightens the rate limit"},
+		{100, 4 * time.Hour, false, "the rate limit is tightened by the maximum scale at most"},
+		{2, time.Hour, true, "the rate limit loosens as load drops"},
+	}
+	for _, tc := range testCases {
+		atomic.StoreInt64(&server.inFlightRequests, tc.inFlight)
+		require.Equal(t, tc.rateLimit, server.Stats().EffectiveRateLimit, tc.info)
+		server.limit.db["peer"] = time.Now().Add(-2 * time.Hour)
+		ok, _ := server.managePeerLimits([]byte("peer"))
+		require.Equal(t, tc.allowed, ok, tc.info)
+	}
+}
+
+func TestLoadScalingDisabled(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+	require.Zero(t, server.Stats().EffectiveRateLimit)
+
+	server.limit = newLimiter(time.Hour)
+	server.setupLoadScaling(0, 4)
+	atomic.StoreInt64(&server.inFlightRequests, 100)
+	require.Equal(t, time.Hour, server.Stats().EffectiveRateLimit)
+}
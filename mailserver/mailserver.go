@@ -17,10 +17,16 @@
 package mailserver
 
 import (
-	"encoding/binary"
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/hex"
 	"errors"
 	"fmt"
-
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -29,27 +35,137 @@ import (
 	"github.com/ethereum/go-ethereum/rlp"
 	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
 	"github.com/status-im/status-go/geth/params"
+	"github.com/status-im/status-go/timesource"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/filter"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
 	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 const (
-	maxQueryRange = 24 * time.Hour
+	maxQueryRange        = 24 * time.Hour
+	defaultQueryDeadline = 30 * time.Second
+	dbKeySize            = common.HashLength + 4
 )
 
 var (
 	errDirectoryNotProvided = errors.New("data directory not provided")
 	errPasswordNotProvided  = errors.New("password is not specified")
+	errEnvelopeTooOld       = errors.New("envelope is too old to be archived")
+	errEnvelopeTooLarge     = errors.New("envelope is too large to be archived")
+	errEnvelopeTTLTooShort  = errors.New("envelope TTL is too short to be archived")
+	errEnvelopeEmpty        = errors.New("envelope without payload not archived")
+	errEnvelopeLowPoW       = errors.New("envelope PoW is below the minimum PoW")
+	errTopicNotArchived     = errors.New("envelope topic is not archived")
+	errEnvelopeFiltered     = errors.New("envelope rejected by the archive filter")
+	errReadOnly             = errors.New("mail server is read-only")
+	errShuttingDown         = errors.New("mail server is shutting down")
+	errServerBusy           = errors.New("mail server is busy")
 )
 
+// ArchiveFilter is invoked on every envelope before it is archived. It can
+// reject the envelope by returning false, or modify it in place.
+type ArchiveFilter func(*whisper.Envelope) (bool, error)
+
 // WMailServer whisper mailserver.
 type WMailServer struct {
+	// accessed atomically, kept first for 64-bit alignment on 32-bit platforms
+	allowedRequests   int64
+	throttledRequests int64
+	inFlightRequests  int64
+	compacting        int32
+	pow               uint64 // bits of the minimum PoW, see SetMinimumPoW
+	diskFull          int32  // set while archiving is stopped for lack of disk space
+
 	db    *leveldb.DB
 	w     *whisper.Whisper
-	pow   float64
-	key   []byte
 	limit *limiter
 	tick  *ticker
+
+	topicLimit *limiter // throttles requests for the same topic across peers
+	topicTick  *ticker
+
+	requestCounts *requestCounter // rolling count of requests per peer
+
+	quota     *requestQuota // bounds the requests per peer over a long window
+	quotaTick *ticker
+
+	reputation *reputation // scales the rate limit of peers by their behavior
+
+	acks    *ackTracker // deliveries waiting to be acknowledged
+	ackTick *ticker
+
+	compactTick *ticker
+
+	diskTick     *ticker
+	minFreeSpace uint64                 // archiving stops below this many free bytes, if set
+	freeSpace    func() (uint64, error) // free bytes on the disk of the DB, for ease of testing
+
+	coldStorage  ColdStorage // holds envelopes past the hot retention, if set
+	coldTick     *ticker
+	hotRetention time.Duration // age after which envelopes are moved to the cold storage
+
+	monitor *http.Server // serves metrics and health over HTTPS, if enabled
+
+	auditLogger AuditLogger // records every request served, if set
+	tracer      Tracer      // traces the validation and processing of requests, if set
+
+	subsMu sync.RWMutex
+	subs   map[*Subscription]struct{} // consumers of newly archived envelopes
+
+	mirror        *mirror             // forwards archived envelopes to standby servers, if set
+	mirrorSources map[string]struct{} // servers whose forwarded envelopes are archived
+
+	readOnly          bool
+	futureGrace       time.Duration
+	queryDeadline     time.Duration
+	maxArchiveAge     time.Duration
+	maxEnvelope       int // maximum encoded size of an archived envelope
+	writeOptions      *opt.WriteOptions
+	tombstones        bool                  // whether pruned envelopes leave a tombstone behind
+	minTTL            time.Duration         // envelopes with a shorter TTL are not archived
+	skipEmpty         bool                  // whether envelopes without payload are not archived
+	maxQueueLength    int                   // maximum number of requests in flight, 0 means unlimited
+	scheduler         *scheduler            // orders requests beyond the maximum served at once, if set
+	openFilesBackoff  time.Duration         // time the concurrency is halved for on running out of files
+	cache             *envelopeCache        // recently archived or read envelopes, if enabled
+	signingKey        *ecdsa.PrivateKey     // signs delivered batches if set
+	errorResponses    bool                  // whether rejected requests are answered with an error
+	maxSenderScan     int                   // maximum envelopes decrypted per request to filter by sender
+	deliveryBatchSize int                   // envelopes buffered before being sent to the peer
+	deliveryPoW       bool                  // whether envelopes below the minimum PoW are withheld on delivery
+	purgeLowPoW       bool                  // whether envelopes withheld on delivery are removed
+	archiveFilter     ArchiveFilter         // ingest policy applied before archiving
+	namespace         []byte                // prefix of the archive keys, nil for the default namespace
+	timeSource        timesource.TimeSource // time.Now if nil
+	arrivalMetadata   bool                  // whether archived envelopes are stored with an arrival record
+
+	// indexMu serializes read-modify-write updates of the indexes of db,
+	// which happen on archive, on prune and on migrations.
+	indexMu sync.Mutex
+
+	keysMu sync.RWMutex
+	keys   [][]byte // candidate symmetric keys to decrypt requests
+
+	exemptMu sync.RWMutex
+	exempt   map[string]struct{} // peers skipping the rate limiter
+
+	archiveTopicsMu sync.RWMutex
+	archiveTopics   map[whisper.TopicType]struct{} // topics archived, nil for every topic
+
+	topicRewritesMu sync.RWMutex
+	topicRewrites   map[whisper.TopicType]whisper.TopicType // topics archived under another one
+
+	pauseMu        sync.Mutex
+	paused         bool                // set by PauseArchiving, envelopes are queued or rejected
+	pauseQueue     []*whisper.Envelope // envelopes received while paused
+	pauseQueueSize int                 // maximum length of pauseQueue, 0 rejects envelopes while paused
+
+	shutdownMu sync.RWMutex
+	draining   bool           // set by PrepareShutdown, new requests are rejected
+	inFlight   sync.WaitGroup // requests being served
+	writes     sync.WaitGroup // envelopes being archived
 }
 
 // DBKey key to be stored on db.
@@ -59,16 +175,10 @@ type DBKey struct {
 	raw       []byte
 }
 
-// NewDbKey creates a new DBKey with the given values.
+// NewDbKey creates a new DBKey with the given values in the default
+// namespace.
 func NewDbKey(t uint32, h common.Hash) *DBKey {
-	const sz = common.HashLength + 4
-	var k DBKey
-	k.timestamp = t
-	k.hash = h
-	k.raw = make([]byte, sz)
-	binary.BigEndian.PutUint32(k.raw, k.timestamp)
-	copy(k.raw[4:], k.hash[:])
-	return &k
+	return NewNamespacedDbKey(nil, t, h)
 }
 
 // Init initializes mailServer.
@@ -83,22 +193,157 @@ func (s *WMailServer) Init(shh *whisper.Whisper, config *params.WhisperConfig) e
 		return errPasswordNotProvided
 	}
 
-	s.db, err = leveldb.OpenFile(config.DataDir, nil)
+	s.readOnly = config.MailServerReadOnly
+	options := &opt.Options{ReadOnly: s.readOnly}
+	if config.MailServerBloomFilterBits > 0 {
+		// speeds up point lookups of keys missing from the DB
+		options.Filter = filter.NewBloomFilter(config.MailServerBloomFilterBits)
+	}
+	s.db, err = openDB(config.DataDir, options, config.MailServerOpenRetries, openRetryDelay)
 	if err != nil {
 		return fmt.Errorf("open DB: %s", err)
 	}
+	if err := migrate(s.db, &s.indexMu, s.readOnly); err != nil {
+		return fmt.Errorf("migrate DB: %s", err)
+	}
+	if err := checkKeyFormat(s.db, s.readOnly); err != nil {
+		return fmt.Errorf("check DB key format: %s", err)
+	}
 
 	s.w = shh
-	s.pow = config.MinimumPoW
+	s.setMinimumPoW(config.MinimumPoW)
+	s.futureGrace = time.Duration(config.MailServerFutureGrace) * time.Second
+	s.queryDeadline = time.Duration(config.MailServerQueryDeadline) * time.Second
+	if s.queryDeadline == 0 {
+		s.queryDeadline = defaultQueryDeadline
+	}
+	s.maxArchiveAge = time.Duration(config.MailServerMaxArchiveAge) * time.Second
+	s.minTTL = time.Duration(config.MailServerMinTTL) * time.Second
+	s.skipEmpty = config.MailServerSkipEmptyEnvelopes
+	s.arrivalMetadata = config.MailServerArrivalMetadata
+	s.maxEnvelope = config.MailServerMaxEnvelopeSize
+	if s.maxEnvelope == 0 {
+		s.maxEnvelope = int(whisper.MaxMessageSize)
+	}
+	s.writeOptions = &opt.WriteOptions{Sync: config.MailServerSyncWrites}
+	s.tombstones = config.MailServerTombstones
+	s.maxQueueLength = config.MailServerMaxQueueLength
+	if config.MailServerMaxConcurrentRequests > 0 {
+		s.scheduler = newScheduler(config.MailServerMaxConcurrentRequests)
+	}
+	s.openFilesBackoff = time.Duration(config.MailServerOpenFilesBackoff) * time.Second
+	s.errorResponses = config.MailServerErrorResponses
+	s.maxSenderScan = config.MailServerMaxSenderScan
+	s.namespace = newNamespace(config.MailServerNamespace)
+	s.hotRetention = time.Duration(config.MailServerHotRetention) * time.Second
+	s.pauseQueueSize = config.MailServerPauseQueueSize
+	if !config.MailServerSkipHashIndexCheck {
+		if err := s.checkHashIndex(); err != nil {
+			return fmt.Errorf("check hash index: %s", err)
+		}
+	}
+	if config.MailServerCacheEntries > 0 || config.MailServerCacheBytes > 0 {
+		s.cache = newEnvelopeCache(config.MailServerCacheEntries, config.MailServerCacheBytes)
+	}
+	s.deliveryPoW = config.MailServerDeliveryPoWCheck
+	s.purgeLowPoW = config.MailServerPurgeLowPoW
+	s.deliveryBatchSize = config.MailServerDeliveryBatchSize
+	if s.deliveryBatchSize == 0 {
+		s.deliveryBatchSize = defaultDeliveryBatchSize
+	}
 
 	if err := s.setupWhisperIdentity(config); err != nil {
 		return err
 	}
-	s.setupLimiter(time.Duration(config.MailServerRateLimit) * time.Second)
+	if config.MailServerDisableRateLimit {
+		// no limiter is set up, so peers are never tracked
+		log.Info("Mail server rate limiting disabled")
+	} else {
+		s.setupLimiter(time.Duration(config.MailServerRateLimit) * time.Second)
+		if s.limit != nil {
+			s.limit.jitter = config.MailServerRateLimitJitter
+			s.limit.maxEntries = config.MailServerRateLimitMaxPeers
+		}
+		s.setupLoadScaling(config.MailServerLoadTarget, config.MailServerMaxLoadScale)
+		s.setupTopicLimiter(time.Duration(config.MailServerTopicRateLimit) * time.Second)
+	}
+	if config.MailServerPeerReputation {
+		s.setupReputation(config.MailServerRateLimitMaxPeers)
+	}
+	s.setupRequestQuota(config.MailServerRequestQuota,
+		time.Duration(config.MailServerRequestQuotaWindow)*time.Second, config.MailServerRequestQuotaCalendar,
+		time.Duration(config.MailServerRequestQuotaSweepPeriod)*time.Second)
+	if window := time.Duration(config.MailServerRequestCountWindow) * time.Second; window > 0 {
+		s.requestCounts = newRequestCounter(window)
+	}
+	if timeout := time.Duration(config.MailServerAckTimeout) * time.Second; timeout > 0 {
+		s.acks = newAckTracker(timeout)
+		s.ackTick = &ticker{}
+		s.ackTick.run(timeout, s.acks.deleteExpired)
+	}
+	s.setupCompaction(time.Duration(config.MailServerCompactionPeriod) * time.Second)
+	s.setupDiskSpaceMonitor(config.DataDir, uint64(config.MailServerMinFreeDiskSpace)<<20)
+	if config.MailServerMonitoringAddr != "" {
+		err := s.startMonitoring(config.MailServerMonitoringAddr,
+			config.MailServerMonitoringCertFile, config.MailServerMonitoringKeyFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !s.readOnly {
+		if err := s.setupMirror(config.MailServerMirrorPeers, config.MailServerMirrorQueueSize); err != nil {
+			return err
+		}
+	}
+	if err := s.setupMirrorSources(config.MailServerMirrorSources); err != nil {
+		return err
+	}
+	topics, err := decodeTopics(config.MailServerArchiveTopics)
+	if err != nil {
+		return err
+	}
+	s.SetArchiveTopics(topics)
+	rewrites, err := decodeTopicRewrites(config.MailServerTopicRewrites)
+	if err != nil {
+		return err
+	}
+	if len(rewrites) > 0 {
+		log.Info("Mail server rewrites envelope topics on archive", "rewrites", len(rewrites))
+	}
+	s.SetTopicRewrites(rewrites)
+
+	for _, id := range config.MailServerRateLimitExemptions {
+		peerID, err := hex.DecodeString(strings.TrimPrefix(id, "0x"))
+		if err != nil {
+			return fmt.Errorf("invalid rate limit exemption %s: %s", id, err)
+		}
+		s.ExemptPeer(peerID)
+	}
 
 	return nil
 }
 
+// checkHashIndex repairs the hash index of the archive, only reporting the
+// repairs needed if read-only.
+func (s *WMailServer) checkHashIndex() error {
+	var coldCutoff uint32
+	if s.hotRetention > 0 {
+		coldCutoff = uint32(s.now().Add(-s.hotRetention).Unix())
+	}
+	start := time.Now()
+	repairs, err := checkHashIndex(s.db, &s.indexMu, coldCutoff, !s.readOnly)
+	if err != nil {
+		return err
+	}
+	if repairs > 0 {
+		hashIndexRepairCounter.Inc(int64(repairs))
+		log.Warn("Hash index inconsistent with the archive", "repairs", repairs, "repaired", !s.readOnly)
+	}
+	log.Info("Checked hash index", "repairs", repairs, "duration", time.Since(start))
+	return nil
+}
+
 // setupLimiter in case limit is bigger than 0 it will setup an automated
 // limit db cleanup.
 func (s *WMailServer) setupLimiter(rateLimit time.Duration) {
@@ -109,6 +354,16 @@ func (s *WMailServer) setupLimiter(rateLimit time.Duration) {
 	}
 }
 
+// setupTopicLimiter in case limit is bigger than 0 it will setup a per-topic
+// limiter along with an automated cleanup of its db.
+func (s *WMailServer) setupTopicLimiter(limit time.Duration) {
+	if limit > 0 {
+		s.topicLimit = newLimiter(limit)
+		s.topicTick = &ticker{}
+		s.topicTick.run(limit, s.topicLimit.deleteExpired)
+	}
+}
+
 // setupWhisperIdentity setup the whisper identity (symkey) for the current mail
 // server.
 func (s *WMailServer) setupWhisperIdentity(config *params.WhisperConfig) error {
@@ -117,46 +372,417 @@ func (s *WMailServer) setupWhisperIdentity(config *params.WhisperConfig) error {
 		return fmt.Errorf("create symmetric key: %s", err)
 	}
 
-	s.key, err = s.w.GetSymKey(MailServerKeyID)
+	key, err := s.w.GetSymKey(MailServerKeyID)
 	if err != nil {
 		return fmt.Errorf("save symmetric key: %s", err)
 	}
+	s.AddSymKey(key)
 
 	return nil
 }
 
+// AddSymKey adds a symmetric key to the set of keys tried when decrypting
+// incoming requests. It allows clients using different passwords to be served.
+func (s *WMailServer) AddSymKey(key []byte) {
+	s.keysMu.Lock()
+	defer s.keysMu.Unlock()
+
+	for _, k := range s.keys {
+		if bytes.Equal(k, key) {
+			return
+		}
+	}
+	s.keys = append(s.keys, key)
+}
+
+// RemoveSymKey removes a symmetric key from the set of keys tried when
+// decrypting incoming requests. It returns false if the key was not found.
+func (s *WMailServer) RemoveSymKey(key []byte) bool {
+	s.keysMu.Lock()
+	defer s.keysMu.Unlock()
+
+	for i, k := range s.keys {
+		if bytes.Equal(k, key) {
+			s.keys = append(s.keys[:i], s.keys[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// SetMinimumPoW sets the minimum PoW of requests and archived envelopes, e.g.
+// to raise it during a spam attack without a restart. Envelopes archived
+// before are only affected if delivery PoW checks are enabled. The minimum
+// PoW of whisper is updated too, so that peers are notified of it.
+func (s *WMailServer) SetMinimumPoW(pow float64) error {
+	if pow < 0 {
+		return fmt.Errorf("invalid PoW: %f", pow)
+	}
+	s.setMinimumPoW(pow)
+	if s.w != nil {
+		return s.w.SetMinimumPoW(pow)
+	}
+	return nil
+}
+
+func (s *WMailServer) setMinimumPoW(pow float64) {
+	atomic.StoreUint64(&s.pow, math.Float64bits(pow))
+}
+
+func (s *WMailServer) minimumPoW() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&s.pow))
+}
+
 // setupMailServerCleanup periodically runs an expired entries deleteion for
 // stored limits.
 func (s *WMailServer) setupMailServerCleanup(period time.Duration) {
 	if s.tick == nil {
 		s.tick = &ticker{}
 	}
-	go s.tick.run(period, s.limit.deleteExpired)
+	s.tick.run(period, s.limit.deleteExpired)
 }
 
-// Close the mailserver and its associated db connection.
+// write stores a raw envelope and updates the topic and sequence indexes
+// accordingly.
+func (s *WMailServer) write(key, rawEnvelope []byte, topic whisper.TopicType, arrival []byte) error {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	batch := new(leveldb.Batch)
+	batch.Put(key, rawEnvelope)
+
+	// an envelope archived again over its tombstone is counted anew
+	existing, err := s.db.Get(key, nil)
+	if err != nil && err != leveldb.ErrNotFound {
+		return err
+	}
+	if err == leveldb.ErrNotFound {
+		// an envelope moved to the cold storage is still in the hash index
+		// and is kept there, instead of being counted and sequenced again
+		keys, err := readHashKeys(s.db, hashIndexKey(envelopeKeyHash(key)))
+		if err != nil {
+			return err
+		}
+		if containsKey(keys, key) {
+			return nil
+		}
+	}
+	if err == leveldb.ErrNotFound || isTombstone(existing) {
+		counts := topicCounts{}
+		counts.add(key, topic, 1)
+		if err := counts.write(s.db, batch); err != nil {
+			return err
+		}
+		if err := s.writeSequence(batch, key); err != nil {
+			return err
+		}
+		if arrival != nil {
+			batch.Put(arrivalKey(key), arrival)
+		}
+	}
+	if err := updateTopicSizes(s.db, batch); err != nil {
+		return err
+	}
+	if err := updateHashIndex(s.db, batch); err != nil {
+		return err
+	}
+
+	return s.db.Write(batch, s.writeOptions)
+}
+
+// Stats describes the current state of the mail server.
+type Stats struct {
+	ReadOnly          bool  // whether archiving is disabled
+	AllowedRequests   int64 // requests let through by the rate limiter
+	ThrottledRequests int64 // requests rejected by the rate limiter
+	InFlightRequests  int64 // requests being served
+	Draining          bool  // whether new requests are rejected
+	PendingAcks       int   // deliveries waiting to be acknowledged
+	ArchivingPaused   bool  // whether archiving is paused
+	PausedEnvelopes   int   // envelopes queued while archiving is paused
+	DiskFull          bool  // whether archiving is stopped as the disk is nearly full
+
+	EffectiveRateLimit time.Duration // rate limit currently applied, tightened under load
+
+	TopicSizes map[whisper.TopicType]int64 // approximate bytes archived per topic
+}
+
+// Stats returns a snapshot of the mail server state.
+func (s *WMailServer) Stats() Stats {
+	stats := Stats{
+		ReadOnly:          s.readOnly,
+		AllowedRequests:   atomic.LoadInt64(&s.allowedRequests),
+		ThrottledRequests: atomic.LoadInt64(&s.throttledRequests),
+		InFlightRequests:  atomic.LoadInt64(&s.inFlightRequests),
+		Draining:          s.isDraining(),
+		DiskFull:          s.isDiskFull(),
+
+		EffectiveRateLimit: s.effectiveRateLimit(),
+	}
+	stats.ArchivingPaused, stats.PausedEnvelopes = s.pauseState()
+	if s.acks != nil {
+		stats.PendingAcks = s.acks.len()
+	}
+	if s.db != nil {
+		sizes, err := s.TopicSizes()
+		if err != nil {
+			log.Warn("Failed to read topic sizes", "error", err)
+		}
+		stats.TopicSizes = sizes
+	}
+	return stats
+}
+
+// PrepareShutdown stops accepting new requests while the ones in flight
+// keep being served, so the server can be drained before it is closed.
+func (s *WMailServer) PrepareShutdown() {
+	s.shutdownMu.Lock()
+	s.draining = true
+	s.shutdownMu.Unlock()
+}
+
+func (s *WMailServer) isDraining() bool {
+	s.shutdownMu.RLock()
+	defer s.shutdownMu.RUnlock()
+	return s.draining
+}
+
+// startRequest registers a new request in flight. It fails if the server
+// is draining or if too many requests are already queued.
+func (s *WMailServer) startRequest() error {
+	s.shutdownMu.RLock()
+	defer s.shutdownMu.RUnlock()
+	if s.draining {
+		return errShuttingDown
+	}
+
+	inFlight := atomic.AddInt64(&s.inFlightRequests, 1)
+	if s.maxQueueLength > 0 && inFlight > int64(s.maxQueueLength) {
+		atomic.AddInt64(&s.inFlightRequests, -1)
+		requestBusyCounter.Inc(1)
+		return errServerBusy
+	}
+	s.inFlight.Add(1)
+	inFlightRequestsGauge.Update(inFlight)
+	return nil
+}
+
+// startWrite registers an archive write in progress. It fails if the server
+// is draining.
+func (s *WMailServer) startWrite() error {
+	s.shutdownMu.RLock()
+	defer s.shutdownMu.RUnlock()
+	if s.draining {
+		return errShuttingDown
+	}
+	s.writes.Add(1)
+	return nil
+}
+
+func (s *WMailServer) finishRequest() {
+	inFlightRequestsGauge.Update(atomic.AddInt64(&s.inFlightRequests, -1))
+	s.inFlight.Done()
+}
+
+// Close the mailserver and its associated db connection. It archives the
+// envelopes queued while paused, stops accepting requests and envelopes,
+// waits for those in flight, then stops the periodic jobs and closes the
+// subscriptions before closing the DB, so that nothing uses the DB once
+// closed.
 func (s *WMailServer) Close() {
+	log.Info("Mail server shutdown: archiving envelopes queued while paused")
+	s.ResumeArchiving()
+
+	log.Info("Mail server shutdown: rejecting new requests and envelopes")
+	s.PrepareShutdown()
+
+	log.Info("Mail server shutdown: waiting for requests in flight",
+		"requests", atomic.LoadInt64(&s.inFlightRequests))
+	s.inFlight.Wait()
+
+	log.Info("Mail server shutdown: waiting for pending archive writes")
+	s.writes.Wait()
+
+	log.Info("Mail server shutdown: stopping periodic jobs")
+	for _, t := range []*ticker{s.tick, s.topicTick, s.quotaTick, s.ackTick, s.compactTick, s.coldTick, s.diskTick} {
+		if t != nil {
+			t.stop()
+		}
+	}
+
+	if s.mirror != nil {
+		log.Info("Mail server shutdown: stopping mirroring")
+		s.mirror.stop()
+	}
+
+	log.Info("Mail server shutdown: closing subscriptions")
+	s.closeSubscriptions()
+
+	log.Info("Mail server shutdown: stopping monitoring endpoint")
+	s.stopMonitoring()
+
+	log.Info("Mail server shutdown: closing DB")
 	if s.db != nil {
 		if err := s.db.Close(); err != nil {
 			log.Error(fmt.Sprintf("s.db.Close failed: %s", err))
 		}
 	}
-	if s.tick != nil {
-		s.tick.stop()
+}
+
+// SetArchiveFilter sets the filter applied to envelopes before they are
+// archived. A nil filter archives every envelope.
+func (s *WMailServer) SetArchiveFilter(filter ArchiveFilter) {
+	s.archiveFilter = filter
+}
+
+// SetTimeSource sets the source of the current time used to check the age
+// of archived envelopes and the time range of requests, e.g. synced with
+// ntp servers. The system clock is used by default. It must be called
+// before Init, which already reads the time and starts the periodic jobs.
+func (s *WMailServer) SetTimeSource(timeSource timesource.TimeSource) {
+	s.timeSource = timeSource
+}
+
+// now returns the current time of the time source.
+func (s *WMailServer) now() time.Time {
+	if s.timeSource != nil {
+		return s.timeSource.Now()
 	}
+	return time.Now()
 }
 
 // Archive a whisper envelope.
 func (s *WMailServer) Archive(env *whisper.Envelope) {
-	key := NewDbKey(env.Expiry-env.TTL, env.Hash())
+	if err := s.archive(env); err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// archive validates and stores a whisper envelope.
+func (s *WMailServer) archive(env *whisper.Envelope) error {
+	return s.archiveFrom(nil, env)
+}
+
+// archiveFrom validates and stores a whisper envelope delivered by the given
+// peer, nil if unknown. Envelopes queued while archiving is paused are
+// archived without their peer.
+func (s *WMailServer) archiveFrom(peer []byte, env *whisper.Envelope) error {
+	if s.readOnly {
+		return errReadOnly
+	}
+	if s.isDiskFull() {
+		archiveDiskFullCounter.Inc(1)
+		return errDiskFull
+	}
+	if queued, err := s.holdWhilePaused(env); queued || err != nil {
+		return err
+	}
+	if err := s.startWrite(); err != nil {
+		return err
+	}
+	defer s.writes.Done()
+
+	sent := env.Expiry - env.TTL
+	if s.maxArchiveAge > 0 && time.Unix(int64(sent), 0).Add(s.maxArchiveAge).Before(s.now()) {
+		archiveTooOldCounter.Inc(1)
+		return errEnvelopeTooOld
+	}
+	// envelopes meant to vanish quickly are not meant for history
+	if s.minTTL > 0 && time.Duration(env.TTL)*time.Second < s.minTTL {
+		archiveShortTTLCounter.Inc(1)
+		return errEnvelopeTTLTooShort
+	}
+	if s.skipEmpty && len(env.Data) == 0 {
+		archiveEmptyCounter.Inc(1)
+		return errEnvelopeEmpty
+	}
+	if pow := s.minimumPoW(); pow > 0 && env.PoW() < pow {
+		archiveLowPoWCounter.Inc(1)
+		return errEnvelopeLowPoW
+	}
+	received := env
+	env = s.rewriteTopic(env)
+	if !s.isArchivedTopic(env.Topic) {
+		archiveTopicCounter.Inc(1)
+		return errTopicNotArchived
+	}
+
+	if s.archiveFilter != nil {
+		ok, err := s.archiveFilter(env)
+		if err != nil {
+			return fmt.Errorf("archive filter failed: %s", err)
+		}
+		if !ok {
+			archiveFilteredCounter.Inc(1)
+			return errEnvelopeFiltered
+		}
+	}
+
+	key := NewNamespacedDbKey(s.namespace, sent, env.Hash())
 	rawEnvelope, err := rlp.EncodeToBytes(env)
 	if err != nil {
-		log.Error(fmt.Sprintf("rlp.EncodeToBytes failed: %s", err))
-	} else {
-		if err = s.db.Put(key.raw, rawEnvelope, nil); err != nil {
-			log.Error(fmt.Sprintf("Writing to DB failed: %s", err))
-		}
+		return fmt.Errorf("rlp.EncodeToBytes failed: %s", err)
+	}
+	if s.maxEnvelope > 0 && len(rawEnvelope) > s.maxEnvelope {
+		archiveTooLargeCounter.Inc(1)
+		return errEnvelopeTooLarge
+	}
+	arrival, err := s.encodeArrival(peer, received)
+	if err != nil {
+		return fmt.Errorf("failed to encode arrival metadata: %s", err)
 	}
+	start := time.Now()
+	if err = s.write(key.raw, rawEnvelope, env.Topic, arrival); err != nil {
+		return fmt.Errorf("Writing to DB failed: %s", err)
+	}
+	archiveWriteTimer.UpdateSince(start)
+	if s.cache != nil {
+		s.cache.add(key.raw, env, len(rawEnvelope))
+	}
+	s.notifySubscribers(env)
+
+	return nil
+}
+
+// DeleteRange removes every archived envelope sent between from and to, both
+// inclusive, and returns how many have been removed. If tombstones are
+// enabled, the keys of the removed envelopes are kept.
+func (s *WMailServer) DeleteRange(from, to time.Time) (int, error) {
+	if s.readOnly {
+		return 0, errReadOnly
+	}
+
+	return s.newCleaner().Prune(uint32(from.Unix()), uint32(to.Unix())+1)
+}
+
+// DeleteVersion removes every archived envelope of the given whisper version
+// sent between from and to, both inclusive, and returns how many have been
+// removed, e.g. to get rid of envelopes carried over from whisper v5.
+func (s *WMailServer) DeleteVersion(from, to time.Time, version uint) (int, error) {
+	if s.readOnly {
+		return 0, errReadOnly
+	}
+
+	return s.newCleaner().PruneVersion(uint32(from.Unix()), uint32(to.Unix())+1, version)
+}
+
+// SweepTombstones removes the tombstones of envelopes sent between from and
+// to, both inclusive, and returns how many have been removed.
+func (s *WMailServer) SweepTombstones(from, to time.Time) (int, error) {
+	if s.readOnly {
+		return 0, errReadOnly
+	}
+
+	return s.newCleaner().SweepTombstones(uint32(from.Unix()), uint32(to.Unix())+1)
+}
+
+// newCleaner returns a cleaner for the archive of the server.
+func (s *WMailServer) newCleaner() *Cleaner {
+	c := NewCleanerWithDB(s.db)
+	c.indexMu = &s.indexMu
+	c.tombstones = s.tombstones
+	c.namespace = s.namespace
+	return c
 }
 
 // DeliverMail sends mail to specified whisper peer.
@@ -165,101 +791,565 @@ func (s *WMailServer) DeliverMail(peer *whisper.Peer, request *whisper.Envelope)
 		log.Error("Whisper peer is nil")
 		return
 	}
-	s.managePeerLimits(peer.ID())
+	// envelopes forwarded by a mirrored server are not requests
+	if s.isMirrorSource(peer.ID()) {
+		s.Archive(request)
+		return
+	}
+	if err := s.startRequest(); err != nil {
+		log.Debug("Rejected p2p request", "peer", peer.ID(), "error", err)
+		return
+	}
+	defer s.finishRequest()
+
+	r, requestErr := s.checkRequestTraced(peer.ID(), request)
+	if requestErr != nil {
+		log.Warn(requestErr.Message)
+		if isMalformedRequest(requestErr) {
+			s.updateReputation(peer.ID(), reputationMalformedRequest)
+		}
+		s.sendRequestError(peer, request, r, requestErr)
+		return
+	}
+
+	// acks are not queries and are not rate limited
+	if r.ack != nil {
+		if s.acks == nil || !s.acks.ack(*r.ack, peer.ID()) {
+			log.Debug("Unexpected delivery ack", "peer", peer.ID(), "request", *r.ack)
+		}
+		return
+	}
 
-	if ok, lower, upper, bloom := s.validateRequest(peer.ID(), request); ok {
-		s.processRequest(peer, lower, upper, bloom)
+	if ok, retryAfter := s.managePeerLimits(peer.ID()); !ok {
+		log.Debug("Throttled p2p request", "peer", peer.ID(), "retryAfter", retryAfter)
+		s.sendRequestError(peer, request, r, &RequestError{
+			Code:       ErrorCodeRateLimited,
+			Message:    "rate limit exceeded",
+			RetryAfter: retryAfterSeconds(retryAfter),
+		})
+		return
+	}
+	if ok, retryAfter := s.manageTopicLimits(peer.ID(), r); !ok {
+		log.Debug("Throttled p2p request for hot topics", "peer", peer.ID(), "retryAfter", retryAfter)
+		s.sendRequestError(peer, request, r, &RequestError{
+			Code:       ErrorCodeRateLimited,
+			Message:    "topic rate limit exceeded",
+			RetryAfter: retryAfterSeconds(retryAfter),
+		})
+		return
+	}
+	if ok, retryAfter := s.manageRequestQuota(peer.ID()); !ok {
+		log.Debug("Rejected p2p request over quota", "peer", peer.ID(), "retryAfter", retryAfter)
+		s.updateReputation(peer.ID(), reputationOverQuota)
+		s.sendRequestError(peer, request, r, &RequestError{
+			Code:       ErrorCodeQuotaExceeded,
+			Message:    "request quota exceeded",
+			RetryAfter: retryAfterSeconds(retryAfter),
+		})
+		return
 	}
+
+	if s.scheduler != nil {
+		s.scheduler.acquire(s.requestCost(r))
+		defer s.scheduler.release()
+	}
+
+	result := s.serveRequest(peer, r)
+	s.audit(peer.ID(), r, result)
+	s.updateReputation(peer.ID(), reputationValidRequest)
+	log.Debug("Processed p2p request", "peer", peer.ID(), "delivered", result.Delivered,
+		"bytes", result.Bytes, "scanned", result.Scanned, "truncated", result.Truncated,
+		"duration", result.Duration)
 }
 
 // managePeerLimits in case limit its been setup on the current server and limit
 // allows the query, it will store/update new query time for the current peer.
-func (s *WMailServer) managePeerLimits(peer []byte) {
-	if s.limit != nil {
-		peerID := string(peer)
-		if !s.limit.isAllowed(peerID) {
-			log.Info("peerID exceeded the number of requests per second")
-			return
+// It returns false if the peer is being throttled, along with a suggested
+// duration to wait before retrying.
+func (s *WMailServer) managePeerLimits(peer []byte) (bool, time.Duration) {
+	if s.requestCounts != nil {
+		s.requestCounts.add(hex.EncodeToString(peer))
+	}
+
+	if s.limit == nil || s.isExempt(peer) {
+		s.countRequest(true)
+		return true, 0
+	}
+
+	peerID := string(peer)
+	if !s.limit.isAllowed(peerID) {
+		log.Info("peerID exceeded the number of requests per second")
+		s.countRequest(false)
+		return false, s.limit.retryAfter(peerID)
+	}
+	s.limit.add(peerID)
+	s.countRequest(true)
+	return true, 0
+}
+
+// RequestCounts returns the number of requests received from every peer,
+// keyed by hex-encoded peer ID, within the window set by
+// MailServerRequestCountWindow. It returns nil if counting is disabled.
+func (s *WMailServer) RequestCounts() map[string]int {
+	if s.requestCounts == nil {
+		return nil
+	}
+	return s.requestCounts.counts()
+}
+
+// ThrottledPeers returns the IDs of the peers currently held back by the
+// rate limiter, i.e. whose next request would be rejected.
+func (s *WMailServer) ThrottledPeers() [][]byte {
+	if s.limit == nil {
+		return nil
+	}
+
+	var peers [][]byte
+	for _, id := range s.limit.active() {
+		peers = append(peers, []byte(id))
+	}
+	return peers
+}
+
+// manageTopicLimits checks the exact topics of a request against the
+// per-topic limiter, if it has been setup on the current server. A request
+// is allowed only if none of its topics was requested recently by any peer.
+// Requests relying on the bloom filter alone cannot be attributed to topics
+// and are always allowed. Throttled requests are returned the time left
+// until all of their throttled topics are allowed again.
+func (s *WMailServer) manageTopicLimits(peer []byte, r *messagesRequest) (bool, time.Duration) {
+	if s.topicLimit == nil || s.isExempt(peer) {
+		return true, 0
+	}
+
+	topics := append(append([]whisper.TopicType(nil), r.topics...), r.all...)
+	var (
+		allowed    = true
+		retryAfter time.Duration
+	)
+	for _, topic := range topics {
+		if !s.topicLimit.isAllowed(string(topic[:])) {
+			allowed = false
+			if wait := s.topicLimit.retryAfter(string(topic[:])); wait > retryAfter {
+				retryAfter = wait
+			}
 		}
-		s.limit.add(peerID)
 	}
+	if !allowed {
+		requestTopicThrottledCounter.Inc(1)
+		return false, retryAfter
+	}
+
+	for _, topic := range topics {
+		s.topicLimit.add(string(topic[:]))
+	}
+	return true, 0
+}
+
+// retryAfterSeconds converts a suggested wait to the whole seconds sent to
+// peers, rounding up so that peers retrying on time are not rejected again.
+func retryAfterSeconds(d time.Duration) uint64 {
+	if d <= 0 {
+		return 0
+	}
+	return uint64((d + time.Second - 1) / time.Second)
+}
+
+func (s *WMailServer) countRequest(allowed bool) {
+	if allowed {
+		atomic.AddInt64(&s.allowedRequests, 1)
+		requestAllowedCounter.Inc(1)
+	} else {
+		atomic.AddInt64(&s.throttledRequests, 1)
+		requestThrottledCounter.Inc(1)
+	}
+}
+
+// ExemptPeer excludes a peer from rate limiting, e.g. a trusted monitoring
+// or bridge node.
+func (s *WMailServer) ExemptPeer(peerID []byte) {
+	s.exemptMu.Lock()
+	defer s.exemptMu.Unlock()
+
+	if s.exempt == nil {
+		s.exempt = make(map[string]struct{})
+	}
+	s.exempt[string(peerID)] = struct{}{}
+}
+
+// UnexemptPeer subjects a previously exempted peer to rate limiting again.
+func (s *WMailServer) UnexemptPeer(peerID []byte) {
+	s.exemptMu.Lock()
+	defer s.exemptMu.Unlock()
+
+	delete(s.exempt, string(peerID))
+}
+
+func (s *WMailServer) isExempt(peerID []byte) bool {
+	s.exemptMu.RLock()
+	defer s.exemptMu.RUnlock()
+
+	_, ok := s.exempt[string(peerID)]
+	return ok
 }
 
 // processRequest processes the current request and re-sends all stored messages
 // accomplishing lower and upper limits.
-func (s *WMailServer) processRequest(peer *whisper.Peer, lower, upper uint32, bloom []byte) []*whisper.Envelope {
+func (s *WMailServer) processRequest(peer *whisper.Peer, r *messagesRequest) ([]*whisper.Envelope, RequestResult) {
 	ret := make([]*whisper.Envelope, 0)
-	var err error
+	var (
+		hashes      []common.Hash
+		descriptors []EnvelopeDescriptor
+		out         = s.newDeliverer(peer, r, &ret)
+	)
+	result, err := s.processRequestStreamRetrying(r, func(envelope *whisper.Envelope) error {
+		if r.countOnly {
+			return nil
+		}
+		if s.signingKey != nil || r.compound {
+			hashes = append(hashes, envelope.Hash())
+		}
+		if r.metadataOnly {
+			raw, err := rlp.EncodeToBytes(envelope)
+			if err != nil {
+				return err
+			}
+			descriptor := newEnvelopeDescriptor(envelope, len(raw))
+			if r.arrival {
+				key := NewNamespacedDbKey(s.namespace, envelope.Expiry-envelope.TTL, envelope.Hash())
+				arrival, err := s.readArrival(key.raw)
+				if err != nil {
+					return fmt.Errorf("failed to read arrival metadata: %s", err)
+				}
+				if arrival != nil {
+					descriptor.Arrival = []Arrival{*arrival}
+				}
+			}
+			descriptors = append(descriptors, descriptor)
+			return nil
+		}
+		if err := out.add(envelope); err != nil {
+			return fmt.Errorf("Failed to send direct message to peer: %s", err)
+		}
+		return nil
+	})
+	switch {
+	case err != nil:
+	case r.countOnly:
+		ret, err = s.sendMatchCount(peer, r, result)
+	case r.metadataOnly:
+		ret, err = s.sendDescriptors(peer, r, descriptors)
+	default:
+		if err = out.flush(); err != nil {
+			err = fmt.Errorf("Failed to send direct message to peer: %s", err)
+		}
+	}
+	if err == nil && r.compound && peer != nil {
+		err = s.sendQueryResult(peer, r, hashes, result)
+	}
+	if err == nil && s.signingKey != nil && peer != nil && !r.countOnly {
+		err = s.sendBatchProof(peer, r, hashes)
+	}
+	if err != nil {
+		log.Error(err.Error())
+		return nil, result
+	}
+	if s.acks != nil && r.expectAck && peer != nil && !r.countOnly {
+		s.acks.expect(r.hash, peer.ID(), result.Delivered)
+	}
+
+	return ret, result
+}
+
+// sendDescriptors sends the peer the descriptors of the matching envelopes.
+// Without a peer, the messages are returned instead.
+func (s *WMailServer) sendDescriptors(peer *whisper.Peer, r *messagesRequest, descriptors []EnvelopeDescriptor) ([]*whisper.Envelope, error) {
+	messages, err := s.newDescriptorMessages(r, descriptors)
+	if err != nil || peer == nil {
+		// used for test purposes
+		return messages, err
+	}
+	for _, message := range messages {
+		if err := s.w.SendP2PDirect(peer, message); err != nil {
+			return nil, fmt.Errorf("Failed to send envelope descriptors to peer: %s", err)
+		}
+	}
+	return nil, nil
+}
+
+// sendBatchProof sends the peer a signed proof of the delivered batch.
+func (s *WMailServer) sendBatchProof(peer *whisper.Peer, r *messagesRequest, hashes []common.Hash) error {
+	proof, err := s.newBatchProof(r, hashes)
+	if err != nil {
+		return err
+	}
+	if err := s.w.SendP2PDirect(peer, proof); err != nil {
+		return fmt.Errorf("Failed to send batch proof to peer: %s", err)
+	}
+	return nil
+}
+
+// processRequestStream scans stored messages accomplishing lower and upper
+// limits and calls fn for every one matching the request, without collecting
+// them in memory. The scan stops at the first error returned by fn.
+//
+// Envelopes are delivered in key order unless the request asks for topic
+// order, in which case those sent in the same second are only delivered once
+// all of them are found. Responses are then only truncated between seconds,
+// so that cursors stay valid, and may exceed the limit of the request by the
+// envelopes sent in the same second as the last one.
+func (s *WMailServer) processRequestStream(r *messagesRequest, fn func(*whisper.Envelope) error) (result RequestResult, err error) {
+	start := time.Now()
+	defer func() { result.Duration = time.Since(start) }()
+	if r.newestPerTopic {
+		return s.processNewestPerTopic(r, fn)
+	}
+
 	var zero common.Hash
-	kl := NewDbKey(lower, zero)
-	ku := NewDbKey(upper, zero)
-	i := s.db.NewIterator(&util.Range{Start: kl.raw, Limit: ku.raw}, nil)
+	kl := NewNamespacedDbKey(s.namespace, r.lower, zero)
+	ku := NewNamespacedDbKey(s.namespace, r.scanLimit(), zero)
+	i, err := s.newRangeIterator(&util.Range{Start: kl.raw, Limit: ku.raw})
+	if err != nil {
+		return result, err
+	}
 	defer i.Release()
 
-	for i.Next() {
-		var envelope whisper.Envelope
-		err = rlp.DecodeBytes(i.Value(), &envelope)
-		if err != nil {
+	next := i.First
+	if after := r.startAfter(); after != nil {
+		next = func() bool { return seekAfter(i, s.namespacedKey(after)) }
+	}
+
+	var (
+		lastKey []byte // last scanned key
+		opened  int    // envelopes decrypted to recover their sender
+		lowPoW  lowPoWEnvelopes
+		pow     = s.minimumPoW()
+		group   topicOrderGroup // envelopes of the current second, in topic order
+	)
+	defer func() { s.removeLowPoW(lowPoW) }()
+	topic, singleTopic := r.singleTopic()
+	for ok := next(); ok; ok = i.Next() {
+		if !isEnvelopeKey(i.Key()) || isTombstone(i.Value()) {
+			continue
+		}
+		// an envelope being moved to the cold storage can be seen in both tiers
+		if bytes.Equal(i.Key(), lastKey) {
+			continue
+		}
+		if r.topicOrder && group.sent != keySentTime(i.Key()) {
+			if err = group.flush(fn); err != nil {
+				return result, err
+			}
+			group.sent = keySentTime(i.Key())
+		}
+		if lastKey != nil && len(group.envelopes) == 0 && s.mustTruncate(r, result, start, opened) {
+			result.Truncated = true
+			result.NextCursor = newCursor(r.lower, r.upper, stripNamespace(lastKey))
+			break
+		}
+		result.Scanned++
+		lastKey = append(lastKey[:0], i.Key()...)
+
+		if r.version != 0 && EnvelopeVersion(i.Value()) != r.version {
+			continue
+		}
+		// fast path: envelopes of other topics are skipped without decoding
+		if singleTopic && !envelopeHasTopic(i.Value(), topic) {
+			continue
+		}
+
+		var envelope *whisper.Envelope
+		if envelope, err = s.decodeEnvelope(i.Key(), i.Value()); err != nil {
 			log.Error(fmt.Sprintf("RLP decoding failed: %s", err))
+			continue
 		}
 
-		if whisper.BloomFilterMatch(bloom, envelope.Bloom()) {
-			if peer == nil {
-				// used for test purposes
-				ret = append(ret, &envelope)
-			} else {
-				err = s.w.SendP2PDirect(peer, &envelope)
-				if err != nil {
-					log.Error(fmt.Sprintf("Failed to send direct message to peer: %s", err))
-					return nil
-				}
+		if !r.match(envelope) {
+			continue
+		}
+		if r.sender != nil {
+			opened++
+			if !r.matchSender(envelope) {
+				continue
 			}
 		}
+		if s.deliveryPoW && envelope.PoW() < pow {
+			deliveryLowPoWCounter.Inc(1)
+			lowPoW.add(i.Key(), envelope.Topic)
+			continue
+		}
+
+		if r.topicOrder {
+			group.envelopes = append(group.envelopes, envelope)
+		} else if err = fn(envelope); err != nil {
+			return result, err
+		}
+		result.Delivered++
+		result.Bytes += len(i.Value())
 	}
 
-	err = i.Error()
-	if err != nil {
-		log.Error(fmt.Sprintf("Level DB iterator error: %s", err))
+	if err = i.Error(); err != nil {
+		return result, fmt.Errorf("Level DB iterator error: %s", err)
+	}
+	if err = group.flush(fn); err != nil {
+		return result, err
 	}
 
-	return ret
+	return result, nil
+}
+
+// decodeEnvelope decodes an envelope read from the DB, through the envelope
+// cache if enabled.
+func (s *WMailServer) decodeEnvelope(key, raw []byte) (*whisper.Envelope, error) {
+	if s.cache != nil {
+		if env, ok := s.cache.get(key); ok {
+			return env, nil
+		}
+	}
+
+	var env whisper.Envelope
+	if err := rlp.DecodeBytes(raw, &env); err != nil {
+		return nil, err
+	}
+	if s.cache != nil {
+		s.cache.add(key, &env, len(raw))
+	}
+	return &env, nil
+}
+
+// mustTruncate reports whether the scan must stop before the next key, as
+// the request limit, the query deadline or the cap on envelopes decrypted to
+// recover their sender has been reached. Counting requests deliver nothing,
+// so the limit does not apply to them.
+func (s *WMailServer) mustTruncate(r *messagesRequest, result RequestResult, start time.Time, opened int) bool {
+	switch {
+	case r.limit > 0 && !r.countOnly && result.Delivered >= int(r.limit):
+		return true
+	case s.queryDeadline > 0 && time.Since(start) > s.queryDeadline:
+		requestDeadlineCounter.Inc(1)
+		return true
+	case r.sender != nil && s.maxSenderScan > 0 && opened >= s.maxSenderScan:
+		return true
+	}
+	return false
+}
+
+// seekAfter moves the iterator to the first key strictly greater than key.
+func seekAfter(i iterator.Iterator, key []byte) bool {
+	if !i.Seek(key) {
+		return false
+	}
+	if bytes.Equal(i.Key(), key) {
+		return i.Next()
+	}
+	return true
 }
 
 // validateRequest runs different validations on the current request.
-func (s *WMailServer) validateRequest(peerID []byte, request *whisper.Envelope) (bool, uint32, uint32, []byte) {
-	if s.pow > 0.0 && request.PoW() < s.pow {
-		return false, 0, 0, nil
+func (s *WMailServer) validateRequest(peerID []byte, request *whisper.Envelope) (bool, *messagesRequest) {
+	r, err := s.checkRequest(peerID, request)
+	if err != nil {
+		log.Warn(err.Message)
+		return false, nil
 	}
+	return true, r
+}
 
-	f := whisper.Filter{KeySym: s.key}
-	decrypted := request.Open(&f)
+// checkRequest decodes the current request and returns the reason it is
+// rejected, if any. The decoded request is returned along with the error
+// once the requesting peer is known.
+func (s *WMailServer) checkRequest(peerID []byte, request *whisper.Envelope) (*messagesRequest, *RequestError) {
+	if pow := s.minimumPoW(); pow > 0.0 && request.PoW() < pow {
+		return nil, newRequestError(ErrorCodeUnauthorized, errInsufficientPoW)
+	}
+
+	decrypted := s.openEnvelope(request)
 	if decrypted == nil {
-		log.Warn(fmt.Sprintf("Failed to decrypt p2p request"))
-		return false, 0, 0, nil
+		return nil, newRequestError(ErrorCodeUnauthorized, errors.New("Failed to decrypt p2p request"))
 	}
 
 	if err := s.checkMsgSignature(decrypted, peerID); err != nil {
-		log.Warn(err.Error())
-		return false, 0, 0, nil
+		return nil, newRequestError(ErrorCodeUnauthorized, err)
 	}
 
-	bloom, err := s.bloomFromReceivedMessage(decrypted)
-	if err != nil {
-		log.Warn(err.Error())
-		return false, 0, 0, nil
+	r := &messagesRequest{
+		src:   decrypted.Src,
+		topic: decrypted.Topic,
+		hash:  request.Hash(),
 	}
 
-	lower := binary.BigEndian.Uint32(decrypted.Payload[:4])
-	upper := binary.BigEndian.Uint32(decrypted.Payload[4:8])
+	var err error
+	if r.lower, r.upper, r.bloom, err = parseRequestPayload(decrypted.Payload); err != nil {
+		return r, newRequestError(ErrorCodeInvalidRequest, err)
+	}
+	if len(decrypted.Payload) > requestHeaderSize {
+		if err := decodeRequestOptions(decrypted.Payload[requestHeaderSize:], r); err != nil {
+			return r, newRequestError(ErrorCodeInvalidRequest, err)
+		}
+	}
 
+	if r.cursor != nil {
+		if err := validateCursor(r); err != nil {
+			return r, newRequestError(ErrorCodeInvalidRequest, err)
+		}
+	}
+
+	var requestErr *RequestError
+	if r.scanUpper, requestErr = s.checkWindow(peerID, r.lower, r.upper); requestErr != nil {
+		return r, requestErr
+	}
+	if len(r.queries) > 0 {
+		if r.cursor != nil {
+			return r, newRequestError(ErrorCodeInvalidRequest, errCompoundCursor)
+		}
+		for i := range r.queries {
+			q := &r.queries[i]
+			if q.Upper, requestErr = s.checkWindow(peerID, q.Lower, q.Upper); requestErr != nil {
+				return r, requestErr
+			}
+		}
+	}
+
+	return r, nil
+}
+
+// checkWindow validates the bounds of a requested window and returns its
+// exclusive upper bound, brought back past the current second if it is
+// slightly ahead.
+func (s *WMailServer) checkWindow(peerID []byte, lower, upper uint32) (uint32, *RequestError) {
 	lowerTime := time.Unix(int64(lower), 0)
 	upperTime := time.Unix(int64(upper), 0)
 	if upperTime.Sub(lowerTime) > maxQueryRange {
-		log.Warn(fmt.Sprintf("Query range too big for peer %s", string(peerID)))
-		return false, 0, 0, nil
+		return upper, newRequestError(ErrorCodeWindowSize, fmt.Errorf("Query range too big for peer %s", string(peerID)))
+	}
+
+	if s.futureGrace > 0 {
+		now := s.now()
+		if upperTime.After(now.Add(s.futureGrace)) {
+			return upper, newRequestError(ErrorCodeTimeRange, fmt.Errorf("Query upper bound too far in the future for peer %s", string(peerID)))
+		}
+		if upperTime.After(now) {
+			// tolerate small clock skews between the client and the server,
+			// still serving the envelopes archived in the current second
+			return uint32(now.Unix()) + 1, nil
+		}
 	}
 
-	return true, lower, upper, bloom
+	return upper, nil
+}
+
+// openEnvelope tries to decrypt the request with every known symmetric key.
+func (s *WMailServer) openEnvelope(request *whisper.Envelope) *whisper.ReceivedMessage {
+	s.keysMu.RLock()
+	defer s.keysMu.RUnlock()
+
+	for _, key := range s.keys {
+		f := whisper.Filter{KeySym: key}
+		if decrypted := request.Open(&f); decrypted != nil {
+			return decrypted
+		}
+	}
+	return nil
 }
 
 // checkMsgSignature returns an error in case the message is not correcly signed
@@ -277,19 +1367,3 @@ func (s *WMailServer) checkMsgSignature(msg *whisper.ReceivedMessage, id []byte)
 
 	return nil
 }
-
-// bloomFromReceivedMessage gor a given whisper.ReceivedMessage it extracts the
-// used bloom filter
-func (s *WMailServer) bloomFromReceivedMessage(msg *whisper.ReceivedMessage) ([]byte, error) {
-	payloadSize := len(msg.Payload)
-
-	if payloadSize < 8 {
-		return nil, errors.New("Undersized p2p request")
-	} else if payloadSize == 8 {
-		return whisper.MakeFullNodeBloom(), nil
-	} else if payloadSize < 8+whisper.BloomFilterSize {
-		return nil, errors.New("Undersized bloom filter in p2p request")
-	}
-
-	return msg.Payload[8 : 8+whisper.BloomFilterSize], nil
-}
@@ -20,31 +20,41 @@ import (
 	"bytes"
 	"crypto/ecdsa"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"os"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/discover"
 	"github.com/ethereum/go-ethereum/rlp"
 	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
 	"github.com/status-im/status-go/geth/params"
+	"github.com/status-im/status-go/timesource"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 )
 
-const powRequirement = 0.00001
+const powRequirement = testEnvelopePoW
 
 var keyID string
 var seed = time.Now().Unix()
 
 type ServerTestParams struct {
-	topic whisper.TopicType
-	birth uint32
-	low   uint32
-	upp   uint32
-	key   *ecdsa.PrivateKey
+	topic   whisper.TopicType
+	birth   uint32
+	low     uint32
+	upp     uint32
+	key     *ecdsa.PrivateKey
+	options []requestOption
+	keyID   string // defaults to the global keyID
 }
 
 func TestMailserverSuite(t *testing.T) {
@@ -109,6 +119,38 @@ func (s *MailserverSuite) TestInit() {
 			limiterActive: false,
 			info:          "Initializing a mail server with a config with empty DataDir and inactive limiter",
 		},
+		{
+			config: params.WhisperConfig{
+				DataDir:                       "/tmp/",
+				Password:                      "pwd",
+				MailServerRateLimitExemptions: []string{"0xzz"},
+			},
+			expectedError: errors.New("invalid rate limit exemption 0xzz: encoding/hex: invalid byte: U+007A 'z'"),
+			limiterActive: false,
+			info:          "Initializing a mail server with a config with an invalid rate limit exemption",
+		},
+		{
+			config: params.WhisperConfig{
+				DataDir:                   "/tmp/",
+				Password:                  "pwd",
+				MailServerBloomFilterBits: 10,
+			},
+			expectedError: nil,
+			limiterActive: false,
+			info:          "Initializing a mail server with a config with a LevelDB bloom filter",
+		},
+		{
+			config: params.WhisperConfig{
+				DataDir:                    "/tmp/",
+				Password:                   "pwd",
+				MailServerRateLimit:        5,
+				MailServerTopicRateLimit:   5,
+				MailServerDisableRateLimit: true,
+			},
+			expectedError: nil,
+			limiterActive: false,
+			info:          "Initializing a mail server with a config with the rate limiter disabled",
+		},
 	}
 
 	for _, tc := range testCases {
@@ -142,18 +184,196 @@ func (s *MailserverSuite) TestArchive() {
 	s.Equal(rawEnvelope, archivedEnvelope)
 }
 
+func (s *MailserverSuite) TestArchiveSyncWrites() {
+	s.config.MailServerSyncWrites = true
+	err := s.server.Init(s.shh, s.config)
+	s.server.tick = nil
+	s.NoError(err)
+	defer s.server.Close()
+	s.True(s.server.writeOptions.Sync)
+
+	env, err := generateEnvelope(time.Now())
+	s.NoError(err)
+	s.NoError(s.server.archive(env))
+
+	key := NewDbKey(env.Expiry-env.TTL, env.Hash())
+	_, err = s.server.db.Get(key.raw, nil)
+	s.NoError(err)
+}
+
+func (s *MailserverSuite) TestReadOnly() {
+	dir, err := ioutil.TempDir("", "whisper-server-read-only-test")
+	s.NoError(err)
+	defer os.RemoveAll(dir)
+	s.config.DataDir = dir
+
+	s.NoError(s.server.Init(s.shh, s.config))
+	s.server.tick = nil
+	s.False(s.server.Stats().ReadOnly)
+	env, err := generateEnvelope(time.Now())
+	s.NoError(err)
+	s.NoError(s.server.archive(env))
+	s.server.Close()
+
+	server := &WMailServer{}
+	s.config.MailServerReadOnly = true
+	s.NoError(server.Init(s.shh, s.config))
+	server.tick = nil
+	defer server.Close()
+	s.True(server.Stats().ReadOnly)
+
+	other, err := generateEnvelope(time.Now())
+	s.NoError(err)
+	s.Equal(errReadOnly, server.archive(other))
+
+	birth := env.Expiry - env.TTL
+	mail, _ := server.processRequest(nil, &messagesRequest{
+		lower: birth,
+		upper: birth + 1,
+		bloom: whisper.MakeFullNodeBloom(),
+	})
+	s.Len(mail, 1)
+	s.Equal(env.Hash(), mail[0].Hash())
+}
+
+func (s *MailserverSuite) TestResumeAfterRestart() {
+	dir, err := ioutil.TempDir("", "whisper-server-resume-test")
+	s.NoError(err)
+	defer os.RemoveAll(dir)
+	s.config.DataDir = dir
+
+	s.NoError(s.server.Init(s.shh, s.config))
+	s.server.tick = nil
+	now := time.Now()
+	for i := 3; i > 0; i-- {
+		env, err := generateEnvelope(now.Add(-time.Duration(i) * time.Second))
+		s.NoError(err)
+		s.NoError(s.server.archive(env))
+	}
+
+	r := &messagesRequest{
+		lower: uint32(now.Add(-time.Minute).Unix()),
+		upper: uint32(now.Unix()) + 1,
+		bloom: whisper.MakeFullNodeBloom(),
+		limit: 2,
+	}
+	first, result := s.server.processRequest(nil, r)
+	s.Len(first, 2)
+	s.True(result.Truncated)
+	s.server.Close()
+
+	// the cursor carries everything needed to resume on a fresh server
+	server := &WMailServer{}
+	s.NoError(server.Init(s.shh, s.config))
+	server.tick = nil
+	defer server.Close()
+
+	r.cursor = result.NextCursor
+	s.NoError(validateCursor(r))
+	rest, result := server.processRequest(nil, r)
+	s.Len(rest, 1)
+	s.False(result.Truncated)
+	for _, env := range first {
+		s.NotEqual(env.Hash(), rest[0].Hash())
+	}
+}
+
 func (s *MailserverSuite) TestManageLimits() {
 	s.server.limit = newLimiter(time.Duration(5) * time.Millisecond)
-	s.server.managePeerLimits([]byte("peerID"))
+	ok, _ := s.server.managePeerLimits([]byte("peerID"))
+	s.True(ok)
 	s.Equal(1, len(s.server.limit.db))
 	firstSaved := s.server.limit.db["peerID"]
 
 	// second call when limit is not accomplished does not store a new limit
-	s.server.managePeerLimits([]byte("peerID"))
+	ok, retryAfter := s.server.managePeerLimits([]byte("peerID"))
+	s.False(ok)
+	s.True(retryAfter <= 5*time.Millisecond)
 	s.Equal(1, len(s.server.limit.db))
 	s.Equal(firstSaved, s.server.limit.db["peerID"])
 }
 
+func (s *MailserverSuite) TestManageLimitsExemptPeer() {
+	s.server.limit = newLimiter(time.Hour)
+	s.server.ExemptPeer([]byte("exemptID"))
+
+	for i := 0; i < 10; i++ {
+		ok, _ := s.server.managePeerLimits([]byte("exemptID"))
+		s.True(ok)
+	}
+	s.Equal(0, len(s.server.limit.db))
+
+	s.server.UnexemptPeer([]byte("exemptID"))
+	ok, _ := s.server.managePeerLimits([]byte("exemptID"))
+	s.True(ok)
+	ok, _ = s.server.managePeerLimits([]byte("exemptID"))
+	s.False(ok)
+}
+
+func (s *MailserverSuite) TestRequestCounts() {
+	s.Nil(s.server.RequestCounts())
+
+	s.server.limit = newLimiter(time.Hour)
+	s.server.requestCounts = newRequestCounter(time.Hour)
+	for i := 0; i < 3; i++ {
+		s.server.managePeerLimits([]byte("peerID"))
+	}
+	s.Equal(map[string]int{hex.EncodeToString([]byte("peerID")): 3}, s.server.RequestCounts(),
+		"throttled requests should be counted too")
+}
+
+func (s *MailserverSuite) TestThrottledPeers() {
+	s.Nil(s.server.ThrottledPeers())
+
+	s.server.limit = newLimiter(time.Hour)
+	s.server.managePeerLimits([]byte("peerID"))
+	s.server.ExemptPeer([]byte("exemptID"))
+	s.server.managePeerLimits([]byte("exemptID"))
+	s.Equal([][]byte{[]byte("peerID")}, s.server.ThrottledPeers())
+}
+
+func (s *MailserverSuite) TestManageTopicLimits() {
+	s.server.topicLimit = newLimiter(time.Hour)
+	hot := whisper.TopicType{0x01, 0x02, 0x03, 0x04}
+	cold := whisper.TopicType{0x05, 0x06, 0x07, 0x08}
+
+	ok, _ := s.server.manageTopicLimits([]byte("peer1"), &messagesRequest{topics: []whisper.TopicType{hot}})
+	s.True(ok)
+	ok, retryAfter := s.server.manageTopicLimits([]byte("peer2"), &messagesRequest{topics: []whisper.TopicType{hot}})
+	s.False(ok, "a hot topic should be throttled across peers")
+	s.True(retryAfter > 59*time.Minute && retryAfter <= time.Hour, "retry after should follow the topic limit")
+	ok, _ = s.server.manageTopicLimits([]byte("peer2"), &messagesRequest{all: []whisper.TopicType{cold, hot}})
+	s.False(ok)
+	ok, _ = s.server.manageTopicLimits([]byte("peer2"), &messagesRequest{topics: []whisper.TopicType{cold}})
+	s.True(ok, "a throttled request should not consume the quota of its other topics")
+	ok, _ = s.server.manageTopicLimits([]byte("peer2"), &messagesRequest{bloom: whisper.MakeFullNodeBloom()})
+	s.True(ok, "bloom requests cannot be attributed to topics")
+
+	s.server.ExemptPeer([]byte("exemptID"))
+	ok, _ = s.server.manageTopicLimits([]byte("exemptID"), &messagesRequest{topics: []whisper.TopicType{hot}})
+	s.True(ok)
+}
+
+func (s *MailserverSuite) TestManageLimitsStats() {
+	s.server.limit = newLimiter(time.Hour)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			peerID := []byte(fmt.Sprintf("peer%d", i))
+			s.server.managePeerLimits(peerID)
+			s.server.managePeerLimits(peerID)
+		}(i)
+	}
+	wg.Wait()
+
+	stats := s.server.Stats()
+	s.Equal(int64(10), stats.AllowedRequests)
+	s.Equal(int64(10), stats.ThrottledRequests)
+}
+
 func (s *MailserverSuite) TestDBKey() {
 	var h common.Hash
 	i := uint32(time.Now().Unix())
@@ -242,7 +462,7 @@ func (s *MailserverSuite) TestMailServer() {
 
 			request := s.createRequest(tc.params)
 			src := crypto.FromECDSAPub(&tc.params.key.PublicKey)
-			ok, lower, upper, bloom := server.validateRequest(src, request)
+			ok, r := server.validateRequest(src, request)
 			if tc.shouldFail {
 				if ok {
 					s.T().Fatal(err)
@@ -252,19 +472,19 @@ func (s *MailserverSuite) TestMailServer() {
 			if !ok {
 				s.T().Fatalf("request validation failed, seed: %d.", seed)
 			}
-			if lower != tc.params.low {
+			if r.lower != tc.params.low {
 				s.T().Fatalf("request validation failed (lower bound), seed: %d.", seed)
 			}
-			if upper != tc.params.upp {
+			if r.upper != tc.params.upp {
 				s.T().Fatalf("request validation failed (upper bound), seed: %d.", seed)
 			}
 			expectedBloom := whisper.TopicToBloom(tc.params.topic)
-			if !bytes.Equal(bloom, expectedBloom) {
+			if !bytes.Equal(r.bloom, expectedBloom) {
 				s.T().Fatalf("request validation failed (topic), seed: %d.", seed)
 			}
 
 			var exist bool
-			mail := server.processRequest(nil, tc.params.low, tc.params.upp, bloom)
+			mail, _ := server.processRequest(nil, r)
 			for _, msg := range mail {
 				if msg.Hash() == env.Hash() {
 					exist = true
@@ -277,51 +497,263 @@ func (s *MailserverSuite) TestMailServer() {
 			}
 
 			src[0]++
-			ok, lower, upper, _ = server.validateRequest(src, request)
+			ok, r = server.validateRequest(src, request)
 			if !ok {
 				// request should be valid regardless of signature
-				s.T().Fatalf("request validation false negative, seed: %d (lower: %d, upper: %d).", seed, lower, upper)
+				s.T().Fatalf("request validation false negative, seed: %d (lower: %d, upper: %d).", seed, r.lower, r.upper)
 			}
 		})
 	}
 }
 
-func (s *MailserverSuite) TestBloomFromReceivedMessage() {
+func (s *MailserverSuite) TestExactTopics() {
+	var server WMailServer
+
+	s.setupServer(&server)
+	defer server.Close()
+
+	env, err := generateEnvelope(time.Now())
+	s.NoError(err)
+	server.Archive(env)
+
+	otherTopic := whisper.TopicType{0x01, 0x02, 0x03, 0x04}
 	testCases := []struct {
-		msg           whisper.ReceivedMessage
-		expectedBloom []byte
-		expectedErr   error
-		info          string
+		topics     []whisper.TopicType
+		expect     bool
+		shouldFail bool
+		info       string
 	}{
 		{
-			msg:           whisper.ReceivedMessage{},
-			expectedBloom: []byte(nil),
-			expectedErr:   errors.New("Undersized p2p request"),
-			info:          "getting bloom filter for an empty whisper message should produce an error",
+			topics: []whisper.TopicType{otherTopic, env.Topic},
+			expect: true,
+			info:   "Processing a request with an exact topic list containing the envelope topic, should provide results",
 		},
 		{
-			msg:           whisper.ReceivedMessage{Payload: []byte("hohohohoho")},
-			expectedBloom: []byte(nil),
-			expectedErr:   errors.New("Undersized bloom filter in p2p request"),
-			info:          "getting bloom filter for a malformed whisper message should produce an error",
+			topics: []whisper.TopicType{otherTopic},
+			expect: false,
+			info:   "Processing a request with an exact topic list not containing the envelope topic, should not provide results",
 		},
 		{
-			msg:           whisper.ReceivedMessage{Payload: []byte("12345678")},
-			expectedBloom: whisper.MakeFullNodeBloom(),
-			expectedErr:   nil,
-			info:          "getting bloom filter for a valid whisper message should be successful",
+			topics:     make([]whisper.TopicType, maxRequestTopics+1),
+			shouldFail: true,
+			info:       "Processing a request with too many exact topics should fail",
 		},
 	}
 
 	for _, tc := range testCases {
 		s.T().Run(tc.info, func(*testing.T) {
-			bloom, err := s.server.bloomFromReceivedMessage(&tc.msg)
-			s.Equal(tc.expectedErr, err)
-			s.Equal(tc.expectedBloom, bloom)
+			params := s.defaultServerParams(env)
+			// the bloom filter matches the envelope; only the topic list
+			// decides whether it is delivered
+			option, err := newTopicsOption(tc.topics)
+			s.NoError(err)
+			params.options = []requestOption{option}
+
+			request := s.createRequest(params)
+			src := crypto.FromECDSAPub(&params.key.PublicKey)
+			ok, r := server.validateRequest(src, request)
+			if tc.shouldFail {
+				s.False(ok)
+				return
+			}
+			s.True(ok)
+			s.Equal(tc.topics, r.topics)
+
+			var exist bool
+			mail, _ := server.processRequest(nil, r)
+			for _, msg := range mail {
+				if msg.Hash() == env.Hash() {
+					exist = true
+				}
+			}
+			s.Equal(tc.expect, exist)
 		})
 	}
 }
 
+func (s *MailserverSuite) TestMultipleSymKeys() {
+	var server WMailServer
+
+	s.setupServer(&server)
+	defer server.Close()
+
+	env, err := generateEnvelope(time.Now())
+	s.NoError(err)
+
+	otherKeyID, err := s.shh.AddSymKeyFromPassword("other_password_for_this_test")
+	s.NoError(err)
+	otherKey, err := s.shh.GetSymKey(otherKeyID)
+	s.NoError(err)
+
+	params := s.defaultServerParams(env)
+	src := crypto.FromECDSAPub(&params.key.PublicKey)
+	request := s.createRequest(params)
+	params.keyID = otherKeyID
+	otherRequest := s.createRequest(params)
+
+	ok, _ := server.validateRequest(src, otherRequest)
+	s.False(ok, "request encrypted with an unknown key should not be decoded")
+
+	server.AddSymKey(otherKey)
+	ok, _ = server.validateRequest(src, request)
+	s.True(ok, "request encrypted with the config password should be decoded")
+	ok, _ = server.validateRequest(src, otherRequest)
+	s.True(ok, "request encrypted with an added key should be decoded")
+
+	s.True(server.RemoveSymKey(otherKey))
+	s.False(server.RemoveSymKey(otherKey))
+	ok, _ = server.validateRequest(src, otherRequest)
+	s.False(ok, "request encrypted with a removed key should not be decoded")
+}
+
+func (s *MailserverSuite) TestFutureGrace() {
+	var server WMailServer
+	now := time.Now()
+	server.SetTimeSource(timesource.TimeSourceFunc(func() time.Time { return now }))
+
+	s.setupServer(&server)
+	defer server.Close()
+	server.futureGrace = 10 * time.Second
+
+	env, err := generateEnvelope(time.Now())
+	s.NoError(err)
+	params := s.defaultServerParams(env)
+	src := crypto.FromECDSAPub(&params.key.PublicKey)
+
+	// within the grace period only the scan is clamped past the current second
+	params.upp = uint32(now.Add(5 * time.Second).Unix())
+	ok, r := server.validateRequest(src, s.createRequest(params))
+	s.True(ok)
+	s.Equal(params.upp, r.upper)
+	s.Equal(uint32(now.Unix())+1, r.scanLimit())
+
+	// beyond the grace period the request is rejected
+	params.upp = uint32(now.Add(20 * time.Second).Unix())
+	ok, _ = server.validateRequest(src, s.createRequest(params))
+	s.False(ok)
+}
+
+func (s *MailserverSuite) TestFutureGraceCursor() {
+	var server WMailServer
+	now := time.Now()
+	server.SetTimeSource(timesource.TimeSourceFunc(func() time.Time { return now }))
+
+	s.setupServer(&server)
+	defer server.Close()
+	server.futureGrace = 10 * time.Second
+
+	older, err := generateEnvelope(now.Add(-2 * time.Second))
+	s.NoError(err)
+	server.Archive(older)
+	// archived in the current second
+	newer, err := generateEnvelope(now)
+	s.NoError(err)
+	server.Archive(newer)
+
+	params := s.defaultServerParams(newer)
+	params.low = uint32(now.Add(-time.Minute).Unix())
+	params.upp = uint32(now.Add(5 * time.Second).Unix())
+	limit, err := newRequestOption(limitOptionCode, uint32(1))
+	s.NoError(err)
+	params.options = []requestOption{limit}
+	src := crypto.FromECDSAPub(&params.key.PublicKey)
+
+	ok, r := server.validateRequest(src, s.createRequest(params))
+	s.True(ok)
+	mail, result := server.processRequest(nil, r)
+	s.Require().Len(mail, 1)
+	s.Equal(older.Hash(), mail[0].Hash())
+	s.True(result.Truncated)
+
+	// the request is resumed with the bounds it was first sent with
+	cursor, err := newRequestOption(cursorOptionCode, result.NextCursor)
+	s.NoError(err)
+	params.options = append(params.options, cursor)
+	ok, r = server.validateRequest(src, s.createRequest(params))
+	s.Require().True(ok, "the cursor should be valid for the original request")
+	mail, result = server.processRequest(nil, r)
+	s.Require().Len(mail, 1)
+	s.Equal(newer.Hash(), mail[0].Hash())
+	s.False(result.Truncated)
+}
+
+func (s *MailserverSuite) TestDeliveryBatches() {
+	// codes of the whisper messages exchanged with the server
+	const (
+		statusCode     = 0
+		p2pRequestCode = 126
+		p2pMessageCode = 127
+	)
+
+	var server WMailServer
+	s.setupServer(&server)
+	defer server.Close()
+	server.deliveryBatchSize = 2
+
+	now := time.Now()
+	var env *whisper.Envelope
+	for i := 0; i < 5; i++ {
+		var err error
+		env, err = generateEnvelope(now.Add(-time.Duration(i) * time.Second))
+		s.Require().NoError(err)
+		server.Archive(env)
+	}
+
+	// a peer connected to the whisper service of the server
+	local, remote := p2p.MsgPipe()
+	defer remote.Close()
+	go s.shh.HandlePeer(p2p.NewPeer(discover.NodeID{0x01}, "peer", nil), local) // nolint: errcheck
+	msg, err := remote.ReadMsg()
+	s.Require().NoError(err)
+	s.Require().Equal(uint64(statusCode), msg.Code)
+	s.NoError(msg.Discard())
+	s.Require().NoError(p2p.SendItems(remote, statusCode, whisper.ProtocolVersion, math.Float64bits(0), whisper.MakeFullNodeBloom()))
+
+	// readWrites reads the direct messages sent in response to a request
+	// until the given number of envelopes is delivered, and returns how many
+	// were read
+	readWrites := func(envelopes int) int {
+		writes := 0
+		for envelopes > 0 {
+			msg, err := remote.ReadMsg()
+			s.Require().NoError(err)
+			if msg.Code != p2pMessageCode {
+				s.NoError(msg.Discard())
+				continue
+			}
+			writes++
+			var raw rlp.RawValue
+			s.Require().NoError(msg.Decode(&raw))
+			content, _, err := rlp.SplitList(raw)
+			s.Require().NoError(err)
+			if kind, _, _, err := rlp.Split(content); err == nil && kind == rlp.List {
+				var batch []*whisper.Envelope
+				s.Require().NoError(rlp.DecodeBytes(raw, &batch))
+				envelopes -= len(batch)
+				continue
+			}
+			envelopes--
+		}
+		return writes
+	}
+
+	params := s.defaultServerParams(env)
+	params.low = uint32(now.Add(-time.Minute).Unix())
+	params.upp = uint32(now.Add(time.Second).Unix())
+
+	// peers decoding batches get one p2p message per batch
+	batches, err := newRequestOption(batchesCode, true)
+	s.Require().NoError(err)
+	params.options = []requestOption{batches}
+	s.Require().NoError(p2p.Send(remote, p2pRequestCode, s.createRequest(params)))
+	s.Equal(3, readWrites(5))
+
+	// other peers get one p2p message per envelope
+	params.options = nil
+	s.Require().NoError(p2p.Send(remote, p2pRequestCode, s.createRequest(params)))
+	s.Equal(5, readWrites(5))
+}
+
 func (s *MailserverSuite) setupServer(server *WMailServer) {
 	const password = "password_for_this_test"
 	const dbPath = "whisper-server-test"
@@ -371,8 +803,19 @@ func (s *MailserverSuite) createRequest(p *ServerTestParams) *whisper.Envelope {
 	binary.BigEndian.PutUint32(data, p.low)
 	binary.BigEndian.PutUint32(data[4:], p.upp)
 	data = append(data, bloom...)
+	if len(p.options) > 0 {
+		options, err := encodeRequestOptions(p.options...)
+		if err != nil {
+			s.T().Fatalf("failed to encode request options with seed %d: %s.", seed, err)
+		}
+		data = append(data, options...)
+	}
 
-	key, err := s.shh.GetSymKey(keyID)
+	symKeyID := keyID
+	if p.keyID != "" {
+		symKeyID = p.keyID
+	}
+	key, err := s.shh.GetSymKey(symKeyID)
 	if err != nil {
 		s.T().Fatalf("failed to retrieve sym key with seed %d: %s.", seed, err)
 	}
@@ -398,23 +841,559 @@ func (s *MailserverSuite) createRequest(p *ServerTestParams) *whisper.Envelope {
 }
 
 func generateEnvelope(sentTime time.Time) (*whisper.Envelope, error) {
-	h := crypto.Keccak256Hash([]byte("test sample data"))
-	params := &whisper.MessageParams{
-		KeySym:   h[:],
-		Topic:    whisper.TopicType{0x1F, 0x7E, 0xA1, 0x7F},
-		Payload:  []byte("test payload"),
-		PoW:      powRequirement,
-		WorkTime: 2,
+	env, err := BuildEnvelope(whisper.TopicType{0x1F, 0x7E, 0xA1, 0x7F}, []byte("test payload"), sentTime)
+	if err != nil {
+		return nil, fmt.Errorf("%s with seed %d", err, seed)
 	}
+	return env, nil
+}
 
-	msg, err := whisper.NewSentMessage(params)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create new message with seed %d: %s", seed, err)
+func TestArchiveMaxEnvelopeSize(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+
+	env, err := generateEnvelope(time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	raw, err := rlp.EncodeToBytes(env)
+	require.NoError(t, err)
+
+	server.maxEnvelope = len(raw) - 1
+	require.Equal(t, errEnvelopeTooLarge, server.archive(env))
+	testMessagesCount(t, 0, server)
+
+	server.maxEnvelope = len(raw)
+	require.NoError(t, server.archive(env))
+	testMessagesCount(t, 1, server)
+}
+
+func TestArchiveFilter(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+
+	rejected := whisper.TopicType{0x01, 0x02, 0x03, 0x04}
+	server.SetArchiveFilter(func(env *whisper.Envelope) (bool, error) {
+		if env.TTL == 0 {
+			return false, errors.New("missing TTL")
+		}
+		return env.Topic != rejected, nil
+	})
+
+	env, err := generateEnvelope(time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	require.NoError(t, server.archive(env))
+	testMessagesCount(t, 1, server)
+
+	env, err = generateEnvelope(time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	env.Topic = rejected
+	require.Equal(t, errEnvelopeFiltered, server.archive(env))
+
+	env.TTL = 0
+	require.EqualError(t, server.archive(env), "archive filter failed: missing TTL")
+	testMessagesCount(t, 1, server)
+}
+
+func TestArchiveTopics(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+
+	env, err := generateEnvelope(time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	other, err := BuildEnvelope(whisper.BytesToTopic([]byte("abcd")), []byte("test payload"), time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+
+	// every topic is archived by default
+	require.NoError(t, server.archive(other))
+	testMessagesCount(t, 1, server)
+
+	server.SetArchiveTopics([]whisper.TopicType{env.Topic})
+	require.Equal(t, []whisper.TopicType{env.Topic}, server.ArchiveTopics())
+	require.NoError(t, server.archive(env))
+	other, err = BuildEnvelope(other.Topic, []byte("another payload"), time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, errTopicNotArchived, server.archive(other))
+	testMessagesCount(t, 2, server)
+
+	server.SetArchiveTopics(nil)
+	require.Nil(t, server.ArchiveTopics())
+	require.NoError(t, server.archive(other))
+	testMessagesCount(t, 3, server)
+}
+
+func TestDecodeTopics(t *testing.T) {
+	topics, err := decodeTopics([]string{"0x1f7ea17f", "61626364"})
+	require.NoError(t, err)
+	require.Equal(t, []whisper.TopicType{{0x1F, 0x7E, 0xA1, 0x7F}, whisper.BytesToTopic([]byte("abcd"))}, topics)
+
+	_, err = decodeTopics([]string{"0x1f7e"})
+	require.Error(t, err, "short topic")
+	_, err = decodeTopics([]string{"0xzz7ea17f"})
+	require.Error(t, err, "invalid hex")
+}
+
+func TestSetMinimumPoW(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+
+	env, err := generateEnvelope(time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	require.NoError(t, server.archive(env))
+
+	// envelopes accepted so far are rejected once the minimum PoW is raised
+	require.NoError(t, server.SetMinimumPoW(1000))
+	env, err = generateEnvelope(time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, errEnvelopeLowPoW, server.archive(env))
+	testMessagesCount(t, 1, server)
+	_, reqErr := server.checkRequest(nil, env)
+	require.Equal(t, newRequestError(ErrorCodeUnauthorized, errInsufficientPoW), reqErr)
+
+	require.NoError(t, server.SetMinimumPoW(0))
+	require.NoError(t, server.archive(env))
+	testMessagesCount(t, 2, server)
+
+	require.Error(t, server.SetMinimumPoW(-1))
+	require.Equal(t, float64(0), server.minimumPoW())
+}
+
+func TestProcessRequestStream(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+
+	for i := 3; i > 0; i-- {
+		archiveEnvelope(t, now.Add(-time.Duration(i)*time.Second), server)
 	}
-	env, err := msg.Wrap(params, sentTime)
-	if err != nil {
-		return nil, fmt.Errorf("failed to wrap with seed %d: %s", seed, err)
+
+	r := &messagesRequest{
+		lower: uint32(now.Add(-time.Minute).Unix()),
+		upper: uint32(now.Unix()) + 1,
+		bloom: whisper.MakeFullNodeBloom(),
 	}
 
-	return env, nil
+	var delivered int
+	_, err := server.processRequestStream(r, func(*whisper.Envelope) error {
+		delivered++
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, delivered)
+
+	// the scan stops as soon as the callback fails
+	delivered = 0
+	errStop := errors.New("stop")
+	_, err = server.processRequestStream(r, func(*whisper.Envelope) error {
+		delivered++
+		return errStop
+	})
+	require.Equal(t, errStop, err)
+	require.Equal(t, 1, delivered)
+
+	mail, _ := server.processRequest(nil, r)
+	require.Len(t, mail, 3)
+}
+
+func TestProcessRequestResult(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+
+	var size int
+	for i := 3; i > 0; i-- {
+		env := archiveEnvelope(t, now.Add(-time.Duration(i)*time.Second), server)
+		raw, err := rlp.EncodeToBytes(env)
+		require.NoError(t, err)
+		size += len(raw)
+	}
+
+	r := &messagesRequest{
+		lower: uint32(now.Add(-time.Minute).Unix()),
+		upper: uint32(now.Unix()) + 1,
+		bloom: whisper.MakeFullNodeBloom(),
+	}
+	mail, result := server.processRequest(nil, r)
+	require.Len(t, mail, 3)
+	require.Equal(t, 3, result.Delivered)
+	require.Equal(t, 3, result.Scanned)
+	require.Equal(t, size, result.Bytes)
+	require.False(t, result.Truncated)
+	require.Nil(t, result.NextCursor)
+
+	// a limited request is truncated and can be resumed from its cursor
+	r.limit = 2
+	mail, result = server.processRequest(nil, r)
+	require.Len(t, mail, 2)
+	require.True(t, result.Truncated)
+	require.NotNil(t, result.NextCursor)
+
+	r.cursor = result.NextCursor
+	rest, result := server.processRequest(nil, r)
+	require.Len(t, rest, 1)
+	require.False(t, result.Truncated)
+	for _, env := range mail {
+		require.NotEqual(t, env.Hash(), rest[0].Hash())
+	}
+}
+
+func TestProcessRequestSender(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+
+	alice, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	bob, err := crypto.GenerateKey()
+	require.NoError(t, err)
+
+	// envelopes alternate between the senders, alice's being the oldest
+	for i, key := range []*ecdsa.PrivateKey{alice, bob, alice, bob} {
+		params := &whisper.MessageParams{
+			Src:      key,
+			KeySym:   testEnvelopeKey[:],
+			Topic:    whisper.TopicType{0x1f, 0x7e, 0xa1, 0x7f},
+			Payload:  []byte("signed payload"),
+			PoW:      testEnvelopePoW,
+			WorkTime: testEnvelopeWorkTime,
+		}
+		msg, err := whisper.NewSentMessage(params)
+		require.NoError(t, err)
+		env, err := msg.Wrap(params, now.Add(time.Duration(i-5)*time.Second))
+		require.NoError(t, err)
+		require.NoError(t, server.archive(env))
+	}
+
+	r := &messagesRequest{
+		lower:     uint32(now.Add(-time.Minute).Unix()),
+		upper:     uint32(now.Unix()) + 1,
+		bloom:     whisper.MakeFullNodeBloom(),
+		sender:    crypto.FromECDSAPub(&alice.PublicKey),
+		senderKey: testEnvelopeKey[:],
+	}
+	mail, result := server.processRequest(nil, r)
+	require.Len(t, mail, 2)
+	require.False(t, result.Truncated)
+
+	// envelopes which cannot be opened with the key are not delivered
+	r.senderKey = make([]byte, symKeySize)
+	mail, _ = server.processRequest(nil, r)
+	require.Len(t, mail, 0)
+
+	// the scan is truncated once the cap on decrypted envelopes is reached
+	r.senderKey = testEnvelopeKey[:]
+	server.maxSenderScan = 2
+	mail, result = server.processRequest(nil, r)
+	require.Len(t, mail, 1)
+	require.True(t, result.Truncated)
+
+	r.cursor = result.NextCursor
+	mail, result = server.processRequest(nil, r)
+	require.Len(t, mail, 1)
+	require.False(t, result.Truncated)
+}
+
+// Scanning 1000 envelopes for one of 10 topics, before and after the single
+// topic fast path, which skips envelopes of other topics without decoding:
+//
+//	BenchmarkProcessRequestSingleTopic  8948124 ns/op  2569403 B/op  13015 allocs/op (before)
+//	BenchmarkProcessRequestSingleTopic   624595 ns/op   258200 B/op   1315 allocs/op (after)
+//	BenchmarkProcessRequestBloom        8684347 ns/op  2633402 B/op  14015 allocs/op (general path)
+func benchmarkProcessRequest(b *testing.B, r *messagesRequest) {
+	t := &testing.T{}
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+
+	// 1000 envelopes over the last few hours, spread across 10 topics
+	for i := 0; i < 1000; i++ {
+		topic := whisper.TopicType{0x01, 0x02, 0x03, byte(i % 10)}
+		env, err := BuildEnvelope(topic, make([]byte, 256), now.Add(-time.Duration(i)*10*time.Second))
+		require.NoError(t, err)
+		require.NoError(t, server.archive(env))
+	}
+	r.lower = uint32(now.Add(-4 * time.Hour).Unix())
+	r.upper = uint32(now.Unix()) + 1
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := server.processRequestStream(r, func(*whisper.Envelope) error { return nil }); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkProcessRequestSingleTopic(b *testing.B) {
+	benchmarkProcessRequest(b, &messagesRequest{topics: []whisper.TopicType{{0x01, 0x02, 0x03, 0x00}}})
+}
+
+func BenchmarkProcessRequestBloom(b *testing.B) {
+	benchmarkProcessRequest(b, &messagesRequest{bloom: whisper.TopicToBloom(whisper.TopicType{0x01, 0x02, 0x03, 0x00})})
+}
+
+func TestArchiveMaxAge(t *testing.T) {
+	now := time.Now().Add(-time.Hour)
+	server := setupTestServer(t)
+	defer server.Close()
+	server.maxArchiveAge = time.Hour
+	server.SetTimeSource(timesource.TimeSourceFunc(func() time.Time { return now }))
+
+	old, err := generateEnvelope(now.Add(-2 * time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, errEnvelopeTooOld, server.archive(old))
+	testMessagesCount(t, 0, server)
+
+	recent, err := generateEnvelope(now.Add(-59 * time.Minute))
+	require.NoError(t, err)
+	require.NoError(t, server.archive(recent))
+	testMessagesCount(t, 1, server)
+
+	// the same envelope is too old once the clock has advanced
+	now = now.Add(2 * time.Minute)
+	require.Equal(t, errEnvelopeTooOld, server.archive(recent))
+}
+
+func TestArchiveMinTTL(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+
+	env, err := generateEnvelope(time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	ttl := time.Duration(env.TTL) * time.Second
+
+	server.minTTL = ttl + time.Second
+	require.Equal(t, errEnvelopeTTLTooShort, server.archive(env))
+	testMessagesCount(t, 0, server)
+
+	server.minTTL = ttl
+	require.NoError(t, server.archive(env))
+	testMessagesCount(t, 1, server)
+}
+
+func TestArchiveSkipEmpty(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+
+	env, err := generateEnvelope(time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	empty := &whisper.Envelope{Expiry: env.Expiry, TTL: env.TTL, Topic: env.Topic, Nonce: env.Nonce}
+
+	require.NoError(t, server.archive(empty), "envelopes without payload should be archived by default")
+	testMessagesCount(t, 1, server)
+
+	server.skipEmpty = true
+	empty = &whisper.Envelope{Expiry: env.Expiry + 1, TTL: env.TTL, Topic: env.Topic, Nonce: env.Nonce}
+	require.Equal(t, errEnvelopeEmpty, server.archive(empty))
+	testMessagesCount(t, 1, server)
+	require.NoError(t, server.archive(env))
+	testMessagesCount(t, 2, server)
+}
+
+func TestProcessRequestDeadline(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+
+	for i := 3; i > 0; i-- {
+		archiveEnvelope(t, now.Add(-time.Duration(i)*time.Second), server)
+	}
+
+	r := &messagesRequest{
+		lower: uint32(now.Add(-time.Minute).Unix()),
+		upper: uint32(now.Unix()) + 1,
+		bloom: whisper.MakeFullNodeBloom(),
+	}
+
+	// the deadline is exceeded right after the first envelope is scanned
+	server.queryDeadline = time.Nanosecond
+	mail, result := server.processRequest(nil, r)
+	require.Len(t, mail, 1)
+	require.True(t, result.Truncated)
+
+	server.queryDeadline = time.Minute
+	r.cursor = result.NextCursor
+	rest, result := server.processRequest(nil, r)
+	require.Len(t, rest, 2)
+	require.False(t, result.Truncated)
+}
+
+func TestProcessRequestAfter(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+
+	now := time.Now()
+	var archived []*whisper.Envelope
+	for i := 5; i > 2; i-- {
+		archived = append(archived, archiveEnvelope(t, now.Add(-time.Duration(i)*time.Minute), server))
+	}
+
+	r := &messagesRequest{
+		lower: uint32(now.Add(-time.Hour).Unix()),
+		upper: uint32(now.Unix()),
+		bloom: whisper.MakeFullNodeBloom(),
+	}
+	first, _ := server.processRequest(nil, r)
+	require.Len(t, first, 3)
+
+	for i := 2; i > 0; i-- {
+		archived = append(archived, archiveEnvelope(t, now.Add(-time.Duration(i)*time.Minute), server))
+	}
+
+	// the peer asks for everything after the last envelope it got
+	last := first[len(first)-1]
+	r.after = NewDbKey(last.Expiry-last.TTL, last.Hash()).raw
+	second, _ := server.processRequest(nil, r)
+	require.Len(t, second, 2, "envelopes already delivered should not be sent again")
+	for i, env := range append(first, second...) {
+		require.Equal(t, archived[i].Hash(), env.Hash())
+	}
+
+	// an anchor before the window has no effect
+	r.after = NewDbKey(r.lower-1, last.Hash()).raw
+	mail, _ := server.processRequest(nil, r)
+	require.Len(t, mail, 5)
+}
+
+func TestValidateCursor(t *testing.T) {
+	var zero common.Hash
+	key := NewDbKey(150, zero).raw
+	r := &messagesRequest{lower: 100, upper: 200}
+
+	testCases := []struct {
+		cursor []byte
+		err    error
+		info   string
+	}{
+		{newCursor(100, 200, key), nil, "cursor inside the window"},
+		{newCursor(100, 200, key)[:cursorSize-1], errMalformedCursor, "truncated cursor"},
+		{[]byte("garbage"), errMalformedCursor, "garbage cursor"},
+		{newCursor(100, 300, key), errStaleCursor, "cursor of another window"},
+		{newCursor(100, 200, NewDbKey(250, zero).raw), errStaleCursor, "cursor key outside the window"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.info, func(t *testing.T) {
+			r.cursor = tc.cursor
+			require.Equal(t, tc.err, validateCursor(r))
+		})
+	}
+}
+
+func TestPrepareShutdown(t *testing.T) {
+	server := setupTestServer(t)
+
+	require.NoError(t, server.startRequest())
+	server.PrepareShutdown()
+	require.Equal(t, errShuttingDown, server.startRequest(), "new requests should be rejected while draining")
+
+	stats := server.Stats()
+	require.True(t, stats.Draining)
+	require.Equal(t, int64(1), stats.InFlightRequests)
+
+	closed := make(chan struct{})
+	go func() {
+		server.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		t.Fatal("Close should wait for requests in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	server.finishRequest()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close should return once requests are served")
+	}
+	require.Equal(t, int64(0), server.Stats().InFlightRequests)
+}
+
+func TestCloseUnderLoad(t *testing.T) {
+	server := setupTestServer(t)
+	server.setupCompaction(time.Millisecond)
+	sub := server.Subscribe(1)
+
+	now := time.Now()
+	r := &messagesRequest{
+		lower: uint32(now.Add(-time.Hour).Unix()),
+		upper: uint32(now.Unix()) + 1,
+		bloom: whisper.MakeFullNodeBloom(),
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				env, err := generateEnvelope(now.Add(-time.Minute))
+				require.NoError(t, err)
+				if err := server.archive(env); err != nil {
+					require.Equal(t, errShuttingDown, err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := server.startRequest(); err != nil {
+					require.Equal(t, errShuttingDown, err)
+					continue
+				}
+				_, err := server.processRequestStream(r, func(*whisper.Envelope) error { return nil })
+				server.finishRequest()
+				require.NoError(t, err, "requests in flight should complete before the DB is closed")
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	server.Close()
+	close(stop)
+	wg.Wait()
+
+	for range sub.C {
+	}
+	require.Equal(t, errShuttingDown, server.archive(&whisper.Envelope{}))
+}
+
+func TestMaxQueueLength(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+	server.maxQueueLength = 2
+
+	require.NoError(t, server.startRequest())
+	require.NoError(t, server.startRequest())
+	require.Equal(t, errServerBusy, server.startRequest())
+	require.Equal(t, int64(2), server.Stats().InFlightRequests)
+
+	server.finishRequest()
+	require.NoError(t, server.startRequest())
+	server.finishRequest()
+	server.finishRequest()
+}
+
+func TestTickerStoppedBeforeRun(t *testing.T) {
+	tick := &ticker{}
+	tick.stop()
+	ran := make(chan struct{}, 1)
+	tick.run(time.Millisecond, func() { ran <- struct{}{} })
+	select {
+	case <-ran:
+		t.Fatal("a stopped ticker should not run")
+	case <-time.After(20 * time.Millisecond):
+	}
 }
@@ -0,0 +1,56 @@
+package mailserver
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// maxDescriptorsPerMessage bounds the number of descriptors sent in a single
+// direct message, keeping messages well below the whisper size limit.
+const maxDescriptorsPerMessage = 1000
+
+// EnvelopeDescriptor describes an archived envelope without its payload. It
+// is delivered instead of the envelope to requests in metadata-only mode, as
+// part of the RLP-encoded list of descriptors making up the payload of a
+// direct message with the topic of the request.
+type EnvelopeDescriptor struct {
+	Hash  common.Hash
+	Topic whisper.TopicType
+	Sent  uint32 // time the envelope was sent at
+	Size  uint32 // RLP size of the envelope
+
+	// Arrival holds the arrival record of the envelope if requested and
+	// stored, and is omitted from the encoding otherwise.
+	Arrival []Arrival `rlp:"tail"`
+}
+
+func newEnvelopeDescriptor(env *whisper.Envelope, size int) EnvelopeDescriptor {
+	return EnvelopeDescriptor{
+		Hash:  env.Hash(),
+		Topic: env.Topic,
+		Sent:  env.Expiry - env.TTL,
+		Size:  uint32(size),
+	}
+}
+
+// newDescriptorMessages returns the direct messages delivering the given
+// descriptors in response to the request.
+func (s *WMailServer) newDescriptorMessages(r *messagesRequest, descriptors []EnvelopeDescriptor) ([]*whisper.Envelope, error) {
+	var messages []*whisper.Envelope
+	for len(descriptors) > 0 {
+		n := len(descriptors)
+		if n > maxDescriptorsPerMessage {
+			n = maxDescriptorsPerMessage
+		}
+
+		env, err := s.newDirectMessage(r.src, r.topic, descriptors[:n])
+		if err != nil {
+			return nil, fmt.Errorf("failed to create envelope descriptors: %s", err)
+		}
+		messages = append(messages, env)
+		descriptors = descriptors[n:]
+	}
+	return messages, nil
+}
@@ -0,0 +1,66 @@
+package mailserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadataOnlyRequest(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+
+	var archived []*whisper.Envelope
+	for i := 3; i > 0; i-- {
+		archived = append(archived, archiveEnvelope(t, now.Add(-time.Duration(i)*time.Second), server))
+	}
+
+	peerKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	r := &messagesRequest{
+		lower:        uint32(now.Add(-time.Minute).Unix()),
+		upper:        uint32(now.Unix()),
+		bloom:        whisper.MakeFullNodeBloom(),
+		src:          &peerKey.PublicKey,
+		metadataOnly: true,
+	}
+	messages, result := server.processRequest(nil, r)
+	require.Equal(t, 3, result.Delivered)
+	require.Len(t, messages, 1)
+
+	msg := messages[0].Open(&whisper.Filter{KeyAsym: peerKey})
+	require.NotNil(t, msg)
+	var descriptors []EnvelopeDescriptor
+	require.NoError(t, rlp.DecodeBytes(msg.Payload, &descriptors))
+	require.Len(t, descriptors, 3)
+	for i, env := range archived {
+		raw, err := rlp.EncodeToBytes(env)
+		require.NoError(t, err)
+		// arrival metadata is only included on request
+		require.Empty(t, descriptors[i].Arrival)
+		descriptors[i].Arrival = nil
+		require.Equal(t, newEnvelopeDescriptor(env, len(raw)), descriptors[i])
+	}
+}
+
+func TestDescriptorMessagesChunking(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+
+	peerKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	r := &messagesRequest{src: &peerKey.PublicKey}
+
+	messages, err := server.newDescriptorMessages(r, make([]EnvelopeDescriptor, maxDescriptorsPerMessage+1))
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+
+	messages, err = server.newDescriptorMessages(r, nil)
+	require.NoError(t, err)
+	require.Empty(t, messages)
+}
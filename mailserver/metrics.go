@@ -0,0 +1,52 @@
+package mailserver
+
+import "github.com/ethereum/go-ethereum/metrics"
+
+var (
+	archiveTooOldCounter   = metrics.NewRegisteredCounter("mailserver/ArchiveTooOld", nil)
+	archiveTooLargeCounter = metrics.NewRegisteredCounter("mailserver/ArchiveTooLarge", nil)
+	archiveFilteredCounter = metrics.NewRegisteredCounter("mailserver/ArchiveFiltered", nil)
+	archiveShortTTLCounter = metrics.NewRegisteredCounter("mailserver/ArchiveShortTTL", nil)
+	archiveEmptyCounter    = metrics.NewRegisteredCounter("mailserver/ArchiveEmpty", nil)
+	archiveLowPoWCounter   = metrics.NewRegisteredCounter("mailserver/ArchiveLowPoW", nil)
+	archiveTopicCounter    = metrics.NewRegisteredCounter("mailserver/ArchiveTopicRejected", nil)
+	archiveRewriteCounter  = metrics.NewRegisteredCounter("mailserver/ArchiveTopicRewritten", nil)
+	archiveWriteTimer      = metrics.NewRegisteredTimer("mailserver/ArchiveWrite", nil)
+	hashCollisionCounter   = metrics.NewRegisteredCounter("mailserver/HashCollision", nil)
+	hashIndexRepairCounter = metrics.NewRegisteredCounter("mailserver/HashIndexRepair", nil)
+
+	archivePausedGauge          = metrics.NewRegisteredGauge("mailserver/ArchivePaused", nil)
+	archivePauseRejectedCounter = metrics.NewRegisteredCounter("mailserver/ArchivePauseRejected", nil)
+
+	diskFullGauge          = metrics.NewRegisteredGauge("mailserver/DiskFull", nil)
+	archiveDiskFullCounter = metrics.NewRegisteredCounter("mailserver/ArchiveDiskFull", nil)
+
+	envelopeCacheHitCounter  = metrics.NewRegisteredCounter("mailserver/EnvelopeCacheHit", nil)
+	envelopeCacheMissCounter = metrics.NewRegisteredCounter("mailserver/EnvelopeCacheMiss", nil)
+
+	subscriptionDroppedCounter = metrics.NewRegisteredCounter("mailserver/SubscriptionDropped", nil)
+	mirrorSentCounter          = metrics.NewRegisteredCounter("mailserver/MirrorSent", nil)
+	mirrorFailedCounter        = metrics.NewRegisteredCounter("mailserver/MirrorFailed", nil)
+	mirrorDroppedCounter       = metrics.NewRegisteredCounter("mailserver/MirrorDropped", nil)
+
+	requestDeadlineCounter = metrics.NewRegisteredCounter("mailserver/RequestDeadlineExceeded", nil)
+	compactionTimer        = metrics.NewRegisteredTimer("mailserver/Compaction", nil)
+	coldMovedCounter       = metrics.NewRegisteredCounter("mailserver/ColdMoved", nil)
+	coldReadCounter        = metrics.NewRegisteredCounter("mailserver/ColdRead", nil)
+
+	openFilesExhaustedCounter = metrics.NewRegisteredCounter("mailserver/OpenFilesExhausted", nil)
+
+	requestAllowedCounter        = metrics.NewRegisteredCounter("mailserver/RequestAllowed", nil)
+	requestThrottledCounter      = metrics.NewRegisteredCounter("mailserver/RequestThrottled", nil)
+	requestTopicThrottledCounter = metrics.NewRegisteredCounter("mailserver/RequestTopicThrottled", nil)
+	requestQuotaExceededCounter  = metrics.NewRegisteredCounter("mailserver/RequestQuotaExceeded", nil)
+	inFlightRequestsGauge        = metrics.NewRegisteredGauge("mailserver/InFlightRequests", nil)
+	requestBusyCounter           = metrics.NewRegisteredCounter("mailserver/RequestServerBusy", nil)
+	limiterEvictedCounter        = metrics.NewRegisteredCounter("mailserver/LimiterEvicted", nil)
+	reputationEvictedCounter     = metrics.NewRegisteredCounter("mailserver/ReputationEvicted", nil)
+
+	deliveryAckedCounter   = metrics.NewRegisteredCounter("mailserver/DeliveryAcked", nil)
+	deliveryUnackedCounter = metrics.NewRegisteredCounter("mailserver/DeliveryUnacked", nil)
+	deliveryAckTimer       = metrics.NewRegisteredTimer("mailserver/DeliveryAck", nil)
+	deliveryLowPoWCounter  = metrics.NewRegisteredCounter("mailserver/DeliveryLowPoW", nil)
+)
@@ -0,0 +1,324 @@
+package mailserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var (
+	// versionKey holds the schema version of the archive.
+	versionKey = []byte{reservedPrefix, 'v'}
+	// migrationKey holds the progress of an interrupted migration.
+	migrationKey = []byte{reservedPrefix, 'm'}
+)
+
+// migrationBatchSize is the number of envelopes migrated per write, after
+// which the progress is saved.
+const migrationBatchSize = 1000
+
+// migrations upgrade the archive from one schema version to the next, the
+// migration at index i upgrading version i. They are resumable: the progress
+// passed in is the last key saved by an interrupted run, nil on a fresh start.
+var migrations = []func(db *leveldb.DB, indexMu *sync.Mutex, progress []byte) error{
+	migrateTopicIndex,
+	migrateHashIndex,
+	migrateTopicSizes,
+	migrateKeyLayout,
+	// the topic and topic size indexes were shared by all namespaces, they
+	// are rebuilt per namespace
+	migrateTopicIndex,
+	migrateTopicSizes,
+}
+
+// schemaVersion is the version of archives written by this mail server.
+var schemaVersion = uint32(len(migrations))
+
+// migrate brings the archive up to schemaVersion, resuming an interrupted
+// migration if there is one. indexMu guards the indexes of db.
+func migrate(db *leveldb.DB, indexMu *sync.Mutex, readOnly bool) error {
+	version, err := readVersion(db)
+	if err != nil {
+		return err
+	}
+	if version >= schemaVersion {
+		return nil
+	}
+	if readOnly {
+		log.Warn("Mail server archive is outdated and cannot be migrated in read-only mode",
+			"version", version, "expected", schemaVersion)
+		return nil
+	}
+
+	for ; version < schemaVersion; version++ {
+		progress, err := db.Get(migrationKey, nil)
+		if err == leveldb.ErrNotFound {
+			progress = nil
+		} else if err != nil {
+			return err
+		}
+
+		log.Info("Migrating mail server archive", "version", version, "resumed", progress != nil)
+		if err := migrations[version](db, indexMu, progress); err != nil {
+			return err
+		}
+
+		batch := new(leveldb.Batch)
+		batch.Delete(migrationKey)
+		batch.Put(versionKey, encodeVersion(version+1))
+		if err := db.Write(batch, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readVersion(db *leveldb.DB) (uint32, error) {
+	value, err := db.Get(versionKey, nil)
+	if err == leveldb.ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(value), nil
+}
+
+func encodeVersion(version uint32) []byte {
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, version)
+	return value
+}
+
+// migrateTopicIndex builds the topic index of archives written before it
+// was introduced. On a fresh start any existing index is dropped, so that
+// envelopes are never counted twice.
+func migrateTopicIndex(db *leveldb.DB, indexMu *sync.Mutex, progress []byte) error {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	if progress == nil {
+		if err := dropIndex(db, topicIndexPrefix); err != nil {
+			return err
+		}
+	}
+
+	i := db.NewIterator(nil, nil)
+	defer i.Release()
+
+	next := i.First
+	if progress != nil {
+		next = func() bool { return seekAfter(i, progress) }
+	}
+
+	var (
+		batch   = new(leveldb.Batch)
+		counts  = make(topicCounts)
+		pending int
+		lastKey []byte
+	)
+	for ok := next(); ok; ok = i.Next() {
+		if !isEnvelopeKey(i.Key()) || isTombstone(i.Value()) {
+			continue
+		}
+		lastKey = append(lastKey[:0], i.Key()...)
+		if err := counts.addEnvelope(i.Key(), i.Value(), 1); err != nil {
+			log.Warn("Skipping undecodable envelope during migration", "key", lastKey, "error", err)
+			continue
+		}
+		pending++
+
+		if pending == migrationBatchSize {
+			if err := writeMigrationBatch(db, batch, counts, lastKey); err != nil {
+				return err
+			}
+			batch = new(leveldb.Batch)
+			counts = make(topicCounts)
+			pending = 0
+		}
+	}
+	if err := i.Error(); err != nil {
+		return err
+	}
+
+	if pending > 0 {
+		return writeMigrationBatch(db, batch, counts, lastKey)
+	}
+	return nil
+}
+
+// writeMigrationBatch writes the accumulated counts along with the key of
+// the last migrated envelope, so that an interrupted run can be resumed.
+func writeMigrationBatch(db *leveldb.DB, batch *leveldb.Batch, counts topicCounts, lastKey []byte) error {
+	if err := counts.write(db, batch); err != nil {
+		return err
+	}
+	batch.Put(migrationKey, append([]byte(nil), lastKey...))
+	return db.Write(batch, nil)
+}
+
+// migrateHashIndex builds the hash index of archives written before it was
+// introduced, resuming from the last migrated key like the topic index
+// migration.
+func migrateHashIndex(db *leveldb.DB, indexMu *sync.Mutex, progress []byte) error {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	if progress == nil {
+		if err := dropIndex(db, hashIndexPrefix); err != nil {
+			return err
+		}
+	}
+
+	i := db.NewIterator(nil, nil)
+	defer i.Release()
+
+	next := i.First
+	if progress != nil {
+		next = func() bool { return seekAfter(i, progress) }
+	}
+
+	var (
+		changes = newHashIndexChanges()
+		pending int
+		lastKey []byte
+	)
+	for ok := next(); ok; ok = i.Next() {
+		if !isEnvelopeKey(i.Key()) || isTombstone(i.Value()) {
+			continue
+		}
+		lastKey = append(lastKey[:0], i.Key()...)
+		changes.Put(lastKey, i.Value())
+		pending++
+
+		if pending == migrationBatchSize {
+			if err := writeHashMigrationBatch(db, changes, lastKey); err != nil {
+				return err
+			}
+			changes = newHashIndexChanges()
+			pending = 0
+		}
+	}
+	if err := i.Error(); err != nil {
+		return err
+	}
+
+	if pending > 0 {
+		return writeHashMigrationBatch(db, changes, lastKey)
+	}
+	return nil
+}
+
+func writeHashMigrationBatch(db *leveldb.DB, changes *hashIndexChanges, lastKey []byte) error {
+	batch := new(leveldb.Batch)
+	if err := changes.write(db, batch); err != nil {
+		return err
+	}
+	batch.Put(migrationKey, append([]byte(nil), lastKey...))
+	return db.Write(batch, nil)
+}
+
+// migrateKeyLayout rewrites the envelopes archived under a legacy key
+// layout, i.e. under any key other than [namespace][sent time][hash] with a
+// big-endian sent time, e.g. by builds encoding the sent time in another
+// byte order, to the current layout. The layout is detected per envelope, so
+// that archives mixing both layouts are migrated fully. The indexes follow
+// the rewritten keys, and an envelope stored under both layouts is kept once.
+// whisper v5 envelopes and tombstones, whose key cannot be derived from
+// their value, are left as they are.
+func migrateKeyLayout(db *leveldb.DB, indexMu *sync.Mutex, progress []byte) error {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	i := db.NewIterator(nil, nil)
+	defer i.Release()
+
+	next := i.First
+	if progress != nil {
+		next = func() bool { return seekAfter(i, progress) }
+	}
+
+	var (
+		batch   = new(leveldb.Batch)
+		counts  = make(topicCounts)
+		pending int
+		lastKey []byte
+	)
+	for ok := next(); ok; ok = i.Next() {
+		if !isEnvelopeKey(i.Key()) || isTombstone(i.Value()) || EnvelopeVersion(i.Value()) != whisperV6 {
+			continue
+		}
+		var env whisper.Envelope
+		if err := rlp.DecodeBytes(i.Value(), &env); err != nil {
+			log.Warn("Skipping undecodable envelope during migration", "key", i.Key(), "error", err)
+			continue
+		}
+		key := NewNamespacedDbKey(keyNamespace(i.Key()), env.Expiry-env.TTL, env.Hash()).raw
+		if bytes.Equal(i.Key(), key) {
+			continue
+		}
+
+		lastKey = append(lastKey[:0], i.Key()...)
+		batch.Delete(append([]byte(nil), lastKey...))
+		exists, err := db.Has(key, nil)
+		if err != nil {
+			return err
+		}
+		if exists {
+			counts.add(key, env.Topic, -1)
+		} else {
+			batch.Put(key, append([]byte(nil), i.Value()...))
+		}
+		pending++
+
+		if pending == migrationBatchSize {
+			if err := writeKeyMigrationBatch(db, batch, counts, lastKey); err != nil {
+				return err
+			}
+			batch = new(leveldb.Batch)
+			counts = make(topicCounts)
+			pending = 0
+		}
+	}
+	if err := i.Error(); err != nil {
+		return err
+	}
+
+	if pending > 0 {
+		return writeKeyMigrationBatch(db, batch, counts, lastKey)
+	}
+	return nil
+}
+
+// writeKeyMigrationBatch writes the rewritten keys along with the matching
+// index changes and the last rewritten legacy key.
+func writeKeyMigrationBatch(db *leveldb.DB, batch *leveldb.Batch, counts topicCounts, lastKey []byte) error {
+	if err := updateTopicSizes(db, batch); err != nil {
+		return err
+	}
+	if err := updateHashIndex(db, batch); err != nil {
+		return err
+	}
+	return writeMigrationBatch(db, batch, counts, lastKey)
+}
+
+// dropIndex removes every key of the index with the given prefix.
+func dropIndex(db *leveldb.DB, prefix []byte) error {
+	i := db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer i.Release()
+
+	batch := new(leveldb.Batch)
+	for i.Next() {
+		batch.Delete(append([]byte(nil), i.Key()...))
+	}
+	if err := i.Error(); err != nil {
+		return err
+	}
+	return db.Write(batch, nil)
+}
@@ -0,0 +1,159 @@
+package mailserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrate(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+
+	// a legacy archive has envelopes but neither a topic index nor a version
+	var keys [][]byte
+	for i := 3; i > 0; i-- {
+		env, err := generateEnvelope(now.Add(-time.Duration(i) * time.Second))
+		require.NoError(t, err)
+		raw, err := rlp.EncodeToBytes(env)
+		require.NoError(t, err)
+		key := NewDbKey(env.Expiry-env.TTL, env.Hash()).raw
+		require.NoError(t, server.db.Put(key, raw, nil))
+		keys = append(keys, key)
+	}
+	topic := whisper.TopicType{0x1F, 0x7E, 0xA1, 0x7F}
+
+	// simulate a migration interrupted after the first envelope
+	require.NoError(t, server.db.Put(topicIndexKey(nil, topic), encodeCount(1), nil))
+	require.NoError(t, server.db.Put(migrationKey, keys[0], nil))
+
+	require.NoError(t, migrate(server.db, &server.indexMu, false))
+	counts, err := server.TopicCounts()
+	require.NoError(t, err)
+	require.Equal(t, map[whisper.TopicType]int64{topic: 3}, counts)
+
+	for _, key := range keys {
+		hashKeys, err := readHashKeys(server.db, hashIndexKey(envelopeKeyHash(key)))
+		require.NoError(t, err)
+		require.Equal(t, [][]byte{key}, hashKeys, "the hash index should be built")
+	}
+
+	version, err := readVersion(server.db)
+	require.NoError(t, err)
+	require.Equal(t, schemaVersion, version)
+	_, err = server.db.Get(migrationKey, nil)
+	require.Error(t, err, "progress should be cleared once the migration completes")
+
+	// migrations run only once
+	require.NoError(t, migrate(server.db, &server.indexMu, false))
+	counts, err = server.TopicCounts()
+	require.NoError(t, err)
+	require.Equal(t, map[whisper.TopicType]int64{topic: 3}, counts)
+
+	// a fresh run rebuilds the index from scratch
+	require.NoError(t, server.db.Delete(versionKey, nil))
+	require.NoError(t, migrate(server.db, &server.indexMu, false))
+	counts, err = server.TopicCounts()
+	require.NoError(t, err)
+	require.Equal(t, map[whisper.TopicType]int64{topic: 3}, counts)
+}
+
+func TestMigrateReadOnly(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+
+	require.NoError(t, migrate(server.db, &server.indexMu, true))
+	version, err := readVersion(server.db)
+	require.NoError(t, err)
+	require.Equal(t, uint32(0), version)
+}
+
+// legacyDbKey returns the key of an envelope in a legacy layout encoding its
+// sent time in little-endian order.
+func legacyDbKey(env *whisper.Envelope) []byte {
+	key := make([]byte, dbKeySize)
+	binary.LittleEndian.PutUint32(key, env.Expiry-env.TTL)
+	hash := env.Hash()
+	copy(key[4:], hash[:])
+	return key
+}
+
+func TestMigrateKeyLayout(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+
+	var (
+		envelopes []*whisper.Envelope
+		size      int64
+	)
+	for i := 4; i > 0; i-- {
+		env, err := generateEnvelope(now.Add(-time.Duration(i) * time.Second))
+		require.NoError(t, err)
+		raw, err := rlp.EncodeToBytes(env)
+		require.NoError(t, err)
+		envelopes = append(envelopes, env)
+		size += int64(len(raw))
+
+		// a mixed archive: the first envelopes are stored under the legacy
+		// layout, the last one under the current one, and one under both
+		if i <= 2 {
+			require.NoError(t, server.db.Put(NewDbKey(env.Expiry-env.TTL, env.Hash()).raw, raw, nil))
+		}
+		if i >= 2 {
+			require.NoError(t, server.db.Put(legacyDbKey(env), raw, nil))
+		}
+	}
+	topic := whisper.TopicType{0x1F, 0x7E, 0xA1, 0x7F}
+
+	require.NoError(t, migrate(server.db, &server.indexMu, false))
+	require.NoError(t, checkKeyFormat(server.db, false))
+	testMessagesCount(t, len(envelopes), server)
+	for _, env := range envelopes {
+		key := NewDbKey(env.Expiry-env.TTL, env.Hash()).raw
+		ok, err := server.db.Has(key, nil)
+		require.NoError(t, err)
+		require.True(t, ok, "envelopes should be stored under the current layout")
+		ok, err = server.db.Has(legacyDbKey(env), nil)
+		require.NoError(t, err)
+		require.False(t, ok, "legacy keys should be removed")
+
+		hashKeys, err := readHashKeys(server.db, hashIndexKey(env.Hash()))
+		require.NoError(t, err)
+		require.Equal(t, [][]byte{key}, hashKeys)
+	}
+
+	counts, err := server.TopicCounts()
+	require.NoError(t, err)
+	require.Equal(t, map[whisper.TopicType]int64{topic: int64(len(envelopes))}, counts, "envelopes under both layouts should be counted once")
+	sizes, err := server.TopicSizes()
+	require.NoError(t, err)
+	require.Equal(t, map[whisper.TopicType]int64{topic: size}, sizes)
+
+	// an interrupted migration resumes after the last rewritten key
+	var legacy [][]byte
+	for i := 2; i > 0; i-- {
+		env, err := generateEnvelope(now.Add(-time.Duration(i) * time.Minute))
+		require.NoError(t, err)
+		raw, err := rlp.EncodeToBytes(env)
+		require.NoError(t, err)
+		require.NoError(t, server.db.Put(legacyDbKey(env), raw, nil))
+		legacy = append(legacy, legacyDbKey(env))
+	}
+	if bytes.Compare(legacy[0], legacy[1]) > 0 {
+		legacy[0], legacy[1] = legacy[1], legacy[0]
+	}
+	require.NoError(t, migrateKeyLayout(server.db, &server.indexMu, legacy[0]))
+	ok, err := server.db.Has(legacy[0], nil)
+	require.NoError(t, err)
+	require.True(t, ok, "keys before the progress should be left to the interrupted run")
+	ok, err = server.db.Has(legacy[1], nil)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
@@ -0,0 +1,112 @@
+package mailserver
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/log"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// defaultMirrorQueueSize is the number of envelopes waiting to be mirrored
+// unless configured otherwise.
+const defaultMirrorQueueSize = 1000
+
+// mirror forwards newly archived envelopes to standby mail servers, keeping
+// them in sync in real time. Forwarding is best-effort: envelopes are taken
+// from a subscription, so that archiving is never blocked, and are dropped
+// when the queue is full or a standby cannot be reached.
+//
+// Whisper only hands envelopes received from peers to the mail server when
+// they are p2p requests, so envelopes are forwarded as such, and standby
+// servers archive those coming from their configured mirror sources instead
+// of serving them. Mirroring must not be configured in both directions, or
+// envelopes would be forwarded back and forth.
+type mirror struct {
+	peers [][]byte
+	sub   *Subscription
+	send  func(peerID []byte, env *whisper.Envelope) error
+	done  chan struct{}
+}
+
+func newMirror(peers [][]byte, sub *Subscription, send func([]byte, *whisper.Envelope) error) *mirror {
+	m := &mirror{peers: peers, sub: sub, send: send, done: make(chan struct{})}
+	go m.run()
+	return m
+}
+
+// run forwards envelopes until the subscription is closed.
+func (m *mirror) run() {
+	defer close(m.done)
+
+	var dropped int64
+	for env := range m.sub.C {
+		if d := m.sub.Dropped(); d > dropped {
+			mirrorDroppedCounter.Inc(d - dropped)
+			dropped = d
+		}
+		for _, peer := range m.peers {
+			if err := m.send(peer, env); err != nil {
+				log.Debug("Failed to mirror envelope", "peer", peer, "error", err)
+				mirrorFailedCounter.Inc(1)
+				continue
+			}
+			mirrorSentCounter.Inc(1)
+		}
+	}
+}
+
+// stop stops forwarding and waits for the envelope being forwarded, if any.
+func (m *mirror) stop() {
+	m.sub.Unsubscribe()
+	<-m.done
+}
+
+// setupMirror starts forwarding archived envelopes to the given standby
+// mail servers, if any.
+func (s *WMailServer) setupMirror(peers []string, queueSize int) error {
+	ids, err := decodePeerIDs(peers)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	if queueSize <= 0 {
+		queueSize = defaultMirrorQueueSize
+	}
+	s.mirror = newMirror(ids, s.Subscribe(queueSize), s.w.RequestHistoricMessages)
+	return nil
+}
+
+// setupMirrorSources sets the mail servers whose forwarded envelopes are
+// archived.
+func (s *WMailServer) setupMirrorSources(peers []string) error {
+	ids, err := decodePeerIDs(peers)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if s.mirrorSources == nil {
+			s.mirrorSources = make(map[string]struct{})
+		}
+		s.mirrorSources[string(id)] = struct{}{}
+	}
+	return nil
+}
+
+func (s *WMailServer) isMirrorSource(peerID []byte) bool {
+	_, ok := s.mirrorSources[string(peerID)]
+	return ok
+}
+
+// decodePeerIDs decodes hex-encoded peer IDs.
+func decodePeerIDs(peers []string) ([][]byte, error) {
+	var ids [][]byte
+	for _, peer := range peers {
+		id, err := hex.DecodeString(strings.TrimPrefix(peer, "0x"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer ID %s: %s", peer, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
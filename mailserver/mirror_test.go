@@ -0,0 +1,58 @@
+package mailserver
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMirror(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+
+	var (
+		mu        sync.Mutex
+		forwarded = make(map[string][]*whisper.Envelope)
+		sent      = make(chan struct{}, 10)
+	)
+	send := func(peerID []byte, env *whisper.Envelope) error {
+		defer func() { sent <- struct{}{} }()
+		if string(peerID) == "unreachable" {
+			return errors.New("peer not connected")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		forwarded[string(peerID)] = append(forwarded[string(peerID)], env)
+		return nil
+	}
+	peers := [][]byte{[]byte("unreachable"), []byte("standby")}
+	server.mirror = newMirror(peers, server.Subscribe(10), send)
+
+	env := archiveEnvelope(t, time.Now(), server)
+	for range peers {
+		<-sent
+	}
+	mu.Lock()
+	require.Equal(t, []*whisper.Envelope{env}, forwarded["standby"], "an unreachable peer should not prevent mirroring")
+	mu.Unlock()
+
+	server.mirror.stop()
+	archiveEnvelope(t, time.Now(), server)
+	require.Len(t, sent, 0, "envelopes should not be mirrored once stopped")
+}
+
+func TestSetupMirrorSources(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+
+	require.False(t, server.isMirrorSource([]byte{0x01}))
+	require.Error(t, server.setupMirrorSources([]string{"not hex"}))
+	require.NoError(t, server.setupMirrorSources([]string{"0x01", "02"}))
+	require.True(t, server.isMirrorSource([]byte{0x01}))
+	require.True(t, server.isMirrorSource([]byte{0x02}))
+	require.False(t, server.isMirrorSource([]byte{0x03}))
+}
@@ -0,0 +1,144 @@
+package mailserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+// monitoringShutdownTimeout bounds the time spent waiting for scrapes in
+// progress when the monitoring endpoint is stopped.
+const monitoringShutdownTimeout = 5 * time.Second
+
+// Quantiles of timers and histograms exposed to Prometheus.
+var monitoringQuantiles = []float64{0.5, 0.95, 0.99}
+
+var errMonitoringTLS = errors.New("monitoring endpoint requires both a TLS certificate and key")
+
+// startMonitoring serves the metrics in the Prometheus text format on
+// /metrics and the health of the mail server on /healthz, over HTTPS.
+func (s *WMailServer) startMonitoring(addr, certFile, keyFile string) error {
+	if certFile == "" || keyFile == "" {
+		return errMonitoringTLS
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listen on monitoring address: %s", err)
+	}
+	s.monitor = &http.Server{Handler: s.monitoringHandler()}
+	go func() {
+		if err := s.monitor.ServeTLS(listener, certFile, keyFile); err != http.ErrServerClosed {
+			log.Error("Mail server monitoring endpoint failed", "addr", addr, "error", err)
+		}
+	}()
+	log.Info("Mail server monitoring endpoint started", "addr", addr)
+	return nil
+}
+
+// stopMonitoring stops the monitoring endpoint, if it was started.
+func (s *WMailServer) stopMonitoring() {
+	if s.monitor == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), monitoringShutdownTimeout)
+	defer cancel()
+	if err := s.monitor.Shutdown(ctx); err != nil {
+		log.Warn("Failed to stop the mail server monitoring endpoint", "error", err)
+	}
+}
+
+func (s *WMailServer) monitoringHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writePrometheus(w, metrics.DefaultRegistry)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.health(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok") // nolint: errcheck
+	})
+	return mux
+}
+
+// health returns an error if the mail server is shutting down or its DB is
+// not usable.
+func (s *WMailServer) health() error {
+	if s.isDraining() {
+		return errShuttingDown
+	}
+	if _, err := s.db.GetProperty("leveldb.num-files-at-level0"); err != nil {
+		return fmt.Errorf("DB is not usable: %s", err)
+	}
+	return nil
+}
+
+// writePrometheus writes the metrics of the registry in the Prometheus text
+// exposition format, sorted by name. Timers and histograms are exposed as
+// summaries, meters as counters.
+func writePrometheus(w io.Writer, r metrics.Registry) {
+	all := make(map[string]interface{})
+	r.Each(func(name string, metric interface{}) {
+		all[name] = metric
+	})
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		n := prometheusName(name)
+		switch metric := all[name].(type) {
+		case metrics.Counter:
+			writeSample(w, n, "counter", metric.Count())
+		case metrics.Gauge:
+			writeSample(w, n, "gauge", metric.Value())
+		case metrics.GaugeFloat64:
+			writeSample(w, n, "gauge", metric.Value())
+		case metrics.Meter:
+			writeSample(w, n, "counter", metric.Count())
+		case metrics.Timer:
+			t := metric.Snapshot()
+			writeSummary(w, n, t.Percentiles(monitoringQuantiles), t.Sum(), t.Count())
+		case metrics.Histogram:
+			h := metric.Snapshot()
+			writeSummary(w, n, h.Percentiles(monitoringQuantiles), h.Sum(), h.Count())
+		}
+	}
+}
+
+func writeSample(w io.Writer, name, kind string, value interface{}) {
+	fmt.Fprintf(w, "# TYPE %s %s\n%s %v\n", name, kind, name, value) // nolint: errcheck
+}
+
+func writeSummary(w io.Writer, name string, quantiles []float64, sum, count int64) {
+	fmt.Fprintf(w, "# TYPE %s summary\n", name) // nolint: errcheck
+	for i, q := range monitoringQuantiles {
+		fmt.Fprintf(w, "%s{quantile=\"%v\"} %v\n", name, q, quantiles[i]) // nolint: errcheck
+	}
+	fmt.Fprintf(w, "%s_sum %d\n%s_count %d\n", name, sum, name, count) // nolint: errcheck
+}
+
+// prometheusName turns a metric name such as mailserver/ArchiveWrite into a
+// valid Prometheus name.
+func prometheusName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == ':' {
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,54 @@
+package mailserver
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	r := metrics.NewRegistry()
+	counter := &metrics.StandardCounter{}
+	counter.Inc(3)
+	require.NoError(t, r.Register("mailserver/RequestAllowed", counter))
+	gauge := &metrics.StandardGauge{}
+	gauge.Update(7)
+	require.NoError(t, r.Register("mailserver/InFlightRequests", gauge))
+
+	var b bytes.Buffer
+	writePrometheus(&b, r)
+	require.Equal(t, "# TYPE mailserver_InFlightRequests gauge\nmailserver_InFlightRequests 7\n"+
+		"# TYPE mailserver_RequestAllowed counter\nmailserver_RequestAllowed 3\n", b.String())
+}
+
+func TestHealthz(t *testing.T) {
+	server := setupTestServer(t)
+	handler := server.monitoringHandler()
+
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+
+	require.Equal(t, http.StatusOK, get("/healthz"))
+	require.Equal(t, http.StatusOK, get("/metrics"))
+
+	server.PrepareShutdown()
+	require.Equal(t, http.StatusServiceUnavailable, get("/healthz"), "draining servers are unhealthy")
+
+	server.draining = false
+	require.NoError(t, server.db.Close())
+	require.Equal(t, http.StatusServiceUnavailable, get("/healthz"), "closed DBs are unhealthy")
+}
+
+func TestStartMonitoringRequiresTLS(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+	require.Equal(t, errMonitoringTLS, server.startMonitoring("127.0.0.1:0", "cert.pem", ""))
+	require.Nil(t, server.monitor)
+}
@@ -0,0 +1,86 @@
+package mailserver
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Envelopes archived in a namespace, e.g. for one of several networks
+// served by the same process, are stored under keys prefixed with
+// namespacePrefix and a hash of the namespace name. As a timestamp the
+// prefix would only be reached in 2105, so namespaced keys never fall in
+// the range scans of another namespace. The default namespace is empty and
+// keeps the bare [timestamp][hash] layout.
+const (
+	namespacePrefix   = 0xFE
+	namespaceHashSize = 4
+	namespaceSize     = 1 + namespaceHashSize
+	namespacedKeySize = namespaceSize + dbKeySize
+)
+
+// newNamespace returns the key prefix of the named namespace, nil for the
+// default namespace.
+func newNamespace(name string) []byte {
+	if name == "" {
+		return nil
+	}
+	return append([]byte{namespacePrefix}, crypto.Keccak256([]byte(name))[:namespaceHashSize]...)
+}
+
+// NewNamespacedDbKey creates a new DBKey with the given values in the
+// namespace with the given prefix.
+func NewNamespacedDbKey(namespace []byte, t uint32, h common.Hash) *DBKey {
+	var k DBKey
+	k.timestamp = t
+	k.hash = h
+	k.raw = make([]byte, len(namespace)+dbKeySize)
+	n := copy(k.raw, namespace)
+	binary.BigEndian.PutUint32(k.raw[n:], k.timestamp)
+	copy(k.raw[n+4:], k.hash[:])
+	return &k
+}
+
+// stripNamespace returns the [timestamp][hash] part of an envelope key.
+func stripNamespace(key []byte) []byte {
+	return key[len(key)-dbKeySize:]
+}
+
+// keyNamespace returns the namespace part of an envelope key, nil for the
+// default namespace.
+func keyNamespace(key []byte) []byte {
+	if len(key) == dbKeySize {
+		return nil
+	}
+	return key[:len(key)-dbKeySize]
+}
+
+// keySentTime returns the sent time embedded in an envelope key.
+func keySentTime(key []byte) uint32 {
+	return binary.BigEndian.Uint32(stripNamespace(key))
+}
+
+// namespacedKey prefixes a [timestamp][hash] key with the namespace of the
+// server.
+func (s *WMailServer) namespacedKey(key []byte) []byte {
+	return append(append([]byte(nil), s.namespace...), key...)
+}
+
+// namespaceRange returns the range spanning the envelope keys of the
+// namespace of the server. The range of the default namespace stops short of
+// the other namespaces and of the reserved keys.
+func (s *WMailServer) namespaceRange() *util.Range {
+	if s.namespace == nil {
+		return &util.Range{Start: []byte{}, Limit: []byte{namespacePrefix}}
+	}
+	return util.BytesPrefix(s.namespace)
+}
+
+// inNamespace reports whether the key is an envelope key of the namespace of
+// the server.
+func (s *WMailServer) inNamespace(key []byte) bool {
+	return len(key) == len(s.namespace)+dbKeySize && bytes.HasPrefix(key, s.namespace)
+}
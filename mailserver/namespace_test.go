@@ -0,0 +1,99 @@
+package mailserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamespaces(t *testing.T) {
+	now := time.Now()
+	defaultNS := setupTestServer(t)
+	defer defaultNS.Close()
+	other := &WMailServer{db: defaultNS.db, pow: defaultNS.pow, namespace: newNamespace("other")}
+
+	// the default namespace keeps today's layout
+	require.Nil(t, newNamespace(""))
+	env := archiveEnvelope(t, now.Add(-time.Minute), defaultNS)
+	_, err := defaultNS.db.Get(NewDbKey(env.Expiry-env.TTL, env.Hash()).raw, nil)
+	require.NoError(t, err)
+
+	var archived []*whisper.Envelope
+	for i := 3; i > 0; i-- {
+		env, err := generateEnvelope(now.Add(-time.Duration(i) * time.Second))
+		require.NoError(t, err)
+		require.NoError(t, other.archive(env))
+		archived = append(archived, env)
+	}
+
+	r := &messagesRequest{
+		lower: uint32(now.Add(-time.Hour).Unix()),
+		upper: uint32(now.Unix()) + 1,
+		bloom: whisper.MakeFullNodeBloom(),
+	}
+	mail, _ := defaultNS.processRequest(nil, r)
+	require.Len(t, mail, 1, "envelopes of other namespaces should not be delivered")
+	require.Equal(t, env.Hash(), mail[0].Hash())
+
+	// truncated requests resume within their namespace
+	r.limit = 2
+	mail, result := other.processRequest(nil, r)
+	require.Len(t, mail, 2)
+	r.cursor = result.NextCursor
+	rest, _ := other.processRequest(nil, r)
+	require.Len(t, rest, 1)
+	require.Equal(t, archived[2].Hash(), rest[0].Hash())
+
+	removed, err := other.DeleteRange(now.Add(-time.Hour), now)
+	require.NoError(t, err)
+	require.Equal(t, 3, removed)
+	testMessagesCount(t, 1, defaultNS)
+}
+
+func TestNamespacedTopicIndexes(t *testing.T) {
+	now := time.Now()
+	defaultNS := setupTestServer(t)
+	defer defaultNS.Close()
+	other := &WMailServer{db: defaultNS.db, pow: defaultNS.pow, namespace: newNamespace("other")}
+
+	env := archiveEnvelope(t, now.Add(-2*time.Second), defaultNS)
+	archiveEnvelope(t, now.Add(-time.Second), defaultNS)
+	otherTopic := whisper.TopicType{0xFE, 0x01, 0x02, 0x03}
+	otherEnv, err := BuildEnvelope(otherTopic, []byte("other payload"), now.Add(-time.Second))
+	require.NoError(t, err)
+	require.NoError(t, other.archive(otherEnv))
+	raw, err := rlp.EncodeToBytes(otherEnv)
+	require.NoError(t, err)
+
+	counts, err := defaultNS.TopicCounts()
+	require.NoError(t, err)
+	require.Equal(t, map[whisper.TopicType]int64{env.Topic: 2}, counts)
+	topics, err := other.Topics()
+	require.NoError(t, err)
+	require.Equal(t, []whisper.TopicType{otherTopic}, topics)
+	sizes, err := other.TopicSizes()
+	require.NoError(t, err)
+	require.Equal(t, map[whisper.TopicType]int64{otherTopic: int64(len(raw))}, sizes)
+	sizes, err = defaultNS.TopicSizes()
+	require.NoError(t, err)
+	require.Len(t, sizes, 1)
+	require.Contains(t, sizes, env.Topic)
+
+	// indexes shared by all namespaces are rebuilt per namespace
+	require.NoError(t, defaultNS.db.Put(topicIndexKey(nil, otherTopic), encodeCount(1), nil))
+	require.NoError(t, defaultNS.db.Put(topicSizeKey(nil, otherTopic), encodeCount(int64(len(raw))), nil))
+	require.NoError(t, defaultNS.db.Put(versionKey, encodeVersion(4), nil))
+	require.NoError(t, migrate(defaultNS.db, &defaultNS.indexMu, false))
+	counts, err = defaultNS.TopicCounts()
+	require.NoError(t, err)
+	require.Equal(t, map[whisper.TopicType]int64{env.Topic: 2}, counts)
+	sizes, err = defaultNS.TopicSizes()
+	require.NoError(t, err)
+	require.NotContains(t, sizes, otherTopic)
+	counts, err = other.TopicCounts()
+	require.NoError(t, err)
+	require.Equal(t, map[whisper.TopicType]int64{otherTopic: 1}, counts)
+}
@@ -0,0 +1,108 @@
+package mailserver
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// processNewestPerTopic delivers the newest envelope matching the request of
+// every topic, e.g. for a client rebuilding the previews of its chat list.
+// The window is scanned backwards, from the newest envelope, and envelopes of
+// topics already found are skipped without being decoded. Envelopes are
+// delivered oldest first, so like any other response, and at most
+// maxRequestTopics topics are served: the response is truncated past that
+// many, past the limit of the request or its deadline, without a cursor, and
+// cursors are ignored.
+func (s *WMailServer) processNewestPerTopic(r *messagesRequest, fn func(*whisper.Envelope) error) (result RequestResult, err error) {
+	start := time.Now()
+
+	var zero common.Hash
+	kl := NewNamespacedDbKey(s.namespace, r.lower, zero)
+	ku := NewNamespacedDbKey(s.namespace, r.scanLimit(), zero)
+	i, err := s.newRangeIterator(&util.Range{Start: kl.raw, Limit: ku.raw})
+	if err != nil {
+		return result, err
+	}
+	defer i.Release()
+
+	maxTopics := maxRequestTopics
+	if r.limit > 0 && int(r.limit) < maxTopics {
+		maxTopics = int(r.limit)
+	}
+	var (
+		lastKey []byte // last scanned key
+		opened  int    // envelopes decrypted to recover their sender
+		pow     = s.minimumPoW()
+		found   = make(map[whisper.TopicType]struct{})
+		newest  []*whisper.Envelope // newest first
+	)
+	for ok := i.Last(); ok; ok = i.Prev() {
+		if !isEnvelopeKey(i.Key()) || isTombstone(i.Value()) {
+			continue
+		}
+		// an envelope being moved to the cold storage can be seen in both tiers
+		if bytes.Equal(i.Key(), lastKey) {
+			continue
+		}
+		if len(r.topics) > 0 && len(found) == len(r.topics) {
+			break
+		}
+		if len(found) >= maxTopics || (s.queryDeadline > 0 && time.Since(start) > s.queryDeadline) ||
+			(r.sender != nil && s.maxSenderScan > 0 && opened >= s.maxSenderScan) {
+			result.Truncated = true
+			break
+		}
+		result.Scanned++
+		lastKey = append(lastKey[:0], i.Key()...)
+
+		if r.version != 0 && EnvelopeVersion(i.Value()) != r.version {
+			continue
+		}
+		// fast path: envelopes of topics already found are skipped without decoding
+		if topic, ok := readEnvelopeTopic(i.Value()); ok {
+			if _, ok := found[topic]; ok {
+				continue
+			}
+		}
+
+		var envelope *whisper.Envelope
+		if envelope, err = s.decodeEnvelope(i.Key(), i.Value()); err != nil {
+			log.Error(fmt.Sprintf("RLP decoding failed: %s", err))
+			continue
+		}
+		if !r.match(envelope) {
+			continue
+		}
+		if r.sender != nil {
+			opened++
+			if !r.matchSender(envelope) {
+				continue
+			}
+		}
+		if s.deliveryPoW && envelope.PoW() < pow {
+			deliveryLowPoWCounter.Inc(1)
+			continue
+		}
+
+		found[envelope.Topic] = struct{}{}
+		newest = append(newest, envelope)
+		result.Bytes += len(i.Value())
+	}
+	if err = i.Error(); err != nil {
+		return result, fmt.Errorf("Level DB iterator error: %s", err)
+	}
+
+	for j := len(newest) - 1; j >= 0; j-- {
+		if err = fn(newest[j]); err != nil {
+			return result, err
+		}
+		result.Delivered++
+	}
+	return result, nil
+}
@@ -0,0 +1,105 @@
+package mailserver
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewestPerTopic(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+
+	topics := []whisper.TopicType{
+		whisper.BytesToTopic([]byte("abcd")),
+		whisper.BytesToTopic([]byte("efgh")),
+		whisper.BytesToTopic([]byte("ijkl")),
+	}
+	// every topic gets three envelopes, the last topic being the most recent
+	var archived []*whisper.Envelope
+	for i := 0; i < 9; i++ {
+		env, err := BuildEnvelope(topics[i%len(topics)], []byte{byte(i)}, now.Add(-time.Duration(10-i)*time.Minute))
+		require.NoError(t, err)
+		require.NoError(t, server.archive(env))
+		archived = append(archived, env)
+	}
+	newest := archived[6:]
+
+	request := func(r *messagesRequest) ([]common.Hash, RequestResult) {
+		r.lower = uint32(now.Add(-time.Hour).Unix())
+		r.upper = uint32(now.Unix())
+		r.newestPerTopic = true
+		var delivered []*whisper.Envelope
+		result, err := server.processRequestStream(r, func(env *whisper.Envelope) error {
+			delivered = append(delivered, env)
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, len(delivered), result.Delivered)
+		return hashes(delivered), result
+	}
+
+	testCases := []struct {
+		request   *messagesRequest
+		expected  []*whisper.Envelope
+		truncated bool
+		info      string
+	}{
+		{&messagesRequest{bloom: whisper.MakeFullNodeBloom()}, newest, false, "bloom matching every topic"},
+		{&messagesRequest{topics: topics[:2]}, newest[:2], false, "exact topics"},
+		{&messagesRequest{topics: topics[:1], limit: 5}, newest[:1], false, "single topic under the limit"},
+		{&messagesRequest{bloom: whisper.MakeFullNodeBloom(), limit: 2}, newest[1:], true, "limit on topics"},
+	}
+	for _, tc := range testCases {
+		delivered, result := request(tc.request)
+		require.Equal(t, hashes(tc.expected), delivered, tc.info)
+		require.Equal(t, tc.truncated, result.Truncated, tc.info)
+	}
+
+	// removed envelopes give way to the previous envelope of their topic
+	_, err := server.DeleteRange(now.Add(-4*time.Minute), now.Add(-4*time.Minute))
+	require.NoError(t, err)
+	delivered, _ := request(&messagesRequest{topics: topics[:1]})
+	require.Equal(t, hashes(archived[3:4]), delivered)
+}
+
+func TestNewestPerTopicBound(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+
+	for i := 0; i <= maxRequestTopics; i++ {
+		var topic [4]byte
+		binary.BigEndian.PutUint32(topic[:], uint32(i))
+		env, err := BuildEnvelope(whisper.BytesToTopic(topic[:]), nil, now.Add(-time.Duration(i+1)*time.Second))
+		require.NoError(t, err)
+		require.NoError(t, server.archive(env))
+	}
+
+	r := &messagesRequest{
+		lower:          uint32(now.Add(-time.Hour).Unix()),
+		upper:          uint32(now.Unix()),
+		bloom:          whisper.MakeFullNodeBloom(),
+		newestPerTopic: true,
+	}
+	result, err := server.processRequestStream(r, func(*whisper.Envelope) error { return nil })
+	require.NoError(t, err)
+	require.Equal(t, maxRequestTopics, result.Delivered)
+	require.True(t, result.Truncated)
+}
+
+func TestDecodeNewestOption(t *testing.T) {
+	option, err := newRequestOption(newestCode, true)
+	require.NoError(t, err)
+	raw, err := encodeRequestOptions(option)
+	require.NoError(t, err)
+
+	var r messagesRequest
+	require.NoError(t, decodeRequestOptions(raw, &r))
+	require.True(t, r.newestPerTopic)
+}
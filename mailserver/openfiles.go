@@ -0,0 +1,63 @@
+package mailserver
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// openFilesRetryDelay is how long a request failing on the open files limit
+// waits before being retried, for other requests to release their files.
+const openFilesRetryDelay = time.Second
+
+// isTooManyOpenFiles reports whether the error is caused by the process
+// running out of file descriptors, which LevelDB hits under heavy concurrent
+// reads as every table file read is kept open.
+func isTooManyOpenFiles(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	if err == syscall.EMFILE || err == syscall.ENFILE {
+		return true
+	}
+	// the error may have been wrapped in a message, e.g. by the iterator
+	return strings.Contains(err.Error(), syscall.EMFILE.Error()) ||
+		strings.Contains(err.Error(), syscall.ENFILE.Error())
+}
+
+// processRequestStreamRetrying runs processRequestStream, retrying once after
+// a delay if it ran out of file descriptors before delivering anything.
+func (s *WMailServer) processRequestStreamRetrying(r *messagesRequest, fn func(*whisper.Envelope) error) (RequestResult, error) {
+	result, err := s.processRequestStream(r, fn)
+	if !isTooManyOpenFiles(err) {
+		return result, err
+	}
+	s.onTooManyOpenFiles(err)
+	if result.Delivered > 0 {
+		return result, err
+	}
+	time.Sleep(openFilesRetryDelay)
+	return s.processRequestStream(r, fn)
+}
+
+// onTooManyOpenFiles reports running out of file descriptors and, if
+// configured, lowers the number of requests served at once for a while.
+func (s *WMailServer) onTooManyOpenFiles(err error) {
+	openFilesExhaustedCounter.Inc(1)
+	log.Error(fmt.Sprintf("Mail server ran out of file descriptors: %s. Raise the open files limit of the process, "+
+		"e.g. with ulimit -n, or lower MailServerMaxConcurrentRequests", err))
+	if s.scheduler != nil && s.openFilesBackoff > 0 {
+		s.scheduler.reduce(s.openFilesBackoff)
+	}
+}
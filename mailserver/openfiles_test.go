@@ -0,0 +1,71 @@
+package mailserver
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/stretchr/testify/require"
+)
+
+// exhaustedColdStorage fails to read as many times as set, as if the process
+// ran out of file descriptors.
+type exhaustedColdStorage struct {
+	ColdStorage
+	failures int
+}
+
+func (e *exhaustedColdStorage) Range(start, limit []byte) ([]ColdEntry, error) {
+	if e.failures > 0 {
+		e.failures--
+		return nil, &os.PathError{Op: "open", Path: "000001.ldb", Err: syscall.EMFILE}
+	}
+	return e.ColdStorage.Range(start, limit)
+}
+
+func TestIsTooManyOpenFiles(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected bool
+		info     string
+	}{
+		{nil, false, "no error"},
+		{errors.New("leveldb: closed"), false, "other error"},
+		{syscall.EMFILE, true, "process limit"},
+		{&os.PathError{Op: "open", Path: "000001.ldb", Err: syscall.ENFILE}, true, "system limit"},
+		{fmt.Errorf("Level DB iterator error: %s", &os.PathError{Op: "open", Path: "000001.ldb", Err: syscall.EMFILE}), true, "wrapped error"},
+	}
+	for _, tc := range testCases {
+		require.Equal(t, tc.expected, isTooManyOpenFiles(tc.err), tc.info)
+	}
+}
+
+func TestTooManyOpenFilesRetry(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+	archiveEnvelope(t, now.Add(-time.Minute), server)
+	server.scheduler = newScheduler(4)
+	server.openFilesBackoff = time.Hour
+
+	cold := &exhaustedColdStorage{ColdStorage: newMemColdStorage(), failures: 1}
+	server.coldStorage = cold
+	r := &messagesRequest{
+		lower: uint32(now.Add(-time.Hour).Unix()),
+		upper: uint32(now.Unix()),
+		bloom: whisper.MakeFullNodeBloom(),
+	}
+
+	mail, _ := server.processRequest(nil, r)
+	require.Len(t, mail, 1, "the request should be retried")
+	require.Equal(t, 2, server.scheduler.free, "the concurrency should be halved")
+
+	// the request is given up on if it keeps failing
+	cold.failures = 2
+	mail, _ = server.processRequest(nil, r)
+	require.Len(t, mail, 0)
+}
@@ -0,0 +1,30 @@
+package mailserver
+
+import (
+	"bytes"
+	"sort"
+
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// topicOrderGroup holds the matching envelopes sent in the same second, in
+// key order, until they can be delivered in topic order.
+type topicOrderGroup struct {
+	sent      uint32
+	envelopes []*whisper.Envelope
+}
+
+// flush calls fn for every envelope of the group by topic, keeping the key
+// order of envelopes of the same topic, and empties the group.
+func (g *topicOrderGroup) flush(fn func(*whisper.Envelope) error) error {
+	sort.SliceStable(g.envelopes, func(i, j int) bool {
+		return bytes.Compare(g.envelopes[i].Topic[:], g.envelopes[j].Topic[:]) < 0
+	})
+	for _, env := range g.envelopes {
+		if err := fn(env); err != nil {
+			return err
+		}
+	}
+	g.envelopes = g.envelopes[:0]
+	return nil
+}
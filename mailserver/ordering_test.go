@@ -0,0 +1,112 @@
+package mailserver
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSameSecondOrdering(t *testing.T) {
+	sent := time.Now().Add(-time.Minute).Truncate(time.Second)
+	server := setupTestServer(t)
+	defer server.Close()
+
+	topics := []whisper.TopicType{
+		whisper.BytesToTopic([]byte("efgh")),
+		whisper.BytesToTopic([]byte("abcd")),
+		whisper.BytesToTopic([]byte("ijkl")),
+	}
+	var archived []*whisper.Envelope
+	for i := 0; i < 9; i++ {
+		// the first three envelopes are sent a second before the others
+		at := sent
+		if i >= 3 {
+			at = sent.Add(time.Second)
+		}
+		env, err := BuildEnvelope(topics[i%len(topics)], []byte{byte(i)}, at)
+		require.NoError(t, err)
+		require.NoError(t, server.archive(env))
+		archived = append(archived, env)
+	}
+
+	r := &messagesRequest{
+		lower: uint32(sent.Unix()),
+		upper: uint32(sent.Add(time.Minute).Unix()),
+		bloom: whisper.MakeFullNodeBloom(),
+	}
+	deliver := func(r *messagesRequest) ([]*whisper.Envelope, RequestResult) {
+		var delivered []*whisper.Envelope
+		result, err := server.processRequestStream(r, func(env *whisper.Envelope) error {
+			delivered = append(delivered, env)
+			return nil
+		})
+		require.NoError(t, err)
+		return delivered, result
+	}
+
+	// envelopes sent in the same second are delivered by hash, whatever the
+	// order they were archived in
+	delivered, _ := deliver(r)
+	require.Len(t, delivered, len(archived))
+	for i := 1; i < len(delivered); i++ {
+		prev, cur := delivered[i-1], delivered[i]
+		if prev.Expiry-prev.TTL == cur.Expiry-cur.TTL {
+			prevHash, curHash := prev.Hash(), cur.Hash()
+			require.True(t, bytes.Compare(prevHash[:], curHash[:]) < 0, "same second envelopes should be ordered by hash")
+		}
+	}
+	again, _ := deliver(r)
+	require.Equal(t, hashes(delivered), hashes(again), "order should be stable across requests")
+
+	// with topic order, envelopes sent in the same second are delivered by
+	// topic, then by hash
+	r.topicOrder = true
+	ordered, _ := deliver(r)
+	require.Len(t, ordered, len(archived))
+	for i := 1; i < len(ordered); i++ {
+		prev, cur := ordered[i-1], ordered[i]
+		if prev.Expiry-prev.TTL != cur.Expiry-cur.TTL {
+			require.True(t, prev.Expiry-prev.TTL < cur.Expiry-cur.TTL)
+			continue
+		}
+		order := bytes.Compare(prev.Topic[:], cur.Topic[:])
+		prevHash, curHash := prev.Hash(), cur.Hash()
+		require.True(t, order < 0 || (order == 0 && bytes.Compare(prevHash[:], curHash[:]) < 0),
+			"same second envelopes should be ordered by topic, then hash")
+	}
+	require.Equal(t, topics[1], ordered[0].Topic)
+	require.Equal(t, topics[1], ordered[3].Topic)
+
+	// limited responses are only truncated between seconds
+	r.limit = 1
+	first, result := deliver(r)
+	require.Equal(t, hashes(ordered[:3]), hashes(first))
+	require.True(t, result.Truncated)
+	r.cursor = result.NextCursor
+	rest, result := deliver(r)
+	require.Equal(t, hashes(ordered[3:]), hashes(rest))
+	require.False(t, result.Truncated)
+}
+
+func TestDecodeTopicOrderOption(t *testing.T) {
+	option, err := newRequestOption(topicOrderCode, true)
+	require.NoError(t, err)
+	raw, err := encodeRequestOptions(option)
+	require.NoError(t, err)
+
+	var r messagesRequest
+	require.NoError(t, decodeRequestOptions(raw, &r))
+	require.True(t, r.topicOrder)
+}
+
+func hashes(envelopes []*whisper.Envelope) []common.Hash {
+	var result []common.Hash
+	for _, env := range envelopes {
+		result = append(result, env.Hash())
+	}
+	return result
+}
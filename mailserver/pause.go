@@ -0,0 +1,75 @@
+package mailserver
+
+import (
+	"errors"
+
+	"github.com/ethereum/go-ethereum/log"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+var (
+	errArchivingPaused = errors.New("archiving is paused")
+	errPauseQueueFull  = errors.New("archiving is paused and its queue is full")
+)
+
+// PauseArchiving stops writing envelopes to the DB, e.g. during maintenance,
+// without dropping the whisper subscription. While paused, envelopes are
+// queued in memory up to MailServerPauseQueueSize, or rejected if the queue
+// is disabled or full.
+func (s *WMailServer) PauseArchiving() {
+	s.pauseMu.Lock()
+	defer s.pauseMu.Unlock()
+
+	if !s.paused {
+		log.Info("Mail server archiving paused", "queue", s.pauseQueueSize)
+	}
+	s.paused = true
+	archivePausedGauge.Update(1)
+}
+
+// ResumeArchiving resumes writing envelopes to the DB and archives those
+// queued while paused.
+func (s *WMailServer) ResumeArchiving() {
+	s.pauseMu.Lock()
+	queued := s.pauseQueue
+	s.paused = false
+	s.pauseQueue = nil
+	archivePausedGauge.Update(0)
+	s.pauseMu.Unlock()
+
+	if len(queued) > 0 {
+		log.Info("Mail server archiving resumed", "queued", len(queued))
+	}
+	for _, env := range queued {
+		s.Archive(env)
+	}
+}
+
+// holdWhilePaused queues the envelope if archiving is paused. It returns
+// false if archiving is not paused and the envelope must be written.
+func (s *WMailServer) holdWhilePaused(env *whisper.Envelope) (bool, error) {
+	s.pauseMu.Lock()
+	defer s.pauseMu.Unlock()
+
+	if !s.paused {
+		return false, nil
+	}
+	if s.pauseQueueSize <= 0 {
+		archivePauseRejectedCounter.Inc(1)
+		return true, errArchivingPaused
+	}
+	if len(s.pauseQueue) >= s.pauseQueueSize {
+		archivePauseRejectedCounter.Inc(1)
+		return true, errPauseQueueFull
+	}
+	s.pauseQueue = append(s.pauseQueue, env)
+	return true, nil
+}
+
+// pauseState returns whether archiving is paused and the number of queued
+// envelopes.
+func (s *WMailServer) pauseState() (bool, int) {
+	s.pauseMu.Lock()
+	defer s.pauseMu.Unlock()
+	return s.paused, len(s.pauseQueue)
+}
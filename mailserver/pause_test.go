@@ -0,0 +1,72 @@
+package mailserver
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func TestPauseArchiving(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+	server.pauseQueueSize = 2
+
+	server.PauseArchiving()
+	for i := 3; i > 1; i-- {
+		env, err := generateEnvelope(now.Add(-time.Duration(i) * time.Second))
+		require.NoError(t, err)
+		require.NoError(t, server.archive(env))
+	}
+	testMessagesCount(t, 0, server)
+	stats := server.Stats()
+	require.True(t, stats.ArchivingPaused)
+	require.Equal(t, 2, stats.PausedEnvelopes)
+
+	env, err := generateEnvelope(now.Add(-time.Second))
+	require.NoError(t, err)
+	require.Equal(t, errPauseQueueFull, server.archive(env))
+
+	server.ResumeArchiving()
+	testMessagesCount(t, 2, server)
+	stats = server.Stats()
+	require.False(t, stats.ArchivingPaused)
+	require.Equal(t, 0, stats.PausedEnvelopes)
+	require.NoError(t, server.archive(env))
+	testMessagesCount(t, 3, server)
+}
+
+func TestPauseArchivingReject(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+
+	server.PauseArchiving()
+	env, err := generateEnvelope(time.Now().Add(-time.Second))
+	require.NoError(t, err)
+	require.Equal(t, errArchivingPaused, server.archive(env), "envelopes should be rejected without a queue")
+	server.ResumeArchiving()
+	testMessagesCount(t, 0, server)
+}
+
+func TestCloseWhilePaused(t *testing.T) {
+	dir, err := ioutil.TempDir("", "whisper-server-pause-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := leveldb.OpenFile(dir, nil)
+	require.NoError(t, err)
+	server := &WMailServer{db: db, pauseQueueSize: 1}
+	server.setMinimumPoW(powRequirement)
+
+	server.PauseArchiving()
+	archiveEnvelope(t, time.Now().Add(-time.Second), server)
+	server.Close()
+
+	server.db, err = leveldb.OpenFile(dir, nil)
+	require.NoError(t, err)
+	defer server.db.Close()
+	testMessagesCount(t, 1, server)
+}
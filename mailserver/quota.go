@@ -0,0 +1,204 @@
+package mailserver
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// defaultQuotaWindow is the window of the request quota unless configured
+// otherwise.
+const defaultQuotaWindow = 24 * time.Hour
+
+// quotaPrefix prefixes the keys holding the quota usage of every peer, so
+// that quotas survive restarts.
+var quotaPrefix = []byte{reservedPrefix, 'q'}
+
+func quotaKey(id string) []byte {
+	return append(append([]byte(nil), quotaPrefix...), id...)
+}
+
+// quotaUsage is the number of requests a peer sent in its current window.
+type quotaUsage struct {
+	Start uint64 // Unix time the window started at
+	Count uint64
+}
+
+// requestQuota bounds the number of requests served per peer over a long
+// window, e.g. a day, catching peers which stay just under the rate limit.
+//
+// Windows either start with the first request of a peer once the previous
+// one is over, or, for calendar windows, at fixed multiples of the window
+// since the Unix epoch, e.g. at midnight UTC for a day.
+type requestQuota struct {
+	mu sync.Mutex
+
+	limit    uint64
+	window   time.Duration
+	calendar bool
+
+	db    *leveldb.DB // DB the usage is persisted to, nil if read-only
+	usage map[string]quotaUsage
+}
+
+func newRequestQuota(limit int, window time.Duration, calendar bool, db *leveldb.DB) *requestQuota {
+	if window <= 0 {
+		window = defaultQuotaWindow
+	}
+	return &requestQuota{
+		limit:    uint64(limit),
+		window:   window,
+		calendar: calendar,
+		db:       db,
+		usage:    make(map[string]quotaUsage),
+	}
+}
+
+// allow counts a request of the peer at the given time, unless its quota is
+// exhausted, in which case it returns false along with the time left until
+// the quota is reset.
+func (q *requestQuota) allow(id string, now time.Time) (bool, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u, err := q.get(id)
+	if err != nil {
+		// failing open, as the rate limiter still applies
+		log.Error(fmt.Sprintf("Failed to read request quota: %s", err))
+	}
+	if q.expired(u, now) {
+		u = quotaUsage{Start: q.windowStart(now)}
+	}
+	if u.Count >= q.limit {
+		return false, time.Unix(int64(u.Start), 0).Add(q.window).Sub(now)
+	}
+
+	u.Count++
+	q.usage[id] = u
+	if q.db != nil {
+		if err := q.put(id, u); err != nil {
+			log.Error(fmt.Sprintf("Failed to persist request quota: %s", err))
+		}
+	}
+	return true, 0
+}
+
+func (q *requestQuota) windowStart(now time.Time) uint64 {
+	start := now.Unix()
+	if q.calendar {
+		start -= start % int64(q.window/time.Second)
+	}
+	return uint64(start)
+}
+
+func (q *requestQuota) expired(u quotaUsage, now time.Time) bool {
+	return !time.Unix(int64(u.Start), 0).Add(q.window).After(now)
+}
+
+// get returns the usage of the peer, read from the DB if not seen since the
+// server started.
+func (q *requestQuota) get(id string) (quotaUsage, error) {
+	if u, ok := q.usage[id]; ok || q.db == nil {
+		return u, nil
+	}
+
+	value, err := q.db.Get(quotaKey(id), nil)
+	if err == leveldb.ErrNotFound {
+		return quotaUsage{}, nil
+	} else if err != nil {
+		return quotaUsage{}, err
+	}
+	var u quotaUsage
+	if err := rlp.DecodeBytes(value, &u); err != nil {
+		return quotaUsage{}, fmt.Errorf("invalid request quota entry: %s", err)
+	}
+	return u, nil
+}
+
+func (q *requestQuota) put(id string, u quotaUsage) error {
+	value, err := rlp.EncodeToBytes(u)
+	if err != nil {
+		return err
+	}
+	return q.db.Put(quotaKey(id), value, nil)
+}
+
+// deleteExpired drops the usage of peers whose window is over, from both
+// memory and the DB, so that the reserved keyspace does not grow with every
+// peer ever seen. Both are swept under the same lock, so that a peer is
+// never dropped from one and kept in the other.
+func (q *requestQuota) deleteExpired(now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for id, u := range q.usage {
+		if q.expired(u, now) {
+			delete(q.usage, id)
+		}
+	}
+	if q.db == nil {
+		return
+	}
+
+	batch := new(leveldb.Batch)
+	i := q.db.NewIterator(util.BytesPrefix(quotaPrefix), nil)
+	defer i.Release()
+	for i.Next() {
+		var u quotaUsage
+		if err := rlp.DecodeBytes(i.Value(), &u); err != nil || q.expired(u, now) {
+			batch.Delete(append([]byte(nil), i.Key()...))
+		}
+	}
+	if err := i.Error(); err != nil {
+		log.Error(fmt.Sprintf("Failed to sweep request quotas: %s", err))
+		return
+	}
+	if batch.Len() == 0 {
+		return
+	}
+	if err := q.db.Write(batch, nil); err != nil {
+		log.Error(fmt.Sprintf("Failed to sweep request quotas: %s", err))
+	}
+}
+
+// setupRequestQuota in case limit is bigger than 0 it will setup a per-peer
+// request quota along with an automated cleanup of expired windows, run on
+// startup and every sweepPeriod, or every window if 0.
+func (s *WMailServer) setupRequestQuota(limit int, window time.Duration, calendar bool, sweepPeriod time.Duration) {
+	if limit <= 0 {
+		return
+	}
+	db := s.db
+	if s.readOnly {
+		log.Warn("Mail server request quotas are not persisted in read-only mode")
+		db = nil
+	}
+	s.quota = newRequestQuota(limit, window, calendar, db)
+	// windows which ended while the server was down are dropped right away
+	s.quota.deleteExpired(s.now())
+
+	if sweepPeriod <= 0 {
+		sweepPeriod = s.quota.window
+	}
+	s.quotaTick = &ticker{}
+	s.quotaTick.run(sweepPeriod, func() { s.quota.deleteExpired(s.now()) })
+}
+
+// manageRequestQuota checks the peer against the request quota, if it has
+// been setup on the current server. Throttled requests are returned the time
+// left until the quota of the peer is reset.
+func (s *WMailServer) manageRequestQuota(peer []byte) (bool, time.Duration) {
+	if s.quota == nil || s.isExempt(peer) {
+		return true, 0
+	}
+	ok, retryAfter := s.quota.allow(string(peer), s.now())
+	if !ok {
+		requestQuotaExceededCounter.Inc(1)
+	}
+	return ok, retryAfter
+}
@@ -0,0 +1,113 @@
+package mailserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/status-im/status-go/timesource"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestRequestQuotaExhaustion(t *testing.T) {
+	start := time.Unix(1000000, 0)
+	q := newRequestQuota(2, time.Hour, false, nil)
+
+	testCases := []struct {
+		at         time.Duration
+		allowed    bool
+		retryAfter time.Duration
+		info       string
+	}{
+		{0, true, 0, "first request"},
+		{time.Minute, true, 0, "second request"},
+		{2 * time.Minute, false, 58 * time.Minute, "quota exhausted"},
+		{time.Hour, true, 0, "window over, quota reset"},
+		{time.Hour + time.Minute, true, 0, "second request of the new window"},
+		{time.Hour + 2*time.Minute, false, 58 * time.Minute, "quota exhausted again"},
+	}
+	for _, tc := range testCases {
+		allowed, retryAfter := q.allow("peer", start.Add(tc.at))
+		require.Equal(t, tc.allowed, allowed, tc.info)
+		require.Equal(t, tc.retryAfter, retryAfter, tc.info)
+	}
+
+	allowed, _ := q.allow("other", start.Add(time.Hour+2*time.Minute))
+	require.True(t, allowed, "quotas should be per peer")
+}
+
+func TestRequestQuotaCalendarWindow(t *testing.T) {
+	midnight := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	q := newRequestQuota(1, 0, true, nil)
+	require.Equal(t, defaultQuotaWindow, q.window)
+
+	allowed, _ := q.allow("peer", midnight.Add(23*time.Hour))
+	require.True(t, allowed)
+	allowed, retryAfter := q.allow("peer", midnight.Add(23*time.Hour+30*time.Minute))
+	require.False(t, allowed)
+	require.Equal(t, 30*time.Minute, retryAfter, "the quota should reset at midnight")
+
+	allowed, _ = q.allow("peer", midnight.Add(24*time.Hour))
+	require.True(t, allowed)
+}
+
+func TestRequestQuotaPersistence(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	now := time.Unix(1000000, 0)
+	q := newRequestQuota(1, time.Hour, false, db)
+	allowed, _ := q.allow("peer", now)
+	require.True(t, allowed)
+
+	// a restarted server reads the usage back
+	q = newRequestQuota(1, time.Hour, false, db)
+	allowed, _ = q.allow("peer", now.Add(time.Minute))
+	require.False(t, allowed)
+
+	q.deleteExpired(now.Add(time.Hour))
+	_, err = db.Get(quotaKey("peer"), nil)
+	require.Equal(t, leveldb.ErrNotFound, err)
+	require.Empty(t, q.usage)
+}
+
+func TestManageRequestQuota(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	server := setupTestServer(t)
+	defer server.Close()
+	server.SetTimeSource(timesource.TimeSourceFunc(func() time.Time { return now }))
+	server.setupRequestQuota(1, time.Hour, false, 0)
+
+	allowed, _ := server.manageRequestQuota([]byte("peer"))
+	require.True(t, allowed)
+	allowed, retryAfter := server.manageRequestQuota([]byte("peer"))
+	require.False(t, allowed)
+	require.Equal(t, time.Hour, retryAfter)
+
+	server.ExemptPeer([]byte("peer"))
+	allowed, _ = server.manageRequestQuota([]byte("peer"))
+	require.True(t, allowed, "exempt peers should not be subject to the quota")
+}
+
+func TestRequestQuotaSweepOnStartup(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	server := setupTestServer(t)
+	defer server.Close()
+	server.SetTimeSource(timesource.TimeSourceFunc(func() time.Time { return now }))
+
+	// usage left by a previous run: one window over, one still running
+	q := newRequestQuota(1, time.Hour, false, server.db)
+	q.allow("stale", now.Add(-2*time.Hour))
+	q.allow("current", now.Add(-time.Minute))
+
+	server.setupRequestQuota(1, time.Hour, false, 0)
+	_, err := server.db.Get(quotaKey("stale"), nil)
+	require.Equal(t, leveldb.ErrNotFound, err, "stale usage should be dropped on load")
+	_, err = server.db.Get(quotaKey("current"), nil)
+	require.NoError(t, err)
+
+	allowed, _ := server.manageRequestQuota([]byte("current"))
+	require.False(t, allowed, "the running window should still apply")
+}
@@ -0,0 +1,53 @@
+package mailserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Checksum returns a hash over the keys of all envelopes sent between from
+// and to, both inclusive. Keys embed the envelope hashes, so two archives
+// holding the same envelopes in a window produce the same checksum without
+// reading any envelope.
+func (s *WMailServer) Checksum(from, to time.Time) ([]byte, error) {
+	h := sha256.New()
+	err := s.forEachKey(from, to, func(key []byte) {
+		h.Write(stripNamespace(key)) // nolint: errcheck
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// forEachKey calls fn with the key of every envelope, or tombstone, sent
+// between from and to, both inclusive, in either tier, in key order.
+func (s *WMailServer) forEachKey(from, to time.Time, fn func(key []byte)) error {
+	var zero common.Hash
+	kl := NewNamespacedDbKey(s.namespace, uint32(from.Unix()), zero)
+	ku := NewNamespacedDbKey(s.namespace, uint32(to.Unix())+1, zero)
+	i, err := s.newRangeIterator(&util.Range{Start: kl.raw, Limit: ku.raw})
+	if err != nil {
+		return err
+	}
+	defer i.Release()
+
+	var lastKey []byte
+	for i.Next() {
+		if !isEnvelopeKey(i.Key()) {
+			continue
+		}
+		// an envelope being moved to the cold storage can be seen in both tiers
+		if bytes.Equal(i.Key(), lastKey) {
+			continue
+		}
+		lastKey = append(lastKey[:0], i.Key()...)
+		fn(i.Key())
+	}
+	return i.Error()
+}
@@ -0,0 +1,43 @@
+package mailserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecksum(t *testing.T) {
+	now := time.Now()
+	from, to := now.Add(-time.Minute), now
+	first := setupTestServer(t)
+	defer first.Close()
+	second := setupTestServer(t)
+	defer second.Close()
+
+	for i := 3; i > 0; i-- {
+		env, err := generateEnvelope(now.Add(-time.Duration(i) * time.Second))
+		require.NoError(t, err)
+		first.Archive(env)
+		second.Archive(env)
+	}
+
+	firstSum, err := first.Checksum(from, to)
+	require.NoError(t, err)
+	secondSum, err := second.Checksum(from, to)
+	require.NoError(t, err)
+	require.Equal(t, firstSum, secondSum)
+
+	// a single differing envelope changes the checksum
+	archiveEnvelope(t, now.Add(-30*time.Second), second)
+	secondSum, err = second.Checksum(from, to)
+	require.NoError(t, err)
+	require.NotEqual(t, firstSum, secondSum)
+
+	// but not the checksum of windows it does not belong to
+	firstSum, err = first.Checksum(now.Add(-10*time.Second), to)
+	require.NoError(t, err)
+	secondSum, err = second.Checksum(now.Add(-10*time.Second), to)
+	require.NoError(t, err)
+	require.Equal(t, firstSum, secondSum)
+}
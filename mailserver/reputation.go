@@ -0,0 +1,204 @@
+package mailserver
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// Bounds of the reputation of a peer. Peers start at 0.
+const (
+	minReputation = -100
+	maxReputation = 100
+)
+
+// Reputation changes on the behavior of a peer.
+const (
+	reputationValidRequest     = 1   // request served
+	reputationMalformedRequest = -10 // request rejected as invalid
+	reputationOverQuota        = -5  // request rejected over quota
+)
+
+// Scales of the rate limit of peers with the best and worst reputation: the
+// former may send requests twice as often as the rate limit allows, the
+// latter four times less.
+const (
+	bestReputationScale  = 0.5
+	worstReputationScale = 4
+)
+
+// reputationPrefix prefixes the keys holding the reputation of every peer,
+// so that reputations survive restarts.
+var reputationPrefix = []byte{reservedPrefix, 'r'}
+
+func reputationKey(id string) []byte {
+	return append(append([]byte(nil), reputationPrefix...), id...)
+}
+
+// reputation tracks how well peers behave, valid requests raising their
+// reputation and malformed or over quota requests lowering it. The rate
+// limit of a peer is scaled by its reputation, giving well-behaved peers
+// more headroom while throttling suspicious ones harder.
+type reputation struct {
+	mu sync.Mutex
+
+	db     *leveldb.DB // DB the reputations are persisted to, nil if read-only
+	scores map[string]int64
+
+	// maxEntries, if set, caps the size of scores like the limiter caps the
+	// peers it tracks. Once reached, the score of the peer seen least
+	// recently is evicted, to be read back from the DB if seen again.
+	maxEntries int
+	order      *list.List
+	elements   map[string]*list.Element
+}
+
+func newReputation(db *leveldb.DB) *reputation {
+	return &reputation{
+		db:       db,
+		scores:   make(map[string]int64),
+		order:    list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
+
+// set caches the reputation of the peer, evicting the peers seen least
+// recently over maxEntries. It must be called with mu held.
+func (r *reputation) set(id string, score int64) {
+	r.scores[id] = score
+
+	if r.maxEntries <= 0 {
+		return
+	}
+	if e, ok := r.elements[id]; ok {
+		r.order.MoveToBack(e)
+	} else {
+		r.elements[id] = r.order.PushBack(id)
+	}
+	for len(r.scores) > r.maxEntries {
+		oldest := r.order.Front()
+		if oldest == nil {
+			break
+		}
+		id := r.order.Remove(oldest).(string)
+		delete(r.elements, id)
+		delete(r.scores, id)
+		reputationEvictedCounter.Inc(1)
+	}
+}
+
+// update changes the reputation of the peer by delta, within the bounds.
+func (r *reputation) update(id string, delta int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	score, err := r.get(id)
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to read peer reputation: %s", err))
+	}
+	score += delta
+	if score < minReputation {
+		score = minReputation
+	} else if score > maxReputation {
+		score = maxReputation
+	}
+	r.set(id, score)
+	if r.db == nil {
+		return
+	}
+	if err := r.put(id, score); err != nil {
+		log.Error(fmt.Sprintf("Failed to persist peer reputation: %s", err))
+	}
+}
+
+// score returns the reputation of the peer.
+func (r *reputation) score(id string) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	score, err := r.get(id)
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to read peer reputation: %s", err))
+	}
+	r.set(id, score)
+	return score
+}
+
+// scale returns the factor the rate limit of the peer is multiplied by,
+// going linearly from bestReputationScale to 1 for a neutral reputation and
+// to worstReputationScale.
+func (r *reputation) scale(id string) float64 {
+	score := r.score(id)
+	if score >= 0 {
+		return 1 - (1-bestReputationScale)*float64(score)/maxReputation
+	}
+	return 1 + (worstReputationScale-1)*float64(score)/minReputation
+}
+
+// get returns the reputation of the peer, read from the DB if not seen since
+// the server started.
+func (r *reputation) get(id string) (int64, error) {
+	if score, ok := r.scores[id]; ok || r.db == nil {
+		return score, nil
+	}
+
+	value, err := r.db.Get(reputationKey(id), nil)
+	if err == leveldb.ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if len(value) != 8 {
+		return 0, fmt.Errorf("invalid peer reputation entry of %d bytes", len(value))
+	}
+	return int64(binary.BigEndian.Uint64(value)), nil
+}
+
+// put persists the reputation of the peer. Neutral reputations are not
+// stored, so that the reserved keyspace does not grow with every peer ever
+// seen.
+func (r *reputation) put(id string, score int64) error {
+	if score == 0 {
+		return r.db.Delete(reputationKey(id), nil)
+	}
+	return r.db.Put(reputationKey(id), encodeCount(score), nil)
+}
+
+// setupReputation scales the rate limit of peers by their reputation, if it
+// has been setup on the current server. At most maxPeers reputations are
+// kept in memory, 0 meaning unlimited.
+func (s *WMailServer) setupReputation(maxPeers int) {
+	db := s.db
+	if s.readOnly {
+		log.Warn("Mail server peer reputations are not persisted in read-only mode")
+		db = nil
+	}
+	s.reputation = newReputation(db)
+	s.reputation.maxEntries = maxPeers
+	if s.limit != nil {
+		s.limit.scale = s.reputation.scale
+	}
+}
+
+// updateReputation changes the reputation of the peer, if reputations are
+// enabled. Exempt peers are not tracked.
+func (s *WMailServer) updateReputation(peer []byte, delta int64) {
+	if s.reputation == nil || s.isExempt(peer) {
+		return
+	}
+	s.reputation.update(string(peer), delta)
+}
+
+// isMalformedRequest reports whether a rejected request was invalid, rather
+// than e.g. not meant for the server.
+func isMalformedRequest(err *RequestError) bool {
+	switch err.Code {
+	case ErrorCodeInvalidRequest, ErrorCodeTimeRange, ErrorCodeWindowSize:
+		return true
+	}
+	return false
+}
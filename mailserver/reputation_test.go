@@ -0,0 +1,99 @@
+package mailserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestReputationScale(t *testing.T) {
+	testCases := []struct {
+		delta int64
+		scale float64
+		info  string
+	}{
+		{0, 1, "neutral reputation"},
+		{maxReputation, bestReputationScale, "best reputation"},
+		{10 * maxReputation, bestReputationScale, "reputation above the bounds"},
+		{maxReputation / 2, 0.75, "good reputation"},
+		{minReputation, worstReputationScale, "worst reputation"},
+		{minReputation / 2, 2.5, "bad reputation"},
+	}
+	for _, tc := range testCases {
+		r := newReputation(nil)
+		r.update("peer", tc.delta)
+		require.Equal(t, tc.scale, r.scale("peer"), tc.info)
+	}
+}
+
+func TestReputationPersisted(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	r := newReputation(db)
+	r.update("peer", reputationMalformedRequest)
+	r.update("peer", reputationValidRequest)
+	r.update("other", reputationOverQuota)
+	r.update("other", -reputationOverQuota)
+
+	// reputations survive restarts
+	r = newReputation(db)
+	require.Equal(t, int64(reputationMalformedRequest+reputationValidRequest), r.score("peer"))
+	require.Equal(t, int64(0), r.score("other"))
+	_, err = db.Get(reputationKey("other"), nil)
+	require.Equal(t, leveldb.ErrNotFound, err, "neutral reputations should not be stored")
+}
+
+func TestReputationMaxEntries(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	r := newReputation(db)
+	r.maxEntries = 2
+	r.update("first", reputationMalformedRequest)
+	r.update("second", reputationOverQuota)
+	r.score("first")
+	r.update("third", reputationValidRequest)
+	require.Len(t, r.scores, 2)
+	require.NotContains(t, r.scores, "second", "the peer seen least recently should be evicted")
+
+	// evicted reputations are read back from the DB
+	require.Equal(t, int64(reputationOverQuota), r.score("second"))
+	require.Len(t, r.scores, 2)
+}
+
+func TestReputationScalesRateLimit(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+	server.limit = newLimiter(time.Hour)
+	server.setupReputation(0)
+
+	testCases := []struct {
+		peer    string
+		delta   int64
+		ago     time.Duration
+		allowed bool
+		info    string
+	}{
+		{"neutral", 0, 40 * time.Minute, false, "peers are held back for the rate limit"},
+		{"neutral", 0, 70 * time.Minute, true, "peers are let through after the rate limit"},
+		{"good", maxReputation, 40 * time.Minute, true, "well-behaved peers get more headroom"},
+		{"bad", reputationMalformedRequest, 70 * time.Minute, false, "suspicious peers are throttled harder"},
+	}
+	for _, tc := range testCases {
+		server.updateReputation([]byte(tc.peer), tc.delta)
+		server.limit.db[tc.peer] = time.Now().Add(-tc.ago)
+		ok, _ := server.managePeerLimits([]byte(tc.peer))
+		require.Equal(t, tc.allowed, ok, tc.info)
+	}
+
+	// exempt peers are not tracked
+	server.ExemptPeer([]byte("exempt"))
+	server.updateReputation([]byte("exempt"), reputationMalformedRequest)
+	require.Equal(t, int64(0), server.reputation.score("exempt"))
+}
@@ -0,0 +1,490 @@
+package mailserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// Request options are optional fields appended to the p2p request payload
+// right after the bloom filter. They are RLP-encoded as a list of
+// (code, value) pairs. Codes unknown to the server are ignored, so newer
+// clients keep working against older servers.
+const (
+	topicsOptionCode  = 1  // exact topics matched instead of the bloom filter
+	limitOptionCode   = 2  // maximum number of envelopes to deliver
+	cursorOptionCode  = 3  // cursor to resume a truncated request from
+	allOptionCode     = 4  // topics that must all be matched
+	expectAckCode     = 5  // the peer will acknowledge the delivery
+	ackOptionCode     = 6  // hash of a request whose delivery is acknowledged
+	metadataOnlyCode  = 7  // deliver envelope descriptors instead of envelopes
+	senderOptionCode  = 8  // sender of the envelopes, with the key to open them
+	compressedCode    = 9  // deliver the envelopes as a compressed stream
+	afterOptionCode   = 10 // deliver only envelopes after one known to the peer
+	queriesOptionCode = 11 // windows and bloom filters served independently
+	countOnlyCode     = 12 // deliver the number of matching envelopes only
+	versionOptionCode = 13 // whisper version of the envelopes to deliver
+	topicOrderCode    = 14 // order envelopes sent in the same second by topic
+	arrivalOptionCode = 15 // include the arrival metadata in envelope descriptors
+	newestCode        = 16 // deliver only the newest matching envelope of every topic
+	batchesCode       = 17 // the peer decodes batches of envelopes sent as one p2p message
+)
+
+// The options can be gzipped, in which case they are preceded by
+// compressedOptionsMarker. An RLP list never starts with this byte.
+const (
+	compressedOptionsMarker = 0x1f
+	maxDecompressedOptions  = 1024 * 1024
+)
+
+// Sizes of the keys of a sender filter.
+const (
+	senderKeySize = 65 // uncompressed secp256k1 public key
+	symKeySize    = 32 // whisper symmetric key
+)
+
+// A request payload starts with the window and the bloom filter of the
+// request: [lower(4)][upper(4)][bloom(64)]. Payloads made of the window
+// only request every topic.
+const (
+	requestWindowSize = 8
+	requestHeaderSize = requestWindowSize + whisper.BloomFilterSize
+	// maxRequestPayloadSize bounds the options following the header as
+	// much as they are bounded once decompressed.
+	maxRequestPayloadSize = requestHeaderSize + maxDecompressedOptions
+)
+
+// maxRequestTopics bounds the number of exact topics a single request can carry.
+const maxRequestTopics = 100
+
+// maxRequestQueries bounds the number of queries a compound request can carry.
+const maxRequestQueries = 16
+
+// A cursor identifies where a truncated request can be resumed. It embeds
+// the window of the request and the DB key of the last delivered envelope,
+// so it stays valid across server restarts: [lower(4)][upper(4)][DB key].
+const cursorSize = 8 + dbKeySize
+
+var (
+	errUndersizedRequest = errors.New("Undersized p2p request")
+	errUndersizedBloom   = errors.New("Undersized bloom filter in p2p request")
+	errOversizedBloom    = errors.New("Oversized bloom filter in p2p request")
+	errOversizedRequest  = errors.New("Oversized p2p request")
+
+	errOptionsTooLarge = errors.New("decompressed options in p2p request are too large")
+	errTooManyTopics   = errors.New("too many topics in p2p request")
+	errMalformedCursor = errors.New("malformed cursor in p2p request")
+	errStaleCursor     = errors.New("cursor does not belong to the requested window")
+	errInvalidSender   = errors.New("invalid sender filter in p2p request")
+	errTooManyQueries  = errors.New("too many queries in p2p request")
+	errInvalidQuery    = errors.New("invalid query in p2p request")
+	errCompoundCursor  = errors.New("cursor in compound p2p request")
+
+	errConflictingTopics = errors.New("distinct topics to be all matched in p2p request")
+)
+
+// requestOption is a single optional field of a p2p request.
+type requestOption struct {
+	Code  uint
+	Value rlp.RawValue
+}
+
+// senderOption filters envelopes by their sender. Whisper envelopes are
+// signed inside the encrypted payload, so the request also carries the
+// symmetric key the envelopes are opened with, e.g. the key of a public chat.
+type senderOption struct {
+	Sender []byte // uncompressed public key of the sender
+	SymKey []byte
+}
+
+// anchorOption identifies an envelope the peer already has, by its sent
+// time and hash, so that only the envelopes after it in key order are
+// delivered. Peers syncing incrementally pass the last envelope they got.
+type anchorOption struct {
+	Timestamp uint32
+	Hash      common.Hash
+}
+
+// messagesRequest is a decoded request for historic messages.
+type messagesRequest struct {
+	lower  uint32
+	upper  uint32
+	bloom  []byte
+	topics []whisper.TopicType
+	all    []whisper.TopicType
+	limit  uint32 // 0 means no limit
+	cursor []byte
+	after  []byte // DB key of the envelope to deliver after, if set
+
+	// scanUpper, if set, is the exclusive bound the window is scanned up
+	// to, the requested upper bound brought back to the current time.
+	// Cursors keep embedding the requested upper bound, so that they stay
+	// valid for the request as sent by the client.
+	scanUpper uint32
+
+	version uint // whisper version of the envelopes to deliver, 0 means any
+
+	// Envelopes are delivered in key order, i.e. by sent time and, within
+	// the same second, by hash. topicOrder orders envelopes sent in the same
+	// second by topic first, still by hash within a topic.
+	topicOrder bool
+
+	// newestPerTopic delivers only the newest matching envelope of every
+	// topic, see processNewestPerTopic.
+	newestPerTopic bool
+
+	queries    []Query // queries of a compound request, served instead of its window
+	compound   bool    // whether this is one of the queries of a compound request
+	queryIndex uint    // index of the query in the compound request
+
+	src   *ecdsa.PublicKey  // key the request was signed with
+	topic whisper.TopicType // topic of the request envelope
+	hash  common.Hash       // hash of the request envelope
+
+	metadataOnly bool // whether to deliver descriptors instead of envelopes
+	arrival      bool // whether descriptors include the arrival metadata of their envelope
+	compressed   bool // whether to deliver the envelopes as a compressed stream
+	batches      bool // whether the peer decodes batches of envelopes per p2p message
+	countOnly    bool // whether to deliver the number of matching envelopes only
+
+	sender    []byte // deliver only envelopes signed by this public key, if set
+	senderKey []byte // symmetric key to open envelopes with to recover their sender
+
+	expectAck bool         // whether the peer will acknowledge the delivery
+	ack       *common.Hash // request acknowledged instead of a query, if set
+}
+
+// RequestResult describes the outcome of processing a request.
+type RequestResult struct {
+	Delivered  int           // number of envelopes delivered
+	Bytes      int           // RLP size of the delivered envelopes
+	Scanned    int           // number of keys scanned, matching or not
+	Truncated  bool          // whether the limit cut the response short
+	NextCursor []byte        // cursor to resume a truncated request from
+	Duration   time.Duration // time spent processing the request
+}
+
+// match reports whether the envelope satisfies the request. An exact topic
+// list, if provided, takes precedence over the bloom filter. Topics to be
+// matched with AND semantics are checked in addition to both.
+func (r *messagesRequest) match(env *whisper.Envelope) bool {
+	// whisper v6 envelopes carry a single topic, so the AND list can only be
+	// met by envelopes whose topic is every topic of the list
+	for _, topic := range r.all {
+		if topic != env.Topic {
+			return false
+		}
+	}
+
+	if len(r.topics) > 0 {
+		for _, topic := range r.topics {
+			if topic == env.Topic {
+				return true
+			}
+		}
+		return false
+	}
+
+	return whisper.BloomFilterMatch(r.bloom, env.Bloom())
+}
+
+// singleTopic returns the topic of requests for a single exact topic, the
+// common case of a client syncing one chat, which can be matched without
+// decoding envelopes.
+func (r *messagesRequest) singleTopic() (whisper.TopicType, bool) {
+	if len(r.topics) != 1 {
+		return whisper.TopicType{}, false
+	}
+	return r.topics[0], true
+}
+
+// envelopeHasTopic reports whether an RLP-encoded envelope has the given
+// topic, reading it in place. Malformed envelopes are reported as matching,
+// so that decoding them fails and gets logged as in the general path.
+func envelopeHasTopic(raw []byte, topic whisper.TopicType) bool {
+	actual, ok := readEnvelopeTopic(raw)
+	return !ok || actual == topic
+}
+
+// readEnvelopeTopic returns the topic of an RLP-encoded envelope, reading
+// only the fields preceding it. It returns false if the topic cannot be
+// read.
+func readEnvelopeTopic(raw []byte) (whisper.TopicType, bool) {
+	content, _, err := rlp.SplitList(raw)
+	if err != nil {
+		return whisper.TopicType{}, false
+	}
+	// skip Expiry and TTL, which precede the topic
+	for i := 0; i < 2; i++ {
+		if _, _, content, err = rlp.Split(content); err != nil {
+			return whisper.TopicType{}, false
+		}
+	}
+	value, _, err := rlp.SplitString(content)
+	if err != nil || len(value) != whisper.TopicLength {
+		return whisper.TopicType{}, false
+	}
+	return whisper.BytesToTopic(value), true
+}
+
+// matchSender reports whether the envelope can be opened with the sender
+// filter key and was signed by the requested sender.
+func (r *messagesRequest) matchSender(env *whisper.Envelope) bool {
+	msg := env.Open(&whisper.Filter{KeySym: r.senderKey})
+	return msg != nil && msg.Src != nil && bytes.Equal(crypto.FromECDSAPub(msg.Src), r.sender)
+}
+
+// newCursor returns a cursor pointing after the given DB key.
+func newCursor(lower, upper uint32, key []byte) []byte {
+	cursor := make([]byte, 8, cursorSize)
+	binary.BigEndian.PutUint32(cursor, lower)
+	binary.BigEndian.PutUint32(cursor[4:], upper)
+	return append(cursor, key...)
+}
+
+// validateCursor checks that the request cursor is well formed and points
+// inside the requested window.
+func validateCursor(r *messagesRequest) error {
+	if len(r.cursor) != cursorSize {
+		return errMalformedCursor
+	}
+
+	lower := binary.BigEndian.Uint32(r.cursor[:4])
+	upper := binary.BigEndian.Uint32(r.cursor[4:8])
+	timestamp := binary.BigEndian.Uint32(r.cursor[8:12])
+	if lower != r.lower || upper != r.upper || timestamp < r.lower || timestamp >= r.upper {
+		return errStaleCursor
+	}
+
+	return nil
+}
+
+// scanLimit returns the exclusive upper bound of the scan of the window.
+func (r *messagesRequest) scanLimit() uint32 {
+	if r.scanUpper != 0 {
+		return r.scanUpper
+	}
+	return r.upper
+}
+
+// cursorKey returns the DB key of the last envelope delivered before the
+// request was truncated.
+func (r *messagesRequest) cursorKey() []byte {
+	return r.cursor[8:]
+}
+
+// startAfter returns the [timestamp][hash] key the scan starts after, nil to
+// scan the whole window. A cursor, which points past the anchor of the
+// request it was returned for, takes precedence.
+func (r *messagesRequest) startAfter() []byte {
+	if r.cursor != nil {
+		return r.cursorKey()
+	}
+	return r.after
+}
+
+// parseRequestPayload returns the window and bloom filter of a request
+// payload, rejecting payloads which are too short, too long or truncated in
+// the middle of the bloom filter. The returned bloom filter shares the
+// payload memory. Options following the header are left to
+// decodeRequestOptions.
+//
+// Bloom filters are exactly whisper.BloomFilterSize bytes long. A longer
+// one, e.g. sent by a client of another whisper version, shows as bytes
+// following the header which cannot start options, and is rejected too.
+func parseRequestPayload(payload []byte) (lower, upper uint32, bloom []byte, err error) {
+	switch {
+	case len(payload) < requestWindowSize:
+		return 0, 0, nil, errUndersizedRequest
+	case len(payload) > maxRequestPayloadSize:
+		return 0, 0, nil, errOversizedRequest
+	case len(payload) == requestWindowSize:
+		bloom = whisper.MakeFullNodeBloom()
+	case len(payload) < requestHeaderSize:
+		return 0, 0, nil, errUndersizedBloom
+	case len(payload) > requestHeaderSize && !startsRequestOptions(payload[requestHeaderSize]):
+		return 0, 0, nil, errOversizedBloom
+	default:
+		bloom = payload[requestWindowSize:requestHeaderSize]
+	}
+
+	lower = binary.BigEndian.Uint32(payload[:4])
+	upper = binary.BigEndian.Uint32(payload[4:requestWindowSize])
+	return lower, upper, bloom, nil
+}
+
+// startsRequestOptions reports whether the given byte can start encoded
+// options, either gzipped or as an RLP list.
+func startsRequestOptions(b byte) bool {
+	return b == compressedOptionsMarker || b >= 0xc0
+}
+
+// decodeRequestOptions decodes the options found after the bloom filter
+// into the given request.
+func decodeRequestOptions(data []byte, r *messagesRequest) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	if data[0] == compressedOptionsMarker {
+		var err error
+		if data, err = decompressRequestOptions(data[1:]); err != nil {
+			return err
+		}
+	}
+
+	var options []requestOption
+	if err := rlp.DecodeBytes(data, &options); err != nil {
+		return fmt.Errorf("invalid options in p2p request: %s", err)
+	}
+
+	for _, option := range options {
+		switch option.Code {
+		case topicsOptionCode:
+			if err := rlp.DecodeBytes(option.Value, &r.topics); err != nil {
+				return fmt.Errorf("invalid topics in p2p request: %s", err)
+			}
+			if len(r.topics) > maxRequestTopics {
+				return errTooManyTopics
+			}
+		case allOptionCode:
+			if err := rlp.DecodeBytes(option.Value, &r.all); err != nil {
+				return fmt.Errorf("invalid topics in p2p request: %s", err)
+			}
+			if len(r.all) > maxRequestTopics {
+				return errTooManyTopics
+			}
+			// whisper v6 envelopes carry a single topic, so distinct topics
+			// can never all be matched
+			for _, topic := range r.all {
+				if topic != r.all[0] {
+					return errConflictingTopics
+				}
+			}
+			if len(r.all) > 1 {
+				r.all = r.all[:1]
+			}
+		case limitOptionCode:
+			if err := rlp.DecodeBytes(option.Value, &r.limit); err != nil {
+				return fmt.Errorf("invalid limit in p2p request: %s", err)
+			}
+		case cursorOptionCode:
+			if err := rlp.DecodeBytes(option.Value, &r.cursor); err != nil {
+				return fmt.Errorf("invalid cursor in p2p request: %s", err)
+			}
+		case expectAckCode:
+			r.expectAck = true
+		case metadataOnlyCode:
+			r.metadataOnly = true
+		case arrivalOptionCode:
+			r.arrival = true
+		case compressedCode:
+			r.compressed = true
+		case countOnlyCode:
+			r.countOnly = true
+		case topicOrderCode:
+			r.topicOrder = true
+		case newestCode:
+			r.newestPerTopic = true
+		case batchesCode:
+			r.batches = true
+		case versionOptionCode:
+			if err := rlp.DecodeBytes(option.Value, &r.version); err != nil {
+				return fmt.Errorf("invalid version in p2p request: %s", err)
+			}
+		case queriesOptionCode:
+			if err := rlp.DecodeBytes(option.Value, &r.queries); err != nil {
+				return fmt.Errorf("invalid queries in p2p request: %s", err)
+			}
+			if len(r.queries) > maxRequestQueries {
+				return errTooManyQueries
+			}
+			for _, q := range r.queries {
+				if len(q.Bloom) != whisper.BloomFilterSize || q.Lower > q.Upper {
+					return errInvalidQuery
+				}
+			}
+		case afterOptionCode:
+			var anchor anchorOption
+			if err := rlp.DecodeBytes(option.Value, &anchor); err != nil {
+				return fmt.Errorf("invalid anchor in p2p request: %s", err)
+			}
+			r.after = NewDbKey(anchor.Timestamp, anchor.Hash).raw
+		case senderOptionCode:
+			var sender senderOption
+			if err := rlp.DecodeBytes(option.Value, &sender); err != nil {
+				return fmt.Errorf("invalid sender filter in p2p request: %s", err)
+			}
+			if len(sender.Sender) != senderKeySize || len(sender.SymKey) != symKeySize {
+				return errInvalidSender
+			}
+			r.sender, r.senderKey = sender.Sender, sender.SymKey
+		case ackOptionCode:
+			r.ack = new(common.Hash)
+			if err := rlp.DecodeBytes(option.Value, r.ack); err != nil {
+				return fmt.Errorf("invalid ack in p2p request: %s", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// encodeRequestOptions encodes the given options so they can be appended to
+// a request payload.
+func encodeRequestOptions(options ...requestOption) ([]byte, error) {
+	return rlp.EncodeToBytes(options)
+}
+
+// compressRequestOptions gzips encoded options and prepends the marker.
+func compressRequestOptions(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte(compressedOptionsMarker)
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func decompressRequestOptions(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid compressed options in p2p request: %s", err)
+	}
+	defer r.Close()
+
+	decompressed, err := ioutil.ReadAll(io.LimitReader(r, maxDecompressedOptions+1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid compressed options in p2p request: %s", err)
+	}
+	if len(decompressed) > maxDecompressedOptions {
+		return nil, errOptionsTooLarge
+	}
+	return decompressed, nil
+}
+
+// newRequestOption returns an option with the given code and RLP-encoded value.
+func newRequestOption(code uint, value interface{}) (requestOption, error) {
+	raw, err := rlp.EncodeToBytes(value)
+	return requestOption{Code: code, Value: raw}, err
+}
+
+// newTopicsOption returns an option carrying an exact list of topics.
+func newTopicsOption(topics []whisper.TopicType) (requestOption, error) {
+	return newRequestOption(topicsOptionCode, topics)
+}
@@ -0,0 +1,20 @@
+//go:build gofuzz
+// +build gofuzz
+
+package mailserver
+
+// Fuzz implements a go-fuzz fuzzer method to test the decoding of request
+// payloads received from peers.
+func Fuzz(data []byte) int {
+	_, _, _, err := parseRequestPayload(data)
+	if err != nil {
+		return 0
+	}
+	if len(data) > requestHeaderSize {
+		var r messagesRequest
+		if err := decodeRequestOptions(data[requestHeaderSize:], &r); err != nil {
+			return 0
+		}
+	}
+	return 1
+}
@@ -0,0 +1,243 @@
+package mailserver
+
+import (
+	"bytes"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRequestPayload(t *testing.T) {
+	bloom := bytes.Repeat([]byte{0xAB}, whisper.BloomFilterSize)
+	window := []byte{0, 0, 0, 1, 0, 0, 0, 2}
+	header := append(append([]byte(nil), window...), bloom...)
+	withHeader := func(suffix ...byte) []byte {
+		return append(append([]byte(nil), header...), suffix...)
+	}
+
+	testCases := []struct {
+		payload []byte
+		bloom   []byte
+		err     error
+		info    string
+	}{
+		{nil, nil, errUndersizedRequest, "empty payload"},
+		{[]byte("1234567"), nil, errUndersizedRequest, "truncated window"},
+		{window, whisper.MakeFullNodeBloom(), nil, "window only, every topic requested"},
+		{[]byte("hohohohoho"), nil, errUndersizedBloom, "truncated bloom filter"},
+		{header[:len(header)-1], nil, errUndersizedBloom, "bloom filter one byte short"},
+		{header, bloom, nil, "window and bloom filter"},
+		{withHeader(0xc0), bloom, nil, "options following the bloom filter"},
+		{withHeader(compressedOptionsMarker), bloom, nil, "compressed options following the bloom filter"},
+		{withHeader(bloom...), nil, errOversizedBloom, "bloom filter twice the whisper size"},
+		{withHeader(0x01), nil, errOversizedBloom, "bloom filter one byte too long"},
+		{make([]byte, maxRequestPayloadSize+1), nil, errOversizedRequest, "oversized payload"},
+	}
+	for _, tc := range testCases {
+		lower, upper, bloom, err := parseRequestPayload(tc.payload)
+		require.Equal(t, tc.err, err, tc.info)
+		require.Equal(t, tc.bloom, bloom, tc.info)
+		if err == nil {
+			require.Equal(t, uint32(1), lower, tc.info)
+			require.Equal(t, uint32(2), upper, tc.info)
+		}
+	}
+}
+
+// TestParseRequestPayloadQuick feeds random payloads, including options, to
+// the decoders, which must never panic and must only accept well-sized
+// headers. See request_fuzz.go for a go-fuzz entry point.
+func TestParseRequestPayloadQuick(t *testing.T) {
+	check := func(payload []byte) bool {
+		_, _, bloom, err := parseRequestPayload(payload)
+		if err != nil {
+			return true
+		}
+		if len(bloom) != whisper.BloomFilterSize {
+			return false
+		}
+		if len(payload) > requestHeaderSize {
+			var r messagesRequest
+			decodeRequestOptions(payload[requestHeaderSize:], &r) // nolint: errcheck
+		}
+		return true
+	}
+	require.NoError(t, quick.Check(check, &quick.Config{MaxCount: 10000}))
+}
+
+func TestDecodeRequestOptions(t *testing.T) {
+	topics := []whisper.TopicType{{0x01, 0x02, 0x03, 0x04}, {0x05, 0x06, 0x07, 0x08}}
+	topicsOption, err := newTopicsOption(topics)
+	require.NoError(t, err)
+	raw, err := encodeRequestOptions(topicsOption)
+	require.NoError(t, err)
+	compressed, err := compressRequestOptions(raw)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		data []byte
+		info string
+	}{
+		{raw, "raw options"},
+		{compressed, "gzipped options"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.info, func(t *testing.T) {
+			var r messagesRequest
+			require.NoError(t, decodeRequestOptions(tc.data, &r))
+			require.Equal(t, topics, r.topics)
+		})
+	}
+}
+
+func TestDecodeInvalidCompressedOptions(t *testing.T) {
+	var r messagesRequest
+	require.Error(t, decodeRequestOptions([]byte{compressedOptionsMarker, 0x01, 0x02}, &r))
+
+	large, err := compressRequestOptions(make([]byte, maxDecompressedOptions+1))
+	require.NoError(t, err)
+	require.Equal(t, errOptionsTooLarge, decodeRequestOptions(large, &r))
+}
+
+func TestMatch(t *testing.T) {
+	env, err := generateEnvelope(time.Now())
+	require.NoError(t, err)
+	other := whisper.TopicType{0x01, 0x02, 0x03, 0x04}
+
+	testCases := []struct {
+		request messagesRequest
+		match   bool
+		info    string
+	}{
+		{messagesRequest{bloom: whisper.MakeFullNodeBloom()}, true, "full bloom"},
+		{messagesRequest{bloom: whisper.TopicToBloom(other)}, false, "bloom of another topic"},
+		{messagesRequest{bloom: whisper.TopicToBloom(other), topics: []whisper.TopicType{env.Topic}}, true, "exact topics take precedence over bloom"},
+		{messagesRequest{bloom: whisper.MakeFullNodeBloom(), all: []whisper.TopicType{env.Topic}}, true, "all topics matched"},
+		{messagesRequest{bloom: whisper.MakeFullNodeBloom(), all: []whisper.TopicType{env.Topic, other}}, false, "not all topics matched"},
+		{messagesRequest{bloom: whisper.TopicToBloom(other), all: []whisper.TopicType{env.Topic}}, false, "all topics matched but not the bloom"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.info, func(t *testing.T) {
+			require.Equal(t, tc.match, tc.request.match(env))
+		})
+	}
+}
+
+func TestEnvelopeHasTopic(t *testing.T) {
+	env, err := generateEnvelope(time.Now())
+	require.NoError(t, err)
+	raw, err := rlp.EncodeToBytes(env)
+	require.NoError(t, err)
+
+	require.True(t, envelopeHasTopic(raw, env.Topic))
+	require.False(t, envelopeHasTopic(raw, whisper.TopicType{0x01, 0x02, 0x03, 0x04}))
+	// malformed envelopes are left to the decoder
+	require.True(t, envelopeHasTopic(raw[:8], whisper.TopicType{0x01, 0x02, 0x03, 0x04}))
+}
+
+func TestDecodeAllTopicsOption(t *testing.T) {
+	option, err := newRequestOption(allOptionCode, make([]whisper.TopicType, maxRequestTopics+1))
+	require.NoError(t, err)
+	raw, err := encodeRequestOptions(option)
+	require.NoError(t, err)
+
+	var r messagesRequest
+	require.Equal(t, errTooManyTopics, decodeRequestOptions(raw, &r))
+
+	topic, other := whisper.TopicType{0x01, 0x02, 0x03, 0x04}, whisper.TopicType{0x05, 0x06, 0x07, 0x08}
+	option, err = newRequestOption(allOptionCode, []whisper.TopicType{topic, topic})
+	require.NoError(t, err)
+	raw, err = encodeRequestOptions(option)
+	require.NoError(t, err)
+	r = messagesRequest{}
+	require.NoError(t, decodeRequestOptions(raw, &r))
+	require.Equal(t, []whisper.TopicType{topic}, r.all, "repeated topics should be matched once")
+
+	option, err = newRequestOption(allOptionCode, []whisper.TopicType{topic, other})
+	require.NoError(t, err)
+	raw, err = encodeRequestOptions(option)
+	require.NoError(t, err)
+	require.Equal(t, errConflictingTopics, decodeRequestOptions(raw, &r), "distinct topics can never all be matched")
+}
+
+func TestDecodeAckOptions(t *testing.T) {
+	hash := common.HexToHash("0x01")
+	expectAck, err := newRequestOption(expectAckCode, true)
+	require.NoError(t, err)
+	ack, err := newRequestOption(ackOptionCode, hash)
+	require.NoError(t, err)
+
+	raw, err := encodeRequestOptions(expectAck)
+	require.NoError(t, err)
+	var r messagesRequest
+	require.NoError(t, decodeRequestOptions(raw, &r))
+	require.True(t, r.expectAck)
+	require.Nil(t, r.ack)
+
+	raw, err = encodeRequestOptions(ack)
+	require.NoError(t, err)
+	r = messagesRequest{}
+	require.NoError(t, decodeRequestOptions(raw, &r))
+	require.False(t, r.expectAck)
+	require.Equal(t, &hash, r.ack)
+}
+
+func TestDecodeSenderOption(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	sender := crypto.FromECDSAPub(&key.PublicKey)
+
+	testCases := []struct {
+		option senderOption
+		err    bool
+		info   string
+	}{
+		{senderOption{Sender: sender, SymKey: testEnvelopeKey[:]}, false, "valid sender filter"},
+		{senderOption{Sender: sender[1:], SymKey: testEnvelopeKey[:]}, true, "invalid public key"},
+		{senderOption{Sender: sender, SymKey: testEnvelopeKey[1:]}, true, "invalid symmetric key"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.info, func(t *testing.T) {
+			option, err := newRequestOption(senderOptionCode, tc.option)
+			require.NoError(t, err)
+			raw, err := encodeRequestOptions(option)
+			require.NoError(t, err)
+
+			var r messagesRequest
+			err = decodeRequestOptions(raw, &r)
+			if tc.err {
+				require.Equal(t, errInvalidSender, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, sender, r.sender)
+			require.Equal(t, testEnvelopeKey[:], r.senderKey)
+		})
+	}
+}
+
+func TestDecodeAfterOption(t *testing.T) {
+	hash := common.HexToHash("0x01")
+	option, err := newRequestOption(afterOptionCode, anchorOption{Timestamp: 100, Hash: hash})
+	require.NoError(t, err)
+	raw, err := encodeRequestOptions(option)
+	require.NoError(t, err)
+
+	var r messagesRequest
+	require.NoError(t, decodeRequestOptions(raw, &r))
+	require.Equal(t, NewDbKey(100, hash).raw, r.after)
+	require.Equal(t, r.after, r.startAfter())
+
+	r.lower, r.upper = 100, 200
+	r.cursor = newCursor(100, 200, NewDbKey(150, hash).raw)
+	require.Equal(t, NewDbKey(150, hash).raw, r.startAfter(), "the cursor should take precedence")
+}
@@ -0,0 +1,158 @@
+package mailserver
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// costAgingPerSecond is how much cheaper, in estimated envelopes, a waiting
+// request is considered for every second it waits. It bounds the wait of
+// large backfills: a request estimated at n envelopes is only overtaken by
+// cheaper requests for up to n/costAgingPerSecond seconds.
+const costAgingPerSecond = 1000
+
+// scheduler bounds the number of requests served at once. Requests beyond
+// the bound wait for a slot, cheapest first, so that small recent-history
+// queries of interactive clients are not stuck behind bulk syncs.
+type scheduler struct {
+	mu      sync.Mutex
+	slots   int
+	free    int // slots not in use
+	waiting waitQueue
+
+	// slots temporarily held back to lower the concurrency, and slots in
+	// use still to be held back once released
+	held int
+	owed int
+}
+
+func newScheduler(slots int) *scheduler {
+	return &scheduler{slots: slots, free: slots}
+}
+
+// acquire waits for a slot to serve a request of the given estimated cost.
+func (s *scheduler) acquire(cost int64) {
+	s.mu.Lock()
+	if s.free > 0 && len(s.waiting) == 0 {
+		s.free--
+		s.mu.Unlock()
+		return
+	}
+	w := &waiter{priority: priority(cost, time.Now()), ready: make(chan struct{})}
+	heap.Push(&s.waiting, w)
+	s.mu.Unlock()
+
+	<-w.ready
+}
+
+// release frees a slot, handing it over to the first waiting request.
+func (s *scheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.owed > 0 {
+		s.owed--
+		s.held++
+		return
+	}
+	s.handOver()
+}
+
+// handOver hands a slot over to the first waiting request, or frees it. It
+// must be called with mu held.
+func (s *scheduler) handOver() {
+	if len(s.waiting) == 0 {
+		s.free++
+		return
+	}
+	close(heap.Pop(&s.waiting).(*waiter).ready)
+}
+
+// reduce halves the number of slots for the given duration, slots in use
+// being held back as they are released. It is a no-op while the slots are
+// already reduced or if there is a single slot.
+func (s *scheduler) reduce(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.slots / 2
+	if n == 0 || s.held+s.owed > 0 {
+		return
+	}
+	taken := n
+	if taken > s.free {
+		taken = s.free
+	}
+	s.free -= taken
+	s.held, s.owed = taken, n-taken
+	time.AfterFunc(d, s.restore)
+}
+
+// restore gives back the slots held back by reduce.
+func (s *scheduler) restore() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.owed = 0
+	for ; s.held > 0; s.held-- {
+		s.handOver()
+	}
+}
+
+func (s *scheduler) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.waiting)
+}
+
+// priority returns the rank of a request waiting since the given time, the
+// lowest first. As all waiting requests age at the same rate, ranking by the
+// cost discounted by the time waited amounts to adding the aging of the
+// enqueue time, which keeps the rank of a waiting request fixed.
+func priority(cost int64, enqueued time.Time) float64 {
+	return float64(cost) + costAgingPerSecond*float64(enqueued.UnixNano())/float64(time.Second)
+}
+
+type waiter struct {
+	priority float64
+	ready    chan struct{}
+}
+
+// waitQueue is a heap of waiting requests, the lowest priority first.
+type waitQueue []*waiter
+
+func (q waitQueue) Len() int            { return len(q) }
+func (q waitQueue) Less(i, j int) bool  { return q[i].priority < q[j].priority }
+func (q waitQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *waitQueue) Push(x interface{}) { *q = append(*q, x.(*waiter)) }
+func (q *waitQueue) Pop() interface{} {
+	old := *q
+	w := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return w
+}
+
+// requestCost estimates the number of envelopes a request will deliver.
+func (s *WMailServer) requestCost(r *messagesRequest) int64 {
+	queries := r.queries
+	if len(queries) == 0 {
+		queries = []Query{{Lower: r.lower, Upper: r.upper, Bloom: r.bloom}}
+	}
+
+	var cost int64
+	for _, q := range queries {
+		keys, err := s.EstimateQueryCost(q.Lower, q.Upper, q.Bloom)
+		if err != nil {
+			log.Warn("Failed to estimate query cost", "error", err)
+			continue
+		}
+		if r.limit > 0 && keys > int64(r.limit) {
+			keys = int64(r.limit)
+		}
+		cost += keys
+	}
+	return cost
+}
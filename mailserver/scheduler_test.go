@@ -0,0 +1,90 @@
+package mailserver
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchedulerOrder(t *testing.T) {
+	s := newScheduler(1)
+	s.acquire(0)
+
+	var wg sync.WaitGroup
+	served := make(chan int64, 2)
+	enqueue := func(cost int64) {
+		queued := s.len()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.acquire(cost)
+			served <- cost
+			s.release()
+		}()
+		// wait for the request to be queued, so the enqueue order is known
+		for s.len() == queued {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	enqueue(100000)
+	enqueue(10)
+
+	s.release()
+	require.Equal(t, int64(10), <-served, "the cheaper request should be served first")
+	require.Equal(t, int64(100000), <-served)
+	wg.Wait()
+	require.Equal(t, 1, s.free)
+}
+
+func TestPriorityAging(t *testing.T) {
+	now := time.Now()
+	testCases := []struct {
+		waited   time.Duration
+		overtake bool
+		info     string
+	}{
+		{0, true, "same enqueue time"},
+		{time.Second, true, "large request waited less than its cost"},
+		{11 * time.Second, false, "large request waited longer than its cost"},
+	}
+	for _, tc := range testCases {
+		large := priority(10*costAgingPerSecond, now.Add(-tc.waited))
+		small := priority(0, now)
+		require.Equal(t, tc.overtake, small < large, tc.info)
+	}
+}
+
+func TestSchedulerReduce(t *testing.T) {
+	s := newScheduler(4)
+	for i := 0; i < 3; i++ {
+		s.acquire(0)
+	}
+
+	// one free slot and one slot in use are held back
+	s.reduce(time.Hour)
+	require.Equal(t, 0, s.free)
+	s.release()
+	require.Equal(t, 0, s.free, "the released slot should be held back")
+	s.release()
+	require.Equal(t, 1, s.free)
+
+	// reducing again while reduced does nothing
+	s.reduce(time.Hour)
+	require.Equal(t, 1, s.free)
+
+	s.acquire(0)
+	acquired := make(chan struct{})
+	go func() {
+		s.acquire(0)
+		close(acquired)
+	}()
+	for s.len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	s.restore()
+	<-acquired
+	require.Equal(t, 1, s.free)
+	require.Equal(t, 0, s.held)
+}
@@ -0,0 +1,74 @@
+package mailserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// selfTestNamespace is the namespace the synthetic envelopes of SelfTest are
+// archived in, so that they are never delivered to peers.
+const selfTestNamespace = "mailserver/self-test"
+
+var selfTestTopic = whisper.TopicType{0x73, 0x65, 0x6c, 0x66} // "self"
+
+// SelfTest archives a synthetic envelope, reads it back with a range query
+// and removes it, checking end to end that the DB can be written and
+// queried, e.g. as a smoke test after a deployment. The envelope is archived
+// in a reserved namespace and never reaches the real archive.
+func (s *WMailServer) SelfTest() error {
+	if s.readOnly {
+		return errReadOnly
+	}
+	if err := s.startWrite(); err != nil {
+		return err
+	}
+	defer s.writes.Done()
+
+	sent := s.now().Add(-time.Minute)
+	env, err := BuildEnvelope(selfTestTopic, []byte("mail server self-test"), sent)
+	if err != nil {
+		return fmt.Errorf("self-test: build envelope: %s", err)
+	}
+	expected, err := rlp.EncodeToBytes(env)
+	if err != nil {
+		return fmt.Errorf("self-test: encode envelope: %s", err)
+	}
+
+	probe := &WMailServer{
+		db:           s.db,
+		writeOptions: s.writeOptions,
+		namespace:    newNamespace(selfTestNamespace),
+	}
+	lower := env.Expiry - env.TTL
+	if err := probe.write(NewNamespacedDbKey(probe.namespace, lower, env.Hash()).raw, expected, env.Topic, nil); err != nil {
+		return fmt.Errorf("self-test: archive envelope: %s", err)
+	}
+
+	var read [][]byte
+	r := &messagesRequest{lower: lower, upper: lower + 1, bloom: whisper.MakeFullNodeBloom()}
+	_, queryErr := probe.processRequestStream(r, func(env *whisper.Envelope) error {
+		raw, err := rlp.EncodeToBytes(env)
+		read = append(read, raw)
+		return err
+	})
+
+	removed, err := probe.newCleaner().Prune(lower, lower+1)
+	switch {
+	case queryErr != nil:
+		return fmt.Errorf("self-test: query envelope: %s", queryErr)
+	case len(read) != 1:
+		return fmt.Errorf("self-test: query returned %d envelopes, expected 1", len(read))
+	case !bytes.Equal(read[0], expected):
+		return errors.New("self-test: envelope read back differs from the archived one")
+	case err != nil:
+		return fmt.Errorf("self-test: remove envelope: %s", err)
+	case removed != 1:
+		return fmt.Errorf("self-test: removed %d envelopes, expected 1", removed)
+	}
+	return nil
+}
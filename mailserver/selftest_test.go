@@ -0,0 +1,30 @@
+package mailserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelfTest(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+	archiveEnvelope(t, time.Now().Add(-time.Hour), server)
+
+	require.NoError(t, server.SelfTest())
+
+	// the real archive is left untouched
+	testMessagesCount(t, 1, server)
+	counts, err := server.TopicCounts()
+	require.NoError(t, err)
+	_, ok := counts[selfTestTopic]
+	require.False(t, ok, "the topic index should not keep the synthetic envelope")
+
+	server.readOnly = true
+	require.Equal(t, errReadOnly, server.SelfTest())
+	server.readOnly = false
+
+	server.PrepareShutdown()
+	require.Equal(t, errShuttingDown, server.SelfTest())
+}
@@ -0,0 +1,113 @@
+package mailserver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var (
+	// sequencePrefix prefixes the keys of the sequence index, which maps the
+	// sequence number of every archived envelope to its DB key. Unlike sent
+	// times, sequence numbers follow the order envelopes were archived in,
+	// so clients can sync without depending on the clocks of senders.
+	sequencePrefix = []byte{reservedPrefix, 's'}
+	// lastSequencePrefix prefixes the key holding the last sequence number
+	// assigned in a namespace. It is kept apart from the index so that
+	// numbers are never reused once the envelopes holding them are removed.
+	lastSequencePrefix = []byte{reservedPrefix, 'n'}
+)
+
+// SequencedEnvelope is an archived envelope along with its sequence number.
+type SequencedEnvelope struct {
+	Sequence uint64
+	Envelope *whisper.Envelope
+}
+
+func (s *WMailServer) sequenceKey(seq uint64) []byte {
+	key := append(append([]byte(nil), sequencePrefix...), s.namespace...)
+	return append(key, encodeSequence(seq)...)
+}
+
+func (s *WMailServer) lastSequenceKey() []byte {
+	return append(append([]byte(nil), lastSequencePrefix...), s.namespace...)
+}
+
+func encodeSequence(seq uint64) []byte {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, seq)
+	return value
+}
+
+// readLastSequence returns the last sequence number assigned in the
+// namespace of the server, 0 if there is none.
+func (s *WMailServer) readLastSequence() (uint64, error) {
+	value, err := s.db.Get(s.lastSequenceKey(), nil)
+	if err == leveldb.ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(value), nil
+}
+
+// writeSequence adds to the batch the next sequence number of the namespace
+// of the server, assigned to the envelope stored under the given key. It
+// must be called with indexMu held until the batch is written.
+func (s *WMailServer) writeSequence(batch *leveldb.Batch, key []byte) error {
+	last, err := s.readLastSequence()
+	if err != nil {
+		return err
+	}
+	batch.Put(s.sequenceKey(last+1), key)
+	batch.Put(s.lastSequenceKey(), encodeSequence(last+1))
+	return nil
+}
+
+// GetAfterSequence returns up to limit archived envelopes with a sequence
+// number greater than n, in the order they were archived. A limit of 0
+// means no limit. Envelopes removed since they were archived are skipped,
+// and envelopes archived before sequence numbers were introduced have none.
+func (s *WMailServer) GetAfterSequence(n uint64, limit int) ([]SequencedEnvelope, error) {
+	if n == math.MaxUint64 {
+		return nil, nil
+	}
+	prefix := append(append([]byte(nil), sequencePrefix...), s.namespace...)
+	i := s.db.NewIterator(&util.Range{
+		Start: s.sequenceKey(n + 1),
+		Limit: util.BytesPrefix(prefix).Limit,
+	}, nil)
+	defer i.Release()
+
+	var envelopes []SequencedEnvelope
+	for i.Next() && (limit <= 0 || len(envelopes) < limit) {
+		// the index of the default namespace spans those of other namespaces
+		if len(i.Key()) != len(prefix)+8 {
+			continue
+		}
+		raw, err := s.getEnvelope(i.Value())
+		if err != nil {
+			return nil, err
+		}
+		if raw == nil {
+			continue
+		}
+		var env whisper.Envelope
+		if err := rlp.DecodeBytes(raw, &env); err != nil {
+			return nil, fmt.Errorf("RLP decoding failed: %s", err)
+		}
+		envelopes = append(envelopes, SequencedEnvelope{
+			Sequence: binary.BigEndian.Uint64(i.Key()[len(i.Key())-8:]),
+			Envelope: &env,
+		})
+	}
+	if err := i.Error(); err != nil {
+		return nil, err
+	}
+	return envelopes, nil
+}
@@ -0,0 +1,66 @@
+package mailserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetAfterSequence(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+	other := &WMailServer{db: server.db, pow: server.pow, namespace: newNamespace("other")}
+
+	// envelopes arrive out of the order they were sent in
+	var archived []common.Hash
+	for _, age := range []time.Duration{time.Minute, 3 * time.Minute, 2 * time.Minute, 5 * time.Minute, 4 * time.Minute} {
+		archived = append(archived, archiveEnvelope(t, now.Add(-age), server).Hash())
+	}
+	archiveEnvelope(t, now.Add(-time.Minute), other)
+	// archiving an envelope again does not assign it a sequence number anew
+	env, err := server.GetByHash(archived[0])
+	require.NoError(t, err)
+	server.Archive(env)
+
+	testCases := []struct {
+		after    uint64
+		limit    int
+		expected []common.Hash
+		info     string
+	}{
+		{0, 0, archived, "all envelopes in archival order"},
+		{2, 0, archived[2:], "envelopes after a sequence number"},
+		{1, 2, archived[1:3], "limited envelopes"},
+		{5, 0, nil, "no envelopes past the last sequence number"},
+	}
+	for _, tc := range testCases {
+		envelopes, err := server.GetAfterSequence(tc.after, tc.limit)
+		require.NoError(t, err, tc.info)
+		var hashes []common.Hash
+		for i, e := range envelopes {
+			require.Equal(t, tc.after+uint64(i)+1, e.Sequence, tc.info)
+			hashes = append(hashes, e.Envelope.Hash())
+		}
+		require.Equal(t, tc.expected, hashes, tc.info)
+	}
+
+	// namespaces are numbered independently
+	envelopes, err := other.GetAfterSequence(0, 0)
+	require.NoError(t, err)
+	require.Len(t, envelopes, 1)
+	require.Equal(t, uint64(1), envelopes[0].Sequence)
+
+	// removed envelopes are skipped and their sequence numbers not reused
+	_, err = server.DeleteRange(now.Add(-time.Minute), now)
+	require.NoError(t, err)
+	later := archiveEnvelope(t, now, server)
+	envelopes, err = server.GetAfterSequence(0, 0)
+	require.NoError(t, err)
+	require.Len(t, envelopes, len(archived))
+	require.Equal(t, archived[1], envelopes[0].Envelope.Hash())
+	require.Equal(t, later.Hash(), envelopes[len(envelopes)-1].Envelope.Hash())
+	require.Equal(t, uint64(len(archived)+1), envelopes[len(envelopes)-1].Sequence)
+}
@@ -0,0 +1,68 @@
+package mailserver
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+var errUnsignedBatchProof = errors.New("batch proof is not signed by the mail server")
+
+// BatchProof lets clients verify that a batch of historic envelopes was
+// delivered by the mail server they sent their request to.
+//
+// When response signing is enabled, the mail server follows every delivered
+// batch with a direct message signed with its node key and encrypted with
+// the public key of the requesting peer. The message has the topic of the
+// request and its payload is the RLP-encoded BatchProof listing the hashes
+// of the delivered envelopes, in delivery order. To verify it, clients:
+//
+//  1. decrypt the message with the private key used to sign the request,
+//  2. pass it to VerifyBatchProof along with the public key of the mail
+//     server, i.e. its enode ID,
+//  3. check that the returned hashes are those of the received envelopes.
+type BatchProof struct {
+	Lower  uint32        // lower bound of the request
+	Upper  uint32        // upper bound of the request
+	Hashes []common.Hash // hashes of the delivered envelopes
+}
+
+// SetSigningKey enables signing of the delivered batches with the given key,
+// usually the node key. It must be called before Init.
+func (s *WMailServer) SetSigningKey(key *ecdsa.PrivateKey) {
+	s.signingKey = key
+}
+
+// newBatchProof returns the envelope proving the delivery of the given
+// envelope hashes in response to the request.
+func (s *WMailServer) newBatchProof(r *messagesRequest, hashes []common.Hash) (*whisper.Envelope, error) {
+	env, err := s.newDirectMessage(r.src, r.topic, BatchProof{
+		Lower:  r.lower,
+		Upper:  r.upper,
+		Hashes: hashes,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create batch proof: %s", err)
+	}
+	return env, nil
+}
+
+// VerifyBatchProof checks that a decrypted batch proof message was signed
+// by the mail server with the given public key and returns the proof.
+func VerifyBatchProof(msg *whisper.ReceivedMessage, server *ecdsa.PublicKey) (*BatchProof, error) {
+	if msg.Src == nil || !bytes.Equal(crypto.FromECDSAPub(msg.Src), crypto.FromECDSAPub(server)) {
+		return nil, errUnsignedBatchProof
+	}
+
+	var proof BatchProof
+	if err := rlp.DecodeBytes(msg.Payload, &proof); err != nil {
+		return nil, fmt.Errorf("invalid batch proof: %s", err)
+	}
+	return &proof, nil
+}
@@ -0,0 +1,42 @@
+package mailserver
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchProof(t *testing.T) {
+	server := setupTestServer(t)
+	defer server.Close()
+
+	serverKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	server.SetSigningKey(serverKey)
+	peerKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+
+	r := &messagesRequest{
+		lower: 10,
+		upper: 20,
+		src:   &peerKey.PublicKey,
+		topic: whisper.TopicType{0x01, 0x02, 0x03, 0x04},
+	}
+	hashes := []common.Hash{common.HexToHash("0x01"), common.HexToHash("0x02")}
+	env, err := server.newBatchProof(r, hashes)
+	require.NoError(t, err)
+	require.Equal(t, r.topic, env.Topic)
+
+	msg := env.Open(&whisper.Filter{KeyAsym: peerKey})
+	require.NotNil(t, msg, "the proof should be readable by the requesting peer")
+
+	proof, err := VerifyBatchProof(msg, &serverKey.PublicKey)
+	require.NoError(t, err)
+	require.Equal(t, &BatchProof{Lower: 10, Upper: 20, Hashes: hashes}, proof)
+
+	_, err = VerifyBatchProof(msg, &peerKey.PublicKey)
+	require.Equal(t, errUnsignedBatchProof, err)
+}
@@ -0,0 +1,57 @@
+package mailserver
+
+import (
+	"fmt"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// snapshotBatchSize is the number of entries copied per write to a snapshot.
+const snapshotBatchSize = 1000
+
+// Snapshot writes a consistent point-in-time copy of the archive to a new DB
+// in dir, e.g. for backups, without stopping the server. It reads from a
+// LevelDB snapshot, so envelopes archived while the copy is made are left out
+// along with their index entries. The copy is restored by pointing Init at
+// it. Envelopes moved to the cold storage are not copied, and it fails if dir
+// already holds a DB.
+func (s *WMailServer) Snapshot(dir string) error {
+	snapshot, err := s.db.GetSnapshot()
+	if err != nil {
+		return fmt.Errorf("snapshot DB: %s", err)
+	}
+	defer snapshot.Release()
+
+	db, err := leveldb.OpenFile(dir, &opt.Options{ErrorIfExist: true})
+	if err != nil {
+		return fmt.Errorf("open snapshot DB: %s", err)
+	}
+	if err := copySnapshot(snapshot, db); err != nil {
+		db.Close()
+		return fmt.Errorf("copy snapshot: %s", err)
+	}
+	return db.Close()
+}
+
+// copySnapshot writes every entry of the snapshot to db, syncing the last
+// write so that the copy is durable once it returns.
+func copySnapshot(snapshot *leveldb.Snapshot, db *leveldb.DB) error {
+	i := snapshot.NewIterator(nil, nil)
+	defer i.Release()
+
+	batch := new(leveldb.Batch)
+	for i.Next() {
+		batch.Put(i.Key(), i.Value())
+		if batch.Len() == snapshotBatchSize {
+			if err := db.Write(batch, nil); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if err := i.Error(); err != nil {
+		return err
+	}
+	return db.Write(batch, &opt.WriteOptions{Sync: true})
+}
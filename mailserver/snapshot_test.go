@@ -0,0 +1,88 @@
+package mailserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func TestSnapshot(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "mailserver-snapshot")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	topics := []whisper.TopicType{whisper.BytesToTopic([]byte("abcd")), whisper.BytesToTopic([]byte("efgh"))}
+	archive := func(from, to int) error {
+		for i := from; i < to; i++ {
+			env, err := BuildEnvelope(topics[i%len(topics)], []byte{byte(i), byte(i >> 8)}, now.Add(-time.Duration(i)*time.Second))
+			if err != nil {
+				return err
+			}
+			if err := server.archive(env); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	require.NoError(t, archive(0, 100))
+
+	// the snapshot is taken while envelopes keep being archived
+	var (
+		wg         sync.WaitGroup
+		archiveErr error
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		archiveErr = archive(100, 1100)
+	}()
+	path := filepath.Join(dir, "snapshot")
+	require.NoError(t, server.Snapshot(path))
+	wg.Wait()
+	require.NoError(t, archiveErr)
+
+	// a DB cannot be snapshotted over another
+	require.Error(t, server.Snapshot(path))
+
+	// the snapshot can be opened as the server would on Init, and its
+	// indexes match the envelopes it holds
+	db, err := leveldb.OpenFile(path, nil)
+	require.NoError(t, err)
+	defer db.Close()
+	restored := &WMailServer{db: db}
+	require.NoError(t, migrate(db, &restored.indexMu, false))
+	require.NoError(t, checkKeyFormat(db, false))
+
+	counts := make(map[whisper.TopicType]int64)
+	i := db.NewIterator(nil, nil)
+	for i.Next() {
+		if !isEnvelopeKey(i.Key()) {
+			continue
+		}
+		topic, ok := readEnvelopeTopic(i.Value())
+		require.True(t, ok)
+		counts[topic]++
+	}
+	i.Release()
+	require.NoError(t, i.Error())
+	total := counts[topics[0]] + counts[topics[1]]
+	require.True(t, total >= 100 && total <= 1100, "unexpected number of envelopes: %d", total)
+
+	indexed, err := restored.TopicCounts()
+	require.NoError(t, err)
+	require.Equal(t, counts, indexed)
+	repairs, err := checkHashIndex(db, &restored.indexMu, 0, false)
+	require.NoError(t, err)
+	require.Zero(t, repairs, "the hash index should match the envelopes")
+}
@@ -0,0 +1,88 @@
+package mailserver
+
+import (
+	"sync"
+	"sync/atomic"
+
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// defaultSubscriptionBuffer is used when subscribing with a non-positive
+// buffer size.
+const defaultSubscriptionBuffer = 100
+
+// Subscription receives envelopes as they are archived. Envelopes are
+// dropped, and counted, when the subscriber lags behind and the buffer is
+// full, so that subscribers never slow archiving down.
+type Subscription struct {
+	dropped int64 // accessed atomically, kept first for 64-bit alignment
+
+	C <-chan *whisper.Envelope
+
+	ch     chan *whisper.Envelope
+	server *WMailServer
+	once   sync.Once
+}
+
+// Dropped returns the number of envelopes dropped because the buffer was full.
+func (sub *Subscription) Dropped() int64 {
+	return atomic.LoadInt64(&sub.dropped)
+}
+
+// Unsubscribe stops the delivery of envelopes and closes the channel.
+func (sub *Subscription) Unsubscribe() {
+	sub.once.Do(func() {
+		sub.server.subsMu.Lock()
+		delete(sub.server.subs, sub)
+		sub.server.subsMu.Unlock()
+		close(sub.ch)
+	})
+}
+
+// Subscribe returns a subscription to newly archived envelopes, buffering
+// up to buffer envelopes.
+func (s *WMailServer) Subscribe(buffer int) *Subscription {
+	if buffer <= 0 {
+		buffer = defaultSubscriptionBuffer
+	}
+	ch := make(chan *whisper.Envelope, buffer)
+	sub := &Subscription{C: ch, ch: ch, server: s}
+
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+	if s.subs == nil {
+		s.subs = make(map[*Subscription]struct{})
+	}
+	s.subs[sub] = struct{}{}
+	return sub
+}
+
+// notifySubscribers hands an archived envelope to every subscriber without
+// blocking.
+func (s *WMailServer) notifySubscribers(env *whisper.Envelope) {
+	s.subsMu.RLock()
+	defer s.subsMu.RUnlock()
+
+	for sub := range s.subs {
+		select {
+		case sub.ch <- env:
+		default:
+			atomic.AddInt64(&sub.dropped, 1)
+			subscriptionDroppedCounter.Inc(1)
+		}
+	}
+}
+
+// closeSubscriptions unsubscribes every subscriber, closing their channels.
+func (s *WMailServer) closeSubscriptions() {
+	s.subsMu.RLock()
+	subs := make([]*Subscription, 0, len(s.subs))
+	for sub := range s.subs {
+		subs = append(subs, sub)
+	}
+	s.subsMu.RUnlock()
+
+	for _, sub := range subs {
+		sub.Unsubscribe()
+	}
+}
@@ -0,0 +1,42 @@
+package mailserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribe(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+
+	first := server.Subscribe(1)
+	second := server.Subscribe(10)
+
+	env := archiveEnvelope(t, now.Add(-2*time.Second), server)
+	require.Equal(t, env, <-first.C)
+	require.Equal(t, env, <-second.C)
+
+	// a lagging subscriber drops envelopes without blocking archiving
+	archiveEnvelope(t, now.Add(-1*time.Second), server)
+	archiveEnvelope(t, now.Add(-1*time.Second), server)
+	require.Equal(t, int64(1), first.Dropped())
+	require.Equal(t, int64(0), second.Dropped())
+	require.Len(t, second.C, 2)
+
+	// envelopes which fail to be archived are not emitted
+	server.readOnly = true
+	server.Archive(env)
+	server.readOnly = false
+	require.Len(t, second.C, 2)
+
+	second.Unsubscribe()
+	second.Unsubscribe()
+	archiveEnvelope(t, now.Add(-1*time.Second), server)
+	<-second.C
+	<-second.C
+	_, ok := <-second.C
+	require.False(t, ok, "the channel should be closed once unsubscribed")
+}
@@ -0,0 +1,42 @@
+package mailserver
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// Defaults of the envelopes built for tests.
+const (
+	testEnvelopePoW      = 0.00001
+	testEnvelopeWorkTime = 2
+)
+
+// testEnvelopeKey is the symmetric key test envelopes are encrypted with.
+var testEnvelopeKey = crypto.Keccak256Hash([]byte("test sample data"))
+
+// BuildEnvelope returns an envelope with the given topic and payload, sent
+// at the given time, to be used as a test fixture. Envelopes are encrypted
+// with a fixed symmetric key and satisfy a minimal PoW.
+func BuildEnvelope(topic whisper.TopicType, payload []byte, sentAt time.Time) (*whisper.Envelope, error) {
+	params := &whisper.MessageParams{
+		KeySym:   testEnvelopeKey[:],
+		Topic:    topic,
+		Payload:  payload,
+		PoW:      testEnvelopePoW,
+		WorkTime: testEnvelopeWorkTime,
+	}
+
+	msg, err := whisper.NewSentMessage(params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new message: %s", err)
+	}
+	env, err := msg.Wrap(params, sentAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap message: %s", err)
+	}
+
+	return env, nil
+}
@@ -0,0 +1,24 @@
+package mailserver
+
+import (
+	"testing"
+	"time"
+
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildEnvelope(t *testing.T) {
+	topic := whisper.TopicType{0x01, 0x02, 0x03, 0x04}
+	sentAt := time.Now().Add(-time.Hour)
+
+	env, err := BuildEnvelope(topic, []byte("payload"), sentAt)
+	require.NoError(t, err)
+	require.Equal(t, topic, env.Topic)
+	require.Equal(t, uint32(sentAt.Unix()), env.Expiry-env.TTL)
+	require.True(t, env.PoW() >= testEnvelopePoW)
+
+	msg := env.Open(&whisper.Filter{KeySym: testEnvelopeKey[:]})
+	require.NotNil(t, msg)
+	require.Equal(t, []byte("payload"), msg.Payload)
+}
@@ -1,24 +1,56 @@
 package mailserver
 
-import "time"
+import (
+	"sync"
+	"time"
+)
 
+// ticker runs a function periodically on a goroutine of its own until stopped.
+// It is safe to stop it concurrently with run, e.g. when the server is closed
+// while being initialized: a ticker stopped before running never starts.
 type ticker struct {
+	mu         sync.Mutex
+	stopped    bool
 	timeTicker *time.Ticker
+	quit       chan struct{}
+	wg         sync.WaitGroup
 }
 
 func (t *ticker) run(period time.Duration, fn func()) {
-	if t.timeTicker != nil {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timeTicker != nil || t.stopped {
 		return
 	}
 
 	t.timeTicker = time.NewTicker(period)
+	ticks, quit := t.timeTicker.C, make(chan struct{})
+	t.quit = quit
+	t.wg.Add(1)
 	go func() {
-		for range t.timeTicker.C {
-			fn()
+		defer t.wg.Done()
+		for {
+			select {
+			case <-ticks:
+				fn()
+			case <-quit:
+				return
+			}
 		}
 	}()
 }
 
+// stop stops the ticker and waits for a running fn to return.
 func (t *ticker) stop() {
+	t.mu.Lock()
+	t.stopped = true
+	if t.timeTicker == nil || t.quit == nil {
+		t.mu.Unlock()
+		return
+	}
 	t.timeTicker.Stop()
+	close(t.quit)
+	t.quit = nil
+	t.mu.Unlock()
+	t.wg.Wait()
 }
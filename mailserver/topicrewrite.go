@@ -0,0 +1,66 @@
+package mailserver
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/log"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// SetTopicRewrites archives the envelopes of every topic of the map under
+// the topic it maps to, e.g. during a protocol migration, so that clients
+// querying the new topic find the history of the old one. Rewritten envelopes
+// keep their nonce, so they no longer carry a valid PoW and hash to a different
+// key: the minimum PoW is checked against the envelope as received. Without
+// rewrites, topics are left untouched. It can be called while the server is
+// running.
+func (s *WMailServer) SetTopicRewrites(rewrites map[whisper.TopicType]whisper.TopicType) {
+	var copied map[whisper.TopicType]whisper.TopicType
+	if len(rewrites) > 0 {
+		copied = make(map[whisper.TopicType]whisper.TopicType, len(rewrites))
+		for from, to := range rewrites {
+			copied[from] = to
+		}
+	}
+
+	s.topicRewritesMu.Lock()
+	defer s.topicRewritesMu.Unlock()
+	s.topicRewrites = copied
+}
+
+// rewriteTopic returns the envelope to archive in place of the given one,
+// with its topic rewritten if needed. The envelope itself is not modified,
+// as it is shared with the whisper pool.
+func (s *WMailServer) rewriteTopic(env *whisper.Envelope) *whisper.Envelope {
+	s.topicRewritesMu.RLock()
+	topic, ok := s.topicRewrites[env.Topic]
+	s.topicRewritesMu.RUnlock()
+	if !ok || topic == env.Topic {
+		return env
+	}
+
+	rewritten := &whisper.Envelope{
+		Expiry: env.Expiry,
+		TTL:    env.TTL,
+		Topic:  topic,
+		Data:   env.Data,
+		Nonce:  env.Nonce,
+	}
+	archiveRewriteCounter.Inc(1)
+	log.Debug("Rewrote topic of archived envelope", "hash", env.Hash().Hex(),
+		"from", env.Topic.String(), "to", topic.String(), "newHash", rewritten.Hash().Hex())
+	return rewritten
+}
+
+// decodeTopicRewrites decodes a map of hex-encoded topics.
+func decodeTopicRewrites(rewrites map[string]string) (map[whisper.TopicType]whisper.TopicType, error) {
+	decoded := make(map[whisper.TopicType]whisper.TopicType, len(rewrites))
+	for from, to := range rewrites {
+		topics, err := decodeTopics([]string{from, to})
+		if err != nil {
+			return nil, fmt.Errorf("invalid topic rewrite: %s", err)
+		}
+		decoded[topics[0]] = topics[1]
+	}
+	return decoded, nil
+}
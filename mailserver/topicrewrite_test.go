@@ -0,0 +1,62 @@
+package mailserver
+
+import (
+	"testing"
+	"time"
+
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopicRewrites(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+
+	oldTopic := whisper.BytesToTopic([]byte("abcd"))
+	newTopic := whisper.BytesToTopic([]byte("efgh"))
+	server.SetTopicRewrites(map[whisper.TopicType]whisper.TopicType{oldTopic: newTopic})
+	// topics are restricted after being rewritten
+	server.SetArchiveTopics([]whisper.TopicType{newTopic})
+
+	env, err := BuildEnvelope(oldTopic, []byte("migrated"), now.Add(-time.Second))
+	require.NoError(t, err)
+	hash := env.Hash()
+	require.NoError(t, server.archive(env))
+	require.Equal(t, oldTopic, env.Topic, "the received envelope should not be modified")
+	require.Equal(t, hash, env.Hash())
+
+	counts, err := server.TopicCounts()
+	require.NoError(t, err)
+	require.Equal(t, map[whisper.TopicType]int64{newTopic: 1}, counts)
+
+	var delivered []*whisper.Envelope
+	r := &messagesRequest{
+		lower:  uint32(now.Add(-time.Minute).Unix()),
+		upper:  uint32(now.Unix()),
+		topics: []whisper.TopicType{newTopic},
+	}
+	_, err = server.processRequestStream(r, func(env *whisper.Envelope) error {
+		delivered = append(delivered, env)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, delivered, 1)
+	require.Equal(t, newTopic, delivered[0].Topic)
+	require.Equal(t, env.Data, delivered[0].Data)
+
+	// without rewrites, topics are left untouched
+	server.SetTopicRewrites(nil)
+	require.Equal(t, env, server.rewriteTopic(env))
+}
+
+func TestDecodeTopicRewrites(t *testing.T) {
+	rewrites, err := decodeTopicRewrites(map[string]string{"0x61626364": "65666768"})
+	require.NoError(t, err)
+	require.Equal(t, map[whisper.TopicType]whisper.TopicType{
+		whisper.BytesToTopic([]byte("abcd")): whisper.BytesToTopic([]byte("efgh")),
+	}, rewrites)
+
+	_, err = decodeTopicRewrites(map[string]string{"0x61626364": "6566"})
+	require.Error(t, err)
+}
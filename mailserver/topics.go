@@ -0,0 +1,149 @@
+package mailserver
+
+import (
+	"encoding/binary"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Keys starting with reservedPrefix hold mail server metadata instead of
+// envelopes. As a timestamp the prefix would only be reached in 2105, so
+// reserved keys never collide with archived envelopes, and their size
+// differs from dbKeySize so range scans can skip them.
+const reservedPrefix = 0xFF
+
+// topicIndexPrefix prefixes the keys of the topic index, which maps every
+// archived topic to the number of envelopes stored for it. Like the sequence
+// index, it is kept per namespace.
+var topicIndexPrefix = []byte{reservedPrefix, 't'}
+
+func topicIndexKey(namespace []byte, topic whisper.TopicType) []byte {
+	key := append(append([]byte(nil), topicIndexPrefix...), namespace...)
+	return append(key, topic[:]...)
+}
+
+// namespacedTopic is a topic of the envelopes archived in a namespace, empty
+// for the default namespace, as indexed by the topic and topic size indexes.
+type namespacedTopic struct {
+	namespace string
+	topic     whisper.TopicType
+}
+
+func newNamespacedTopic(key []byte, topic whisper.TopicType) namespacedTopic {
+	return namespacedTopic{namespace: string(keyNamespace(key)), topic: topic}
+}
+
+// isEnvelopeKey reports whether a DB key belongs to an archived envelope,
+// in any namespace.
+func isEnvelopeKey(key []byte) bool {
+	return len(key) == dbKeySize || (len(key) == namespacedKeySize && key[0] == namespacePrefix)
+}
+
+// isTombstone reports whether the value of an envelope key is a tombstone
+// left by a prune, i.e. the envelope was removed but its key, made of the
+// sent time and hash, is kept.
+func isTombstone(value []byte) bool {
+	return len(value) == 0
+}
+
+// topicCounts accumulates changes of the topic index.
+type topicCounts map[namespacedTopic]int64
+
+// add accounts for an envelope of the given topic stored or removed under
+// the given DB key.
+func (c topicCounts) add(key []byte, topic whisper.TopicType, delta int64) {
+	c[newNamespacedTopic(key, topic)] += delta
+}
+
+// addEnvelope accounts for an RLP-encoded envelope stored or removed under
+// the given DB key.
+func (c topicCounts) addEnvelope(key, raw []byte, delta int64) error {
+	var env whisper.Envelope
+	if err := rlp.DecodeBytes(raw, &env); err != nil {
+		return err
+	}
+	c.add(key, env.Topic, delta)
+	return nil
+}
+
+// write adds the accumulated changes to the batch. It must be called with
+// indexMu held until the batch is written.
+func (c topicCounts) write(db *leveldb.DB, batch *leveldb.Batch) error {
+	for t, delta := range c {
+		if delta == 0 {
+			continue
+		}
+
+		key := topicIndexKey([]byte(t.namespace), t.topic)
+		count, err := readTopicCount(db, key)
+		if err != nil {
+			return err
+		}
+
+		count += delta
+		if count <= 0 {
+			batch.Delete(key)
+			continue
+		}
+		batch.Put(key, encodeCount(count))
+	}
+	return nil
+}
+
+func encodeCount(count int64) []byte {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(count))
+	return value
+}
+
+func readTopicCount(db *leveldb.DB, key []byte) (int64, error) {
+	value, err := db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(value)), nil
+}
+
+// Topics returns the distinct topics present in the archive.
+func (s *WMailServer) Topics() ([]whisper.TopicType, error) {
+	counts, err := s.TopicCounts()
+	if err != nil {
+		return nil, err
+	}
+
+	topics := make([]whisper.TopicType, 0, len(counts))
+	for topic := range counts {
+		topics = append(topics, topic)
+	}
+	return topics, nil
+}
+
+// TopicCounts returns the approximate number of archived envelopes per topic
+// in the namespace of the server.
+func (s *WMailServer) TopicCounts() (map[whisper.TopicType]int64, error) {
+	return s.readTopicIndex(topicIndexPrefix)
+}
+
+// readTopicIndex returns the values of the namespace of the server in the
+// topic index, or the topic size index, with the given prefix.
+func (s *WMailServer) readTopicIndex(indexPrefix []byte) (map[whisper.TopicType]int64, error) {
+	prefix := append(append([]byte(nil), indexPrefix...), s.namespace...)
+	i := s.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer i.Release()
+
+	values := make(map[whisper.TopicType]int64)
+	for i.Next() {
+		// the index of the default namespace spans those of other namespaces
+		if len(i.Key()) != len(prefix)+whisper.TopicLength {
+			continue
+		}
+		topic := whisper.BytesToTopic(i.Key()[len(prefix):])
+		values[topic] = int64(binary.BigEndian.Uint64(i.Value()))
+	}
+	return values, i.Error()
+}
@@ -0,0 +1,48 @@
+package mailserver
+
+import (
+	"testing"
+	"time"
+
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopicIndex(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+
+	first := archiveEnvelope(t, now.Add(-3*time.Second), server)
+	archiveEnvelope(t, now.Add(-2*time.Second), server)
+
+	other, err := generateEnvelope(now.Add(-1 * time.Second))
+	require.NoError(t, err)
+	other.Topic = whisper.TopicType{0x01, 0x02, 0x03, 0x04}
+	server.Archive(other)
+
+	// archiving the same envelope twice is not counted twice
+	server.Archive(first)
+
+	counts, err := server.TopicCounts()
+	require.NoError(t, err)
+	require.Equal(t, map[whisper.TopicType]int64{first.Topic: 2, other.Topic: 1}, counts)
+
+	topics, err := server.Topics()
+	require.NoError(t, err)
+	require.Len(t, topics, 2)
+	require.Contains(t, topics, first.Topic)
+	require.Contains(t, topics, other.Topic)
+
+	// the index is kept consistent on prune
+	_, err = server.DeleteRange(now.Add(-3*time.Second), now.Add(-3*time.Second))
+	require.NoError(t, err)
+	counts, err = server.TopicCounts()
+	require.NoError(t, err)
+	require.Equal(t, map[whisper.TopicType]int64{first.Topic: 1, other.Topic: 1}, counts)
+
+	testPrune(t, now, 0, NewCleanerWithDB(server.db), server)
+	topics, err = server.Topics()
+	require.NoError(t, err)
+	require.Empty(t, topics)
+}
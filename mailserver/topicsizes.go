@@ -0,0 +1,186 @@
+package mailserver
+
+import (
+	"sync"
+
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// topicSizePrefix prefixes the keys of the topic size index, which maps
+// every archived topic to the encoded size in bytes of the envelopes stored
+// for it. Like the topic index, it keeps counting envelopes moved to the
+// cold storage, and is kept per namespace.
+var topicSizePrefix = []byte{reservedPrefix, 'b'}
+
+func topicSizeKey(namespace []byte, topic whisper.TopicType) []byte {
+	key := append(append([]byte(nil), topicSizePrefix...), namespace...)
+	return append(key, topic[:]...)
+}
+
+// topicSizeChanges accumulates the envelope writes of a batch. It implements
+// leveldb.BatchReplay, so that the topic size changes implied by a batch can
+// be collected by replaying it.
+type topicSizeChanges struct {
+	keys   [][]byte
+	values [][]byte // nil for deleted envelopes
+}
+
+// Put accounts for an envelope stored or replaced by its tombstone.
+func (c *topicSizeChanges) Put(key, value []byte) {
+	if !isEnvelopeKey(key) {
+		return
+	}
+	c.keys = append(c.keys, append([]byte(nil), key...))
+	c.values = append(c.values, append([]byte(nil), value...))
+}
+
+// Delete accounts for an envelope removed.
+func (c *topicSizeChanges) Delete(key []byte) {
+	if !isEnvelopeKey(key) {
+		return
+	}
+	c.keys = append(c.keys, append([]byte(nil), key...))
+	c.values = append(c.values, nil)
+}
+
+// sizes returns the size changes per topic, subtracting the size of the
+// envelopes overwritten or removed, as read from the DB.
+func (c *topicSizeChanges) sizes(db *leveldb.DB) (topicSizes, error) {
+	sizes := topicSizes{}
+	for i, key := range c.keys {
+		existing, err := db.Get(key, nil)
+		if err != nil && err != leveldb.ErrNotFound {
+			return nil, err
+		}
+		if err == nil {
+			sizes.addEnvelope(key, existing, -1)
+		}
+		sizes.addEnvelope(key, c.values[i], 1)
+	}
+	return sizes, nil
+}
+
+// topicSizes accumulates changes of the topic size index.
+type topicSizes map[namespacedTopic]int64
+
+// addEnvelope accounts for the size of an RLP-encoded envelope stored under
+// the given DB key, with a sign of 1, or removed, with a sign of -1.
+// Tombstones and envelopes whose topic cannot be read, e.g. whisper v5
+// envelopes, are ignored.
+func (s topicSizes) addEnvelope(key, raw []byte, sign int64) {
+	if isTombstone(raw) || EnvelopeVersion(raw) == whisperV5 {
+		return
+	}
+	topic, ok := readEnvelopeTopic(raw)
+	if !ok {
+		return
+	}
+	s[newNamespacedTopic(key, topic)] += sign * int64(len(raw))
+}
+
+// write adds the accumulated changes to the batch. It must be called with
+// indexMu held until the batch is written.
+func (s topicSizes) write(db *leveldb.DB, batch *leveldb.Batch) error {
+	for t, delta := range s {
+		if delta == 0 {
+			continue
+		}
+
+		key := topicSizeKey([]byte(t.namespace), t.topic)
+		size, err := readTopicCount(db, key)
+		if err != nil {
+			return err
+		}
+
+		size += delta
+		if size <= 0 {
+			batch.Delete(key)
+			continue
+		}
+		batch.Put(key, encodeCount(size))
+	}
+	return nil
+}
+
+// updateTopicSizes adds to the batch the topic size index changes implied by
+// the envelope writes it holds. It must be called with indexMu held until
+// the batch is written.
+func updateTopicSizes(db *leveldb.DB, batch *leveldb.Batch) error {
+	changes := new(topicSizeChanges)
+	if err := batch.Replay(changes); err != nil {
+		return err
+	}
+	sizes, err := changes.sizes(db)
+	if err != nil {
+		return err
+	}
+	return sizes.write(db, batch)
+}
+
+// migrateTopicSizes builds the topic size index of archives written before
+// it was introduced, resuming from the last migrated key like the topic
+// index migration.
+func migrateTopicSizes(db *leveldb.DB, indexMu *sync.Mutex, progress []byte) error {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	if progress == nil {
+		if err := dropIndex(db, topicSizePrefix); err != nil {
+			return err
+		}
+	}
+
+	i := db.NewIterator(nil, nil)
+	defer i.Release()
+
+	next := i.First
+	if progress != nil {
+		next = func() bool { return seekAfter(i, progress) }
+	}
+
+	var (
+		sizes   = topicSizes{}
+		pending int
+		lastKey []byte
+	)
+	flush := func() error {
+		batch := new(leveldb.Batch)
+		if err := sizes.write(db, batch); err != nil {
+			return err
+		}
+		batch.Put(migrationKey, append([]byte(nil), lastKey...))
+		return db.Write(batch, nil)
+	}
+	for ok := next(); ok; ok = i.Next() {
+		if !isEnvelopeKey(i.Key()) || isTombstone(i.Value()) {
+			continue
+		}
+		lastKey = append(lastKey[:0], i.Key()...)
+		sizes.addEnvelope(i.Key(), i.Value(), 1)
+		pending++
+
+		if pending == migrationBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+			sizes = topicSizes{}
+			pending = 0
+		}
+	}
+	if err := i.Error(); err != nil {
+		return err
+	}
+
+	if pending > 0 {
+		return flush()
+	}
+	return nil
+}
+
+// TopicSizes returns the approximate encoded size in bytes of the archived
+// envelopes per topic in the namespace of the server, e.g. to find the
+// topics worth pruning.
+func (s *WMailServer) TopicSizes() (map[whisper.TopicType]int64, error) {
+	return s.readTopicIndex(topicSizePrefix)
+}
@@ -0,0 +1,80 @@
+package mailserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopicSizes(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+	server.tombstones = true
+
+	topics := []whisper.TopicType{whisper.BytesToTopic([]byte("abcd")), whisper.BytesToTopic([]byte("efgh"))}
+	expected := make(map[whisper.TopicType]int64)
+	var envelopes []*whisper.Envelope
+	for i := 0; i < 5; i++ {
+		env, err := BuildEnvelope(topics[i%2], make([]byte, 100*(i+1)), now.Add(-time.Duration(i+1)*time.Minute))
+		require.NoError(t, err)
+		require.NoError(t, server.archive(env))
+		raw, err := rlp.EncodeToBytes(env)
+		require.NoError(t, err)
+		expected[env.Topic] += int64(len(raw))
+		envelopes = append(envelopes, env)
+	}
+
+	sizes, err := server.TopicSizes()
+	require.NoError(t, err)
+	require.Equal(t, expected, sizes)
+	require.Equal(t, expected, server.Stats().TopicSizes)
+
+	// archiving an envelope again does not count it twice
+	require.NoError(t, server.archive(envelopes[0]))
+	sizes, err = server.TopicSizes()
+	require.NoError(t, err)
+	require.Equal(t, expected, sizes)
+
+	// pruned envelopes are not counted anymore, whether tombstones are kept
+	// or not
+	oldest := envelopes[len(envelopes)-1]
+	raw, err := rlp.EncodeToBytes(oldest)
+	require.NoError(t, err)
+	_, err = server.DeleteRange(now.Add(-time.Hour), now.Add(-5*time.Minute))
+	require.NoError(t, err)
+	expected[oldest.Topic] -= int64(len(raw))
+	sizes, err = server.TopicSizes()
+	require.NoError(t, err)
+	require.Equal(t, expected, sizes)
+
+	server.tombstones = false
+	_, err = server.DeleteRange(now.Add(-time.Hour), now)
+	require.NoError(t, err)
+	sizes, err = server.TopicSizes()
+	require.NoError(t, err)
+	require.Empty(t, sizes)
+}
+
+func TestMigrateTopicSizes(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+
+	for i := 3; i > 0; i-- {
+		archiveEnvelope(t, now.Add(-time.Duration(i)*time.Second), server)
+	}
+	expected, err := server.TopicSizes()
+	require.NoError(t, err)
+	require.Len(t, expected, 1)
+
+	// a fresh run rebuilds the index from scratch
+	require.NoError(t, server.db.Put(topicSizeKey(nil, whisper.BytesToTopic([]byte("abcd"))), encodeCount(1), nil))
+	require.NoError(t, migrateTopicSizes(server.db, &server.indexMu, nil))
+	sizes, err := server.TopicSizes()
+	require.NoError(t, err)
+	require.Equal(t, expected, sizes)
+}
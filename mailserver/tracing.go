@@ -0,0 +1,78 @@
+package mailserver
+
+import whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+
+// Names of the spans traced for every request.
+const (
+	validateRequestSpan = "mailserver.validateRequest"
+	processRequestSpan  = "mailserver.processRequest"
+)
+
+// Tracer starts the spans recording how long the mail server takes to
+// validate and process requests, e.g. to see its latency within a broader
+// distributed trace. It can be implemented on top of an OpenTelemetry
+// tracer, starting a span of the given name and mapping attributes to
+// OpenTelemetry attributes.
+type Tracer interface {
+	StartSpan(name string) Span
+}
+
+// Span is a traced operation. Attribute values are int64, bool or string.
+type Span interface {
+	SetAttribute(key string, value interface{})
+	End()
+}
+
+// SetTracer sets the tracer of the requests served. A nil tracer, the
+// default, traces nothing.
+func (s *WMailServer) SetTracer(tracer Tracer) {
+	s.tracer = tracer
+}
+
+// checkRequestTraced runs checkRequest within a span, if a tracer is set.
+func (s *WMailServer) checkRequestTraced(peerID []byte, request *whisper.Envelope) (*messagesRequest, *RequestError) {
+	if s.tracer == nil {
+		return s.checkRequest(peerID, request)
+	}
+
+	span := s.tracer.StartSpan(validateRequestSpan)
+	defer span.End()
+	r, requestErr := s.checkRequest(peerID, request)
+	if r != nil {
+		setWindowAttributes(span, r)
+	}
+	if requestErr != nil {
+		span.SetAttribute("mailserver.error_code", int64(requestErr.Code))
+	}
+	return r, requestErr
+}
+
+// serveRequest processes a request, compound or not, within a span if a
+// tracer is set.
+func (s *WMailServer) serveRequest(peer *whisper.Peer, r *messagesRequest) RequestResult {
+	var span Span
+	if s.tracer != nil {
+		span = s.tracer.StartSpan(processRequestSpan)
+		defer span.End()
+	}
+
+	var result RequestResult
+	if len(r.queries) > 0 {
+		_, result = s.processQueries(peer, r)
+	} else {
+		_, result = s.processRequest(peer, r)
+	}
+	if span != nil {
+		setWindowAttributes(span, r)
+		span.SetAttribute("mailserver.delivered", int64(result.Delivered))
+		span.SetAttribute("mailserver.bytes", int64(result.Bytes))
+		span.SetAttribute("mailserver.scanned", int64(result.Scanned))
+		span.SetAttribute("mailserver.truncated", result.Truncated)
+	}
+	return result
+}
+
+func setWindowAttributes(span Span, r *messagesRequest) {
+	span.SetAttribute("mailserver.lower", int64(r.lower))
+	span.SetAttribute("mailserver.upper", int64(r.upper))
+}
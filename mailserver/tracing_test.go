@@ -0,0 +1,81 @@
+package mailserver
+
+import (
+	"testing"
+	"time"
+
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/stretchr/testify/require"
+)
+
+type recordedSpan struct {
+	name       string
+	attributes map[string]interface{}
+	ended      bool
+}
+
+func (s *recordedSpan) SetAttribute(key string, value interface{}) {
+	s.attributes[key] = value
+}
+
+func (s *recordedSpan) End() {
+	s.ended = true
+}
+
+type spanRecorder struct {
+	spans []*recordedSpan
+}
+
+func (r *spanRecorder) StartSpan(name string) Span {
+	span := &recordedSpan{name: name, attributes: make(map[string]interface{})}
+	r.spans = append(r.spans, span)
+	return span
+}
+
+func TestTracing(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+	for i := 2; i > 0; i-- {
+		archiveEnvelope(t, now.Add(-time.Duration(i)*time.Second), server)
+	}
+	r := &messagesRequest{
+		lower: uint32(now.Add(-time.Minute).Unix()),
+		upper: uint32(now.Unix()),
+		bloom: whisper.MakeFullNodeBloom(),
+	}
+	request, err := generateEnvelope(now)
+	require.NoError(t, err)
+
+	// nothing is traced by default
+	require.Equal(t, 2, server.serveRequest(nil, r).Delivered)
+	_, requestErr := server.checkRequestTraced([]byte("peer"), request)
+	require.NotNil(t, requestErr)
+
+	recorder := &spanRecorder{}
+	server.SetTracer(recorder)
+	result := server.serveRequest(nil, r)
+	require.Equal(t, 2, result.Delivered)
+	_, requestErr = server.checkRequestTraced([]byte("peer"), request)
+	require.NotNil(t, requestErr)
+
+	require.Len(t, recorder.spans, 2)
+	processed, validated := recorder.spans[0], recorder.spans[1]
+	require.Equal(t, processRequestSpan, processed.name)
+	require.True(t, processed.ended)
+	require.Equal(t, map[string]interface{}{
+		"mailserver.lower":     int64(r.lower),
+		"mailserver.upper":     int64(r.upper),
+		"mailserver.delivered": int64(2),
+		"mailserver.bytes":     int64(result.Bytes),
+		"mailserver.scanned":   int64(2),
+		"mailserver.truncated": false,
+	}, processed.attributes)
+
+	// the request could not be decrypted, so its window is unknown
+	require.Equal(t, validateRequestSpan, validated.name)
+	require.True(t, validated.ended)
+	require.Equal(t, map[string]interface{}{
+		"mailserver.error_code": int64(ErrorCodeUnauthorized),
+	}, validated.attributes)
+}
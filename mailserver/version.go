@@ -0,0 +1,44 @@
+package mailserver
+
+import (
+	"github.com/ethereum/go-ethereum/rlp"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// Whisper protocol versions whose envelope encodings are recognized in the
+// archive. Envelopes carry no version of their own, so it is told from the
+// number of fields of the encoding.
+const (
+	whisperV5 = 5 // Version, Expiry, TTL, Topic, AESNonce, Data, EnvNonce
+	whisperV6 = uint(whisper.ProtocolVersion)
+
+	whisperV5Fields = 7
+	whisperV6Fields = 5
+)
+
+// EnvelopeVersion returns the whisper protocol version an RLP-encoded
+// envelope is encoded for, or 0 if it is not recognized. Archives carried
+// over from whisper v5 hold envelopes which cannot be delivered anymore and
+// can be pruned by version.
+func EnvelopeVersion(raw []byte) uint {
+	content, _, err := rlp.SplitList(raw)
+	if err != nil {
+		return 0
+	}
+
+	fields := 0
+	for len(content) > 0 {
+		if _, _, content, err = rlp.Split(content); err != nil {
+			return 0
+		}
+		fields++
+	}
+
+	switch fields {
+	case whisperV6Fields:
+		return whisperV6
+	case whisperV5Fields:
+		return whisperV5
+	}
+	return 0
+}
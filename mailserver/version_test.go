@@ -0,0 +1,120 @@
+package mailserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// v5Envelope is the layout of whisper v5 envelopes.
+type v5Envelope struct {
+	Version  []byte
+	Expiry   uint32
+	TTL      uint32
+	Topic    whisper.TopicType
+	AESNonce []byte
+	Data     []byte
+	EnvNonce uint64
+}
+
+// archiveV5Envelope stores a whisper v5 envelope sent at the given time, as
+// left by a whisper v5 mail server, and returns its key.
+func archiveV5Envelope(t *testing.T, sentTime time.Time, server *WMailServer) []byte {
+	sent := uint32(sentTime.Unix())
+	raw, err := rlp.EncodeToBytes(v5Envelope{Version: []byte{0}, Expiry: sent + 10, TTL: 10, Data: []byte{1}})
+	require.NoError(t, err)
+	key := NewDbKey(sent, crypto.Keccak256Hash(raw))
+	require.NoError(t, server.db.Put(key.raw, raw, nil))
+	return key.raw
+}
+
+func TestEnvelopeVersion(t *testing.T) {
+	env, err := generateEnvelope(time.Now())
+	require.NoError(t, err)
+	v6, err := rlp.EncodeToBytes(env)
+	require.NoError(t, err)
+	v5, err := rlp.EncodeToBytes(v5Envelope{Version: []byte{0}})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		raw     []byte
+		version uint
+		info    string
+	}{
+		{v6, 6, "whisper v6 envelope"},
+		{v5, 5, "whisper v5 envelope"},
+		{[]byte{0xc1, 0x01}, 0, "unknown layout"},
+		{[]byte{0x01}, 0, "not a list"},
+	}
+	for _, tc := range testCases {
+		require.Equal(t, tc.version, EnvelopeVersion(tc.raw), tc.info)
+	}
+}
+
+func TestDeleteVersion(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+
+	env := archiveEnvelope(t, now.Add(-2*time.Second), server)
+	key := archiveV5Envelope(t, now.Add(-1*time.Second), server)
+
+	removed, err := server.DeleteVersion(now.Add(-time.Minute), now, 5)
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+	_, err = server.db.Get(key, nil)
+	require.Equal(t, leveldb.ErrNotFound, err)
+	found, err := server.GetByHash(env.Hash())
+	require.NoError(t, err)
+	require.NotNil(t, found, "v6 envelopes should be left in place")
+}
+
+func TestProcessRequestVersion(t *testing.T) {
+	now := time.Now()
+	server := setupTestServer(t)
+	defer server.Close()
+
+	env := archiveEnvelope(t, now.Add(-2*time.Second), server)
+	archiveV5Envelope(t, now.Add(-1*time.Second), server)
+
+	testCases := []struct {
+		version  uint
+		expected []common.Hash
+		info     string
+	}{
+		{0, []common.Hash{env.Hash()}, "any version"},
+		{6, []common.Hash{env.Hash()}, "whisper v6 envelopes"},
+		{5, nil, "whisper v5 envelopes cannot be delivered"},
+	}
+	for _, tc := range testCases {
+		r := &messagesRequest{
+			lower:   uint32(now.Add(-time.Minute).Unix()),
+			upper:   uint32(now.Unix()),
+			bloom:   whisper.MakeFullNodeBloom(),
+			version: tc.version,
+		}
+		messages, _ := server.processRequest(nil, r)
+		var hashes []common.Hash
+		for _, message := range messages {
+			hashes = append(hashes, message.Hash())
+		}
+		require.Equal(t, tc.expected, hashes, tc.info)
+	}
+}
+
+func TestDecodeVersionOption(t *testing.T) {
+	option, err := newRequestOption(versionOptionCode, uint(6))
+	require.NoError(t, err)
+	raw, err := encodeRequestOptions(option)
+	require.NoError(t, err)
+
+	var r messagesRequest
+	require.NoError(t, decodeRequestOptions(raw, &r))
+	require.Equal(t, uint(6), r.version)
+}
@@ -2,12 +2,20 @@ package timesource
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/beevik/ntp"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/p2p"
 	"github.com/ethereum/go-ethereum/rpc"
 )
@@ -21,8 +29,37 @@ const (
 
 	// DefaultRPCTimeout defines write deadline for single ntp server request.
 	DefaultRPCTimeout = 2 * time.Second
+
+	// halfConfidenceSpread is the spread between server offsets at which
+	// the confidence in the computed offset drops to one half.
+	halfConfidenceSpread = 500 * time.Millisecond
+)
+
+var (
+	spreadGauge          = metrics.NewRegisteredGauge("timesource/Spread", nil)
+	syncSucceededCounter = metrics.NewRegisteredCounter("timesource/SyncSucceeded", nil)
+	syncFailedCounter    = metrics.NewRegisteredCounter("timesource/SyncFailed", nil)
+	syncTimer            = metrics.NewRegisteredTimer("timesource/Sync", nil)
+	// offsetHistogram records the magnitude of the computed offsets, in nanoseconds
+	offsetHistogram = metrics.NewRegisteredHistogram("timesource/Offset", nil, metrics.NewExpDecaySample(1028, 0.015))
 )
 
+// TimeSource provides the current time, possibly corrected for the skew of
+// the system clock.
+type TimeSource interface {
+	Now() time.Time
+}
+
+// TimeSourceFunc is an adapter to use a function as a TimeSource.
+type TimeSourceFunc func() time.Time
+
+// Now returns the time returned by f.
+func (f TimeSourceFunc) Now() time.Time {
+	return f()
+}
+
+var _ TimeSource = (*NTPTimeSource)(nil)
+
 // defaultServers will be resolved to the closest available,
 // and with high probability resolved to the different IPs
 var defaultServers = []string{
@@ -36,6 +73,7 @@ type ntpQuery func(string, ntp.QueryOptions) (*ntp.Response, error)
 
 type queryResponse struct {
 	Offset time.Duration
+	RTT    time.Duration
 	Error  error
 }
 
@@ -56,21 +94,36 @@ func (e multiRPCError) Error() string {
 	return b.String()
 }
 
-func computeOffset(timeQuery ntpQuery, servers []string, allowedFailures int) (time.Duration, error) {
+// computeOffset queries all servers with the given options and returns the
+// median of their offsets under the given policy, along with the spread
+// between the lowest and highest offset.
+// If maxRTT is positive, responses with a higher round-trip delay are
+// considered less trustworthy and counted as failures.
+// If parallelism is positive, at most that many servers are queried at once,
+// otherwise all of them are.
+func computeOffset(timeQuery ntpQuery, servers []string, options ntp.QueryOptions, allowedFailures int, maxRTT time.Duration, policy MedianPolicy, parallelism int) (time.Duration, time.Duration, error) {
 	if len(servers) == 0 {
-		return 0, nil
+		return 0, 0, nil
 	}
+	if parallelism <= 0 || parallelism > len(servers) {
+		parallelism = len(servers)
+	}
+	slots := make(chan struct{}, parallelism)
 	responses := make(chan queryResponse, len(servers))
 	for _, server := range servers {
 		go func(server string) {
-			response, err := timeQuery(server, ntp.QueryOptions{
-				Timeout: DefaultRPCTimeout,
-			})
+			slots <- struct{}{}
+			response, err := timeQuery(server, options)
+			<-slots
 			if err != nil {
 				responses <- queryResponse{Error: err}
 				return
 			}
-			responses <- queryResponse{Offset: response.ClockOffset}
+			if maxRTT > 0 && response.RTT > maxRTT {
+				responses <- queryResponse{Error: fmt.Errorf("%s: round-trip delay %s exceeds %s", server, response.RTT, maxRTT)}
+				return
+			}
+			responses <- queryResponse{Offset: response.ClockOffset, RTT: response.RTT}
 		}(server)
 	}
 	var (
@@ -90,18 +143,169 @@ func computeOffset(timeQuery ntpQuery, servers []string, allowedFailures int) (t
 		}
 	}
 	if lth := len(rpcErrors); lth > allowedFailures {
-		return 0, rpcErrors
+		return 0, 0, rpcErrors
 	} else if lth == len(servers) {
-		return 0, rpcErrors
+		return 0, 0, rpcErrors
+	}
+	lowest, highest := offsets[0], offsets[0]
+	for _, offset := range offsets[1:] {
+		if offset < lowest {
+			lowest = offset
+		} else if offset > highest {
+			highest = offset
+		}
 	}
-	sort.SliceStable(offsets, func(i, j int) bool {
-		return offsets[i] > offsets[j]
+	return policy.Median(offsets), highest - lowest, nil
+}
+
+// MedianPolicy tells which value is the median of an even number of values.
+type MedianPolicy int
+
+const (
+	// MedianAverage takes the mean of the two middle values.
+	MedianAverage MedianPolicy = iota
+	// MedianLower takes the lower of the two middle values.
+	MedianLower
+	// MedianUpper takes the upper of the two middle values.
+	MedianUpper
+)
+
+// MedianDuration returns the median of the given durations, which are left
+// unmodified. For an even number of durations it is the mean of the two
+// middle ones. It returns 0 for no durations.
+func MedianDuration(durations []time.Duration) time.Duration {
+	return MedianAverage.Median(durations)
+}
+
+// Median returns the median of the given durations, which are left
+// unmodified, picking the median of an even number of durations according
+// to the policy. It returns 0 for no durations.
+func (p MedianPolicy) Median(durations []time.Duration) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
 	})
-	mid := len(offsets) / 2
-	if len(offsets)%2 == 0 {
-		return (offsets[mid-1] + offsets[mid]) / 2, nil
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 1 {
+		return sorted[mid]
+	}
+	switch p {
+	case MedianLower:
+		return sorted[mid-1]
+	case MedianUpper:
+		return sorted[mid]
+	default:
+		return sorted[mid-1] + (sorted[mid]-sorted[mid-1])/2
+	}
+}
+
+// Config of an NTPTimeSource. Zero values mean defaults, except for
+// AllowedFailures.
+type Config struct {
+	// Servers to query, defaults to the ntp.org pool.
+	Servers []string
+	// MinServers is the minimum number of configured servers.
+	MinServers int
+	// AllowedFailures defines how many failures will be tolerated per update.
+	// Zero tolerates none, unlike Default which tolerates
+	// DefaultMaxAllowedFailures.
+	AllowedFailures int
+	// AllowedFailureRatio, if set, defines the tolerated failures as a
+	// fraction of the servers queried per update, overriding AllowedFailures.
+	AllowedFailureRatio float64
+	// UpdatePeriod defines how often time will be queried from ntp.
+	UpdatePeriod time.Duration
+	// MaxRTT discards responses with a higher round-trip delay.
+	MaxRTT time.Duration
+	// SampleSize limits how many servers are queried per update.
+	SampleSize int
+	// OffsetFile persists the last known good offset across restarts.
+	OffsetFile string
+	// SlewRate, in parts per million, applies offset corrections larger
+	// than StepThreshold gradually.
+	SlewRate      float64
+	StepThreshold time.Duration
+	// QueryOptions is applied to every ntp query, e.g. to pin the protocol
+	// version or set the IP TTL. The timeout defaults to DefaultRPCTimeout.
+	QueryOptions ntp.QueryOptions
+	// EvenMedianPolicy picks the offset of an even number of responses,
+	// the mean of the two middle offsets by default.
+	EvenMedianPolicy MedianPolicy
+	// Parallelism limits how many servers are queried at once per update,
+	// 0 means all of them.
+	Parallelism int
+}
+
+var (
+	errNoServers           = errors.New("no ntp servers given")
+	errNotEnoughServers    = errors.New("not enough ntp servers configured")
+	errInvalidFailureRatio = errors.New("allowed failure ratio must be between 0 and 1")
+	errInvalidMedianPolicy = errors.New("unknown even median policy")
+	errInvalidParallelism  = errors.New("query parallelism must not be negative")
+)
+
+// uniqueServers returns the given servers without duplicates, in order. It
+// fails if fewer than minServers servers are left.
+func uniqueServers(servers []string, minServers int) ([]string, error) {
+	seen := make(map[string]struct{}, len(servers))
+	unique := make([]string, 0, len(servers))
+	for _, server := range servers {
+		if _, ok := seen[server]; ok {
+			continue
+		}
+		seen[server] = struct{}{}
+		unique = append(unique, server)
 	}
-	return offsets[mid], nil
+	if len(unique) < minServers {
+		return nil, errNotEnoughServers
+	}
+	return unique, nil
+}
+
+// NewNTPTimeSource returns a time source with the given config. It fails if
+// fewer than MinServers servers are configured.
+func NewNTPTimeSource(config Config) (*NTPTimeSource, error) {
+	if config.AllowedFailureRatio < 0 || config.AllowedFailureRatio > 1 {
+		return nil, errInvalidFailureRatio
+	}
+	if config.EvenMedianPolicy < MedianAverage || config.EvenMedianPolicy > MedianUpper {
+		return nil, errInvalidMedianPolicy
+	}
+	if config.Parallelism < 0 {
+		return nil, errInvalidParallelism
+	}
+	servers := config.Servers
+	if len(servers) == 0 {
+		servers = defaultServers
+	}
+	servers, err := uniqueServers(servers, config.MinServers)
+	if err != nil {
+		return nil, err
+	}
+	updatePeriod := config.UpdatePeriod
+	if updatePeriod == 0 {
+		updatePeriod = DefaultUpdatePeriod
+	}
+
+	return &NTPTimeSource{
+		servers:             servers,
+		minServers:          config.MinServers,
+		allowedFailures:     config.AllowedFailures,
+		allowedFailureRatio: config.AllowedFailureRatio,
+		updatePeriod:        updatePeriod,
+		maxRTT:              config.MaxRTT,
+		timeQuery:           ntp.QueryWithOptions,
+		sampleSize:          config.SampleSize,
+		offsetFile:          config.OffsetFile,
+		slewRate:            config.SlewRate,
+		stepThreshold:       config.StepThreshold,
+		queryOptions:        config.QueryOptions,
+		medianPolicy:        config.EvenMedianPolicy,
+		parallelism:         config.Parallelism,
+	}, nil
 }
 
 // Default initializes time source with default config values.
@@ -117,41 +321,305 @@ func Default() *NTPTimeSource {
 // NTPTimeSource provides source of time that tries to be resistant to time skews.
 // It does so by periodically querying time offset from ntp servers.
 type NTPTimeSource struct {
-	servers         []string
 	allowedFailures int
 	updatePeriod    time.Duration
-	timeQuery       ntpQuery // for ease of testing
+	maxRTT          time.Duration    // responses with higher round-trip delay are discarded if set
+	timeQuery       ntpQuery         // for ease of testing
+	queryOptions    ntp.QueryOptions // template of the options of every query
+	medianPolicy    MedianPolicy     // median of an even number of offsets
+	parallelism     int              // servers queried at once, all if 0
+	nowFunc         func() time.Time // for ease of testing, time.Now if nil
+
+	// allowedFailureRatio, if set, overrides allowedFailures with a fraction
+	// of the servers queried in the current cycle.
+	allowedFailureRatio float64
+
+	// serversMu guards the server list, which can be swapped at runtime.
+	// The list is replaced rather than modified, so that a cycle in flight
+	// keeps querying the servers it sampled.
+	serversMu  sync.Mutex
+	servers    []string
+	minServers int
+
+	// sampleSize limits how many servers are queried per cycle, 0 means all.
+	// Servers are sampled from a shuffled order so that the whole list is
+	// covered over time.
+	sampleSize int
+	rand       *rand.Rand
+	order      []int
+	next       int
+
+	// offsetFile, if set, persists the last known good offset so that it
+	// can be used on startup before the first sync completes.
+	offsetFile string
+
+	// slewRate, if set, is the rate in parts per million at which offset
+	// corrections larger than stepThreshold are applied gradually, as
+	// opposed to stepping to the new offset at once.
+	slewRate      float64
+	stepThreshold time.Duration
 
 	quit chan struct{}
 	wg   sync.WaitGroup
 
 	mu           sync.RWMutex
 	latestOffset time.Duration
+	latestSpread time.Duration
+	synced       bool          // whether an offset was computed from ntp servers
+	syncedCh     chan struct{} // closed once synced, created on demand
+	offsetLoaded bool          // whether the offset was loaded from offsetFile
+
+	// the offset is being slewed from slewFrom to latestOffset since slewStart
+	slewing   bool
+	slewFrom  time.Duration
+	slewStart time.Time
 }
 
 // Now returns time adjusted by latest known offset
 func (s *NTPTimeSource) Now() time.Time {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return time.Now().Add(s.latestOffset)
+	now := s.now()
+	return now.Add(s.offsetAt(now))
+}
+
+// now returns the current time of the system clock.
+func (s *NTPTimeSource) now() time.Time {
+	if s.nowFunc != nil {
+		return s.nowFunc()
+	}
+	return time.Now()
+}
+
+// offsetAt returns the offset applied at the given time. While slewing,
+// the applied offset moves from slewFrom towards latestOffset by
+// slewRate microseconds per second elapsed since slewStart, so a correction
+// of d takes d / (slewRate * 1e-6) to be fully applied. E.g. at 500 ppm a
+// correction of 1s is applied in 2000s, or 60ms per 2 minute update period.
+// It must be called with mu held.
+func (s *NTPTimeSource) offsetAt(t time.Time) time.Duration {
+	if !s.slewing {
+		return s.latestOffset
+	}
+
+	slewed := time.Duration(float64(t.Sub(s.slewStart)) * s.slewRate * 1e-6)
+	delta := s.latestOffset - s.slewFrom
+	switch {
+	case delta > slewed:
+		return s.slewFrom + slewed
+	case delta < -slewed:
+		return s.slewFrom - slewed
+	default:
+		return s.latestOffset
+	}
+}
+
+// applyOffset sets the new offset, either at once or by slewing to it.
+// The first offset is always stepped to unless one was persisted, as there
+// is no previously applied offset to correct gradually.
+// It must be called with mu held.
+func (s *NTPTimeSource) applyOffset(offset time.Duration) {
+	now := s.now()
+	current := s.offsetAt(now)
+	delta := offset - current
+	if delta < 0 {
+		delta = -delta
+	}
+
+	s.latestOffset = offset
+	s.slewing = s.slewRate > 0 && delta > s.stepThreshold && (s.synced || s.offsetLoaded)
+	if s.slewing {
+		s.slewFrom = current
+		s.slewStart = now
+	}
+}
+
+// Spread returns the difference between the lowest and highest offset
+// reported by ntp servers during the latest successful update.
+func (s *NTPTimeSource) Spread() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.latestSpread
+}
+
+// Confidence returns a value between 0 and 1 telling how trustworthy the
+// latest offset is. It degrades as the servers disagree more with each
+// other, and is 0 until the first successful update.
+func (s *NTPTimeSource) Confidence() float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.synced {
+		return 0
+	}
+	return float64(halfConfidenceSpread) / float64(halfConfidenceSpread+s.latestSpread)
+}
+
+// WaitForSync blocks until an offset was computed from ntp servers or the
+// context is done, in which case it returns the context error. It returns at
+// once if an update already succeeded, so that consumers needing accurate
+// time do not use the system clock during the cold-start gap.
+func (s *NTPTimeSource) WaitForSync(ctx context.Context) error {
+	s.mu.Lock()
+	synced := s.syncedChan()
+	s.mu.Unlock()
+
+	select {
+	case <-synced:
+		return nil
+	default:
+	}
+	select {
+	case <-synced:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// syncedChan returns the channel closed once synced. It must be called with
+// mu held.
+func (s *NTPTimeSource) syncedChan() chan struct{} {
+	if s.syncedCh == nil {
+		s.syncedCh = make(chan struct{})
+	}
+	return s.syncedCh
+}
+
+// SetServers replaces the servers to query, starting with the next cycle.
+// Duplicates are dropped, and it fails if fewer servers than the configured
+// minimum are left, in which case the servers in use are kept.
+func (s *NTPTimeSource) SetServers(servers []string) error {
+	if len(servers) == 0 {
+		return errNoServers
+	}
+	servers, err := uniqueServers(servers, s.minServers)
+	if err != nil {
+		return err
+	}
+
+	s.serversMu.Lock()
+	defer s.serversMu.Unlock()
+	s.servers = servers
+	// the sampling order is a permutation of the previous list
+	s.order, s.next = nil, 0
+	return nil
+}
+
+// sampleServers returns the servers to query in the current cycle.
+func (s *NTPTimeSource) sampleServers() []string {
+	s.serversMu.Lock()
+	defer s.serversMu.Unlock()
+
+	if s.sampleSize <= 0 || s.sampleSize >= len(s.servers) {
+		return s.servers
+	}
+	if s.rand == nil {
+		s.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	sample := make([]string, 0, s.sampleSize)
+	for len(sample) < s.sampleSize {
+		if s.next >= len(s.order) {
+			s.order = s.rand.Perm(len(s.servers))
+			s.next = 0
+		}
+		sample = append(sample, s.servers[s.order[s.next]])
+		s.next++
+	}
+	return sample
+}
+
+// failuresAllowed returns how many of the given number of queried servers
+// may fail in the current cycle.
+func (s *NTPTimeSource) failuresAllowed(servers int) int {
+	if s.allowedFailureRatio > 0 {
+		return int(s.allowedFailureRatio * float64(servers))
+	}
+	return s.allowedFailures
 }
 
 func (s *NTPTimeSource) updateOffset() {
-	offset, err := computeOffset(s.timeQuery, s.servers, s.allowedFailures)
+	start := time.Now()
+	servers := s.sampleServers()
+	offset, spread, err := computeOffset(s.timeQuery, servers, s.ntpQueryOptions(), s.failuresAllowed(len(servers)), s.maxRTT, s.medianPolicy, s.parallelism)
+	syncTimer.UpdateSince(start)
 	if err != nil {
+		syncFailedCounter.Inc(1)
 		log.Error("failed to compute offset", "error", err)
 		return
 	}
-	log.Info("Difference with ntp servers", "offset", offset)
+	log.Info("Difference with ntp servers", "offset", offset, "spread", spread)
+	syncSucceededCounter.Inc(1)
+	spreadGauge.Update(int64(spread))
+	if offset < 0 {
+		offsetHistogram.Update(int64(-offset))
+	} else {
+		offsetHistogram.Update(int64(offset))
+	}
+	s.mu.Lock()
+	s.applyOffset(offset)
+	s.latestSpread = spread
+	if !s.synced {
+		close(s.syncedChan())
+	}
+	s.synced = true
+	s.mu.Unlock()
+	s.saveOffset(offset)
+}
+
+// ntpQueryOptions returns the options every ntp query is made with.
+func (s *NTPTimeSource) ntpQueryOptions() ntp.QueryOptions {
+	options := s.queryOptions
+	if options.Timeout == 0 {
+		options.Timeout = DefaultRPCTimeout
+	}
+	return options
+}
+
+// loadOffset applies the offset persisted by a previous run, if any.
+func (s *NTPTimeSource) loadOffset() {
+	if s.offsetFile == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(s.offsetFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn("failed to read persisted offset", "file", s.offsetFile, "error", err)
+		}
+		return
+	}
+	offset, err := time.ParseDuration(strings.TrimSpace(string(data)))
+	if err != nil {
+		log.Warn("invalid persisted offset", "file", s.offsetFile, "error", err)
+		return
+	}
+	log.Info("Using persisted offset until ntp servers respond", "offset", offset)
 	s.mu.Lock()
 	s.latestOffset = offset
+	s.offsetLoaded = true
 	s.mu.Unlock()
 }
 
+// saveOffset persists the offset so that it survives restarts.
+func (s *NTPTimeSource) saveOffset(offset time.Duration) {
+	if s.offsetFile == "" {
+		return
+	}
+	tmp := s.offsetFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(offset.String()), 0600); err != nil {
+		log.Warn("failed to persist offset", "file", s.offsetFile, "error", err)
+		return
+	}
+	if err := os.Rename(tmp, s.offsetFile); err != nil {
+		log.Warn("failed to persist offset", "file", s.offsetFile, "error", err)
+	}
+}
+
 // Start runs a goroutine that updates local offset every updatePeriod.
 func (s *NTPTimeSource) Start(*p2p.Server) error {
 	s.quit = make(chan struct{})
 	ticker := time.NewTicker(s.updatePeriod)
+	s.loadOffset()
 	// we try to do it synchronously so that user can have reliable messages right away
 	s.updateOffset()
 	s.wg.Add(1)
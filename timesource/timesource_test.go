@@ -1,7 +1,13 @@
 package timesource
 
 import (
+	"context"
 	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
 	"sync"
 	"testing"
 	"time"
@@ -23,6 +29,7 @@ type testCase struct {
 	description     string
 	servers         []string
 	allowedFailures int
+	maxRTT          time.Duration
 	responses       []queryResponse
 	expected        time.Duration
 	expectError     bool
@@ -38,7 +45,10 @@ func (tc *testCase) query(string, ntp.QueryOptions) (*ntp.Response, error) {
 		tc.actualAttempts++
 		tc.mu.Unlock()
 	}()
-	response := &ntp.Response{ClockOffset: tc.responses[tc.actualAttempts].Offset}
+	response := &ntp.Response{
+		ClockOffset: tc.responses[tc.actualAttempts].Offset,
+		RTT:         tc.responses[tc.actualAttempts].RTT,
+	}
 	return response, tc.responses[tc.actualAttempts].Error
 }
 
@@ -149,13 +159,50 @@ func newTestCases() []*testCase {
 			},
 			expected: 15 * time.Second,
 		},
+		{
+			description:     "HighRTTDiscarded",
+			servers:         mockedServers,
+			allowedFailures: 1,
+			maxRTT:          100 * time.Millisecond,
+			responses: []queryResponse{
+				{Offset: 10 * time.Second, RTT: 10 * time.Millisecond},
+				{Offset: 100 * time.Second, RTT: time.Second},
+				{Offset: 20 * time.Second, RTT: 10 * time.Millisecond},
+				{Offset: 30 * time.Second, RTT: 10 * time.Millisecond},
+			},
+			expected: 20 * time.Second,
+		},
+		{
+			description: "HighRTTNonTolerable",
+			servers:     mockedServers,
+			maxRTT:      100 * time.Millisecond,
+			responses: []queryResponse{
+				{Offset: 10 * time.Second, RTT: 10 * time.Millisecond},
+				{Offset: 100 * time.Second, RTT: time.Second},
+				{Offset: 20 * time.Second, RTT: 10 * time.Millisecond},
+				{Offset: 30 * time.Second, RTT: 10 * time.Millisecond},
+			},
+			expected:    time.Duration(0),
+			expectError: true,
+		},
+		{
+			description: "HighRTTIgnoredByDefault",
+			servers:     mockedServers,
+			responses: []queryResponse{
+				{Offset: 10 * time.Second, RTT: time.Second},
+				{Offset: 20 * time.Second, RTT: time.Second},
+				{Offset: 20 * time.Second, RTT: time.Second},
+				{Offset: 30 * time.Second, RTT: time.Second},
+			},
+			expected: 20 * time.Second,
+		},
 	}
 }
 
 func TestComputeOffset(t *testing.T) {
 	for _, tc := range newTestCases() {
 		t.Run(tc.description, func(t *testing.T) {
-			offset, err := computeOffset(tc.query, tc.servers, tc.allowedFailures)
+			offset, _, err := computeOffset(tc.query, tc.servers, ntp.QueryOptions{}, tc.allowedFailures, tc.maxRTT, MedianAverage, 0)
 			if tc.expectError {
 				assert.Error(t, err)
 			} else {
@@ -166,12 +213,113 @@ func TestComputeOffset(t *testing.T) {
 	}
 }
 
+func TestQueryParallelism(t *testing.T) {
+	servers := []string{"ntp1", "ntp2", "ntp3", "ntp4", "ntp5", "ntp6"}
+	var (
+		mu       sync.Mutex
+		inFlight int
+		peak     int
+		queried  int
+	)
+	// the first two queries fail, the others report their position
+	query := func(string, ntp.QueryOptions) (*ntp.Response, error) {
+		mu.Lock()
+		inFlight++
+		if inFlight > peak {
+			peak = inFlight
+		}
+		queried++
+		n := queried
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		if n <= 2 {
+			return nil, errors.New("timeout")
+		}
+		return &ntp.Response{ClockOffset: time.Duration(n) * time.Second}, nil
+	}
+
+	testCases := []struct {
+		allowedFailures int
+		expectError     bool
+		info            string
+	}{
+		{2, false, "failures within the tolerance"},
+		{1, true, "failures above the tolerance"},
+	}
+	for _, tc := range testCases {
+		peak, queried = 0, 0
+		offset, _, err := computeOffset(query, servers, ntp.QueryOptions{}, tc.allowedFailures, 0, MedianAverage, 2)
+		assert.Equal(t, len(servers), queried, tc.info)
+		assert.Equal(t, 2, peak, "%s: queries should be bounded", tc.info)
+		if tc.expectError {
+			assert.Error(t, err, tc.info)
+			continue
+		}
+		assert.NoError(t, err, tc.info)
+		assert.Equal(t, 4500*time.Millisecond, offset, tc.info)
+	}
+
+	_, err := NewNTPTimeSource(Config{Parallelism: -1})
+	assert.Equal(t, errInvalidParallelism, err)
+}
+
+func TestMedianPolicy(t *testing.T) {
+	durations := []time.Duration{30 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second}
+	testCases := []struct {
+		policy   MedianPolicy
+		expected time.Duration
+		info     string
+	}{
+		{MedianAverage, 25 * time.Second, "average"},
+		{MedianLower, 20 * time.Second, "lower"},
+		{MedianUpper, 30 * time.Second, "upper"},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, tc.policy.Median(durations), tc.info)
+		assert.Equal(t, 20*time.Second, tc.policy.Median(durations[1:]), "%s: odd number of durations", tc.info)
+	}
+
+	source, err := NewNTPTimeSource(Config{EvenMedianPolicy: MedianLower})
+	assert.NoError(t, err)
+	assert.Equal(t, MedianLower, source.medianPolicy)
+	_, err = NewNTPTimeSource(Config{EvenMedianPolicy: MedianUpper + 1})
+	assert.Equal(t, errInvalidMedianPolicy, err)
+}
+
+func TestMedianDuration(t *testing.T) {
+	testCases := []struct {
+		durations []time.Duration
+		expected  time.Duration
+		info      string
+	}{
+		{nil, 0, "empty"},
+		{[]time.Duration{-time.Second}, -time.Second, "single element"},
+		{[]time.Duration{30 * time.Second, 10 * time.Second, 20 * time.Second, 20 * time.Second}, 20 * time.Second, "Median"},
+		{[]time.Duration{20 * time.Second, 10 * time.Second}, 15 * time.Second, "EvenMedian"},
+		{[]time.Duration{30 * time.Second, -10 * time.Second, 10 * time.Second}, 10 * time.Second, "odd unsorted"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.info, func(t *testing.T) {
+			durations := append([]time.Duration(nil), tc.durations...)
+			assert.Equal(t, tc.expected, MedianDuration(durations))
+			assert.Equal(t, tc.durations, durations, "durations should not be modified")
+		})
+	}
+}
+
 func TestNTPTimeSource(t *testing.T) {
 	for _, tc := range newTestCases() {
 		t.Run(tc.description, func(t *testing.T) {
 			source := &NTPTimeSource{
 				servers:         tc.servers,
 				allowedFailures: tc.allowedFailures,
+				maxRTT:          tc.maxRTT,
 				timeQuery:       tc.query,
 			}
 			assert.WithinDuration(t, time.Now(), source.Now(), clockCompareDelta)
@@ -180,3 +328,327 @@ func TestNTPTimeSource(t *testing.T) {
 		})
 	}
 }
+
+func TestConfidence(t *testing.T) {
+	tc := &testCase{
+		servers: mockedServers,
+		responses: []queryResponse{
+			{Offset: 10 * time.Second},
+			{Offset: 10 * time.Second},
+			{Offset: 10 * time.Second},
+			{Offset: 10 * time.Second},
+			{Offset: 9 * time.Second},
+			{Offset: 10 * time.Second},
+			{Offset: 10 * time.Second},
+			{Offset: 11 * time.Second},
+		},
+	}
+	source := &NTPTimeSource{
+		servers:   tc.servers,
+		timeQuery: tc.query,
+	}
+	assert.Equal(t, float64(0), source.Confidence(), "no confidence before the first update")
+
+	source.updateOffset()
+	assert.Equal(t, time.Duration(0), source.Spread())
+	assert.Equal(t, float64(1), source.Confidence())
+
+	source.updateOffset()
+	assert.Equal(t, 2*time.Second, source.Spread())
+	assert.InDelta(t, 0.2, source.Confidence(), 0.001)
+}
+
+func TestWaitForSync(t *testing.T) {
+	tc := &testCase{
+		servers: mockedServers[:1],
+		responses: []queryResponse{
+			{Error: errors.New("timeout")},
+			{Offset: 10 * time.Second},
+		},
+	}
+	source := &NTPTimeSource{
+		servers:   tc.servers,
+		timeQuery: tc.query,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, source.WaitForSync(ctx), "should wait until the first sync")
+
+	waited := make(chan error, 1)
+	go func() { waited <- source.WaitForSync(context.Background()) }()
+	source.updateOffset()
+	select {
+	case err := <-waited:
+		t.Fatalf("returned after a failed sync: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	source.updateOffset()
+	select {
+	case err := <-waited:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("should return once synced")
+	}
+
+	// once synced, it returns at once even with a done context
+	done, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.NoError(t, source.WaitForSync(done))
+}
+
+func TestSampleServers(t *testing.T) {
+	newSource := func() *NTPTimeSource {
+		return &NTPTimeSource{
+			servers:    mockedServers,
+			sampleSize: 2,
+			rand:       rand.New(rand.NewSource(1)),
+		}
+	}
+	source := newSource()
+
+	// the whole list is covered every len(servers)/sampleSize cycles
+	for cycle := 0; cycle < 3; cycle++ {
+		seen := make(map[string]bool)
+		for i := 0; i < len(mockedServers)/2; i++ {
+			sample := source.sampleServers()
+			assert.Len(t, sample, 2)
+			for _, server := range sample {
+				seen[server] = true
+			}
+		}
+		assert.Len(t, seen, len(mockedServers))
+	}
+
+	// sampling is deterministic under a seeded source
+	first, second := newSource(), newSource()
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, first.sampleServers(), second.sampleServers())
+	}
+
+	source.sampleSize = 0
+	assert.Equal(t, mockedServers, source.sampleServers())
+}
+
+func TestPersistedOffset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timesource-offset-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	offsetFile := filepath.Join(dir, "offset")
+
+	// without a persisted value the offset degrades to zero
+	source := &NTPTimeSource{offsetFile: offsetFile}
+	source.loadOffset()
+	assert.WithinDuration(t, time.Now(), source.Now(), clockCompareDelta)
+
+	tc := &testCase{
+		servers:   mockedServers[:1],
+		responses: []queryResponse{{Offset: 10 * time.Second}},
+	}
+	source.servers = tc.servers
+	source.timeQuery = tc.query
+	source.updateOffset()
+
+	// a fresh source starts from the offset of the last successful sync
+	restarted := &NTPTimeSource{offsetFile: offsetFile}
+	restarted.loadOffset()
+	assert.WithinDuration(t, time.Now().Add(10*time.Second), restarted.Now(), clockCompareDelta)
+
+	assert.NoError(t, ioutil.WriteFile(offsetFile, []byte("garbage"), 0600))
+	corrupted := &NTPTimeSource{offsetFile: offsetFile}
+	corrupted.loadOffset()
+	assert.WithinDuration(t, time.Now(), corrupted.Now(), clockCompareDelta)
+}
+
+func TestNowFunc(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	source := &NTPTimeSource{nowFunc: func() time.Time { return now }, latestOffset: 10 * time.Second}
+	assert.Equal(t, now.Add(10*time.Second), source.Now())
+
+	now = now.Add(time.Hour)
+	assert.Equal(t, now.Add(10*time.Second), source.Now())
+}
+
+func TestSlewOffset(t *testing.T) {
+	tc := &testCase{
+		servers: mockedServers[:1],
+		responses: []queryResponse{
+			{Offset: 50 * time.Millisecond},
+			{Offset: time.Second},
+			{Offset: -time.Second},
+		},
+	}
+	source := &NTPTimeSource{
+		servers:       tc.servers,
+		updatePeriod:  DefaultUpdatePeriod,
+		timeQuery:     tc.query,
+		slewRate:      500,
+		stepThreshold: 100 * time.Millisecond,
+	}
+
+	// small corrections are stepped
+	source.updateOffset()
+	assert.WithinDuration(t, time.Now().Add(50*time.Millisecond), source.Now(), clockCompareDelta)
+
+	// large ones are slewed by 60ms per period, which takes 16 periods for 950ms
+	source.updateOffset()
+	assert.True(t, source.slewing)
+	start := source.slewStart
+	assert.Equal(t, 50*time.Millisecond, source.offsetAt(start))
+	assert.Equal(t, 110*time.Millisecond, source.offsetAt(start.Add(DefaultUpdatePeriod)))
+	assert.Equal(t, 950*time.Millisecond, source.offsetAt(start.Add(15*DefaultUpdatePeriod)))
+	assert.Equal(t, time.Second, source.offsetAt(start.Add(16*DefaultUpdatePeriod)))
+	assert.Equal(t, time.Second, source.offsetAt(start.Add(100*DefaultUpdatePeriod)))
+
+	// slewing backwards starts from the offset applied so far
+	source.slewStart = start.Add(-DefaultUpdatePeriod)
+	source.updateOffset()
+	start = source.slewStart
+	applied := source.offsetAt(start)
+	assert.InDelta(t, float64(110*time.Millisecond), float64(applied), float64(time.Millisecond))
+	assert.Equal(t, applied-60*time.Millisecond, source.offsetAt(start.Add(DefaultUpdatePeriod)))
+	assert.Equal(t, -time.Second, source.offsetAt(start.Add(20*DefaultUpdatePeriod)))
+}
+
+func TestStepFirstOffset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timesource-step-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	offsetFile := filepath.Join(dir, "offset")
+
+	newSource := func() *NTPTimeSource {
+		tc := &testCase{
+			servers:   mockedServers[:1],
+			responses: []queryResponse{{Offset: 2 * time.Second}},
+		}
+		return &NTPTimeSource{
+			servers:       tc.servers,
+			timeQuery:     tc.query,
+			offsetFile:    offsetFile,
+			slewRate:      500,
+			stepThreshold: 100 * time.Millisecond,
+		}
+	}
+
+	// on a cold start there is no applied offset to correct gradually
+	source := newSource()
+	source.loadOffset()
+	source.updateOffset()
+	assert.False(t, source.slewing)
+	assert.WithinDuration(t, time.Now().Add(2*time.Second), source.Now(), clockCompareDelta)
+
+	// a persisted offset is trusted, and later corrections are slewed
+	assert.NoError(t, ioutil.WriteFile(offsetFile, []byte("0s"), 0600))
+	source = newSource()
+	source.loadOffset()
+	source.updateOffset()
+	assert.True(t, source.slewing)
+	assert.WithinDuration(t, time.Now(), source.Now(), clockCompareDelta)
+}
+
+func TestNewNTPTimeSource(t *testing.T) {
+	source, err := NewNTPTimeSource(Config{})
+	assert.NoError(t, err)
+	assert.Equal(t, defaultServers, source.servers)
+	assert.Equal(t, DefaultUpdatePeriod, source.updatePeriod)
+
+	source, err = NewNTPTimeSource(Config{Servers: mockedServers, MinServers: 4, MaxRTT: time.Second})
+	assert.NoError(t, err)
+	assert.Equal(t, mockedServers, source.servers)
+	assert.Equal(t, time.Second, source.maxRTT)
+
+	_, err = NewNTPTimeSource(Config{Servers: mockedServers[:1], MinServers: 2})
+	assert.Equal(t, errNotEnoughServers, err)
+}
+
+func TestFailuresAllowed(t *testing.T) {
+	testCases := []struct {
+		allowedFailures int
+		ratio           float64
+		servers         int
+		expected        int
+		info            string
+	}{
+		{2, 0, 4, 2, "absolute count"},
+		{2, 0.5, 4, 2, "half of the servers"},
+		{2, 0.5, 10, 5, "ratio scales with the servers"},
+		{2, 0.5, 3, 1, "ratio rounds down"},
+		{1, 1, 4, 4, "ratio overrides the absolute count"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.info, func(t *testing.T) {
+			source := &NTPTimeSource{allowedFailures: tc.allowedFailures, allowedFailureRatio: tc.ratio}
+			assert.Equal(t, tc.expected, source.failuresAllowed(tc.servers))
+		})
+	}
+
+	_, err := NewNTPTimeSource(Config{AllowedFailureRatio: 1.5})
+	assert.Equal(t, errInvalidFailureRatio, err)
+}
+
+func TestQueryOptions(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		received []ntp.QueryOptions
+	)
+	query := func(_ string, options ntp.QueryOptions) (*ntp.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, options)
+		return &ntp.Response{}, nil
+	}
+
+	source, err := NewNTPTimeSource(Config{
+		Servers:      mockedServers,
+		QueryOptions: ntp.QueryOptions{Version: 4, TTL: 2},
+	})
+	assert.NoError(t, err)
+	source.timeQuery = query
+	source.updateOffset()
+
+	assert.Len(t, received, len(mockedServers))
+	for _, options := range received {
+		assert.Equal(t, ntp.QueryOptions{Timeout: DefaultRPCTimeout, Version: 4, TTL: 2}, options,
+			"the template should be applied to every query, with the default timeout")
+	}
+
+	received = nil
+	source.queryOptions = ntp.QueryOptions{Timeout: time.Second}
+	source.updateOffset()
+	assert.Equal(t, time.Second, received[0].Timeout)
+}
+
+func TestSetServers(t *testing.T) {
+	source, err := NewNTPTimeSource(Config{Servers: []string{"ntp1", "ntp2", "ntp1"}, MinServers: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ntp1", "ntp2"}, source.servers, "duplicates should be dropped")
+
+	var (
+		mu      sync.Mutex
+		queried []string
+	)
+	source.timeQuery = func(server string, _ ntp.QueryOptions) (*ntp.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		queried = append(queried, server)
+		return &ntp.Response{}, nil
+	}
+
+	assert.Equal(t, errNoServers, source.SetServers(nil))
+	assert.Equal(t, errNotEnoughServers, source.SetServers([]string{"ntp3", "ntp3"}))
+	assert.Equal(t, []string{"ntp1", "ntp2"}, source.servers, "servers should be kept on error")
+
+	assert.NoError(t, source.SetServers([]string{"ntp3", "ntp4", "ntp3"}))
+	source.updateOffset()
+	sort.Strings(queried)
+	assert.Equal(t, []string{"ntp3", "ntp4"}, queried, "the next cycle should query the new servers")
+}
+
+func TestSetServersDuringCycle(t *testing.T) {
+	source := &NTPTimeSource{servers: mockedServers[:1]}
+	sample := source.sampleServers()
+	assert.NoError(t, source.SetServers(mockedServers[1:]))
+	assert.Equal(t, mockedServers[:1], sample, "a cycle in flight should keep its servers")
+	assert.Equal(t, mockedServers[1:], source.sampleServers())
+}